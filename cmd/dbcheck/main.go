@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// options are the command line flags of dbcheck
+type options struct {
+	DB        string `short:"d" long:"db" description:"Directory of the LevelDB database, sharded or not" default:"./embeddings"`
+	Dims      int    `long:"dims" description:"Expected dimensionality of the vectors" default:"300"`
+	NoCompact bool   `long:"no-compact" description:"Skip compacting the database before verifying it"`
+	Examples  int    `long:"examples" description:"Number of broken words listed per problem" default:"10"`
+	Means     bool   `long:"means" description:"Write the mean and the frequency-weighted mean of the vectors to means.npy if the database is sound, for databases imported without --means"`
+}
+
+// problem counts the records with a problem and keeps a few examples
+type problem struct {
+	n        int
+	examples []string
+}
+
+func (p *problem) add(word string, examples int) {
+	p.n++
+	if len(p.examples) < examples {
+		p.examples = append(p.examples, word)
+	}
+}
+
+// report collects the problems found in a database
+type report struct {
+	records      int
+	undecodable  problem
+	wrongDims    problem
+	nonFinite    problem
+	bloomMissing problem
+	// checksums is the result of verifying the checksums written by the importer
+	checksums error
+	// means sums the sound vectors for --means
+	means pkg.MeanAccumulator
+}
+
+func (r *report) ok() bool {
+	return r.undecodable.n == 0 && r.wrongDims.n == 0 && r.nonFinite.n == 0 && r.bloomMissing.n == 0 && r.checksums == nil
+}
+
+func (r *report) print() {
+	if r.checksums != nil {
+		fmt.Printf("checksums:           %v\n", r.checksums)
+	}
+	fmt.Printf("records:             %d\n", r.records)
+	fmt.Printf("undecodable:         %d %q\n", r.undecodable.n, r.undecodable.examples)
+	fmt.Printf("wrong dimensions:    %d %q\n", r.wrongDims.n, r.wrongDims.examples)
+	fmt.Printf("NaN or infinite:     %d %q\n", r.nonFinite.n, r.nonFinite.examples)
+	fmt.Printf("missing from filter: %d %q\n", r.bloomMissing.n, r.bloomMissing.examples)
+}
+
+// check compacts the shard at path and verifies every record in it
+func check(path string, opts options, bloom *pkg.BloomFilter, r *report) error {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if !opts.NoCompact {
+		fmt.Printf("compacting %s\n", path)
+		if err := db.CompactRange(util.Range{}); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("verifying %s\n", path)
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		r.records++
+		word := string(iter.Key())
+		vector, err := pkg.DecodeVector(iter.Value())
+		if err != nil {
+			r.undecodable.add(word, opts.Examples)
+		} else if len(vector) != opts.Dims {
+			r.wrongDims.add(word, opts.Examples)
+		} else if pkg.NonFinite(vector) > 0 {
+			r.nonFinite.add(word, opts.Examples)
+		} else if opts.Means {
+			if err := r.means.Add(iter.Value()); err != nil {
+				return fmt.Errorf("%s: %v", word, err)
+			}
+		}
+		if bloom != nil && !bloom.MayContain(iter.Key()) {
+			r.bloomMissing.add(word, opts.Examples)
+		}
+	}
+	return iter.Error()
+}
+
+func loadBloomFilter(dbPath string) (*pkg.BloomFilter, error) {
+	f, err := os.Open(filepath.Join(dbPath, pkg.BloomFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return pkg.ReadBloomFilter(bufio.NewReader(f))
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+
+	n, err := pkg.ReadShards(opts.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths := []string{opts.DB}
+	if n > 0 {
+		paths = nil
+		for i := 0; i < n; i++ {
+			paths = append(paths, pkg.ShardPath(opts.DB, i))
+		}
+	}
+
+	bloom, err := loadBloomFilter(opts.DB)
+	if err != nil {
+		log.Fatalf("bloom filter: %v", err)
+	}
+
+	checksums, err := pkg.ReadChecksums(opts.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := &report{}
+	if checksums != nil {
+		r.checksums = pkg.VerifyChecksums(opts.DB, checksums)
+	}
+	for _, path := range paths {
+		if err := check(path, opts, bloom, r); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	r.print()
+	if !r.ok() {
+		os.Exit(1)
+	}
+
+	if mean, weighted := r.means.Means(); mean != nil {
+		if err := pkg.WriteMeans(opts.DB, mean, weighted); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s\n", pkg.MeansFile)
+	}
+
+	// opening the database for compaction rewrites its files
+	if checksums != nil {
+		if checksums.Files, err = pkg.ComputeChecksums(opts.DB); err != nil {
+			log.Fatal(err)
+		}
+		checksums.Words = r.records
+		if err := pkg.WriteChecksums(opts.DB, checksums); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("updated %s\n", pkg.ChecksumsFile)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// options are the command line flags of export
+type options struct {
+	DB      string `short:"d" long:"db" description:"Directory of the LevelDB database, sharded or not" default:"./embeddings"`
+	Vectors string `long:"vectors" description:"NumPy file the float32 matrix of vectors is written to" default:"./vectors.npy"`
+	Vocab   string `long:"vocab" description:"File the words are written to, one per line in the order of the matrix rows" default:"./vocab.txt"`
+	Dims    int    `long:"dims" description:"Dimensionality of the vectors, records with other dimensions are skipped" default:"300"`
+}
+
+// exporter appends the records of a database to the vectors and vocab files
+type exporter struct {
+	vectors *bufio.Writer
+	vocab   *bufio.Writer
+	dims    int
+	rows    int
+	skipped int
+}
+
+// export appends every record of the shard at path
+func (e *exporter) export(path string) error {
+	db, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		vector, err := pkg.DecodeVector(iter.Value())
+		if err != nil || len(vector) != e.dims {
+			e.skipped++
+			continue
+		}
+		if _, err := e.vectors.Write(pkg.AppendFloat32s(nil, vector)); err != nil {
+			return err
+		}
+		if _, err := e.vocab.Write(append(iter.Key(), '\n')); err != nil {
+			return err
+		}
+		e.rows++
+	}
+	return iter.Error()
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+
+	n, err := pkg.ReadShards(opts.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths := []string{opts.DB}
+	if n > 0 {
+		paths = nil
+		for i := 0; i < n; i++ {
+			paths = append(paths, pkg.ShardPath(opts.DB, i))
+		}
+	}
+
+	vectors, err := os.Create(opts.Vectors)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer vectors.Close()
+	vocab, err := os.Create(opts.Vocab)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer vocab.Close()
+
+	e := &exporter{
+		vectors: bufio.NewWriterSize(vectors, 1<<20),
+		vocab:   bufio.NewWriter(vocab),
+		dims:    opts.Dims,
+	}
+	// the header is rewritten with the number of rows at the end
+	if _, err := e.vectors.Write(pkg.NpyHeader(0, opts.Dims)); err != nil {
+		log.Fatal(err)
+	}
+	for _, path := range paths {
+		if err := e.export(path); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	if err := e.vectors.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := vectors.WriteAt(pkg.NpyHeader(e.rows, opts.Dims), 0); err != nil {
+		log.Fatal(err)
+	}
+	if err := e.vocab.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range []*os.File{vectors, vocab} {
+		if err := f.Sync(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("exported %d words, skipped %d records\n", e.rows, e.skipped)
+}
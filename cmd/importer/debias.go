@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// debiasing removes a bias direction from the vectors of the import, the
+// hard debiasing of Bolukbasi et al.: the direction is fitted to the seed
+// pairs of --debias, the seed words are equalized and all other words
+// neutralized. A nil debiasing leaves the vectors as they are
+type debiasing struct {
+	direction []float32
+	// equalized holds the equalized vectors of the seed words
+	equalized map[string][]float32
+}
+
+// fitDebias reads the vectors of the seed pairs of opts.Debias from the
+// GloVe text in and fits the bias direction to them. Pairs with a word
+// missing from the input are left out
+func fitDebias(in io.Reader, opts options) (*debiasing, error) {
+	f, err := os.Open(opts.Debias)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := pkg.ReadBiasPairs(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Debias, err)
+	}
+
+	vectors := map[string][]float32{}
+	for _, pair := range pairs {
+		vectors[pair[0]], vectors[pair[1]] = nil, nil
+	}
+	reader := bufio.NewReaderSize(in, 1<<20)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			// malformed lines are reported by the import
+			if word, vector, parseErr := parseLine(line, opts.Dims); parseErr == nil {
+				if v, ok := vectors[word]; ok && v == nil {
+					vectors[word] = vector
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var found [][2][]float32
+	var foundPairs [][2]string
+	for _, pair := range pairs {
+		a, b := vectors[pair[0]], vectors[pair[1]]
+		if a == nil || b == nil {
+			log.Printf("%s: leaving out %s %s, not both words are in the input", opts.Debias, pair[0], pair[1])
+			continue
+		}
+		found = append(found, [2][]float32{a, b})
+		foundPairs = append(foundPairs, pair)
+	}
+	direction, err := pkg.BiasDirection(found)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", opts.Debias, err)
+	}
+
+	d := &debiasing{direction: direction, equalized: map[string][]float32{}}
+	for i, pair := range foundPairs {
+		d.equalized[pair[0]], d.equalized[pair[1]] = pkg.Equalize(found[i][0], found[i][1], direction)
+	}
+	return d, nil
+}
+
+// apply returns the debiased vector of word
+func (d *debiasing) apply(word string, vector []float32) []float32 {
+	if d == nil {
+		return vector
+	}
+	if equalized, ok := d.equalized[word]; ok {
+		return equalized
+	}
+	return pkg.Neutralize(vector, d.direction)
+}
+
+// write stores the bias direction in the output, in the coordinates of the
+// principal axes if the vectors are rotated
+func (d *debiasing) write(output string, rotation *pcaRotation) error {
+	direction := d.direction
+	if rotation != nil {
+		direction = rotation.rotate(direction)
+	}
+	return pkg.WriteBias(output, direction)
+}
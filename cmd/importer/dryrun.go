@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+const (
+	// maxReported is the number of duplicate words listed by a dry run
+	maxReported = 10
+	// recordOverhead estimates the bytes LevelDB adds to every record: the
+	// sequence number of the key, the lengths and the block index
+	recordOverhead = 12
+)
+
+// dryRunStats is what a dry run found in the input
+type dryRunStats struct {
+	lines, valid, malformed, nonFinite int
+	// values counts the lines by their number of values, taking the first
+	// field as the word
+	values map[int]int
+	// spaced counts the words containing spaces
+	spaced int
+	// duplicates counts the words seen before, first lists some of them
+	duplicates      int
+	firstDuplicates []string
+	// caseVariants counts the words --merge-case would merge
+	caseVariants int
+	// seen holds the words, keys the keys of the database
+	seen, keys map[string]struct{}
+	// bytes estimates the size of the database
+	bytes int64
+}
+
+// dryRun parses the input like an import and reports its problems and the
+// estimated size of the database without writing anything. It returns
+// whether the input would be imported without skipping lines
+func dryRun(in io.Reader, opts options, freqs *frequencies) (bool, error) {
+	s := dryRunStats{values: map[int]int{}, seen: map[string]struct{}{}, keys: map[string]struct{}{}}
+	reader := bufio.NewReaderSize(in, 1<<20)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			s.lines++
+			s.values[len(strings.Fields(line))-1]++
+			word, vector, _, parseErr := parseSanitized(line, opts.Dims, opts.NonFinite == "zero")
+			if parseErr != nil {
+				log.Printf("line %d: %v", s.lines, parseErr)
+				s.malformed++
+				if errors.Is(parseErr, errNonFinite) {
+					s.nonFinite++
+				}
+			} else if err := s.add(word, vector, opts, freqs); err != nil {
+				return false, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	s.report(opts)
+	return s.malformed == 0, nil
+}
+
+// add counts a valid line
+func (s *dryRunStats) add(word string, vector []float32, opts options, freqs *frequencies) error {
+	s.valid++
+	if strings.Contains(word, " ") {
+		s.spaced++
+	}
+	_, duplicate := s.seen[word]
+	if duplicate {
+		if s.duplicates++; len(s.firstDuplicates) < maxReported {
+			s.firstDuplicates = append(s.firstDuplicates, fmt.Sprintf("%q on line %d", word, s.lines))
+		}
+	}
+	s.seen[word] = struct{}{}
+
+	key := word
+	if opts.MergeCase != mergeNone {
+		key = strings.ToLower(word)
+	}
+	if _, ok := s.keys[key]; ok {
+		if !duplicate {
+			s.caseVariants++
+		}
+		return nil
+	}
+	s.keys[key] = struct{}{}
+	value, err := pkg.EncodeVector(vector)
+	if err != nil {
+		return err
+	}
+	value = freqs.appendTo(value, word, s.valid)
+	s.bytes += int64(len(key) + len(value) + recordOverhead)
+	return nil
+}
+
+func (s *dryRunStats) report(opts options) {
+	fmt.Printf("read %d lines: %d valid, %d malformed", s.lines, s.valid, s.malformed)
+	if s.nonFinite > 0 {
+		fmt.Printf(" of which %d have NaN or infinite values", s.nonFinite)
+	}
+	fmt.Println()
+
+	if len(s.values) > 1 {
+		counts := make([]int, 0, len(s.values))
+		for n := range s.values {
+			counts = append(counts, n)
+		}
+		sort.Slice(counts, func(i, j int) bool { return s.values[counts[i]] > s.values[counts[j]] })
+		fmt.Printf("lines by number of values, counting words with spaces as values:")
+		for i, n := range counts {
+			if i == maxReported {
+				fmt.Printf(" ...")
+				break
+			}
+			fmt.Printf(" %d: %d", n, s.values[n])
+		}
+		fmt.Println()
+	}
+	if _, ok := s.values[opts.Dims]; !ok && s.lines > 0 {
+		fmt.Printf("no line has %d values, check --dims\n", opts.Dims)
+	}
+	if s.spaced > 0 {
+		fmt.Printf("%d words contain spaces\n", s.spaced)
+	}
+	if s.duplicates > 0 {
+		resolution := map[string]string{
+			mergeNone:     "later lines replace earlier ones",
+			mergeAverage:  "their vectors are averaged",
+			mergeFrequent: "the first line is kept",
+		}[opts.MergeCase]
+		fmt.Printf("%d duplicate words, %s: %s\n", s.duplicates, resolution, strings.Join(s.firstDuplicates, ", "))
+	}
+	if opts.MergeCase != mergeNone {
+		fmt.Printf("--merge-case would merge %d case variants\n", s.caseVariants)
+	}
+
+	words := len(s.keys)
+	size := s.bytes
+	if opts.BloomBits > 0 {
+		size += int64(words) * int64(opts.BloomBits) / 8
+	}
+	fmt.Printf("the database would hold %d words in about %.1f MiB before compression\n", words, float64(size)/(1<<20))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// sources of the frequencies stored with the vectors, recorded in
+// checksums.json
+const (
+	// frequenciesOrder ranks words by their position in the input
+	frequenciesOrder = "order"
+	// frequenciesCounts ranks words by the counts of --counts
+	frequenciesCounts = "counts"
+)
+
+// frequencies assigns the frequencies stored with the vectors. A nil
+// frequencies stores none
+type frequencies struct {
+	// counts holds the frequencies of --counts, nil to rank words by
+	// their position in the input
+	counts map[string]pkg.WordFrequency
+}
+
+func newFrequencies(opts options) (*frequencies, error) {
+	if opts.Counts != "" {
+		counts, err := readCounts(opts.Counts)
+		if err != nil {
+			return nil, fmt.Errorf("--counts: %v", err)
+		}
+		return &frequencies{counts: counts}, nil
+	}
+	if opts.Ranks {
+		return &frequencies{}, nil
+	}
+	return nil, nil
+}
+
+// frequencies returns how the frequencies stored with the vectors are
+// assigned, empty if none are stored
+func (opts options) frequencies() string {
+	switch {
+	case opts.Counts != "":
+		return frequenciesCounts
+	case opts.Ranks:
+		return frequenciesOrder
+	}
+	return ""
+}
+
+// appendTo appends the frequency of word, the position-th word of the
+// input, to its encoded vector
+func (f *frequencies) appendTo(value []byte, word string, position int) []byte {
+	if f == nil {
+		return value
+	}
+	if f.counts == nil {
+		return pkg.AppendFrequency(value, pkg.WordFrequency{Rank: int64(position)})
+	}
+	if freq, ok := f.counts[word]; ok {
+		return pkg.AppendFrequency(value, freq)
+	}
+	return value
+}
+
+// readCounts reads a file of a word and its count per line, like the
+// vocab.txt written by GloVe, and ranks the words by their counts, ties
+// in the order of the file
+func readCounts(path string) (map[string]pkg.WordFrequency, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	type wordCount struct {
+		word  string
+		count int64
+	}
+	var words []wordCount
+	reader := bufio.NewReaderSize(in, 1<<20)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimRight(line, " \r\n"); line != "" {
+			// words may contain spaces, the count is the last field
+			at := strings.LastIndexByte(line, ' ')
+			if at <= 0 {
+				return nil, fmt.Errorf("line %d: expected a word and its count", lineNo)
+			}
+			count, parseErr := strconv.ParseInt(line[at+1:], 10, 64)
+			if parseErr != nil || count < 0 {
+				return nil, fmt.Errorf("line %d: invalid count %q", lineNo, line[at+1:])
+			}
+			words = append(words, wordCount{line[:at], count})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(words, func(i, j int) bool { return words[i].count > words[j].count })
+	counts := make(map[string]pkg.WordFrequency, len(words))
+	for i, w := range words {
+		if _, ok := counts[w.word]; !ok {
+			counts[w.word] = pkg.WordFrequency{Rank: int64(i + 1), Count: w.count}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// wordIndex writes the index of --index, mapping the lowercase and folded
+// forms of the words to the first word of the input having them, the most
+// frequent one as GloVe files are sorted by frequency. A nil index writes
+// nothing
+type wordIndex struct {
+	db    *leveldb.DB
+	batch *leveldb.Batch
+	size  int
+	// keys holds the keys written so far, later words don't replace them
+	keys map[string]struct{}
+}
+
+// newWordIndex opens the index in the output, with the entries of an
+// interrupted import
+func newWordIndex(opts options) (*wordIndex, error) {
+	if !opts.Index {
+		return nil, nil
+	}
+	db, err := leveldb.OpenFile(filepath.Join(opts.Output, pkg.IndexDir), opts.levelDBOptions())
+	if err != nil {
+		return nil, err
+	}
+	x := &wordIndex{db: db, batch: new(leveldb.Batch), size: opts.BatchSize, keys: map[string]struct{}{}}
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		x.keys[string(iter.Key())] = struct{}{}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// add indexes the forms of word, which is written to the database
+func (x *wordIndex) add(word string) error {
+	if x == nil {
+		return nil
+	}
+	lower, folded := pkg.IndexLowercaseKey(word), pkg.IndexFoldKey(word)
+	keys := [][]byte{lower}
+	// words without diacritics are found by their lowercase entry
+	if string(folded[2:]) != string(lower[2:]) {
+		keys = append(keys, folded)
+	}
+	for _, key := range keys {
+		// the fallbacks find the word itself without the index
+		if string(key[2:]) == word {
+			continue
+		}
+		if _, ok := x.keys[string(key)]; ok {
+			continue
+		}
+		x.keys[string(key)] = struct{}{}
+		x.batch.Put(key, []byte(word))
+	}
+	if x.batch.Len() >= x.size {
+		return x.flush(nil)
+	}
+	return nil
+}
+
+// flush writes the pending entries
+func (x *wordIndex) flush(wo *opt.WriteOptions) error {
+	if x == nil {
+		return nil
+	}
+	if err := x.db.Write(x.batch, wo); err != nil {
+		return err
+	}
+	x.batch.Reset()
+	return nil
+}
+
+// entries returns the number of entries written
+func (x *wordIndex) entries() int {
+	if x == nil {
+		return 0
+	}
+	return len(x.keys)
+}
+
+func (x *wordIndex) close() error {
+	if x == nil {
+		return nil
+	}
+	err := x.flush(nil)
+	if closeErr := x.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/snapshot"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// options are the command line flags of the importer
+type options struct {
+	Input      string `short:"i" long:"input" description:"GloVe text file, one word followed by its vector per line, or a patch file with --base"`
+	From       string `long:"from" description:"URL or path of the input instead of --input, like https://nlp.stanford.edu/data/glove.840B.300d.zip. The first file of a zip archive is unzipped while it downloads"`
+	Output     string `short:"o" long:"output" description:"Directory the LevelDB database is written to" default:"./embeddings"`
+	Base       string `long:"base" description:"Database the input is applied to as a patch. It is copied to the output, which must be empty, and left untouched"`
+	Dims       int    `long:"dims" description:"Dimensionality of the vectors" default:"300"`
+	Shards     int    `long:"shards" description:"Number of databases the vocabulary is hash-partitioned over, 1 writes a single database" default:"1"`
+	BatchSize  int    `long:"batch-size" description:"Number of words written per batch" default:"10000"`
+	BloomBits  int    `long:"bloom-bits" description:"Bits per word of the bloom filter letting the server skip reads for unknown words, 0 disables it" default:"10"`
+	PCA        bool   `long:"pca" description:"Rotate the vectors onto their principal axes, so truncating them to their first dimensions keeps the most variance. Reads the input twice"`
+	NonFinite  string `long:"non-finite" description:"Lines with NaN or infinite values are skipped (reject) or imported with the values replaced by 0 (zero)" choice:"reject" choice:"zero" default:"reject"`
+	MergeCase  string `long:"merge-case" description:"Merge the case variants of words into their lowercase key with the mean of their vectors (average) or the vector of the first, most frequent, variant (frequent)" choice:"none" choice:"average" choice:"frequent" default:"none"`
+	Ranks      bool   `long:"ranks" description:"Store the rank of every word by its position in the input, which GloVe sorts by frequency, with its vector"`
+	Counts     string `long:"counts" description:"File of a word and its count per line, like the vocab.txt of GloVe. The counts and the ranks by count are stored with the vectors"`
+	Index      bool   `long:"index" description:"Write an index of the lowercase and diacritic-free forms of the words, so the lowercase and fold lookup steps of the server find NASA from nasa and café from cafe"`
+	Means      bool   `long:"means" description:"Write the mean of the vectors and, with --ranks or --counts, their frequency-weighted mean to means.npy for the fallback vector of the server"`
+	Debias     string `long:"debias" description:"File of seed pairs like \"he she\", one per line. The bias direction they define is removed from all other vectors and the pairs are equalized along it (hard debiasing), the direction is written to bias.npy. Reads the input twice"`
+	DryRun     bool   `long:"dry-run" description:"Parse and validate the input, report malformed lines, duplicate words and the estimated size of the database without writing anything. Exits with 1 if lines would be skipped"`
+	Workers    int    `long:"workers" description:"Number of goroutines parsing and encoding lines, 0 for the number of CPUs. Patches are applied in order by one" default:"0"`
+	Checkpoint int    `long:"checkpoint" description:"Number of lines after which the progress is saved, an interrupted import of the same input resumes there. 0 disables it" default:"500000"`
+
+	Compression    string `long:"compression" description:"Block compression of the LevelDB tables" choice:"snappy" choice:"none" default:"snappy"`
+	TableBloomBits int    `long:"table-bloom-bits" description:"Bits per key of the LevelDB table filters, 0 disables them. Must match VECTORIZER_LEVELDB_BLOOM_BITS of the server" default:"10"`
+	WriteBufferMB  int    `long:"write-buffer-mb" description:"Size of the LevelDB memtable" default:"64"`
+	TableSizeMB    int    `long:"table-size-mb" description:"Size of the LevelDB table files" default:"8"`
+
+	Publish string `long:"publish" description:"Object storage the database is published to for replicas, like s3://bucket/prefix, https://host/prefix or a directory"`
+	Version string `long:"version" description:"Version of the published snapshot, defaults to the current time"`
+}
+
+// levelDBOptions returns the options the database is written with
+func (opts options) levelDBOptions() *opt.Options {
+	o := &opt.Options{
+		WriteBuffer:         opts.WriteBufferMB * opt.MiB,
+		CompactionTableSize: opts.TableSizeMB * opt.MiB,
+	}
+	if opts.Compression == "none" {
+		o.Compression = opt.NoCompression
+	}
+	if opts.TableBloomBits > 0 {
+		o.Filter = filter.NewBloomFilter(opts.TableBloomBits)
+	}
+	return o
+}
+
+// writer writes vectors in batches to the shards of the output
+type writer struct {
+	shards  []*leveldb.DB
+	batches []*leveldb.Batch
+	size    int
+	// hashes of all written words for the bloom filter
+	hashes []uint64
+	// sanitize replaces NaN and infinite values by 0 instead of rejecting
+	// the line, sanitized counts the vectors it happened to
+	sanitize  bool
+	sanitized int
+	// index is the index of --index, nil without it
+	index *wordIndex
+}
+
+func newWriter(opts options) (*writer, error) {
+	if err := os.MkdirAll(opts.Output, 0o755); err != nil {
+		return nil, err
+	}
+
+	paths := []string{opts.Output}
+	if opts.Shards > 1 {
+		paths = nil
+		for i := 0; i < opts.Shards; i++ {
+			paths = append(paths, pkg.ShardPath(opts.Output, i))
+		}
+	}
+
+	w := &writer{size: opts.BatchSize, sanitize: opts.NonFinite == "zero"}
+	for _, path := range paths {
+		db, err := leveldb.OpenFile(path, opts.levelDBOptions())
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.shards = append(w.shards, db)
+		w.batches = append(w.batches, new(leveldb.Batch))
+	}
+
+	if opts.Shards > 1 {
+		if err := pkg.WriteShards(opts.Output, opts.Shards); err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+	index, err := newWordIndex(opts)
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	w.index = index
+	return w, nil
+}
+
+func (w *writer) put(word string, vector []float32) error {
+	value, err := pkg.EncodeVector(vector)
+	if err != nil {
+		return err
+	}
+	return w.putValue(word, value)
+}
+
+// putValue writes the encoded vector of word
+func (w *writer) putValue(word string, value []byte) error {
+	w.hashes = append(w.hashes, pkg.BloomHash([]byte(word)))
+	if err := w.index.add(word); err != nil {
+		return err
+	}
+
+	i := w.shardOf(word)
+	w.batches[i].Put([]byte(word), value)
+	if w.batches[i].Len() >= w.size {
+		return w.flush(i)
+	}
+	return nil
+}
+
+// replace writes the encoded vector of word, which is already written
+func (w *writer) replace(word string, value []byte) error {
+	i := w.shardOf(word)
+	w.batches[i].Put([]byte(word), value)
+	if w.batches[i].Len() >= w.size {
+		return w.flush(i)
+	}
+	return nil
+}
+
+// get returns the encoded vector of word, pending writes included
+func (w *writer) get(word string) ([]byte, error) {
+	i := w.shardOf(word)
+	if err := w.flush(i); err != nil {
+		return nil, err
+	}
+	return w.shards[i].Get([]byte(word), nil)
+}
+
+// shardOf returns the shard holding word
+func (w *writer) shardOf(word string) int {
+	if len(w.shards) == 1 {
+		return 0
+	}
+	return pkg.Shard([]byte(word), len(w.shards))
+}
+
+// has reports whether word is in the database, pending writes included
+func (w *writer) has(word string) (bool, error) {
+	i := w.shardOf(word)
+	if err := w.flush(i); err != nil {
+		return false, err
+	}
+	return w.shards[i].Has([]byte(word), nil)
+}
+
+func (w *writer) delete(word string) error {
+	i := w.shardOf(word)
+	w.batches[i].Delete([]byte(word))
+	if w.batches[i].Len() >= w.size {
+		return w.flush(i)
+	}
+	return nil
+}
+
+// scanHashes replaces the hashes for the bloom filter with those of all
+// words in the database, after a patch removed some of them
+func (w *writer) scanHashes() error {
+	w.hashes = w.hashes[:0]
+	for i, db := range w.shards {
+		if err := w.flush(i); err != nil {
+			return err
+		}
+		iter := db.NewIterator(nil, nil)
+		for iter.Next() {
+			w.hashes = append(w.hashes, pkg.BloomHash(iter.Key()))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMeans writes the means of all vectors in the database to output
+func (w *writer) writeMeans(output string) error {
+	var acc pkg.MeanAccumulator
+	for i, db := range w.shards {
+		if err := w.flush(i); err != nil {
+			return err
+		}
+		iter := db.NewIterator(nil, nil)
+		for iter.Next() {
+			if err := acc.Add(iter.Value()); err != nil {
+				iter.Release()
+				return fmt.Errorf("%q: %v", iter.Key(), err)
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	mean, weighted := acc.Means()
+	if mean == nil {
+		return nil
+	}
+	return pkg.WriteMeans(output, mean, weighted)
+}
+
+func (w *writer) flush(i int) error {
+	if err := w.shards[i].Write(w.batches[i], nil); err != nil {
+		return err
+	}
+	w.batches[i].Reset()
+	return nil
+}
+
+// writeBloomFilter writes the filter of all written words to the output
+func (w *writer) writeBloomFilter(output string, bitsPerKey int) error {
+	filter := pkg.NewBloomFilter(len(w.hashes), bitsPerKey)
+	for _, h := range w.hashes {
+		filter.AddHash(h)
+	}
+
+	f, err := os.Create(filepath.Join(output, pkg.BloomFile))
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	if _, err := filter.WriteTo(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (w *writer) close() error {
+	var firstErr error
+	for i, db := range w.shards {
+		if err := w.flush(i); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := w.index.close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// errNonFinite is returned by parseLine along with the vector if it has
+// NaN or infinite values
+var errNonFinite = errors.New("NaN or infinite values")
+
+// parse parses a line like parseLine, replacing NaN and infinite values by
+// 0 if the writer sanitizes them
+func (w *writer) parse(line string, dims int) (string, []float32, error) {
+	word, vector, sanitized, err := parseSanitized(line, dims, w.sanitize)
+	if sanitized {
+		w.sanitized++
+	}
+	return word, vector, err
+}
+
+// parseSanitized parses a line like parseLine, replacing NaN and infinite
+// values by 0 if sanitize is set and reporting whether it did
+func parseSanitized(line string, dims int, sanitize bool) (string, []float32, bool, error) {
+	word, vector, err := parseLine(line, dims)
+	if errors.Is(err, errNonFinite) && sanitize {
+		pkg.Sanitize(vector)
+		return word, vector, true, nil
+	}
+	return word, vector, false, err
+}
+
+// parseLine splits a line into its word and vector. A few words of the
+// 840B vocabulary contain spaces, so the vector is taken from the end
+func parseLine(line string, dims int) (string, []float32, error) {
+	fields := strings.Split(strings.TrimRight(line, " \r\n"), " ")
+	if len(fields) < dims+1 {
+		return "", nil, fmt.Errorf("expected %d values, got %d", dims, len(fields)-1)
+	}
+
+	word := strings.Join(fields[:len(fields)-dims], " ")
+	vector := make([]float32, dims)
+	for i, field := range fields[len(fields)-dims:] {
+		f, err := strconv.ParseFloat(field, 32)
+		if err != nil {
+			return "", nil, err
+		}
+		vector[i] = float32(f)
+	}
+	if n := pkg.NonFinite(vector); n > 0 {
+		return word, vector, fmt.Errorf("%q has %d %w", word, n, errNonFinite)
+	}
+	return word, vector, nil
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	if (opts.Input == "") == (opts.From == "") {
+		log.Fatal("either --input or --from is required")
+	}
+	if opts.Shards < 1 {
+		log.Fatal("--shards must be at least 1")
+	}
+	if opts.PCA && opts.Base != "" {
+		log.Fatal("--pca can't be combined with --base, the patch would need the rotation of the base")
+	}
+	if opts.MergeCase != mergeNone && opts.Base != "" {
+		log.Fatal("--merge-case can't be combined with --base")
+	}
+	if (opts.Ranks || opts.Counts != "") && opts.Base != "" {
+		log.Fatal("--ranks and --counts can't be combined with --base, the patch would need the ranks of the base")
+	}
+	if opts.Index && opts.Base != "" {
+		log.Fatal("--index can't be combined with --base, the index of the base is copied as it is")
+	}
+	if opts.Debias != "" && opts.Base != "" {
+		log.Fatal("--debias can't be combined with --base, the patch would need the bias direction of the base")
+	}
+	if opts.Ranks && opts.Counts != "" {
+		log.Fatal("--ranks can't be combined with --counts, which ranks the words by their counts")
+	}
+	if opts.DryRun {
+		if opts.Base != "" {
+			log.Fatal("--dry-run can't be combined with --base")
+		}
+		freqs, err := newFrequencies(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		in, _, err := openInput(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ok, err := dryRun(in, opts, freqs)
+		in.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if opts.Base != "" {
+		n, err := baseShards(opts.Base)
+		if err != nil {
+			log.Fatalf("--base: %v", err)
+		}
+		// the words stay in their shards
+		opts.Shards = n
+		if err := copyDatabase(opts.Base, opts.Output); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var debias *debiasing
+	if opts.Debias != "" {
+		fmt.Println("fitting the bias direction")
+		in, _, err := openInput(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		debias, err = fitDebias(in, opts)
+		in.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var rotation *pcaRotation
+	if opts.PCA {
+		fmt.Println("fitting the principal axes")
+		in, _, err := openInput(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rotation, err = fitPCA(in, opts.Dims, debias)
+		in.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	in, size, err := openInput(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+
+	w, err := newWriter(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var imported, malformed int
+	var stats patchStats
+	var resumed bool
+	merger := newCaseMerger(opts.MergeCase)
+	freqs, err := newFrequencies(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Base != "" {
+		reader := bufio.NewReaderSize(in, 1<<20)
+		for lineNo := 1; ; lineNo++ {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				if patchErr := w.applyPatchLine(line, opts.Dims, &stats); patchErr != nil {
+					log.Printf("line %d: %v", lineNo, patchErr)
+					malformed++
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		c := newCheckpoint(opts, size)
+		saved, err := readCheckpoint(opts.Output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if saved != nil {
+			if !saved.sameImport(c) {
+				log.Fatalf("%s holds an interrupted import of %s with other options, remove it to start over", opts.Output, saved.Source)
+			}
+			if err := skip(in, saved.Offset); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("resuming after line %d, %d words were imported\n", saved.Lines, saved.Imported)
+			c, resumed = saved, true
+		}
+		workers := opts.Workers
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+		checkpointLines := opts.Checkpoint
+		if merger != nil {
+			// the variants seen so far are only in memory
+			checkpointLines = 0
+		}
+		if err := w.importParallel(in, opts, debias, rotation, merger, freqs, c, workers, checkpointLines); err != nil {
+			log.Fatal(err)
+		}
+		imported, malformed, w.sanitized = c.Imported, c.Malformed, c.Sanitized
+	}
+
+	// the words imported before an interruption are only in the database
+	if opts.Base != "" || resumed {
+		if err := w.scanHashes(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// a patch updates the means of its base
+	if _, err := os.Stat(filepath.Join(opts.Output, pkg.MeansFile)); opts.Means || err == nil {
+		if err := w.writeMeans(opts.Output); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		log.Fatal(err)
+	}
+	if opts.BloomBits > 0 {
+		if err := w.writeBloomFilter(opts.Output, opts.BloomBits); err != nil {
+			log.Fatal(err)
+		}
+	} else if opts.Base != "" {
+		// the filter of the base would reject the added words
+		if err := os.Remove(filepath.Join(opts.Output, pkg.BloomFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatal(err)
+		}
+	}
+	if opts.Base != "" {
+		fmt.Printf("added %d words, changed %d, removed %d, %d removed words were missing, skipped %d malformed lines\n",
+			stats.added, stats.changed, stats.removed, stats.missing, malformed)
+	} else {
+		fmt.Printf("imported %d words, skipped %d malformed lines\n", imported, malformed)
+	}
+	if w.index != nil {
+		fmt.Printf("indexed %d lowercase and diacritic-free forms\n", w.index.entries())
+	}
+	if merger != nil {
+		fmt.Printf("merged %d case variants, %d words remain\n", merger.merged, imported-merger.merged)
+	}
+	if w.sanitized > 0 {
+		fmt.Printf("replaced NaN or infinite values of %d vectors by 0\n", w.sanitized)
+	}
+
+	if rotation != nil {
+		if err := rotation.write(opts.Output); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if debias != nil {
+		if err := debias.write(opts.Output, rotation); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("removed the bias direction of %d seed words\n", len(debias.equalized))
+	}
+
+	words := imported
+	if opts.Base != "" {
+		words = len(w.hashes)
+	} else if merger != nil {
+		words -= merger.merged
+	}
+	if err := os.Remove(filepath.Join(opts.Output, checkpointFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+	if err := writeChecksums(opts, words); err != nil {
+		log.Fatal(err)
+	}
+
+	if opts.Publish != "" {
+		if err := publish(opts); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// writeChecksums lists the files of the database with their checksums, so
+// the server can detect corrupt copies
+func writeChecksums(opts options, words int) error {
+	files, err := pkg.ComputeChecksums(opts.Output)
+	if err != nil {
+		return err
+	}
+	caseMerge := opts.MergeCase
+	if caseMerge == mergeNone {
+		caseMerge = ""
+	}
+	// a patched database keeps the index of its base
+	_, err = os.Stat(filepath.Join(opts.Output, pkg.IndexDir))
+	index := err == nil
+	_, err = os.Stat(filepath.Join(opts.Output, pkg.BiasFile))
+	debiased := err == nil
+	return pkg.WriteChecksums(opts.Output, &pkg.Checksums{
+		Words:       words,
+		Dims:        opts.Dims,
+		Shards:      opts.Shards,
+		Source:      opts.source(),
+		PCA:         opts.PCA,
+		CaseMerge:   caseMerge,
+		Frequencies: opts.frequencies(),
+		Index:       index,
+		Debiased:    debiased,
+		Created:     time.Now().UTC(),
+		Files:       files,
+	})
+}
+
+// publish uploads the database as a snapshot replicas switch to
+func publish(opts options) error {
+	store, err := snapshot.Open(opts.Publish)
+	if err != nil {
+		return err
+	}
+	version := opts.Version
+	if version == "" {
+		version = time.Now().UTC().Format("20060102T150405Z")
+	}
+	m, err := snapshot.Publish(context.Background(), store, opts.Output, version)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("published snapshot %s of %d files to %s\n", m.Version, len(m.Files), opts.Publish)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// policies of --merge-case
+const (
+	// mergeNone keeps every case variant under its own key
+	mergeNone = "none"
+	// mergeAverage stores the mean of the vectors of all variants
+	mergeAverage = "average"
+	// mergeFrequent keeps the vector of the variant first in the input,
+	// the most frequent one as GloVe files are sorted by frequency
+	mergeFrequent = "frequent"
+)
+
+// caseMerger merges the case variants of words, like Apple and apple, into
+// their lowercase key. A nil merger keeps the words as they are
+type caseMerger struct {
+	policy string
+	// variants counts the variants merged into every key so far
+	variants map[string]int32
+	// merged counts the variants merged into an existing key
+	merged int
+}
+
+func newCaseMerger(policy string) *caseMerger {
+	if policy == mergeNone {
+		return nil
+	}
+	return &caseMerger{policy: policy, variants: map[string]int32{}}
+}
+
+// put writes the encoded vector of word, merged into its lowercase key
+func (m *caseMerger) put(w *writer, word string, value []byte) error {
+	if m == nil {
+		return w.putValue(word, value)
+	}
+
+	key := strings.ToLower(word)
+	n := m.variants[key]
+	m.variants[key] = n + 1
+	if n == 0 {
+		return w.putValue(key, value)
+	}
+	m.merged++
+	if m.policy == mergeFrequent {
+		return nil
+	}
+
+	// the running mean of the n variants so far and this one, with the
+	// best rank of the variants and the sum of their counts
+	stored, err := w.get(key)
+	if err != nil {
+		return err
+	}
+	mean, freq, hasFreq, err := pkg.DecodeRecord(stored)
+	if err != nil {
+		return err
+	}
+	vector, variantFreq, variantHasFreq, err := pkg.DecodeRecord(value)
+	if err != nil {
+		return err
+	}
+	for i := range mean {
+		mean[i] += (vector[i] - mean[i]) / float32(n+1)
+	}
+	value, err = pkg.EncodeVector(mean)
+	if err != nil {
+		return err
+	}
+	switch {
+	case hasFreq && variantHasFreq:
+		freq.Count += variantFreq.Count
+		if variantFreq.Rank < freq.Rank {
+			freq.Rank = variantFreq.Rank
+		}
+	case variantHasFreq:
+		freq, hasFreq = variantFreq, true
+	}
+	if hasFreq {
+		value = pkg.AppendFrequency(value, freq)
+	}
+	return w.replace(key, value)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	// checkpointFile holds the progress of an import in its output, it is
+	// removed once the import is complete
+	checkpointFile = "import.checkpoint"
+	// chunkLines is the number of lines a worker parses at once
+	chunkLines = 1000
+)
+
+// checkpoint is the progress of an import: every line of the input before
+// Offset is written to the database
+type checkpoint struct {
+	// the input and the options of the import, the checkpoint of another
+	// import isn't resumed
+	Source    string `json:"source"`
+	Size      int64  `json:"size"`
+	Dims      int    `json:"dims"`
+	Shards    int    `json:"shards"`
+	PCA       bool   `json:"pca"`
+	NonFinite string `json:"non_finite"`
+	MergeCase string `json:"merge_case"`
+	// Frequencies is the source of the frequencies, the counts file isn't
+	// compared
+	Frequencies string `json:"frequencies"`
+	Index       bool   `json:"index"`
+	Debias      string `json:"debias"`
+
+	Offset    int64 `json:"offset"`
+	Lines     int   `json:"lines"`
+	Imported  int   `json:"imported"`
+	Malformed int   `json:"malformed"`
+	Sanitized int   `json:"sanitized"`
+}
+
+func newCheckpoint(opts options, size int64) *checkpoint {
+	return &checkpoint{
+		Source:      opts.source(),
+		Size:        size,
+		Dims:        opts.Dims,
+		Shards:      opts.Shards,
+		PCA:         opts.PCA,
+		NonFinite:   opts.NonFinite,
+		MergeCase:   opts.MergeCase,
+		Frequencies: opts.frequencies(),
+		Index:       opts.Index,
+		Debias:      opts.Debias,
+	}
+}
+
+// sameImport reports whether c and other are checkpoints of the same import
+func (c *checkpoint) sameImport(other *checkpoint) bool {
+	return c.Source == other.Source && c.Size == other.Size && c.Dims == other.Dims &&
+		c.Shards == other.Shards && c.PCA == other.PCA && c.NonFinite == other.NonFinite &&
+		c.MergeCase == other.MergeCase && c.Frequencies == other.Frequencies && c.Index == other.Index &&
+		c.Debias == other.Debias
+}
+
+// readCheckpoint returns the checkpoint of an interrupted import to output,
+// nil if there is none
+func readCheckpoint(output string) (*checkpoint, error) {
+	b, err := os.ReadFile(filepath.Join(output, checkpointFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", checkpointFile, err)
+	}
+	return &c, nil
+}
+
+// write replaces the checkpoint in output, a crash leaves either the old or
+// the new one
+func (c *checkpoint) write(output string) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(output, checkpointFile)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// chunk is a run of lines of the input, parsed and encoded by a worker
+type chunk struct {
+	seq int
+	// end is the offset of the input after the last line
+	end     int64
+	lines   []string
+	records []record
+}
+
+// record is a parsed line, err is set if it is malformed
+type record struct {
+	word      string
+	value     []byte
+	sanitized bool
+	err       error
+}
+
+// importParallel imports the lines of in, positioned at c.Offset, parsing,
+// debiasing, rotating and encoding them on workers goroutines while the
+// calling goroutine writes them with their frequencies through merger in the
+// order of the input. Every
+// checkpointLines lines the shards are synced and c saved, 0 never saves it
+func (w *writer) importParallel(in io.Reader, opts options, debias *debiasing, rotation *pcaRotation, merger *caseMerger, freqs *frequencies, c *checkpoint, workers, checkpointLines int) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	chunks := make(chan *chunk, workers)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		reader := bufio.NewReaderSize(in, 1<<20)
+		offset := c.Offset
+		current := &chunk{}
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				offset += int64(len(line))
+				current.lines = append(current.lines, line)
+				current.end = offset
+			}
+			if len(current.lines) == chunkLines || (err != nil && len(current.lines) > 0) {
+				select {
+				case chunks <- current:
+				case <-done:
+					return
+				}
+				current = &chunk{seq: current.seq + 1}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+
+	parsed := make(chan *chunk, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range chunks {
+				ch.records = make([]record, len(ch.lines))
+				for i, line := range ch.lines {
+					r := &ch.records[i]
+					var vector []float32
+					r.word, vector, r.sanitized, r.err = parseSanitized(line, opts.Dims, w.sanitize)
+					if r.err != nil {
+						continue
+					}
+					vector = debias.apply(r.word, vector)
+					if rotation != nil {
+						vector = rotation.rotate(vector)
+					}
+					r.value, r.err = pkg.EncodeVector(vector)
+				}
+				select {
+				case parsed <- ch:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(parsed)
+	}()
+
+	start, startOffset := time.Now(), c.Offset
+	sinceCheckpoint := 0
+	// chunks parsed ahead of the next one to write
+	pending := map[int]*chunk{}
+	next := 0
+	for ch := range parsed {
+		pending[ch.seq] = ch
+		for {
+			ch, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			for i, r := range ch.records {
+				if r.err != nil {
+					log.Printf("line %d: %v", c.Lines+i+1, r.err)
+					c.Malformed++
+					continue
+				}
+				if r.sanitized {
+					c.Sanitized++
+				}
+				value := freqs.appendTo(r.value, r.word, c.Imported+1)
+				if err := merger.put(w, r.word, value); err != nil {
+					return err
+				}
+				if c.Imported++; c.Imported%100000 == 0 {
+					fmt.Printf("imported %d words, %s\n", c.Imported, eta(start, startOffset, ch.end, c.Size))
+				}
+			}
+			c.Lines += len(ch.lines)
+			c.Offset = ch.end
+
+			if sinceCheckpoint += len(ch.lines); checkpointLines > 0 && sinceCheckpoint >= checkpointLines {
+				sinceCheckpoint = 0
+				if err := w.sync(); err != nil {
+					return err
+				}
+				if err := c.write(opts.Output); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// eta describes the progress through an input of size bytes, at offset
+// after starting at startOffset at start
+func eta(start time.Time, startOffset, offset, size int64) string {
+	if size <= 0 || offset <= startOffset {
+		return "time remaining unknown"
+	}
+	remaining := time.Duration(float64(time.Since(start)) * float64(size-offset) / float64(offset-startOffset))
+	return fmt.Sprintf("%.1f%% of the input, %s remaining", 100*float64(offset)/float64(size), remaining.Round(time.Second))
+}
+
+// sync writes the pending batches of all shards and of the index and syncs
+// them to disk
+func (w *writer) sync() error {
+	for i, db := range w.shards {
+		if err := db.Write(w.batches[i], &opt.WriteOptions{Sync: true}); err != nil {
+			return err
+		}
+		w.batches[i].Reset()
+	}
+	return w.index.flush(&opt.WriteOptions{Sync: true})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// patchStats counts the changes of a patch
+type patchStats struct {
+	added, changed, removed, missing int
+}
+
+// copyDatabase copies the database at base to output, which must not exist
+// or be empty. The lock, the info logs and the checksums are left out
+func copyDatabase(base, output string) error {
+	if entries, err := os.ReadDir(output); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", output)
+	}
+	return filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(output, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		if pkg.SkipFile(info.Name()) {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// baseShards returns the number of shards of the database at base
+func baseShards(base string) (int, error) {
+	if _, err := os.Stat(filepath.Join(base, "CURRENT")); errors.Is(err, fs.ErrNotExist) {
+		n, err := pkg.ReadShards(base)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("%s is not a database", base)
+		}
+		return n, nil
+	}
+	return 1, nil
+}
+
+// applyPatchLine applies a line of a patch file: "+ word v1 ... vN" adds or
+// replaces the vector of word and "- word" removes it
+func (w *writer) applyPatchLine(line string, dims int, stats *patchStats) error {
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) < 3 || line[1] != ' ' {
+		return fmt.Errorf("expected '+ word vector' or '- word'")
+	}
+
+	switch line[0] {
+	case '+':
+		word, vector, err := w.parse(line[2:], dims)
+		if err != nil {
+			return err
+		}
+		exists, err := w.has(word)
+		if err != nil {
+			return err
+		}
+		if exists {
+			stats.changed++
+		} else {
+			stats.added++
+		}
+		return w.put(word, vector)
+	case '-':
+		word := line[2:]
+		exists, err := w.has(word)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			stats.missing++
+			return nil
+		}
+		stats.removed++
+		return w.delete(word)
+	}
+	return fmt.Errorf("unknown operation %q", line[0])
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// pcaRotation rotates vectors onto the principal axes of the vocabulary,
+// the axis of the largest variance first, so the first dimensions of every
+// vector keep as much of it as possible when truncated. The axes are those
+// of the uncentered second moment matrix: the rotation is orthogonal and
+// leaves dot products, norms and distances of full vectors unchanged
+type pcaRotation struct {
+	dims int
+	// axes holds the principal axes, one per row
+	axes []float64
+}
+
+// fitPCA reads the vectors of the GloVe text in and returns the rotation
+// onto their principal axes, after debias
+func fitPCA(in io.Reader, dims int, debias *debiasing) (*pcaRotation, error) {
+	moments := make([]float64, dims*dims)
+	var n int
+	reader := bufio.NewReaderSize(in, 1<<20)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			// malformed lines are reported by the import
+			if word, vector, parseErr := parseLine(line, dims); parseErr == nil {
+				vector = debias.apply(word, vector)
+				for i, a := range vector {
+					row := moments[i*dims : (i+1)*dims]
+					for j := i; j < dims; j++ {
+						row[j] += float64(a) * float64(vector[j])
+					}
+				}
+				n++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("no vectors to fit the rotation to")
+	}
+	for i := 0; i < dims; i++ {
+		for j := i; j < dims; j++ {
+			moments[i*dims+j] /= float64(n)
+			moments[j*dims+i] = moments[i*dims+j]
+		}
+	}
+
+	values, vectors := symmetricEigen(moments, dims)
+	order := make([]int, dims)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return values[order[a]] > values[order[b]] })
+
+	r := &pcaRotation{dims: dims, axes: make([]float64, dims*dims)}
+	for row, k := range order {
+		// the eigenvectors are the columns of vectors
+		for i := 0; i < dims; i++ {
+			r.axes[row*dims+i] = vectors[i*dims+k]
+		}
+	}
+	return r, nil
+}
+
+// rotate returns vector in the coordinates of the principal axes
+func (r *pcaRotation) rotate(vector []float32) []float32 {
+	rotated := make([]float32, r.dims)
+	for row := range rotated {
+		axis := r.axes[row*r.dims : (row+1)*r.dims]
+		var sum float64
+		for i, value := range vector {
+			sum += axis[i] * float64(value)
+		}
+		rotated[row] = float32(sum)
+	}
+	return rotated
+}
+
+// write stores the rotation as a .npy matrix in the output, the matrix
+// that projections and clients multiply vectors of the original space by,
+// v·matrix, to compare them with the stored ones
+func (r *pcaRotation) write(output string) error {
+	b := pkg.NpyHeader(r.dims, r.dims)
+	for i := 0; i < r.dims; i++ {
+		for row := 0; row < r.dims; row++ {
+			b = pkg.AppendFloat32s(b, []float32{float32(r.axes[row*r.dims+i])})
+		}
+	}
+	return os.WriteFile(filepath.Join(output, pkg.RotationFile), b, 0o644)
+}
+
+// symmetricEigen returns the eigenvalues and eigenvectors, as columns, of
+// the symmetric n×n matrix a by cyclic Jacobi rotations. a is overwritten
+func symmetricEigen(a []float64, n int) ([]float64, []float64) {
+	v := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		v[i*n+i] = 1
+	}
+
+	for sweep := 0; sweep < 100; sweep++ {
+		var off float64
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				off += a[p*n+q] * a[p*n+q]
+			}
+		}
+		if off < 1e-22 {
+			break
+		}
+
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				apq := a[p*n+q]
+				if math.Abs(apq) < 1e-30 {
+					continue
+				}
+				theta := (a[q*n+q] - a[p*n+p]) / (2 * apq)
+				t := math.Copysign(1, theta) / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+
+				for k := 0; k < n; k++ {
+					akp, akq := a[k*n+p], a[k*n+q]
+					a[k*n+p] = c*akp - s*akq
+					a[k*n+q] = s*akp + c*akq
+				}
+				for k := 0; k < n; k++ {
+					apk, aqk := a[p*n+k], a[q*n+k]
+					a[p*n+k] = c*apk - s*aqk
+					a[q*n+k] = s*apk + c*aqk
+				}
+				for k := 0; k < n; k++ {
+					vkp, vkq := v[k*n+p], v[k*n+q]
+					v[k*n+p] = c*vkp - s*vkq
+					v[k*n+q] = s*vkp + c*vkq
+				}
+			}
+		}
+	}
+
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = a[i*n+i]
+	}
+	return values, v
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// zipLocalHeader starts every file of a zip archive
+const zipLocalHeader = "PK\x03\x04"
+
+// source returns the name of the input recorded in checksums.json
+func (opts options) source() string {
+	if opts.From == "" {
+		return filepath.Base(opts.Input)
+	}
+	if u, err := url.Parse(opts.From); err == nil && u.Scheme != "" {
+		return path.Base(u.Path)
+	}
+	return filepath.Base(opts.From)
+}
+
+// openInput opens the text of the import: the file of --input or the
+// download or file of --from, unzipped while it is read if it is a zip
+// archive. size is the size of the text, 0 if it isn't known
+func openInput(opts options) (r io.ReadCloser, size int64, err error) {
+	if opts.From == "" {
+		f, err := os.Open(opts.Input)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	}
+
+	var body io.ReadCloser
+	if u, err := url.Parse(opts.From); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		resp, err := http.Get(opts.From)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("%s: %s", opts.From, resp.Status)
+		}
+		body, size = resp.Body, resp.ContentLength
+	} else {
+		f, err := os.Open(opts.From)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		body, size = f, fi.Size()
+	}
+
+	buffered := bufio.NewReaderSize(body, 1<<20)
+	magic, err := buffered.Peek(len(zipLocalHeader))
+	if err != nil && err != io.EOF {
+		body.Close()
+		return nil, 0, err
+	}
+	if string(magic) != zipLocalHeader {
+		if size < 0 {
+			size = 0
+		}
+		return readCloser{buffered, body}, size, nil
+	}
+	entry, size, err := unzipFirst(buffered)
+	if err != nil {
+		body.Close()
+		return nil, 0, fmt.Errorf("%s: %v", opts.From, err)
+	}
+	return readCloser{entry, body}, size, nil
+}
+
+// readCloser reads from a reader wrapping the body it closes
+type readCloser struct {
+	io.Reader
+	body io.Closer
+}
+
+func (r readCloser) Close() error {
+	return r.body.Close()
+}
+
+// unzipFirst returns the contents of the first file of the zip archive r
+// and their size, 0 if the archive doesn't record it before the data. The
+// archive is read as a stream from its first local file header, so it is
+// unzipped while it downloads. The contents are verified against their
+// CRC-32 at the end if the header records it
+func unzipFirst(r io.Reader) (io.Reader, int64, error) {
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	if string(header[:4]) != zipLocalHeader {
+		return nil, 0, errors.New("not a zip archive")
+	}
+	flags := binary.LittleEndian.Uint16(header[6:])
+	method := binary.LittleEndian.Uint16(header[8:])
+	checksum := binary.LittleEndian.Uint32(header[14:])
+	compressed := int64(binary.LittleEndian.Uint32(header[18:]))
+	size := int64(binary.LittleEndian.Uint32(header[22:]))
+	name := make([]byte, binary.LittleEndian.Uint16(header[26:]))
+	extra := make([]byte, binary.LittleEndian.Uint16(header[28:]))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.ReadFull(r, extra); err != nil {
+		return nil, 0, err
+	}
+	if flags&0x1 != 0 {
+		return nil, 0, fmt.Errorf("%s is encrypted", name)
+	}
+	if strings.HasSuffix(string(name), "/") {
+		return nil, 0, fmt.Errorf("the first entry of the archive, %s, is a directory", name)
+	}
+
+	// the sizes of files of 4 GiB and more are in the zip64 extra field
+	for rest := extra; len(rest) >= 4; {
+		id, length := binary.LittleEndian.Uint16(rest), int(binary.LittleEndian.Uint16(rest[2:]))
+		if len(rest) < 4+length {
+			break
+		}
+		field := rest[4 : 4+length]
+		if id == 0x0001 {
+			if size == 0xffffffff && len(field) >= 8 {
+				size, field = int64(binary.LittleEndian.Uint64(field)), field[8:]
+			}
+			if compressed == 0xffffffff && len(field) >= 8 {
+				compressed = int64(binary.LittleEndian.Uint64(field))
+			}
+		}
+		rest = rest[4+length:]
+	}
+	// with a data descriptor the sizes and the checksum follow the data
+	described := flags&0x8 != 0
+	if described {
+		size = 0
+	}
+
+	var contents io.Reader
+	switch method {
+	case 0:
+		if described {
+			return nil, 0, fmt.Errorf("%s is stored without its size", name)
+		}
+		contents = io.LimitReader(r, compressed)
+	case 8:
+		contents = flate.NewReader(r)
+	default:
+		return nil, 0, fmt.Errorf("%s is compressed with the unsupported method %d", name, method)
+	}
+	if described {
+		return contents, 0, nil
+	}
+	return &crcReader{r: contents, hash: crc32.NewIEEE(), want: checksum, name: string(name)}, size, nil
+}
+
+// crcReader fails at the end of r unless its CRC-32 is want
+type crcReader struct {
+	r    io.Reader
+	hash hash.Hash32
+	want uint32
+	name string
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF && c.hash.Sum32() != c.want {
+		return n, fmt.Errorf("%s: checksum mismatch, the archive is corrupt", c.name)
+	}
+	return n, err
+}
+
+// skip advances r by n bytes, by seeking if it can
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+	skipped, err := io.CopyN(io.Discard, r, n)
+	if err == io.EOF || (err == nil && skipped < n) {
+		return fmt.Errorf("the input ends before the checkpoint at byte %d", n)
+	}
+	return err
+}
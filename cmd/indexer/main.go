@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/router"
+)
+
+// options are the command line flags of indexer
+type options struct {
+	Input       string   `short:"i" long:"input" description:"JSONL file of documents like {\"id\": \"doc-1\", \"text\": \"...\"}" required:"true"`
+	Output      string   `short:"o" long:"output" description:"Faiss index file to write" default:"./index.faiss"`
+	IDs         string   `long:"ids" description:"File the document ids are written to, one per line in the order of the index" default:"./index.ids"`
+	Servers     []string `long:"server" description:"URL of the vectorizer, repeat it to spread the documents over several instances" default:"http://localhost:9876"`
+	Options     string   `long:"options" description:"JSON options of the vectorize endpoint, like {\"ngrams\": 2}"`
+	Metric      string   `long:"metric" description:"Metric of the index" choice:"ip" choice:"l2" default:"ip"`
+	Normalize   bool     `long:"normalize" description:"Normalize the vectors, so inner product is cosine similarity"`
+	Concurrency int      `long:"concurrency" description:"Number of documents vectorized at the same time" default:"8"`
+}
+
+// document is a line of the input
+type document struct {
+	ID   json.RawMessage `json:"id"`
+	Text string          `json:"text"`
+}
+
+// Faiss metric types
+const (
+	metricInnerProduct = 0
+	metricL2           = 1
+)
+
+// faissHeader returns the serialization of an IndexFlat holding n vectors of
+// d dimensions up to the vectors, see write_index in faiss/impl/index_write.cpp
+func faissHeader(metric string, d, n int) []byte {
+	fourcc, metricType := "IxFI", int32(metricInnerProduct)
+	if metric == "l2" {
+		fourcc, metricType = "IxF2", metricL2
+	}
+	b := []byte(fourcc)
+	b = binary.LittleEndian.AppendUint32(b, uint32(d))
+	b = binary.LittleEndian.AppendUint64(b, uint64(n))
+	b = binary.LittleEndian.AppendUint64(b, 1<<20)
+	b = binary.LittleEndian.AppendUint64(b, 1<<20)
+	b = append(b, 1) // is_trained
+	b = binary.LittleEndian.AppendUint32(b, uint32(metricType))
+	return binary.LittleEndian.AppendUint64(b, uint64(n*d))
+}
+
+// vectorizer calls the vectorize endpoint of the servers
+type vectorizer struct {
+	router  *router.Router
+	options map[string]json.RawMessage
+}
+
+// rejectedError is returned for documents the server refused to vectorize,
+// like those without known words
+type rejectedError struct {
+	status  string
+	message string
+}
+
+func (e *rejectedError) Error() string {
+	return e.status + ": " + e.message
+}
+
+// vectorize returns the vector of text, the documents are routed to the
+// servers by id
+func (v *vectorizer) vectorize(id, text string) ([]float32, error) {
+	body := map[string]interface{}{"query": []string{text}}
+	for name, value := range v.options {
+		body[name] = value
+	}
+	request, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.router.Post(context.Background(), id, "/vectorize", "application/json", request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := &rejectedError{status: resp.Status, message: strings.TrimSpace(string(message))}
+		if resp.StatusCode >= 500 {
+			return nil, fmt.Errorf("server error %v", err)
+		}
+		return nil, err
+	}
+
+	var response struct {
+		Vector []float32 `json:"vector"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Vector, nil
+}
+
+func normalize(vector []float32) {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	if opts.Concurrency < 1 {
+		log.Fatal("--concurrency must be positive")
+	}
+
+	r, err := router.New(opts.Servers, router.DefaultReplicas)
+	if err != nil {
+		log.Fatalf("--server: %v", err)
+	}
+	if len(opts.Servers) > 1 {
+		go r.CheckHealth(context.Background(), 5*time.Second)
+	}
+	v := &vectorizer{router: r}
+	if opts.Options != "" {
+		if err := json.Unmarshal([]byte(opts.Options), &v.options); err != nil {
+			log.Fatalf("--options: %v", err)
+		}
+	}
+
+	in, err := os.Open(opts.Input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(opts.Output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	idsFile, err := os.Create(opts.IDs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer idsFile.Close()
+
+	vectors := bufio.NewWriterSize(out, 1<<20)
+	ids := bufio.NewWriter(idsFile)
+
+	// documents are vectorized in batches, so the index keeps their order
+	reader := bufio.NewReader(in)
+	batch := make([]document, 0, 16*opts.Concurrency)
+	results := make([][]float32, cap(batch))
+	errs := make([]error, cap(batch))
+	var dims, n, skipped, line int
+	flush := func() {
+		var wg sync.WaitGroup
+		work := make(chan int)
+		for w := 0; w < opts.Concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					results[i], errs[i] = v.vectorize(string(batch[i].ID), batch[i].Text)
+				}
+			}()
+		}
+		for i := range batch {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+
+		for i, doc := range batch {
+			var rejected *rejectedError
+			if errs[i] != nil && !errors.As(errs[i], &rejected) {
+				log.Fatalf("%s: %v", doc.ID, errs[i])
+			}
+			if errs[i] != nil {
+				log.Printf("skipping %s: %v", doc.ID, errs[i])
+				skipped++
+				continue
+			}
+			if dims == 0 {
+				dims = len(results[i])
+				if _, err := vectors.Write(faissHeader(opts.Metric, dims, 0)); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if len(results[i]) != dims {
+				log.Fatalf("%s: vector of %d dimensions, expected %d", doc.ID, len(results[i]), dims)
+			}
+			if opts.Normalize {
+				normalize(results[i])
+			}
+			if _, err := vectors.Write(pkg.AppendFloat32s(nil, results[i])); err != nil {
+				log.Fatal(err)
+			}
+
+			// string ids are written unquoted, others as their JSON
+			var id string
+			if err := json.Unmarshal(doc.ID, &id); err != nil {
+				id = string(doc.ID)
+			}
+			if _, err := ids.WriteString(id + "\n"); err != nil {
+				log.Fatal(err)
+			}
+			n++
+			if n%10000 == 0 {
+				fmt.Printf("indexed %d documents\n", n)
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		if len(b) > 0 {
+			line++
+		}
+		if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 {
+			var doc document
+			if err := json.Unmarshal(trimmed, &doc); err != nil {
+				log.Fatalf("line %d: %v", line, err)
+			}
+			if doc.ID == nil {
+				doc.ID = json.RawMessage(strconv.Itoa(line))
+			}
+			batch = append(batch, doc)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	flush()
+
+	if n == 0 {
+		log.Fatal("no documents could be vectorized")
+	}
+	if err := vectors.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	// the header is rewritten with the number of vectors
+	if _, err := out.WriteAt(faissHeader(opts.Metric, dims, n), 0); err != nil {
+		log.Fatal(err)
+	}
+	if err := ids.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range []*os.File{out, idsFile} {
+		if err := f.Sync(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("wrote %d vectors of %d dimensions to %s, skipped %d documents\n", n, dims, opts.Output, skipped)
+}
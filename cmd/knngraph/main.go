@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/metric"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// options are the command line flags of knngraph
+type options struct {
+	DB          string `short:"d" long:"db" description:"Directory of the LevelDB database, sharded or not" default:"./embeddings"`
+	Output      string `short:"o" long:"output" description:"Directory of the LevelDB database the graph is written to" default:"./knn"`
+	K           int    `short:"k" description:"Number of neighbors of every word" default:"10"`
+	Metric      string `long:"metric" description:"Distance the neighbors are ranked by, see pkg/metric" default:"cosine"`
+	Concurrency int    `long:"concurrency" description:"Number of words searched at the same time, 0 for the number of CPUs" default:"0"`
+	Chunk       int    `long:"chunk" description:"Number of words whose neighbors are written at once, progress is kept per chunk" default:"1024"`
+}
+
+// vocabulary holds all vectors of the source database in a single matrix
+type vocabulary struct {
+	words   []string
+	matrix  []float32
+	dims    int
+	skipped int
+}
+
+func (v *vocabulary) vector(i int) []float32 {
+	return v.matrix[i*v.dims : (i+1)*v.dims]
+}
+
+// load appends every record of the shard at path. Records of other
+// dimensions and with NaN or infinite values are skipped
+func (v *vocabulary) load(path string) error {
+	db, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		vector, err := pkg.DecodeVector(iter.Value())
+		if err == nil && v.dims == 0 {
+			v.dims = len(vector)
+		}
+		if err != nil || len(vector) != v.dims || v.dims == 0 || pkg.NonFinite(vector) > 0 {
+			v.skipped++
+			continue
+		}
+		v.words = append(v.words, string(iter.Key()))
+		v.matrix = append(v.matrix, vector...)
+	}
+	return iter.Error()
+}
+
+// prepare replaces all vectors with their prepared forms, e.g. unit vectors
+// for cosine, so every comparison only needs the distance
+func (v *vocabulary) prepare(m metric.Metric) {
+	for i := range v.words {
+		copy(v.vector(i), m.Prepare(v.vector(i)))
+	}
+}
+
+// neighbors returns the k words nearest to word i, nearest first, comparing
+// it with every other word
+func (v *vocabulary) neighbors(i, k int, m metric.Metric) []pkg.GraphNeighbor {
+	type candidate struct {
+		index    int
+		distance float32
+	}
+	// nearest is kept sorted, nearest first
+	nearest := make([]candidate, 0, k+1)
+	query := v.vector(i)
+	for j := range v.words {
+		if j == i {
+			continue
+		}
+		distance := m.Distance(query, v.vector(j))
+		if len(nearest) == k && distance >= nearest[k-1].distance {
+			continue
+		}
+		at := sort.Search(len(nearest), func(n int) bool { return nearest[n].distance > distance })
+		nearest = append(nearest, candidate{})
+		copy(nearest[at+1:], nearest[at:])
+		nearest[at] = candidate{index: j, distance: distance}
+		if len(nearest) > k {
+			nearest = nearest[:k]
+		}
+	}
+
+	neighbors := make([]pkg.GraphNeighbor, len(nearest))
+	for n, c := range nearest {
+		neighbors[n] = pkg.GraphNeighbor{Word: v.words[c.index], Distance: c.distance}
+	}
+	return neighbors
+}
+
+// readMeta returns the description of the graph in db, nil if there is none
+func readMeta(db *leveldb.DB) (*pkg.GraphMeta, error) {
+	b, err := db.Get([]byte(pkg.GraphMetaKey), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta pkg.GraphMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("%s: %v", pkg.GraphMetaKey, err)
+	}
+	return &meta, nil
+}
+
+// sameMetric reports whether name, as stored in a graph, is m
+func sameMetric(name string, m metric.Metric) bool {
+	stored, err := metric.Get(name)
+	return err == nil && stored.Name() == m.Name()
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	if opts.K < 1 {
+		log.Fatal("-k must be positive")
+	}
+	if opts.Chunk < 1 {
+		log.Fatal("--chunk must be positive")
+	}
+	m, err := metric.Get(opts.Metric)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = runtime.NumCPU()
+	}
+
+	n, err := pkg.ReadShards(opts.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths := []string{opts.DB}
+	if n > 0 {
+		paths = nil
+		for i := 0; i < n; i++ {
+			paths = append(paths, pkg.ShardPath(opts.DB, i))
+		}
+	}
+	v := &vocabulary{}
+	for _, path := range paths {
+		if err := v.load(path); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+	if len(v.words) < 2 {
+		log.Fatal("the database needs at least two words")
+	}
+	v.prepare(m)
+	fmt.Printf("loaded %d words of %d dimensions, skipped %d records\n", len(v.words), v.dims, v.skipped)
+
+	out, err := leveldb.OpenFile(opts.Output, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+
+	// a graph of the same parameters is resumed where it stopped
+	meta, err := readMeta(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if meta == nil {
+		meta = &pkg.GraphMeta{K: opts.K, Metric: m.Name(), Words: len(v.words), Dims: v.dims, Created: time.Now().UTC()}
+	} else if meta.K != opts.K || !sameMetric(meta.Metric, m) || meta.Words != len(v.words) || meta.Dims != v.dims {
+		log.Fatalf("%s holds a graph of %d neighbors by %s of %d words of %d dimensions, remove it to start over", opts.Output, meta.K, meta.Metric, meta.Words, meta.Dims)
+	} else if meta.Done > 0 && meta.Done < meta.Words {
+		fmt.Printf("resuming after %d words\n", meta.Done)
+	}
+
+	start := time.Now()
+	resumed := meta.Done
+	results := make([][]pkg.GraphNeighbor, opts.Chunk)
+	for meta.Done < len(v.words) {
+		end := meta.Done + opts.Chunk
+		if end > len(v.words) {
+			end = len(v.words)
+		}
+
+		var wg sync.WaitGroup
+		work := make(chan int)
+		for w := 0; w < opts.Concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					results[i-meta.Done] = v.neighbors(i, opts.K, m)
+				}
+			}()
+		}
+		for i := meta.Done; i < end; i++ {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+
+		// the neighbors and the progress are written together, so an
+		// interrupted run resumes at the first chunk not written
+		batch := new(leveldb.Batch)
+		for i := meta.Done; i < end; i++ {
+			batch.Put([]byte(pkg.GraphNeighborsPrefix+v.words[i]), pkg.EncodeNeighbors(results[i-meta.Done]))
+		}
+		meta.Done = end
+		b, err := json.Marshal(meta)
+		if err != nil {
+			log.Fatal(err)
+		}
+		batch.Put([]byte(pkg.GraphMetaKey), b)
+		if err := out.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+			log.Fatal(err)
+		}
+
+		perWord := time.Since(start) / time.Duration(meta.Done-resumed)
+		remaining := time.Duration(len(v.words)-meta.Done) * perWord
+		fmt.Printf("searched %d of %d words, %s remaining\n", meta.Done, len(v.words), remaining.Round(time.Second))
+	}
+
+	fmt.Printf("wrote the %d nearest neighbors of %d words to %s\n", opts.K, len(v.words), opts.Output)
+}
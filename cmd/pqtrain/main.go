@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// options are the command line flags of pqtrain
+type options struct {
+	DB          string `short:"d" long:"db" description:"Directory of the LevelDB database, sharded or not" default:"./embeddings"`
+	Output      string `short:"o" long:"output" description:"The .npy file the codebook is written to" default:"./pq.npy"`
+	M           int    `short:"m" description:"Number of subspaces, the bytes of a code, must divide the dimensions" default:"30"`
+	Iterations  int    `long:"iterations" description:"Maximum number of k-means iterations per subspace" default:"25"`
+	Sample      int    `long:"sample" description:"Number of vectors the codebook is trained on, 0 for all" default:"100000"`
+	Seed        int64  `long:"seed" description:"Seed of the sample and the initial centroids" default:"1"`
+	Concurrency int    `long:"concurrency" description:"Number of subspaces trained at the same time, 0 for the number of CPUs" default:"0"`
+}
+
+// vocabulary holds all vectors of the source database in a single matrix
+type vocabulary struct {
+	matrix  []float32
+	dims    int
+	words   int
+	skipped int
+}
+
+func (v *vocabulary) vector(i int) []float32 {
+	return v.matrix[i*v.dims : (i+1)*v.dims]
+}
+
+// load appends every record of the shard at path. Records of other
+// dimensions and with NaN or infinite values are skipped
+func (v *vocabulary) load(path string) error {
+	db, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		vector, err := pkg.DecodeVector(iter.Value())
+		if err == nil && v.dims == 0 {
+			v.dims = len(vector)
+		}
+		if err != nil || len(vector) != v.dims || v.dims == 0 || pkg.NonFinite(vector) > 0 {
+			v.skipped++
+			continue
+		}
+		v.matrix = append(v.matrix, vector...)
+		v.words++
+	}
+	return iter.Error()
+}
+
+// sample returns the vectors of n random words, all words if n is 0 or not
+// smaller than the vocabulary
+func (v *vocabulary) sample(n int, rng *rand.Rand) [][]float32 {
+	order := rng.Perm(v.words)
+	if n > 0 && n < len(order) {
+		order = order[:n]
+	}
+	vectors := make([][]float32, len(order))
+	for i, word := range order {
+		vectors[i] = v.vector(word)
+	}
+	return vectors
+}
+
+// kmeans returns PQCentroids centroids of the points, all of size values,
+// initialized by k-means++ and refined by Lloyd iterations until no point
+// changes its cluster
+func kmeans(points [][]float32, size, iterations int, rng *rand.Rand) []float32 {
+	k := pkg.PQCentroids
+	centroids := make([]float32, 0, k*size)
+	centroid := func(c int) []float32 { return centroids[c*size : (c+1)*size] }
+
+	// k-means++: every centroid is a point picked with a probability
+	// proportional to its squared distance from the nearest centroid so far
+	nearest := make([]float32, len(points))
+	centroids = append(centroids, points[rng.Intn(len(points))]...)
+	for i, p := range points {
+		nearest[i] = vecmath.SquaredDistance(p, centroid(0))
+	}
+	for c := 1; c < k; c++ {
+		var total float64
+		for _, d := range nearest {
+			total += float64(d)
+		}
+		pick := 0
+		if total > 0 {
+			target := rng.Float64() * total
+			for pick = 0; pick < len(points)-1; pick++ {
+				target -= float64(nearest[pick])
+				if target < 0 {
+					break
+				}
+			}
+		}
+		centroids = append(centroids, points[pick]...)
+		for i, p := range points {
+			if d := vecmath.SquaredDistance(p, centroid(c)); d < nearest[i] {
+				nearest[i] = d
+			}
+		}
+	}
+
+	assignment := make([]int, len(points))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+	sums := make([]float64, k*size)
+	counts := make([]int, k)
+	for iteration := 0; iteration < iterations; iteration++ {
+		changed := 0
+		for i, p := range points {
+			best, bestDistance := 0, float32(0)
+			for c := 0; c < k; c++ {
+				if d := vecmath.SquaredDistance(p, centroid(c)); c == 0 || d < bestDistance {
+					best, bestDistance = c, d
+				}
+			}
+			if assignment[i] != best {
+				assignment[i] = best
+				changed++
+			}
+			nearest[i] = bestDistance
+		}
+		if changed == 0 {
+			break
+		}
+
+		for i := range sums {
+			sums[i] = 0
+		}
+		for c := range counts {
+			counts[c] = 0
+		}
+		for i, p := range points {
+			c := assignment[i]
+			counts[c]++
+			for j, value := range p {
+				sums[c*size+j] += float64(value)
+			}
+		}
+		for c := 0; c < k; c++ {
+			if counts[c] == 0 {
+				// an empty cluster takes over the point quantized worst
+				worst := 0
+				for i, d := range nearest {
+					if d > nearest[worst] {
+						worst = i
+					}
+				}
+				copy(centroid(c), points[worst])
+				nearest[worst] = 0
+				continue
+			}
+			for j := range centroid(c) {
+				centroid(c)[j] = float32(sums[c*size+j] / float64(counts[c]))
+			}
+		}
+	}
+	return centroids
+}
+
+func main() {
+	var opts options
+	if _, err := flags.Parse(&opts); err != nil {
+		os.Exit(1)
+	}
+	if opts.M < 1 {
+		log.Fatal("-m must be positive")
+	}
+	if opts.Iterations < 1 {
+		log.Fatal("--iterations must be positive")
+	}
+	if opts.Sample < 0 {
+		log.Fatal("--sample must not be negative")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = runtime.NumCPU()
+	}
+
+	n, err := pkg.ReadShards(opts.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths := []string{opts.DB}
+	if n > 0 {
+		paths = nil
+		for i := 0; i < n; i++ {
+			paths = append(paths, pkg.ShardPath(opts.DB, i))
+		}
+	}
+	v := &vocabulary{}
+	for _, path := range paths {
+		if err := v.load(path); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+	}
+	if v.words < pkg.PQCentroids {
+		log.Fatalf("the database needs at least %d words", pkg.PQCentroids)
+	}
+	if v.dims%opts.M != 0 {
+		log.Fatalf("-m must divide the %d dimensions", v.dims)
+	}
+	fmt.Printf("loaded %d words of %d dimensions, skipped %d records\n", v.words, v.dims, v.skipped)
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	vectors := v.sample(opts.Sample, rng)
+	if len(vectors) < pkg.PQCentroids {
+		log.Fatalf("--sample must be at least %d", pkg.PQCentroids)
+	}
+	size := v.dims / opts.M
+	// every subspace gets a seed of its own, so the codebook doesn't depend
+	// on the order the subspaces are trained in
+	seeds := make([]int64, opts.M)
+	for i := range seeds {
+		seeds[i] = rng.Int63()
+	}
+
+	start := time.Now()
+	centroids := make([]float32, pkg.PQCentroids*v.dims)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		done int
+	)
+	work := make(chan int)
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sub := range work {
+				points := make([][]float32, len(vectors))
+				for i, vector := range vectors {
+					points[i] = vector[sub*size : (sub+1)*size]
+				}
+				trained := kmeans(points, size, opts.Iterations, rand.New(rand.NewSource(seeds[sub])))
+				copy(centroids[sub*pkg.PQCentroids*size:], trained)
+
+				mu.Lock()
+				done++
+				fmt.Printf("trained %d of %d subspaces in %s\n", done, opts.M, time.Since(start).Round(time.Second))
+				mu.Unlock()
+			}
+		}()
+	}
+	for sub := 0; sub < opts.M; sub++ {
+		work <- sub
+	}
+	close(work)
+	wg.Wait()
+
+	codebook, err := pkg.NewPQCodebook(opts.M, v.dims, centroids)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the share of the energy of the sample lost by quantizing it
+	var lost, energy float64
+	for _, vector := range vectors {
+		codes, err := codebook.Encode(vector)
+		if err != nil {
+			log.Fatal(err)
+		}
+		decoded, err := codebook.Decode(codes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lost += float64(vecmath.SquaredDistance(vector, decoded))
+		energy += float64(vecmath.Dot(vector, vector))
+	}
+	if err := os.WriteFile(opts.Output, codebook.Npy(), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote a codebook of %d subspaces to %s, codes of %d bytes lose %.1f%% of the squared norm of the sample\n", opts.M, opts.Output, opts.M, 100*lost/energy)
+}
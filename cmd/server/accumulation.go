@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// accumulations of the weighted sum of a centroid. float32 loses precision
+// once thousands of vectors are summed, the others keep the error of long
+// documents at the level of a single rounding
+const (
+	// accumulateFloat32 sums in float32, the fastest and the default
+	accumulateFloat32 = "float32"
+	// accumulateFloat64 sums in float64 and rounds the mean to float32
+	accumulateFloat64 = "float64"
+	// accumulateKahan sums in float32 with Kahan's compensated summation
+	accumulateKahan = "kahan"
+	// accumulateFixed sums in fixed point, see weightedMeanFixed
+	accumulateFixed = "fixed"
+)
+
+const (
+	// fixedValueBits are the fractional bits of the values summed in fixed
+	// point, a resolution of about 1e-6
+	fixedValueBits = 20
+	// fixedWeightBits are the fractional bits of the weights
+	fixedWeightBits = 16
+)
+
+// normalizeAccumulation maps the default to the empty string, so vectors
+// computed before the option existed keep their manifests
+func normalizeAccumulation(accumulation string) string {
+	if accumulation == accumulateFloat32 {
+		return ""
+	}
+	return accumulation
+}
+
+func validAccumulation(accumulation string) error {
+	switch accumulation {
+	case "", accumulateFloat32, accumulateFloat64, accumulateKahan, accumulateFixed:
+		return nil
+	default:
+		return fmt.Errorf("accumulation must be one of %q, %q, %q or %q", accumulateFloat32, accumulateFloat64, accumulateKahan, accumulateFixed)
+	}
+}
+
+// weightedMeanFloat32 returns the weighted mean of vectors of the same
+// dimensions summed in float32
+func weightedMeanFloat32(vectors []pkg.Vector, weights []float32) []float32 {
+	mean := make([]float32, vectors[0].Len())
+	var weightSum float32
+	for i, v := range vectors {
+		weightSum += weights[i]
+		for j, value := range v.ToArray() {
+			mean[j] += value * weights[i]
+		}
+	}
+	for j := range mean {
+		mean[j] /= weightSum
+	}
+	return mean
+}
+
+func weightedMeanFloat64(vectors []pkg.Vector, weights []float32) []float32 {
+	sum := make([]float64, vectors[0].Len())
+	var weightSum float64
+	for i, v := range vectors {
+		weight := float64(weights[i])
+		weightSum += weight
+		for j, value := range v.ToArray() {
+			sum[j] += float64(value) * weight
+		}
+	}
+	mean := make([]float32, len(sum))
+	for j := range sum {
+		mean[j] = float32(sum[j] / weightSum)
+	}
+	return mean
+}
+
+// weightedMeanKahan carries the rounding error of every addition over to
+// the next one. The explicit conversions keep the compiler from fusing the
+// operations, which would break the compensation
+func weightedMeanKahan(vectors []pkg.Vector, weights []float32) []float32 {
+	sum := make([]float32, vectors[0].Len())
+	compensation := make([]float32, len(sum))
+	var weightSum, weightCompensation float32
+	add := func(sum, compensation *float32, value float32) {
+		y := float32(value - *compensation)
+		t := float32(*sum + y)
+		*compensation = float32(float32(t-*sum) - y)
+		*sum = t
+	}
+	for i, v := range vectors {
+		add(&weightSum, &weightCompensation, weights[i])
+		for j, value := range v.ToArray() {
+			add(&sum[j], &compensation[j], float32(value*weights[i]))
+		}
+	}
+	for j := range sum {
+		sum[j] /= weightSum
+	}
+	return sum
+}
+
+// int128 is a signed 128 bit accumulator in two's complement, so the sums of
+// long documents can't overflow
+type int128 struct {
+	hi, lo uint64
+}
+
+func (a *int128) add(x int64) {
+	var carry uint64
+	a.lo, carry = bits.Add64(a.lo, uint64(x), 0)
+	// x>>63 sign extends x into the high word
+	a.hi += uint64(x>>63) + carry
+}
+
+func (a int128) float64() float64 {
+	hi, lo := a.hi, a.lo
+	negative := int64(hi) < 0
+	if negative {
+		var borrow uint64
+		lo, borrow = bits.Sub64(0, lo, 0)
+		hi, _ = bits.Sub64(0, hi, borrow)
+	}
+	// the explicit conversion keeps the compiler from fusing the operations
+	f := float64(float64(hi)*0x1p64) + float64(lo)
+	if negative {
+		return -f
+	}
+	return f
+}
+
+// weightedMeanFixed rounds the values and weights to fixed point and sums
+// their products in integers. Integer sums don't depend on the order of the
+// additions or on the floating point unit, so equal inputs give
+// bit-identical means on every platform. The only floating point operations
+// left are the conversions and a single correctly rounded division
+func weightedMeanFixed(vectors []pkg.Vector, weights []float32) []float32 {
+	sum := make([]int128, vectors[0].Len())
+	var weightSum int128
+	for i, v := range vectors {
+		weight := int64(math.Round(math.Ldexp(float64(weights[i]), fixedWeightBits)))
+		weightSum.add(weight)
+		for j, value := range v.ToArray() {
+			sum[j].add(int64(math.Round(math.Ldexp(float64(value), fixedValueBits))) * weight)
+		}
+	}
+	if weightSum == (int128{}) {
+		// all weights rounded to 0, they are too small to tell apart
+		ones := make([]float32, len(weights))
+		for i := range ones {
+			ones[i] = 1
+		}
+		return weightedMeanFixed(vectors, ones)
+	}
+	scale := math.Ldexp(weightSum.float64(), fixedValueBits)
+	mean := make([]float32, len(sum))
+	for j := range sum {
+		mean[j] = float32(sum[j].float64() / scale)
+	}
+	return mean
+}
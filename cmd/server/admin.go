@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// scopes of /admin/cache/flush
+const (
+	flushWords   = "words"
+	flushResults = "results"
+	flushAll     = "all"
+)
+
+// dbStatsHandler returns the LevelDB internals of every shard
+func (vtcrzr *Vectorizer) dbStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := vtcrzr.db().store.stats()
+	if err != nil {
+		http.Error(w, "Failed to read stats "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// cacheFlushHandler empties the word cache, the result cache or both, of
+// all models or of the model of the query, e.g. after its vocabulary was
+// patched
+func (vtcrzr *Vectorizer) cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = flushAll
+	}
+	if scope != flushWords && scope != flushResults && scope != flushAll {
+		http.Error(w, "'scope' must be one of \""+flushWords+"\", \""+flushResults+"\" or \""+flushAll+"\"", http.StatusBadRequest)
+		return
+	}
+	var hash string
+	if model := r.URL.Query().Get("model"); model != "" {
+		var ok bool
+		if hash, ok = vtcrzr.tokens.modelHash(model); !ok {
+			http.Error(w, "No model "+model+" was served", http.StatusNotFound)
+			return
+		}
+	}
+
+	flushed := map[string]int{}
+	if scope != flushResults {
+		flushed[flushWords] = vtcrzr.tokens.flush(hash)
+	}
+	if scope != flushWords && vtcrzr.results != nil {
+		n, err := vtcrzr.results.flush(hash)
+		if err != nil {
+			http.Error(w, "Failed to flush results "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		flushed[flushResults] = n
+	}
+
+	response, err := json.Marshal(flushed)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
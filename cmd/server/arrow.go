@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// The results of bulk jobs can be written as an Arrow IPC stream with the
+// columns id (utf8), vector (fixed_size_list<float32>) and error (utf8). The
+// flatbuffers metadata is built by hand, it is small enough not to need the
+// Arrow libraries.
+
+// flatbuffer values, written front to back so every offset points forward
+type fbValue interface {
+	write(b *fbBuilder) int
+}
+
+// fbField is a table field, either a little endian scalar or a reference
+type fbField struct {
+	scalar []byte
+	ref    fbValue
+}
+
+type fbTable []fbField
+
+type fbString string
+
+// fbVector is a vector of references
+type fbVector []fbValue
+
+// fbStructs is a vector of structs with 8 byte alignment
+type fbStructs struct {
+	data  []byte
+	count int
+}
+
+type fbBuilder struct {
+	buf []byte
+}
+
+func (b *fbBuilder) align(n int) {
+	for len(b.buf)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// patch points the offset at pos to target
+func (b *fbBuilder) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+func (t fbTable) write(b *fbBuilder) int {
+	// lay out the fields after the vtable offset, aligned to their size
+	offsets := make([]int, len(t))
+	size := 4
+	for i, field := range t {
+		n := len(field.scalar)
+		if field.ref != nil {
+			n = 4
+		}
+		if n == 0 {
+			continue
+		}
+		for size%n != 0 {
+			size++
+		}
+		offsets[i] = size
+		size += n
+	}
+
+	b.align(2)
+	vtable := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*len(t)))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(size))
+	for _, offset := range offsets {
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(offset))
+	}
+
+	b.align(8)
+	table := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[table:], uint32(table-vtable))
+	for i, field := range t {
+		copy(b.buf[table+offsets[i]:], field.scalar)
+	}
+	for i, field := range t {
+		if field.ref != nil {
+			b.patch(table+offsets[i], field.ref.write(b))
+		}
+	}
+	return table
+}
+
+func (s fbString) write(b *fbBuilder) int {
+	b.align(4)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(s)))
+	b.buf = append(append(b.buf, s...), 0)
+	return pos
+}
+
+func (v fbVector) write(b *fbBuilder) int {
+	b.align(4)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+	b.buf = append(b.buf, make([]byte, 4*len(v))...)
+	for i, value := range v {
+		b.patch(pos+4+4*i, value.write(b))
+	}
+	return pos
+}
+
+func (v fbStructs) write(b *fbBuilder) int {
+	for len(b.buf)%8 != 4 {
+		b.buf = append(b.buf, 0)
+	}
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v.count))
+	b.buf = append(b.buf, v.data...)
+	return pos
+}
+
+// finishFlatbuffer returns the buffer with root as its root table
+func finishFlatbuffer(root fbValue) []byte {
+	b := &fbBuilder{buf: make([]byte, 8)}
+	b.patch(0, root.write(b))
+	return b.buf
+}
+
+func fbInt16(v int16) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint16(nil, uint16(v))}
+}
+
+func fbInt32(v int32) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint32(nil, uint32(v))}
+}
+
+func fbInt64(v int64) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint64(nil, uint64(v))}
+}
+
+func fbUint8(v uint8) fbField {
+	return fbField{scalar: []byte{v}}
+}
+
+func fbBool(v bool) fbField {
+	if v {
+		return fbUint8(1)
+	}
+	return fbUint8(0)
+}
+
+// Arrow metadata, see format/Schema.fbs and format/Message.fbs of Arrow
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+	arrowTypeFixedSizeList = 16
+
+	arrowPrecisionSingle = 1
+)
+
+// arrowField describes a column: name, nullable, type, children
+func arrowField(name string, nullable bool, typeID uint8, typ fbTable, children ...fbValue) fbTable {
+	return fbTable{
+		{ref: fbString(name)},
+		fbBool(nullable),
+		fbUint8(typeID),
+		{ref: typ},
+		{},
+		{ref: fbVector(children)},
+	}
+}
+
+// arrowMessage is the table of an Arrow IPC message
+func arrowMessage(headerType uint8, header fbTable, bodyLength int64) fbTable {
+	return fbTable{
+		fbInt16(arrowMetadataV5),
+		fbUint8(headerType),
+		{ref: header},
+		fbInt64(bodyLength),
+	}
+}
+
+// arrowWriter buffers job results and writes them as record batches
+type arrowWriter struct {
+	w       io.Writer
+	dims    int
+	ids     []string
+	vectors [][]float32
+	errors  []string
+}
+
+func newArrowWriter(w io.Writer, dims int) *arrowWriter {
+	return &arrowWriter{w: w, dims: dims}
+}
+
+// writeSchema starts the stream
+func (a *arrowWriter) writeSchema() error {
+	vector := arrowField("vector", true, arrowTypeFixedSizeList, fbTable{fbInt32(int32(a.dims))},
+		arrowField("item", true, arrowTypeFloatingPoint, fbTable{fbInt16(arrowPrecisionSingle)}))
+	schema := fbTable{
+		fbInt16(0), // little endian
+		{ref: fbVector{
+			arrowField("id", false, arrowTypeUtf8, fbTable{}),
+			vector,
+			arrowField("error", true, arrowTypeUtf8, fbTable{}),
+		}},
+	}
+	return a.writeMessage(arrowMessage(arrowHeaderSchema, schema, 0), nil)
+}
+
+// add buffers a row, vector is nil for rows that failed
+func (a *arrowWriter) add(id string, vector []float32, errMsg string) {
+	a.ids = append(a.ids, id)
+	a.vectors = append(a.vectors, vector)
+	a.errors = append(a.errors, errMsg)
+}
+
+// flush writes the buffered rows as a record batch
+func (a *arrowWriter) flush() error {
+	n := len(a.ids)
+	if n == 0 {
+		return nil
+	}
+
+	var body []byte
+	var buffers []byte
+	addBuffer := func(data []byte) {
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(data)))
+		body = append(body, data...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+	var nodes []byte
+	addNode := func(length, nulls int) {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(length))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(nulls))
+	}
+
+	// id
+	addNode(n, 0)
+	addBuffer(nil)
+	addStrings(a.ids, addBuffer)
+
+	// vector and its items, rows without vector are null but keep their slots
+	validity := make([]byte, (n+7)/8)
+	values := make([]byte, 0, 4*n*a.dims)
+	nulls := 0
+	for i, vector := range a.vectors {
+		if vector == nil {
+			nulls++
+			values = append(values, make([]byte, 4*a.dims)...)
+			continue
+		}
+		validity[i/8] |= 1 << (i % 8)
+		values = pkg.AppendFloat32s(values, vector)
+	}
+	addNode(n, nulls)
+	addBuffer(validity)
+	addNode(n*a.dims, 0)
+	addBuffer(nil)
+	addBuffer(values)
+
+	// error
+	validity = make([]byte, (n+7)/8)
+	nulls = 0
+	for i, errMsg := range a.errors {
+		if errMsg == "" {
+			nulls++
+			continue
+		}
+		validity[i/8] |= 1 << (i % 8)
+	}
+	addNode(n, nulls)
+	addBuffer(validity)
+	addStrings(a.errors, addBuffer)
+
+	batch := fbTable{
+		fbInt64(int64(n)),
+		{ref: fbStructs{data: nodes, count: len(nodes) / 16}},
+		{ref: fbStructs{data: buffers, count: len(buffers) / 16}},
+	}
+	a.ids, a.vectors, a.errors = a.ids[:0], a.vectors[:0], a.errors[:0]
+	return a.writeMessage(arrowMessage(arrowHeaderRecordBatch, batch, int64(len(body))), body)
+}
+
+// addStrings adds the offsets and data buffers of a utf8 column
+func addStrings(values []string, addBuffer func([]byte)) {
+	offsets := make([]byte, 0, 4*(len(values)+1))
+	var data []byte
+	offsets = binary.LittleEndian.AppendUint32(offsets, 0)
+	for _, value := range values {
+		data = append(data, value...)
+		offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+	}
+	addBuffer(offsets)
+	addBuffer(data)
+}
+
+// close writes the remaining rows and ends the stream
+func (a *arrowWriter) close() error {
+	if err := a.flush(); err != nil {
+		return err
+	}
+	_, err := a.w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	return err
+}
+
+// writeMessage writes an encapsulated message, the metadata is padded so the
+// body starts 8 byte aligned
+func (a *arrowWriter) writeMessage(message fbTable, body []byte) error {
+	metadata := finishFlatbuffer(message)
+	for len(metadata)%8 != 0 {
+		metadata = append(metadata, 0)
+	}
+	prefix := []byte{0xff, 0xff, 0xff, 0xff}
+	prefix = binary.LittleEndian.AppendUint32(prefix, uint32(len(metadata)))
+	for _, b := range [][]byte{prefix, metadata, body} {
+		if _, err := a.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+)
+
+// genderPairs are the seed pairs of the gender direction of Bolukbasi et
+// al., the female word first
+var genderPairs = [][2]string{
+	{"she", "he"}, {"her", "his"}, {"woman", "man"}, {"Mary", "John"}, {"herself", "himself"},
+	{"daughter", "son"}, {"mother", "father"}, {"gal", "guy"}, {"girl", "boy"}, {"female", "male"},
+}
+
+// biasAxis is the bias direction the debias option removes from vectors
+// and /bias measures them along, defined by seed pairs like the importer's
+// --debias
+type biasAxis struct {
+	pairs [][2]string
+	// hash identifies the pairs in manifests
+	hash string
+}
+
+func biasAxisFromEnv() (*biasAxis, error) {
+	var path string
+	if err := envString("VECTORIZER_BIAS_PAIRS", &path); err != nil {
+		return nil, err
+	}
+	a := &biasAxis{pairs: genderPairs}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("bias pairs: %v", err)
+		}
+		a.pairs, err = pkg.ReadBiasPairs(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bias pairs: %s: %v", path, err)
+		}
+	}
+	h := sha256.New()
+	for _, pair := range a.pairs {
+		fmt.Fprintf(h, "%s %s\n", pair[0], pair[1])
+	}
+	a.hash = hex.EncodeToString(h.Sum(nil))
+	return a, nil
+}
+
+// direction returns the unit bias direction in the space opts vectorize
+// in, fitted to the vectors of the seed pairs. Pairs with a word without a
+// vector are left out. The direction of a database debiased by the
+// importer along the same pairs is the one it was debiased along
+func (a *biasAxis) direction(vtcrzr *Vectorizer, opts vectorizeOptions) ([]float32, error) {
+	// the seeds are single words, none of them is filtered out, and they
+	// are not counted to the tenant
+	seedOpts := opts
+	seedOpts.NGrams = 1
+	seedOpts.Entities = false
+	seedOpts.MinCoverage = 0
+	seedOpts.SkipStopwords = false
+	seedOpts.MinTokenLength = 0
+	seedOpts.MaxTokenLength = 0
+	seedOpts.IncludeTokens = nil
+	seedOpts.ExcludeTokens = nil
+	seedOpts.SynthesizeOOV = false
+	seedOpts.Disambiguation = 0
+	seedOpts.Debias = false
+	seedOpts.tenant = nil
+
+	var pairs [][2][]float32
+	for _, pair := range a.pairs {
+		var vectors [2][]float32
+		for i, word := range pair {
+			vectorized, err := vtcrzr.vectorize([]string{word}, seedOpts)
+			var noVectorsErr *noVectorsError
+			if errors.As(err, &noVectorsErr) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			vectors[i] = vectorized.vector.ToArray()
+		}
+		if vectors[0] != nil && vectors[1] != nil {
+			pairs = append(pairs, vectors)
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no seed pair of the bias direction has vectors")
+	}
+	return pkg.BiasDirection(pairs)
+}
+
+// debias removes the bias direction from a vector vectorized with opts
+func (vtcrzr *Vectorizer) debias(vectorized *vectorization, opts vectorizeOptions) (*vectorization, error) {
+	direction, err := vtcrzr.bias.direction(vtcrzr, opts)
+	if err != nil {
+		return nil, err
+	}
+	vector := pkg.NewVector(pkg.Neutralize(vectorized.vector.ToArray(), direction))
+	debiased := *vectorized
+	debiased.vector = &vector
+	return &debiased, nil
+}
+
+// finish maps a vector pooled in the space of the model of opts to the
+// space returned: it is projected and, if opts asks, debiased
+func (vtcrzr *Vectorizer) finish(vectorized *vectorization, opts vectorizeOptions) (*vectorization, error) {
+	vectorized, err := vtcrzr.project(vectorized, opts)
+	if err != nil || !opts.Debias {
+		return vectorized, err
+	}
+	return vtcrzr.debias(vectorized, opts)
+}
+
+// biasResponse is the body returned by the bias endpoint
+type biasResponse struct {
+	// Projection is the component of the vector along the unit bias
+	// direction, positive towards the first words of the seed pairs
+	Projection float64 `json:"projection"`
+	// Cosine is the cosine similarity of the vector and the direction
+	Cosine   float64 `json:"cosine"`
+	Quality  quality `json:"quality"`
+	Degraded bool    `json:"degraded,omitempty"`
+}
+
+// biasHandler measures the projection of a text onto the bias direction
+func (vtcrzr *Vectorizer) biasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody vectorizeRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := requestBody.checkInput(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	vectorized, err := vtcrzr.vectorizeBody(&requestBody, opts)
+	if err != nil {
+		vectorizeError(w, err)
+		return
+	}
+	direction, err := vtcrzr.bias.direction(vtcrzr, opts)
+	if err != nil {
+		http.Error(w, "Failed to fit the bias direction "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// measured on the full vector, dims only truncates returned vectors
+	vector := vectorized.vector.ToArray()
+	responseBody := biasResponse{
+		Projection: float64(vecmath.Dot(vector, direction)),
+		Quality:    vectorized.quality,
+		Degraded:   degraded,
+	}
+	if norm := math.Sqrt(float64(vecmath.Dot(vector, vector))); norm > 0 {
+		responseBody.Cosine = responseBody.Projection / norm
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
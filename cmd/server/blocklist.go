@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// builtinProfanity is the list of VECTORIZER_BLOCKLIST_PROFANITY, one word
+// per line
+//
+//go:embed profanity.txt
+var builtinProfanity string
+
+// wordBlocklist holds words never returned by /neighbors and /expand, the
+// 840B vocabulary has plenty of words products shouldn't surface. A nil
+// blocklist blocks nothing
+type wordBlocklist struct {
+	// words holds the lowercase forms without diacritics
+	words    map[string]bool
+	filtered atomic.Uint64
+}
+
+// blocklistFromEnv reads the words of VECTORIZER_BLOCKLIST and, with
+// VECTORIZER_BLOCKLIST_PROFANITY, the built-in profanity list. It returns
+// nil if neither is set
+func blocklistFromEnv() (*wordBlocklist, error) {
+	var path string
+	var profanity bool
+	for _, err := range []error{
+		envString("VECTORIZER_BLOCKLIST", &path),
+		envBool("VECTORIZER_BLOCKLIST_PROFANITY", &profanity),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if path == "" && !profanity {
+		return nil, nil
+	}
+
+	b := &wordBlocklist{words: map[string]bool{}}
+	if profanity {
+		if err := b.read(strings.NewReader(builtinProfanity)); err != nil {
+			return nil, err
+		}
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist: %v", err)
+		}
+		err = b.read(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("blocklist %s: %v", path, err)
+		}
+	}
+	return b, nil
+}
+
+// read adds the words of r, one per line. Lines starting with # are
+// comments
+func (b *wordBlocklist) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		b.words[blocklistForm(word)] = true
+	}
+	return scanner.Err()
+}
+
+// blocklistForm is the form words are compared in, so "Shit" and "shït"
+// match "shit"
+func blocklistForm(word string) string {
+	return pkg.FoldDiacritics(strings.ToLower(word))
+}
+
+// blocked reports whether word or one of the parts of a compound, like
+// "bull-shit" or "shit_storm", is on the list
+func (b *wordBlocklist) blocked(word string) bool {
+	if b == nil {
+		return false
+	}
+	form := blocklistForm(word)
+	if b.words[form] {
+		return true
+	}
+	for _, part := range strings.FieldsFunc(form, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }) {
+		if b.words[part] {
+			return true
+		}
+	}
+	return false
+}
+
+// filterNeighbors returns the neighbors that aren't blocked
+func (b *wordBlocklist) filterNeighbors(neighbors []pkg.GraphNeighbor) []pkg.GraphNeighbor {
+	if b == nil {
+		return neighbors
+	}
+	kept := neighbors[:0:0]
+	for _, n := range neighbors {
+		if b.blocked(n.Word) {
+			b.filtered.Add(1)
+			continue
+		}
+		kept = append(kept, n)
+	}
+	return kept
+}
+
+func (b *wordBlocklist) writeMetrics(m *metricsWriter) {
+	if b == nil {
+		return
+	}
+	m.counter("vectorizer_blocklist_filtered_total", "Number of blocked words left out of the candidates of /neighbors and /expand", float64(b.filtered.Load()))
+}
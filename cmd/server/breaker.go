@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errReadFailed wraps errors of LevelDB reads other than missing keys
+	errReadFailed = errors.New("database read failed")
+	// errCircuitOpen is returned without reading while the breaker is open
+	errCircuitOpen = fmt.Errorf("%w: circuit breaker is open, reopening the database", errReadFailed)
+)
+
+// breaker stops reading a database that keeps failing, e.g. on a disk error
+// or a corrupted block, so requests fail fast instead of piling up on it.
+// Once open it stays open until the database is reopened successfully
+type breaker struct {
+	// threshold is the number of consecutive failed reads opening the breaker
+	threshold int64
+	// retryInterval is the time between attempts to reopen the database
+	retryInterval time.Duration
+
+	failures   atomic.Int64
+	open       atomic.Bool
+	readErrors atomic.Uint64
+	trips      atomic.Uint64
+	reopens    atomic.Uint64
+	// tripped wakes the recovery when the breaker opens
+	tripped chan struct{}
+
+	mu sync.Mutex
+	// lastErr is the read error that opened the breaker
+	lastErr  error
+	openedAt time.Time
+}
+
+func breakerFromEnv() (*breaker, error) {
+	threshold := 5
+	b := &breaker{retryInterval: 10 * time.Second, tripped: make(chan struct{}, 1)}
+	for _, err := range []error{
+		envInt("VECTORIZER_BREAKER_THRESHOLD", &threshold),
+		envDuration("VECTORIZER_BREAKER_RETRY_INTERVAL", &b.retryInterval),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if threshold < 1 || b.retryInterval <= 0 {
+		return nil, fmt.Errorf("invalid circuit breaker threshold %d or retry interval %s", threshold, b.retryInterval)
+	}
+	b.threshold = int64(threshold)
+	return b, nil
+}
+
+// allow returns errCircuitOpen while the breaker is open. A nil breaker
+// always allows reads
+func (b *breaker) allow() error {
+	if b != nil && b.open.Load() {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// record counts the outcome of a read, err is nil for reads that succeeded
+// or found no key
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+	if err == nil {
+		b.failures.Store(0)
+		return
+	}
+	b.readErrors.Add(1)
+	if b.failures.Add(1) < b.threshold || b.open.Swap(true) {
+		return
+	}
+
+	b.mu.Lock()
+	b.lastErr, b.openedAt = err, time.Now()
+	b.mu.Unlock()
+	b.trips.Add(1)
+	log.Printf("circuit breaker opened after %d failed reads: %v", b.threshold, err)
+	select {
+	case b.tripped <- struct{}{}:
+	default:
+	}
+}
+
+// close lets reads through again after the database was reopened
+func (b *breaker) close() {
+	b.failures.Store(0)
+	b.reopens.Add(1)
+	b.open.Store(false)
+	log.Printf("circuit breaker closed")
+}
+
+// recoverDB reopens the served database whenever the breaker opens, retrying
+// until it succeeds. The reopened database replaces the failing one like an
+// activated version
+func (vtcrzr *Vectorizer) recoverDB(config dbConfig) {
+	b := config.breaker
+	for range b.tripped {
+		for {
+			time.Sleep(b.retryInterval)
+			if err := vtcrzr.reopen(config); err != nil {
+				log.Printf("failed to reopen the database: %v", err)
+				continue
+			}
+			b.close()
+			break
+		}
+	}
+}
+
+// reopen opens the served database again and swaps it in
+func (vtcrzr *Vectorizer) reopen(config dbConfig) error {
+	if vtcrzr.models != nil {
+		vtcrzr.models.mu.Lock()
+		defer vtcrzr.models.mu.Unlock()
+	}
+	old := vtcrzr.db()
+	db, err := openServedDB(old.path, old.version, config)
+	if err != nil {
+		return err
+	}
+	if err := db.store.probe(); err != nil {
+		db.store.Close()
+		return err
+	}
+	vtcrzr.activate(db, nil)
+	return nil
+}
+
+// breakerState is the body returned by the readiness endpoint
+type breakerState struct {
+	Ready bool `json:"ready"`
+	// Error is the read error that opened the breaker
+	Error    string     `json:"error,omitempty"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// readyHandler reports whether the database can be read. Load balancers
+// take the server out of rotation on 503 while the breaker is open
+func (vtcrzr *Vectorizer) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b := vtcrzr.breaker
+	state := breakerState{Ready: b.allow() == nil}
+	b.mu.Lock()
+	// the error is set right after the breaker opens
+	if !state.Ready && b.lastErr != nil {
+		state.Error = b.lastErr.Error()
+		openedAt := b.openedAt.UTC()
+		state.OpenedAt = &openedAt
+	}
+	b.mu.Unlock()
+	response, err := json.Marshal(state)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !state.Ready {
+		w.Header().Set("Retry-After", strconv.Itoa(int(b.retryInterval.Seconds()+0.5)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(response)
+}
+
+// probe reads the first key of every shard, bypassing the breaker that is
+// still open while the store is reopened
+func (s *store) probe() error {
+	for _, db := range s.shards {
+		iter := db.NewIterator(nil, nil)
+		iter.First()
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *breaker) writeMetrics(m *metricsWriter) {
+	var open float64
+	if b.open.Load() {
+		open = 1
+	}
+	m.gauge("vectorizer_breaker_open", "Whether the circuit breaker stopped reading the database", open)
+	m.counter("vectorizer_breaker_trips_total", "Number of times the circuit breaker opened", float64(b.trips.Load()))
+	m.counter("vectorizer_breaker_reopens_total", "Number of times the database was reopened after the breaker opened", float64(b.reopens.Load()))
+	m.counter("vectorizer_store_read_errors_total", "Number of reads of the vocabulary that failed", float64(b.readErrors.Load()))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// cacheSnapshotMagic starts a snapshot of the vector cache
+const cacheSnapshotMagic = "GLOVECACHE2\n"
+
+// normalizations of words looked up, part of the cache keys so vectors
+// looked up differently don't mix
+const (
+	// normCaseFallback looks up the word as it is, then lowercased
+	normCaseFallback = "case_fallback"
+)
+
+// cacheKey is the key of word looked up with normalization in a vectorCache
+func cacheKey(normalization, word string) string {
+	return normalization + "\x00" + word
+}
+
+// tokenCache holds a vectorCache for every model served recently, so vectors
+// of different models never mix and a model activated again, e.g. on a
+// rollback, starts warm. Every model has its own budget
+type tokenCache struct {
+	mu sync.Mutex
+	// size is the number of words cached of models without a budget
+	size int
+	// budgets are the numbers of words cached of models named by version
+	// or model hash
+	budgets map[string]int
+	// maxModels is the number of models whose caches are kept
+	maxModels int
+	models    map[string]*vectorCache
+	// versions maps the hashes of the models served to their versions
+	versions map[string]string
+	// order holds the model hashes, least recently served first
+	order []string
+}
+
+func tokenCacheFromEnv() (*tokenCache, error) {
+	c := &tokenCache{size: 10000, maxModels: 2, budgets: map[string]int{}, models: map[string]*vectorCache{}, versions: map[string]string{}}
+	var budgets string
+	for _, err := range []error{
+		envInt("VECTORIZER_CACHE_SIZE", &c.size),
+		envString("VECTORIZER_CACHE_BUDGETS", &budgets),
+		envInt("VECTORIZER_CACHE_MODELS", &c.maxModels),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.maxModels < 1 {
+		return nil, fmt.Errorf("VECTORIZER_CACHE_MODELS must be positive")
+	}
+	// budgets look like v2=50000,v1=1000
+	for _, budget := range strings.Split(budgets, ",") {
+		if strings.TrimSpace(budget) == "" {
+			continue
+		}
+		name, size, ok := strings.Cut(budget, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid VECTORIZER_CACHE_BUDGETS entry %q, expected <version>=<words>", budget)
+		}
+		c.budgets[strings.TrimSpace(name)] = n
+	}
+	return c, nil
+}
+
+// model returns the cache of the model with hash, served as version, nil if
+// its budget is 0. The caches of the models served longest ago are dropped
+func (c *tokenCache) model(hash, version string) *vectorCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, h := range c.order {
+		if h == hash {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, hash)
+	if version != "" {
+		c.versions[hash] = version
+	}
+	if len(c.order) > c.maxModels {
+		delete(c.models, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	if cache, ok := c.models[hash]; ok {
+		return cache
+	}
+	size, ok := c.budgets[version]
+	if !ok || version == "" {
+		size, ok = c.budgets[hash]
+	}
+	if !ok {
+		size = c.size
+	}
+	cache := newVectorCache(size)
+	c.models[hash] = cache
+	return cache
+}
+
+// modelHash returns the hash of the model served since the start with the
+// version or hash name, and whether there is one
+func (c *tokenCache) modelHash(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash, version := range c.versions {
+		if version == name {
+			return hash, true
+		}
+	}
+	if _, ok := c.models[name]; ok {
+		return name, true
+	}
+	_, ok := c.versions[name]
+	return name, ok
+}
+
+// flush empties the cache of the model of hash, or of all models if hash is
+// empty. It returns the number of words dropped
+func (c *tokenCache) flush(hash string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for h, cache := range c.models {
+		if hash == "" || h == hash {
+			n += cache.flush()
+		}
+	}
+	return n
+}
+
+// vectorCache keeps the vectors of the most recently looked up words of a
+// model, including the words that are not in the vocabulary. Words are
+// keyed by cacheKey
+type vectorCache struct {
+	mu       sync.Mutex
+	capacity int
+	// order holds the cacheEntry values, most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheEntry struct {
+	key string
+	// vector is nil if the word is not in the vocabulary
+	vector *pkg.Vector
+}
+
+// newVectorCache returns a cache of capacity words, nil if capacity is 0
+func newVectorCache(capacity int) *vectorCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &vectorCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// get returns the cached vector of the key and whether it was cached
+func (c *vectorCache) get(key string) (*pkg.Vector, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).vector, true
+}
+
+// put caches the vector of the key, evicting the least recently used key if
+// the cache is full
+func (c *vectorCache) put(key string, vector *pkg.Vector) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).vector = vector
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, vector: vector})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// flush drops all cached words and returns their number
+func (c *vectorCache) flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+	return n
+}
+
+func (c *vectorCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *vectorCache) writeMetrics(m *metricsWriter) {
+	if c == nil {
+		return
+	}
+	m.counter("vectorizer_cache_hits_total", "Number of words found in the vector cache", float64(c.hits.Load()))
+	m.counter("vectorizer_cache_misses_total", "Number of words read from the store because they were not cached", float64(c.misses.Load()))
+	m.gauge("vectorizer_cache_words", "Number of words in the vector cache", float64(c.len()))
+}
+
+// save writes the cached keys from the least to the most recently used to
+// path, along with the hash of the model they were read from. The file is
+// replaced atomically
+func (c *vectorCache) save(path, modelHash string) error {
+	if c == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if err := c.writeSnapshot(w, modelHash); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *vectorCache) writeSnapshot(w *bufio.Writer, modelHash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.WriteString(cacheSnapshotMagic)
+	buf := binary.AppendUvarint(nil, uint64(len(modelHash)))
+	buf = append(buf, modelHash...)
+	buf = binary.AppendUvarint(buf, uint64(c.order.Len()))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	for e := c.order.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*cacheEntry)
+		buf = binary.AppendUvarint(buf[:0], uint64(len(entry.key)))
+		buf = append(buf, entry.key...)
+		// the number of dimensions, 0 for words not in the vocabulary
+		var values []float32
+		if entry.vector != nil {
+			values = entry.vector.ToArray()
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(values)))
+		buf = pkg.AppendFloat32s(buf, values)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load fills the cache from the snapshot at path. A missing snapshot or one
+// of another model is ignored, it returns the number of words loaded
+func (c *vectorCache) load(path, modelHash string) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(cacheSnapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != cacheSnapshotMagic {
+		return 0, fmt.Errorf("%s: not a cache snapshot", path)
+	}
+	hash, err := readSnapshotBytes(r)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+	if string(hash) != modelHash {
+		return 0, nil
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		key, err := readSnapshotBytes(r)
+		if err != nil {
+			return int(i), fmt.Errorf("%s: %v", path, err)
+		}
+		dims, err := binary.ReadUvarint(r)
+		if err != nil {
+			return int(i), fmt.Errorf("%s: %v", path, err)
+		}
+		if dims > math.MaxUint16 {
+			return int(i), fmt.Errorf("%s: corrupt vector of %q", path, key)
+		}
+		var vector *pkg.Vector
+		if dims > 0 {
+			data := make([]byte, 4*dims)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return int(i), fmt.Errorf("%s: %v", path, err)
+			}
+			values := make([]float32, dims)
+			for j := range values {
+				values[j] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*j:]))
+			}
+			v := pkg.NewVector(values)
+			vector = &v
+		}
+		c.put(string(key), vector)
+	}
+	return int(n), nil
+}
+
+// readSnapshotBytes reads a length prefixed byte string
+func readSnapshotBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxUint16 {
+		return nil, fmt.Errorf("corrupt cache snapshot")
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
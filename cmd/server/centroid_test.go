@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// weightedVectors is a random input of ComputeWeightedCentroid: vectors of
+// the same dimensions with positive weights
+type weightedVectors struct {
+	vectors []pkg.Vector
+	weights []float32
+}
+
+func (weightedVectors) Generate(r *rand.Rand, size int) reflect.Value {
+	n, dims := 1+r.Intn(20), 1+r.Intn(size+1)
+	in := weightedVectors{}
+	for i := 0; i < n; i++ {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = float32(r.NormFloat64())
+		}
+		in.vectors = append(in.vectors, pkg.NewVector(vector))
+		in.weights = append(in.weights, 0.05+r.Float32()*4)
+	}
+	return reflect.ValueOf(in)
+}
+
+// closeTo reports whether a and b are equal up to rounding errors of
+// float32 sums
+func closeTo(a, b *pkg.Vector) bool {
+	x, y := a.ToArray(), b.ToArray()
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if math.Abs(float64(x[i]-y[i])) > 1e-4*math.Max(1, math.Abs(float64(x[i]))) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkProperty(t *testing.T, property interface{}) {
+	t.Helper()
+	if err := quick.Check(property, &quick.Config{MaxCount: 500, Rand: rand.New(rand.NewSource(1))}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCentroidWeightScaleInvariance(t *testing.T) {
+	checkProperty(t, func(in weightedVectors, scale uint8) bool {
+		c := float32(scale%100+1) / 10
+		scaled := make([]float32, len(in.weights))
+		for i, weight := range in.weights {
+			scaled[i] = weight * c
+		}
+		a, errA := ComputeWeightedCentroid(in.vectors, in.weights)
+		b, errB := ComputeWeightedCentroid(in.vectors, scaled)
+		return errA == nil && errB == nil && closeTo(a, b)
+	})
+}
+
+func TestCentroidPermutationInvariance(t *testing.T) {
+	checkProperty(t, func(in weightedVectors, seed int64) bool {
+		perm := rand.New(rand.NewSource(seed)).Perm(len(in.vectors))
+		vectors := make([]pkg.Vector, len(perm))
+		weights := make([]float32, len(perm))
+		for i, j := range perm {
+			vectors[i], weights[i] = in.vectors[j], in.weights[j]
+		}
+		a, errA := ComputeWeightedCentroid(in.vectors, in.weights)
+		b, errB := ComputeWeightedCentroid(vectors, weights)
+		return errA == nil && errB == nil && closeTo(a, b)
+	})
+}
+
+func TestCentroidSingleVectorIdentity(t *testing.T) {
+	checkProperty(t, func(in weightedVectors) bool {
+		c, err := ComputeWeightedCentroid(in.vectors[:1], in.weights[:1])
+		if err != nil {
+			return false
+		}
+		equal, err := c.Equal(&in.vectors[0])
+		return err == nil && equal
+	})
+}
+
+// TestCentroidRepeatedVector checks that the centroid of copies of a
+// vector is the vector, whatever their weights
+func TestCentroidRepeatedVector(t *testing.T) {
+	checkProperty(t, func(in weightedVectors) bool {
+		vectors := make([]pkg.Vector, len(in.vectors))
+		for i := range vectors {
+			vectors[i] = in.vectors[0]
+		}
+		c, err := ComputeWeightedCentroid(vectors, in.weights)
+		return err == nil && closeTo(c, &in.vectors[0])
+	})
+}
+
+// TestCentroidWithinBounds checks that every value of the centroid lies
+// between the smallest and the largest value of its dimension
+func TestCentroidWithinBounds(t *testing.T) {
+	checkProperty(t, func(in weightedVectors) bool {
+		c, err := ComputeWeightedCentroid(in.vectors, in.weights)
+		if err != nil {
+			return false
+		}
+		for i, value := range c.ToArray() {
+			low, high := math.Inf(1), math.Inf(-1)
+			for _, v := range in.vectors {
+				x := float64(v.ToArray()[i])
+				low, high = math.Min(low, x), math.Max(high, x)
+			}
+			if float64(value) < low-1e-4 || float64(value) > high+1e-4 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCentroidRejectsMismatches(t *testing.T) {
+	checkProperty(t, func(in weightedVectors, at uint8) bool {
+		if len(in.vectors) < 2 {
+			return true
+		}
+		// one vector with a dimension more
+		i := int(at) % len(in.vectors)
+		vectors := append([]pkg.Vector{}, in.vectors...)
+		vectors[i] = pkg.NewVector(append(vectors[i].ToArray(), 1))
+		if _, err := ComputeWeightedCentroid(vectors, in.weights); err == nil {
+			return false
+		}
+		// a weight more or less than vectors
+		if _, err := ComputeWeightedCentroid(in.vectors, in.weights[1:]); err == nil {
+			return false
+		}
+		_, err := ComputeWeightedCentroid(in.vectors, append(in.weights, 1))
+		return err != nil
+	})
+	if _, err := ComputeWeightedCentroid(nil, nil); err == nil {
+		t.Error("centroid of no vectors computed")
+	}
+}
+
+// TestCentroidAccumulation checks that float64, Kahan and fixed point accumulation keep
+// the mean of many vectors accurate where float32 sums drift
+func TestCentroidAccumulation(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	vectors := make([]pkg.Vector, 100000)
+	weights := make([]float32, len(vectors))
+	var exact float64
+	for i := range vectors {
+		value := float32(r.NormFloat64()) + 3
+		vectors[i] = pkg.NewVector([]float32{value})
+		weights[i] = 1.3
+		exact += float64(value)
+	}
+	exact /= float64(len(vectors))
+
+	for _, accumulation := range []string{accumulateFloat64, accumulateKahan, accumulateFixed} {
+		c, err := computeWeightedCentroid(vectors, weights, accumulation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(c.ToArray()[0]); math.Abs(got-exact) > 1e-6 {
+			t.Errorf("%s accumulation: mean %v, want %v", accumulation, got, exact)
+		}
+	}
+}
+
+// TestCentroidFixedOrder checks that fixed point accumulation gives the same
+// bits whatever the order of the vectors, including negative sums
+func TestCentroidFixedOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	vectors := make([]pkg.Vector, 1000)
+	weights := make([]float32, len(vectors))
+	for i := range vectors {
+		vectors[i] = pkg.NewVector([]float32{float32(r.NormFloat64()) - 1, float32(r.NormFloat64() * 1e-3)})
+		weights[i] = r.Float32() + 0.5
+	}
+	want, err := computeWeightedCentroid(vectors, weights, accumulateFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exact, err := computeWeightedCentroid(vectors, weights, accumulateFloat64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, value := range want.ToArray() {
+		if math.Abs(float64(value-exact.ToArray()[j])) > 1e-5 {
+			t.Errorf("dimension %d: mean %v, want %v", j, value, exact.ToArray()[j])
+		}
+	}
+
+	for run := 0; run < 10; run++ {
+		r.Shuffle(len(vectors), func(i, j int) {
+			vectors[i], vectors[j] = vectors[j], vectors[i]
+			weights[i], weights[j] = weights[j], weights[i]
+		})
+		got, err := computeWeightedCentroid(vectors, weights, accumulateFixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, value := range got.ToArray() {
+			if math.Float32bits(value) != math.Float32bits(want.ToArray()[j]) {
+				t.Fatalf("run %d dimension %d: mean %v, want %v", run, j, value, want.ToArray()[j])
+			}
+		}
+	}
+}
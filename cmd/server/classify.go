@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// defaultClassifyTemperature sharpens the softmax over the label
+// similarities. Cosine similarities of centroids rarely differ by more than a
+// few tenths, a temperature of 1 would score all labels about the same
+const defaultClassifyTemperature = 0.05
+
+// classifyLabel is a candidate label, optionally with a description that is
+// vectorized along with it. It is either given as a string or an object
+type classifyLabel struct {
+	Label       string `json:"label"`
+	Description string `json:"description,omitempty"`
+}
+
+func (l *classifyLabel) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &l.Label)
+	}
+	type plain classifyLabel
+	return json.Unmarshal(data, (*plain)(l))
+}
+
+// classifyRequest is the body accepted by the classify endpoint. It takes the
+// input and options of the vectorize endpoint
+type classifyRequest struct {
+	Labels []classifyLabel `json:"labels"`
+	// Temperature divides the similarities before the softmax, lower
+	// temperatures favor the most similar label
+	Temperature *float64 `json:"temperature,omitempty"`
+	vectorizeRequest
+}
+
+// classifyScore is the score of a single label
+type classifyScore struct {
+	Label string `json:"label"`
+	// Score is the softmax of the similarities, the scores of all labels
+	// add up to 1
+	Score float64 `json:"score"`
+	// Similarity is the cosine similarity of the text and the label
+	Similarity float64 `json:"similarity"`
+}
+
+// classifyResponse is the body returned by the classify endpoint
+type classifyResponse struct {
+	// Label is the label with the highest score
+	Label string `json:"label"`
+	// Scores holds the scores of all labels, highest first
+	Scores   []classifyScore `json:"scores"`
+	Quality  quality         `json:"quality"`
+	Degraded bool            `json:"degraded,omitempty"`
+}
+
+// classifyHandler scores candidate labels by the similarity of their vectors
+// to the vector of the text, a zero-shot classifier
+func (vtcrzr *Vectorizer) classifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody classifyRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := requestBody.checkInput(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Labels) < 2 {
+		http.Error(w, "At least two 'labels' are required in request body", http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	for _, label := range requestBody.Labels {
+		if label.Label == "" {
+			http.Error(w, "Labels must not be empty", http.StatusBadRequest)
+			return
+		}
+		if seen[label.Label] {
+			http.Error(w, fmt.Sprintf("Duplicate label %q", label.Label), http.StatusBadRequest)
+			return
+		}
+		seen[label.Label] = true
+	}
+	temperature := defaultClassifyTemperature
+	if requestBody.Temperature != nil {
+		temperature = *requestBody.Temperature
+	}
+	if temperature <= 0 {
+		http.Error(w, "Invalid temperature, it must be positive", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	vectorized, err := vtcrzr.vectorizeBody(&requestBody.vectorizeRequest, opts)
+	if err != nil {
+		vectorizeError(w, err)
+		return
+	}
+	text := unitVector(vectorized.vector.ToArray())
+
+	// labels are short, the coverage of the text doesn't apply to them
+	labelOpts := opts
+	labelOpts.MinCoverage = 0
+	scores := make([]classifyScore, len(requestBody.Labels))
+	for i, label := range requestBody.Labels {
+		labelVector, err := vtcrzr.vectorize([]string{label.Label + " " + label.Description}, labelOpts)
+		if err != nil {
+			vectorizeError(w, fmt.Errorf("label %q: %w", label.Label, err))
+			return
+		}
+		var similarity float64
+		for j, value := range unitVector(labelVector.vector.ToArray()) {
+			similarity += value * text[j]
+		}
+		scores[i] = classifyScore{Label: label.Label, Similarity: similarity}
+	}
+	softmax(scores, temperature)
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+
+	responseBody := classifyResponse{
+		Label:    scores[0].Label,
+		Scores:   scores,
+		Quality:  vectorized.quality,
+		Degraded: degraded,
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// softmax sets the scores to the softmax of the similarities divided by
+// temperature
+func softmax(scores []classifyScore, temperature float64) {
+	highest := math.Inf(-1)
+	for _, score := range scores {
+		highest = math.Max(highest, score.Similarity)
+	}
+
+	// subtracting the highest similarity keeps the exponentials finite
+	var sum float64
+	for i, score := range scores {
+		scores[i].Score = math.Exp((score.Similarity - highest) / temperature)
+		sum += scores[i].Score
+	}
+	for i := range scores {
+		scores[i].Score /= sum
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// errCoalescedPanic is returned to the requests waiting for a vectorization
+// that panicked, the request computing it fails with the panic
+var errCoalescedPanic = errors.New("vectorization of an identical request failed")
+
+// coalescer lets concurrent identical requests share one vectorization,
+// like singleflight: the first request of a key computes it, the ones
+// arriving meanwhile wait for its result. Bursts of identical requests are
+// common when many workers index the same hot document
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	// shared counts the requests that got the result of another one
+	shared atomic.Uint64
+}
+
+// coalescedCall is a vectorization in flight
+type coalescedCall struct {
+	done   chan struct{}
+	result *vectorization
+	err    error
+}
+
+func coalescerFromEnv() (*coalescer, error) {
+	enabled := true
+	if err := envBool("VECTORIZER_COALESCE", &enabled); err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, nil
+	}
+	return &coalescer{calls: map[string]*coalescedCall{}}, nil
+}
+
+// do returns the result of fn for key, computing it unless a call of the
+// same key is in flight. shared is set if the result came from another
+// call. A nil coalescer always calls fn
+func (c *coalescer) do(key string, fn func() (*vectorization, error)) (result *vectorization, err error, shared bool) {
+	if c == nil {
+		result, err = fn()
+		return result, err, false
+	}
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		c.shared.Add(1)
+		return call.result, call.err, true
+	}
+	call := &coalescedCall{done: make(chan struct{}), err: errCoalescedPanic}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.result, call.err = fn()
+	return call.result, call.err, false
+}
+
+func (c *coalescer) writeMetrics(m *metricsWriter) {
+	if c == nil {
+		return
+	}
+	m.counter("vectorizer_coalesced_requests_total", "Number of requests that shared the vectorization of an identical concurrent request", float64(c.shared.Load()))
+}
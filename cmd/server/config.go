@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envString sets dst to the value of the environment variable name if it is set
+func envString(name string, dst *string) error {
+	if s := os.Getenv(name); s != "" {
+		*dst = s
+	}
+	return nil
+}
+
+// envInt sets dst to the integer value of the environment variable name if it is set
+func envInt(name string, dst *int) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+// envFloat32 sets dst to the float value of the environment variable name if it is set
+func envFloat32(name string, dst *float32) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	*dst = float32(f)
+	return nil
+}
+
+// envBool sets dst to the boolean value of the environment variable name if it is set
+func envBool(name string, dst *bool) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	*dst = b
+	return nil
+}
+
+// envDuration sets dst to the duration value of the environment variable name if it is set
+func envDuration(name string, dst *time.Duration) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	*dst = d
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// request schema versions, the version of a request is its "v" field
+const (
+	// requestV1 ignores fields the server doesn't know
+	requestV1 = 1
+	// requestV2 rejects fields the server doesn't know, so misspelled
+	// options are caught instead of silently falling back to the defaults
+	requestV2 = 2
+)
+
+// decodeVectorizeRequest reads the request of /vectorize: the q parameters
+// of a GET, the text of a text/plain body or a JSON body decoded like
+// decodeRequest. Requests without JSON take the default options
+func decodeVectorizeRequest(r *http.Request, req *vectorizeRequest, defaultVersion int) error {
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query()["q"]
+		if len(req.Query) == 0 {
+			return errors.New("missing q parameter")
+		}
+		return nil
+	}
+	if isPlainText(r) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		text := string(body)
+		req.Text = &text
+		return nil
+	}
+	return decodeRequest(r.Body, req, defaultVersion)
+}
+
+// isPlainText reports whether the body of r is text/plain
+func isPlainText(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "text/plain"
+}
+
+// decodeRequest decodes a JSON request body into v according to the version
+// of the request, defaultVersion if it has none. Errors name the offending
+// field in terms of the JSON body rather than the Go types it is decoded to
+func decodeRequest(r io.Reader, v interface{}, defaultVersion int) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var peek struct {
+		V json.RawMessage `json:"v"`
+	}
+	// a body that isn't an object fails below with a better message
+	json.Unmarshal(body, &peek)
+	version := defaultVersion
+	if peek.V != nil {
+		switch string(peek.V) {
+		case "1":
+			version = requestV1
+		case "2":
+			version = requestV2
+		default:
+			return fmt.Errorf("unsupported request version %s, expected %d or %d", peek.V, requestV1, requestV2)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if version == requestV2 {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return describeDecodeError(err)
+	}
+	if version == requestV2 && decoder.More() {
+		return errors.New("unexpected data after the JSON object")
+	}
+	return nil
+}
+
+// describeDecodeError rewrites the errors of encoding/json, which name Go
+// types and struct fields, into ones a client can act on
+func describeDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("body must be %s, got %s", jsonType(typeErr.Type), typeErr.Value)
+		}
+		return fmt.Errorf("'%s' must be %s, got %s", typeErr.Field, jsonType(typeErr.Type), typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("invalid JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)
+	case errors.Is(err, io.EOF):
+		return errors.New("body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body is truncated")
+	}
+	// encoding/json has no type for unknown fields
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fmt.Errorf("unknown field %s, version %d requests only take the documented fields", name, requestV2)
+	}
+	return err
+}
+
+// jsonType names the JSON type a Go type is decoded from
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	dedupeEmbedding = "embedding"
+	dedupeSimHash   = "simhash"
+)
+
+// default thresholds of the dedupe methods. Centroids of unrelated texts
+// are already quite similar, so the embedding threshold is high. A SimHash
+// similarity of 0.9 allows 6 of 64 bits to differ
+var dedupeThresholds = map[string]float32{
+	dedupeEmbedding: 0.95,
+	dedupeSimHash:   0.9,
+}
+
+// dedupeRequest is the body accepted by the dedupe endpoint. It takes the
+// options of the vectorize endpoint
+type dedupeRequest struct {
+	Texts []string `json:"texts"`
+	// Method is either embedding, comparing the centroids of the texts, or
+	// simhash, comparing fingerprints of their words
+	Method string `json:"method"`
+	// Threshold is the smallest similarity of two texts considered
+	// duplicates, it defaults to the threshold of the method
+	Threshold *float32 `json:"threshold,omitempty"`
+	vectorizeRequest
+}
+
+// dedupeResponse is the body returned by the dedupe endpoint
+type dedupeResponse struct {
+	Method    string  `json:"method"`
+	Threshold float32 `json:"threshold"`
+	// Clusters holds the indexes of texts that are near-duplicates of each
+	// other, in ascending order. Texts without duplicates are left out
+	Clusters [][]int `json:"clusters"`
+	// Duplicates is the number of texts that can be dropped keeping one
+	// text of every cluster
+	Duplicates int `json:"duplicates"`
+	// Skipped holds the indexes of texts that could not be compared, e.g.
+	// because none of their words were found or the coverage was too low
+	Skipped  []int `json:"skipped,omitempty"`
+	Degraded bool  `json:"degraded,omitempty"`
+}
+
+// dedupeHandler clusters the near-duplicates of a list of texts
+func (vtcrzr *Vectorizer) dedupeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody dedupeRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Texts == nil {
+		http.Error(w, "Missing 'texts' field in request body", http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Texts) > vtcrzr.maxDedupeTexts {
+		http.Error(w, fmt.Sprintf("Too many texts, at most %d are compared", vtcrzr.maxDedupeTexts), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if requestBody.Query != nil || requestBody.Fields != nil {
+		http.Error(w, "'query' and 'fields' are not supported when deduplicating", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Method == "" {
+		requestBody.Method = dedupeEmbedding
+	}
+	threshold, ok := dedupeThresholds[requestBody.Method]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown method %q, expected %q or %q", requestBody.Method, dedupeEmbedding, dedupeSimHash), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Threshold != nil {
+		threshold = *requestBody.Threshold
+	}
+	if threshold < 0 || threshold > 1 {
+		http.Error(w, "Invalid threshold, it must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	dedupe := vtcrzr.dedupeEmbedding
+	if requestBody.Method == dedupeSimHash {
+		dedupe = vtcrzr.dedupeSimHash
+	}
+	clusters, skipped := dedupe(requestBody.Texts, opts, threshold)
+
+	responseBody := dedupeResponse{
+		Method:    requestBody.Method,
+		Threshold: threshold,
+		Clusters:  clusters,
+		Skipped:   skipped,
+		Degraded:  degraded,
+	}
+	for _, cluster := range clusters {
+		responseBody.Duplicates += len(cluster) - 1
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// dedupeEmbedding clusters texts whose centroids have a cosine similarity of
+// at least threshold
+func (vtcrzr *Vectorizer) dedupeEmbedding(texts []string, opts vectorizeOptions, threshold float32) ([][]int, []int) {
+	var skipped []int
+	units := make([][]float64, len(texts))
+	for i, text := range texts {
+		vectorized, err := vtcrzr.vectorize([]string{text}, opts)
+		if err != nil {
+			skipped = append(skipped, i)
+			continue
+		}
+		units[i] = unitVector(vectorized.vector.ToArray())
+	}
+
+	clusters := newDisjointSet(len(texts))
+	for i := range units {
+		if units[i] == nil {
+			continue
+		}
+		for j := i + 1; j < len(units); j++ {
+			if units[j] == nil {
+				continue
+			}
+			var dot float64
+			for k, value := range units[i] {
+				dot += value * units[j][k]
+			}
+			if dot >= float64(threshold) {
+				clusters.union(i, j)
+			}
+		}
+	}
+	return clusters.groups(), skipped
+}
+
+// dedupeSimHash clusters texts whose SimHash fingerprints agree in at least
+// threshold of their bits. It doesn't need the vocabulary, so it also
+// catches near-duplicates of text that isn't in it
+func (vtcrzr *Vectorizer) dedupeSimHash(texts []string, opts vectorizeOptions, threshold float32) ([][]int, []int) {
+	var skipped []int
+	fingerprints := make([]uint64, len(texts))
+	found := make([]bool, len(texts))
+	for i, text := range texts {
+		tokens := tokenize(vtcrzr.preprocess(text, opts), opts)
+		if len(tokens) == 0 {
+			skipped = append(skipped, i)
+			continue
+		}
+		fingerprints[i] = simHash(tokens)
+		found[i] = true
+	}
+
+	maxDistance := int(math.Floor(float64(1-threshold) * 64))
+	clusters := newDisjointSet(len(texts))
+	for i := range fingerprints {
+		if !found[i] {
+			continue
+		}
+		for j := i + 1; j < len(fingerprints); j++ {
+			if found[j] && bits.OnesCount64(fingerprints[i]^fingerprints[j]) <= maxDistance {
+				clusters.union(i, j)
+			}
+		}
+	}
+	return clusters.groups(), skipped
+}
+
+// simHash fingerprints the lowercased words and word pairs of a text, so
+// texts sharing most of their words in the same order have fingerprints that
+// differ in few bits
+func simHash(tokens []string) uint64 {
+	var counts [64]int
+	add := func(feature string) {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				counts[bit]++
+			} else {
+				counts[bit]--
+			}
+		}
+	}
+	for i, token := range tokens {
+		token = strings.ToLower(token)
+		add(token)
+		if i > 0 {
+			add(strings.ToLower(tokens[i-1]) + " " + token)
+		}
+	}
+
+	var fingerprint uint64
+	for bit, count := range counts {
+		if count > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint
+}
+
+// unitVector returns vector scaled to a length of 1
+func unitVector(vector []float32) []float64 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	norm = math.Sqrt(norm)
+
+	unit := make([]float64, len(vector))
+	if norm == 0 {
+		return unit
+	}
+	for i, value := range vector {
+		unit[i] = float64(value) / norm
+	}
+	return unit
+}
+
+// disjointSet is a union-find over the indexes of texts
+type disjointSet []int
+
+func newDisjointSet(n int) disjointSet {
+	set := make(disjointSet, n)
+	for i := range set {
+		set[i] = i
+	}
+	return set
+}
+
+func (s disjointSet) find(i int) int {
+	for s[i] != i {
+		s[i] = s[s[i]]
+		i = s[i]
+	}
+	return i
+}
+
+func (s disjointSet) union(i, j int) {
+	i, j = s.find(i), s.find(j)
+	if i < j {
+		s[j] = i
+	} else if j < i {
+		s[i] = j
+	}
+}
+
+// groups returns the sets of more than one index, ordered by their smallest
+// index
+func (s disjointSet) groups() [][]int {
+	members := map[int][]int{}
+	for i := range s {
+		root := s.find(i)
+		members[root] = append(members[root], i)
+	}
+
+	groups := [][]int{}
+	for _, group := range members {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
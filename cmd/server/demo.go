@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// demoModel is the value of MODEL selecting the demo model
+const demoModel = "demo"
+
+// demoDims is the number of dimensions of the demo vectors
+const demoDims = 25
+
+// demoVocabulary lists the topics of the demo model and their words
+//
+//go:embed demo.txt
+var demoVocabulary string
+
+// demoSeed seeds the generator of the vector of name, so vectors don't
+// depend on the order of the vocabulary
+func demoSeed(name string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// demoVectors derives the vectors of the demo vocabulary. The vector of a
+// word is the mean of the centers of its topics plus a little noise, and it
+// is moved along the directions of the pairs it belongs to. The vectors are
+// the same in every run and on every platform
+func demoVectors() (map[string][]float32, error) {
+	normal := func(r *rand.Rand, scale float64) []float64 {
+		v := make([]float64, demoDims)
+		for i := range v {
+			v[i] = r.NormFloat64() * scale
+		}
+		return v
+	}
+
+	topics := map[string][]string{}
+	offsets := map[string][]float64{}
+	var words []string
+	scanner := bufio.NewScanner(strings.NewReader(demoVocabulary))
+	scanner.Buffer(nil, 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, list, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("demo vocabulary line %d: missing ':'", lineNo)
+		}
+		if direction, ok := strings.CutPrefix(name, "~"); ok {
+			d := normal(demoSeed("~"+direction), 0.4)
+			for _, pair := range strings.Split(list, ",") {
+				fields := strings.Fields(pair)
+				if len(fields) != 2 {
+					return nil, fmt.Errorf("demo vocabulary line %d: invalid pair %q", lineNo, pair)
+				}
+				for i, word := range fields {
+					offset := offsets[word]
+					if offset == nil {
+						offset = make([]float64, demoDims)
+						offsets[word] = offset
+					}
+					sign := float64(2*i - 1)
+					for j := range offset {
+						offset[j] += sign * d[j] / 2
+					}
+				}
+			}
+			continue
+		}
+		for _, word := range strings.Fields(list) {
+			if topics[word] == nil {
+				words = append(words, word)
+			}
+			topics[word] = append(topics[word], name)
+		}
+	}
+	for word := range offsets {
+		if topics[word] == nil {
+			return nil, fmt.Errorf("demo vocabulary: %q is in a pair but in no topic", word)
+		}
+	}
+
+	centers := map[string][]float64{}
+	vectors := make(map[string][]float32, len(words))
+	for _, word := range words {
+		vector := normal(demoSeed(word), 0.25)
+		for _, topic := range topics[word] {
+			center := centers[topic]
+			if center == nil {
+				center = normal(demoSeed(topic+":"), 1)
+				centers[topic] = center
+			}
+			for i := range vector {
+				vector[i] += center[i] / float64(len(topics[word]))
+			}
+		}
+		for i, value := range offsets[word] {
+			vector[i] += value
+		}
+		v := make([]float32, demoDims)
+		for i := range v {
+			v[i] = float32(vector[i])
+		}
+		vectors[word] = v
+	}
+	return vectors, scanner.Err()
+}
+
+// openDemoDB opens the demo model. Its database is written to the
+// temporary directory on first use, named after the vocabulary so it is
+// reused until the vocabulary changes
+func openDemoDB(config dbConfig) (*servedDB, error) {
+	sum := sha256.Sum256([]byte(demoVocabulary))
+	dir := filepath.Join(os.TempDir(), "vectorizer-demo-"+hex.EncodeToString(sum[:8]))
+	if _, err := os.Stat(filepath.Join(dir, pkg.ChecksumsFile)); err != nil {
+		if err := writeDemoDB(dir); err != nil {
+			return nil, fmt.Errorf("demo model: %v", err)
+		}
+	}
+	return openServedDB(dir, demoModel, config)
+}
+
+// writeDemoDB writes the database of the demo model to dir, in a temporary
+// directory first so a failed or concurrent write leaves no partial one
+func writeDemoDB(dir string) error {
+	vectors, err := demoVectors()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	db, err := leveldb.OpenFile(tmp, nil)
+	if err != nil {
+		return err
+	}
+	// written in order, so the files and the model hash are the same
+	// every time
+	words := make([]string, 0, len(vectors))
+	for word := range vectors {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	batch := new(leveldb.Batch)
+	for _, word := range words {
+		value, err := pkg.EncodeVector(vectors[word])
+		if err != nil {
+			db.Close()
+			return err
+		}
+		batch.Put([]byte(word), value)
+	}
+	if err := db.Write(batch, nil); err != nil {
+		db.Close()
+		return err
+	}
+	// tables rather than a journal, like imported databases
+	if err := db.CompactRange(util.Range{}); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	files, err := pkg.ComputeChecksums(tmp)
+	if err != nil {
+		return err
+	}
+	err = pkg.WriteChecksums(tmp, &pkg.Checksums{
+		Words:   len(vectors),
+		Dims:    demoDims,
+		Shards:  1,
+		Source:  "demo",
+		Created: time.Now().UTC(),
+		Files:   files,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// another server wrote it meanwhile
+		if _, statErr := os.Stat(filepath.Join(dir, pkg.ChecksumsFile)); statErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
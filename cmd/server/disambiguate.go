@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// disambiguate moves the vectors of a text towards the direction of their
+// context, the weighted centroid of the other vectors of the text. A static
+// vector mixes all senses of a word, "bank" is half river and half money;
+// the part of it along the context keeps the sense the text is about.
+// Every vector becomes (1-strength)·v + strength·(v·ĉ)ĉ, with ĉ the unit
+// context direction, so strength 1 keeps only the projection
+func disambiguate(vectors []pkg.Vector, weights []float32, strength float32) {
+	if strength == 0 || len(vectors) < 2 {
+		return
+	}
+	values := make([][]float32, len(vectors))
+	var sum []float64
+	for i := range vectors {
+		values[i] = vectors[i].ToArray()
+		if sum == nil {
+			sum = make([]float64, len(values[i]))
+		}
+		if len(values[i]) != len(sum) {
+			// left to computeCentroid to report
+			return
+		}
+		for j, value := range values[i] {
+			sum[j] += float64(weights[i]) * float64(value)
+		}
+	}
+
+	context := make([]float64, len(sum))
+	for i, v := range values {
+		// the word itself is no context of its sense
+		var norm float64
+		for j, value := range v {
+			context[j] = sum[j] - float64(weights[i])*float64(value)
+			norm += context[j] * context[j]
+		}
+		if norm == 0 {
+			continue
+		}
+		norm = math.Sqrt(norm)
+		var dot float64
+		for j, value := range v {
+			context[j] /= norm
+			dot += float64(value) * context[j]
+		}
+		moved := make([]float32, len(v))
+		for j, value := range v {
+			moved[j] = float32((1-float64(strength))*float64(value) + float64(strength)*dot*context[j])
+		}
+		vectors[i] = pkg.NewVector(moved)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+const (
+	defaultDriftTerms = 10
+	maxDriftTerms     = 100
+)
+
+// driftRequest is the body accepted by the drift endpoint. It takes the
+// options of the vectorize endpoint
+type driftRequest struct {
+	// Baseline and Current are the two sets of texts that are compared,
+	// e.g. last week's and this week's support tickets
+	Baseline []string `json:"baseline"`
+	Current  []string `json:"current"`
+	// Terms is the number of diverging terms returned
+	Terms *int `json:"terms,omitempty"`
+	vectorizeRequest
+}
+
+// driftTerm is a word whose change in frequency moved the centroid
+type driftTerm struct {
+	Term string `json:"term"`
+	// Contribution is the share of the term in the distance between the
+	// centroids. It is negative for terms that moved the centroids closer,
+	// the rates tell whether a term became more or less frequent
+	Contribution float64 `json:"contribution"`
+	BaselineRate float64 `json:"baseline_rate"`
+	CurrentRate  float64 `json:"current_rate"`
+}
+
+// driftResponse is the body returned by the drift endpoint
+type driftResponse struct {
+	// Distance is the cosine distance between the centroids of the sets
+	Distance float64     `json:"distance"`
+	Terms    []driftTerm `json:"terms"`
+	Baseline quality     `json:"baseline"`
+	Current  quality     `json:"current"`
+	Degraded bool        `json:"degraded,omitempty"`
+}
+
+// driftHandler compares the centroids of two sets of texts, for monitoring
+// how the content of a stream changes over time
+func (vtcrzr *Vectorizer) driftHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody driftRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Baseline == nil || requestBody.Current == nil {
+		http.Error(w, "Missing 'baseline' or 'current' field in request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Query != nil || requestBody.Fields != nil {
+		http.Error(w, "'query' and 'fields' are not supported when comparing sets of texts", http.StatusBadRequest)
+		return
+	}
+	terms := defaultDriftTerms
+	if requestBody.Terms != nil {
+		terms = *requestBody.Terms
+	}
+	if terms < 0 || terms > maxDriftTerms {
+		http.Error(w, fmt.Sprintf("Invalid terms, it must be between 0 and %d", maxDriftTerms), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	baseline, err := vtcrzr.vectorize(requestBody.Baseline, opts)
+	if err != nil {
+		vectorizeError(w, fmt.Errorf("baseline: %w", err))
+		return
+	}
+	current, err := vtcrzr.vectorize(requestBody.Current, opts)
+	if err != nil {
+		vectorizeError(w, fmt.Errorf("current: %w", err))
+		return
+	}
+
+	baselineVector, currentVector := baseline.vector.ToArray(), current.vector.ToArray()
+	currentUnit := unitVector(currentVector)
+	var similarity float64
+	for i, value := range unitVector(baselineVector) {
+		similarity += value * currentUnit[i]
+	}
+
+	responseBody := driftResponse{
+		Distance: 1 - similarity,
+		Terms:    []driftTerm{},
+		Baseline: baseline.quality,
+		Current:  current.quality,
+		Degraded: degraded,
+	}
+	if terms > 0 {
+		responseBody.Terms, err = vtcrzr.driftTerms(requestBody.Baseline, requestBody.Current, baselineVector, currentVector, opts)
+		if err != nil {
+			http.Error(w, "Failed to vectorize "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(responseBody.Terms) > terms {
+			responseBody.Terms = responseBody.Terms[:terms]
+		}
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// driftTerms ranks the words of both sets by how much they moved the
+// centroid. The difference of the centroids is the sum of the word vectors
+// weighted by the change of their rates, so the projection of every term of
+// the sum onto the difference is the contribution of that word. Phrases and
+// entities are left out
+func (vtcrzr *Vectorizer) driftTerms(baselineTexts, currentTexts []string, baseline, current []float32, opts vectorizeOptions) ([]driftTerm, error) {
+	difference := make([]float32, len(current))
+	for i := range current {
+		difference[i] = current[i] - baseline[i]
+	}
+	direction := unitVector(difference)
+
+	baselineRates, vectors, err := vtcrzr.termRates(baselineTexts, opts)
+	if err != nil {
+		return nil, err
+	}
+	currentRates, currentVectors, err := vtcrzr.termRates(currentTexts, opts)
+	if err != nil {
+		return nil, err
+	}
+	for term, vector := range currentVectors {
+		vectors[term] = vector
+	}
+
+	terms := make([]driftTerm, 0, len(vectors))
+	for term, vector := range vectors {
+		var projection float64
+		for i, value := range vector.ToArray() {
+			projection += float64(value) * direction[i]
+		}
+		change := currentRates[term] - baselineRates[term]
+		terms = append(terms, driftTerm{
+			Term:         term,
+			Contribution: change * projection,
+			BaselineRate: baselineRates[term],
+			CurrentRate:  currentRates[term],
+		})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Contribution != terms[j].Contribution {
+			return terms[i].Contribution > terms[j].Contribution
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	return terms, nil
+}
+
+// termRates returns the share of every lowercase word among the words of
+// texts that have a vector, along with their vectors
+func (vtcrzr *Vectorizer) termRates(texts []string, opts vectorizeOptions) (map[string]float64, map[string]*pkg.Vector, error) {
+	counts := map[string]int{}
+	vectors := map[string]*pkg.Vector{}
+	var total int
+	for _, text := range texts {
+		words := tokenize(vtcrzr.preprocess(text, opts), opts)
+		if opts.MaxTokens > 0 && len(words) > opts.MaxTokens {
+			words = words[:opts.MaxTokens]
+		}
+		known, err := vtcrzr.prefetch(words, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, word := range words {
+			vector := known[word]
+			if vector == nil {
+				continue
+			}
+			term := strings.ToLower(word)
+			counts[term]++
+			if _, ok := vectors[term]; !ok {
+				vectors[term] = vector
+			}
+			total++
+		}
+	}
+
+	rates := make(map[string]float64, len(counts))
+	for term, count := range counts {
+		rates[term] = float64(count) / float64(total)
+	}
+	return rates, vectors, nil
+}
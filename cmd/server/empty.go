@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// answers to /vectorize requests without any text, VECTORIZER_EMPTY_INPUT
+const (
+	// emptyUnusable answers like any input without words, 422 with the
+	// reason no_tokens
+	emptyUnusable = "unusable"
+	// emptyZero answers with a zero vector and "empty": true
+	emptyZero = "zero"
+	// emptyError answers 400 with the reason empty_input
+	emptyError = "error"
+)
+
+// reasonEmptyInput means the request had no text at all, with
+// VECTORIZER_EMPTY_INPUT=error
+const reasonEmptyInput = "empty_input"
+
+func emptyInputFromEnv() (string, error) {
+	policy := emptyUnusable
+	if err := envString("VECTORIZER_EMPTY_INPUT", &policy); err != nil {
+		return "", err
+	}
+	switch policy {
+	case emptyUnusable, emptyZero, emptyError:
+		return policy, nil
+	}
+	return "", fmt.Errorf("VECTORIZER_EMPTY_INPUT must be %s, %s or %s, got %q", emptyUnusable, emptyZero, emptyError, policy)
+}
+
+// empty reports whether the input of r, after checkInput, has no text but
+// whitespace: an empty text, query or fields object, or only blank texts
+func (r *vectorizeRequest) empty() bool {
+	for _, text := range r.Query {
+		if strings.TrimSpace(text) != "" {
+			return false
+		}
+	}
+	for _, field := range r.Fields {
+		if strings.TrimSpace(field.Text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// emptyVectorization is the zero vector of dims returned for empty input
+func emptyVectorization(dims int) *vectorization {
+	vector := pkg.NewVector(make([]float32, dims))
+	return &vectorization{vector: &vector}
+}
+
+// writeEmptyInput answers an empty request with 400
+func writeEmptyInput(w http.ResponseWriter) {
+	response, err := json.Marshal(unusableCorpus{Error: "Failed to vectorize empty input", Reason: reasonEmptyInput, OOV: []string{}})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(response)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/metric"
+)
+
+const (
+	// encodingFloat returns vectors as JSON arrays of numbers
+	encodingFloat = "float"
+	// encodingBase64 returns vectors as base64 of little endian float32
+	encodingBase64 = "base64"
+	// encodingBase64Float16 returns vectors as base64 of little endian IEEE
+	// half precision floats, a quarter of the size of JSON numbers
+	encodingBase64Float16 = "base64_float16"
+	// encodingNone leaves the vector out, for clients that only need its
+	// simhash or codes
+	encodingNone = "none"
+
+	// maxPrecision is the largest number of decimals, float32 doesn't
+	// hold more
+	maxPrecision = 9
+)
+
+func validEncoding(encoding string) error {
+	switch encoding {
+	case encodingFloat, encodingBase64, encodingBase64Float16, encodingNone:
+		return nil
+	}
+	return fmt.Errorf("encoding must be %s, %s, %s or %s", encodingFloat, encodingBase64, encodingBase64Float16, encodingNone)
+}
+
+// encodedVector is a vector in a response, rounded and encoded as requested
+type encodedVector struct {
+	values   []float32
+	encoding string
+}
+
+func newEncodedVector(vector *pkg.Vector, opts vectorizeOptions) *encodedVector {
+	return &encodedVector{
+		values:   roundVector(truncateVector(vector.ToArray(), opts.Dims), opts.Precision),
+		encoding: opts.Encoding,
+	}
+}
+
+func (v *encodedVector) MarshalJSON() ([]byte, error) {
+	var b []byte
+	switch v.encoding {
+	case encodingBase64:
+		b = pkg.AppendFloat32s(nil, v.values)
+	case encodingBase64Float16:
+		b = make([]byte, 0, 2*len(v.values))
+		for _, value := range v.values {
+			b = binary.LittleEndian.AppendUint16(b, float16(value))
+		}
+	case encodingNone:
+		return []byte("null"), nil
+	default:
+		return json.Marshal(v.values)
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// truncateVector returns the first dims values scaled to unit length, like
+// Matryoshka embeddings are used. Vectors of a database imported with
+// --pca keep the most variance in their first dimensions. 0 or dims beyond
+// the length of values return values as they are
+func truncateVector(values []float32, dims int) []float32 {
+	if dims <= 0 || dims >= len(values) {
+		return values
+	}
+	return metric.Unit(values[:dims])
+}
+
+// roundVector rounds the values to precision decimals in place, 0 keeps them
+// as they are. JSON numbers of rounded values are as short as the precision
+func roundVector(values []float32, precision int) []float32 {
+	if precision <= 0 {
+		return values
+	}
+	scale := math.Pow(10, float64(precision))
+	for i, value := range values {
+		values[i] = float32(math.Round(float64(value)*scale) / scale)
+	}
+	return values
+}
+
+// float16 converts f to the nearest IEEE 754 half precision float, rounding
+// ties to even. Values beyond the range of half precision become infinite
+func float16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exponent := int(bits>>23) & 0xff
+	mantissa := bits & 0x7fffff
+
+	if exponent == 0xff {
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+
+	// the exponent rebiased from 127 to 15
+	exponent = exponent - 127 + 15
+	if exponent >= 0x1f {
+		return sign | 0x7c00
+	}
+	if exponent <= 0 {
+		// subnormal, the implicit leading bit becomes explicit
+		if exponent < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - exponent)
+		half := mantissa >> shift
+		remainder := mantissa & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if remainder > halfway || (remainder == halfway && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+
+	half := uint32(exponent)<<10 | mantissa>>13
+	remainder := mantissa & 0x1fff
+	// a carry out of the mantissa correctly increments the exponent
+	if remainder > 0x1000 || (remainder == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return sign | uint16(half)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// defaultModelAlias names the model served by the database, the models root
+// or the replica, so ensembles can include it
+const defaultModelAlias = "default"
+
+// ensemble combinations of the vectors of the members
+const (
+	// combineConcat concatenates the vectors, the dimensions add up
+	combineConcat = "concat"
+	// combineAverage averages the vectors, all members must have the same
+	// dimensions
+	combineAverage = "average"
+)
+
+// modelsConfig is the file of VECTORIZER_MODELS_CONFIG, e.g.
+//
+//	{
+//	  "models": {"medical": "/data/pubmed-db"},
+//	  "ensembles": {
+//	    "blend": {"combine": "concat", "members": [
+//	      {"model": "default", "weight": 1},
+//	      {"model": "medical", "weight": 0.5}
+//	    ]}
+//	  },
+//	  "projections": {"blend": "/data/blend-to-768.npy"}
+//	}
+type modelsConfig struct {
+	// Models maps an alias to the directory of its database
+	Models    map[string]string   `json:"models"`
+	Ensembles map[string]ensemble `json:"ensembles"`
+	// Projections maps the alias of a model or ensemble to the .npy file
+	// of the matrix projecting its vectors, see projection
+	Projections map[string]string `json:"projections"`
+}
+
+// ensemble blends the vectors of several models into one
+type ensemble struct {
+	Combine string           `json:"combine"`
+	Members []ensembleMember `json:"members"`
+}
+
+type ensembleMember struct {
+	Model  string  `json:"model"`
+	Weight float32 `json:"weight"`
+}
+
+// modelAliases are the models and ensembles a request can select besides
+// the default model
+type modelAliases struct {
+	models      map[string]*servedDB
+	ensembles   map[string]*ensemble
+	projections map[string]*projection
+	// defaultDims are the dimensions of the default model
+	defaultDims int
+}
+
+// modelAliasesFromEnv opens the models of VECTORIZER_MODELS_CONFIG. It
+// returns nil if none is configured. dims are the dimensions of the
+// default model
+func modelAliasesFromEnv(config dbConfig, dims int) (*modelAliases, error) {
+	path := os.Getenv("VECTORIZER_MODELS_CONFIG")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_MODELS_CONFIG: %v", err)
+	}
+	var c modelsConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("VECTORIZER_MODELS_CONFIG: %v", err)
+	}
+
+	a := &modelAliases{
+		models:      map[string]*servedDB{},
+		ensembles:   map[string]*ensemble{},
+		projections: map[string]*projection{},
+		defaultDims: dims,
+	}
+	for alias, dir := range c.Models {
+		if alias == defaultModelAlias || alias == "" {
+			return nil, fmt.Errorf("VECTORIZER_MODELS_CONFIG: invalid model alias %q", alias)
+		}
+		db, err := openServedDB(dir, "", config)
+		if err != nil {
+			return nil, fmt.Errorf("VECTORIZER_MODELS_CONFIG: model %s: %w", alias, err)
+		}
+		a.models[alias] = db
+	}
+	// the projections of the members come first, they change the
+	// dimensions the ensembles combine
+	for alias, e := range c.Ensembles {
+		e := e
+		if alias == defaultModelAlias || alias == "" || a.models[alias] != nil {
+			return nil, fmt.Errorf("VECTORIZER_MODELS_CONFIG: invalid ensemble alias %q", alias)
+		}
+		a.ensembles[alias] = &e
+	}
+	for alias, path := range c.Projections {
+		if a.ensembles[alias] == nil {
+			if err := a.loadProjection(alias, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for alias, e := range a.ensembles {
+		if err := a.validEnsemble(e); err != nil {
+			return nil, fmt.Errorf("VECTORIZER_MODELS_CONFIG: ensemble %s: %w", alias, err)
+		}
+	}
+	for alias, path := range c.Projections {
+		if a.ensembles[alias] != nil {
+			if err := a.loadProjection(alias, path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return a, nil
+}
+
+// loadProjection reads the projection of alias from path and checks that
+// it takes the dimensions of alias
+func (a *modelAliases) loadProjection(alias, path string) error {
+	if err := a.validModel(alias); err != nil {
+		return fmt.Errorf("VECTORIZER_MODELS_CONFIG: projection of %w", err)
+	}
+	dims := a.dims(alias)
+	p, err := loadProjection(path)
+	if err != nil {
+		return fmt.Errorf("VECTORIZER_MODELS_CONFIG: projection of %s: %w", alias, err)
+	}
+	if p.in != dims {
+		return fmt.Errorf("VECTORIZER_MODELS_CONFIG: projection of %s takes %d dimensions, the model has %d", alias, p.in, dims)
+	}
+	a.projections[normalizeModel(alias)] = p
+	return nil
+}
+
+// dims returns the dimensions of the vectors of the model or ensemble
+// alias, before its own projection
+func (a *modelAliases) dims(alias string) int {
+	if e := a.ensembles[alias]; e != nil {
+		dims := 0
+		for _, member := range e.Members {
+			if e.Combine == combineConcat {
+				dims += a.projectedDims(member.Model)
+			} else {
+				dims = a.projectedDims(member.Model)
+			}
+		}
+		return dims
+	}
+	if db := a.models[alias]; db != nil {
+		return db.info.Dims
+	}
+	return a.defaultDims
+}
+
+// projectedDims returns the dimensions of the vectors of alias after its
+// projection
+func (a *modelAliases) projectedDims(alias string) int {
+	if p := a.projection(alias); p != nil {
+		return p.out
+	}
+	return a.dims(alias)
+}
+
+func (a *modelAliases) validEnsemble(e *ensemble) error {
+	if e.Combine != combineConcat && e.Combine != combineAverage {
+		return fmt.Errorf("combine must be %q or %q", combineConcat, combineAverage)
+	}
+	if len(e.Members) == 0 {
+		return fmt.Errorf("no members")
+	}
+	dims := 0
+	for _, member := range e.Members {
+		if member.Model != defaultModelAlias && a.models[member.Model] == nil {
+			return fmt.Errorf("unknown model %q", member.Model)
+		}
+		if member.Weight <= 0 {
+			return fmt.Errorf("weight of %s must be positive", member.Model)
+		}
+		memberDims := a.projectedDims(member.Model)
+		if dims == 0 {
+			dims = memberDims
+		}
+		if e.Combine == combineAverage && memberDims != dims {
+			return fmt.Errorf("%s has %d dimensions, averaged members need %d", member.Model, memberDims, dims)
+		}
+	}
+	return nil
+}
+
+// normalizeModel maps the default model to the empty string, so vectors
+// computed before the option existed keep their manifests
+func normalizeModel(model string) string {
+	if model == defaultModelAlias {
+		return ""
+	}
+	return model
+}
+
+// validModel returns an error if model names neither the default model nor
+// an alias
+func (a *modelAliases) validModel(model string) error {
+	if model == "" || model == defaultModelAlias {
+		return nil
+	}
+	if a != nil && (a.models[model] != nil || a.ensembles[model] != nil) {
+		return nil
+	}
+	return fmt.Errorf("unknown model %q", model)
+}
+
+// ensemble returns the ensemble of model, nil if it isn't one
+func (a *modelAliases) ensemble(model string) *ensemble {
+	if a == nil {
+		return nil
+	}
+	return a.ensembles[model]
+}
+
+// projection returns the projection of model, nil if it has none
+func (a *modelAliases) projection(model string) *projection {
+	if a == nil {
+		return nil
+	}
+	return a.projections[normalizeModel(model)]
+}
+
+// modelDB returns the database the words of opts are looked up in. Word
+// level endpoints like /wmd use the first member of an ensemble
+func (vtcrzr *Vectorizer) modelDB(opts vectorizeOptions) *servedDB {
+	model := opts.Model
+	if e := vtcrzr.aliases.ensemble(model); e != nil {
+		model = e.Members[0].Model
+	}
+	if vtcrzr.aliases != nil {
+		if db, ok := vtcrzr.aliases.models[model]; ok {
+			return db
+		}
+	}
+	return vtcrzr.db()
+}
+
+// modelInfo describes the model of opts. The hash of an ensemble covers
+// the hashes of its members, their weights and the combination, a
+// projection adds the hash of its matrix. The dimensions are those returned,
+// after truncation to opts.Dims
+func (vtcrzr *Vectorizer) modelInfo(opts vectorizeOptions) modelInfo {
+	var info modelInfo
+	if e := vtcrzr.aliases.ensemble(opts.Model); e != nil {
+		lines := []string{e.Combine}
+		for _, member := range e.Members {
+			memberOpts := opts
+			memberOpts.Model = member.Model
+			memberOpts.Dims = 0
+			memberInfo := vtcrzr.modelInfo(memberOpts)
+			if e.Combine == combineConcat {
+				info.Dims += memberInfo.Dims
+			} else {
+				info.Dims = memberInfo.Dims
+			}
+			lines = append(lines, memberInfo.Hash+" "+strconv.FormatFloat(float64(member.Weight), 'g', -1, 32))
+		}
+		h := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+		info.Hash = hex.EncodeToString(h[:])
+	} else {
+		info = vtcrzr.modelDB(opts).info
+	}
+
+	if p := vtcrzr.aliases.projection(opts.Model); p != nil {
+		h := sha256.Sum256([]byte(info.Hash + "\n" + p.hash))
+		info = modelInfo{Hash: hex.EncodeToString(h[:]), Dims: p.out}
+	}
+	if opts.Dims > 0 && opts.Dims < info.Dims {
+		// the hash stays the one of the model, the manifest options cover
+		// the truncation
+		info.Dims = opts.Dims
+	}
+	return info
+}
+
+// vectorizeEnsemble vectorizes with every member of e and combines their
+// vectors. Every vector is scaled to unit length and then by the weight of
+// its member, so the members contribute by their weights whatever the
+// norms of their models. The quality is the one of the first member. The
+// combined vector is projected if the ensemble has a projection and
+// debiased in its space
+func (vtcrzr *Vectorizer) vectorizeEnsemble(e *ensemble, opts vectorizeOptions, vectorize func(opts vectorizeOptions) (*vectorization, error)) (*vectorization, error) {
+	var combined []float32
+	var quality quality
+	var weightSum float32
+	for i, member := range e.Members {
+		memberOpts := opts
+		memberOpts.Model = member.Model
+		// the bias direction is removed from the combined vector
+		memberOpts.Debias = false
+		vectorized, err := vectorize(memberOpts)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			quality = vectorized.quality
+		}
+
+		values := vectorized.vector.ToArray()
+		var norm float64
+		for _, value := range values {
+			norm += float64(value) * float64(value)
+		}
+		scale := member.Weight
+		if norm > 0 {
+			scale /= float32(math.Sqrt(norm))
+		}
+		weightSum += member.Weight
+
+		switch e.Combine {
+		case combineConcat:
+			for _, value := range values {
+				combined = append(combined, value*scale)
+			}
+		default:
+			if combined == nil {
+				combined = make([]float32, len(values))
+			}
+			for j, value := range values {
+				combined[j] += value * scale
+			}
+		}
+	}
+	if e.Combine == combineAverage {
+		for j := range combined {
+			combined[j] /= weightSum
+		}
+	}
+	vector := pkg.NewVector(combined)
+	return vtcrzr.finish(&vectorization{vector: &vector, quality: quality}, opts)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// entityConnectors may appear inside a capitalized entity,
+// e.g. "Bank of America" or "Lord of the Rings"
+var entityConnectors = map[string]bool{
+	"of":  true,
+	"the": true,
+	"and": true,
+	"for": true,
+	"de":  true,
+}
+
+// gazetteer is a dictionary of known multi-word entities
+type gazetteer struct {
+	// entries maps the lowercase first word of an entity to the lowercase
+	// words of every entity starting with it
+	entries map[string][][]string
+	// hash identifies the entities, it is empty if none are loaded
+	hash string
+}
+
+// loadGazetteer reads one entity per line from path
+func loadGazetteer(path string) (*gazetteer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &gazetteer{entries: map[string][][]string{}}
+	var entities []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		words := split(strings.ToLower(scanner.Text()))
+		if len(words) < 2 {
+			continue
+		}
+		g.entries[words[0]] = append(g.entries[words[0]], words)
+		entities = append(entities, strings.Join(words, " "))
+	}
+	g.hash = hashWords(entities)
+	return g, scanner.Err()
+}
+
+// match returns the length of the longest entity starting at words[0], or 0
+func (g *gazetteer) match(words []string) int {
+	longest := 0
+	for _, entity := range g.entries[strings.ToLower(words[0])] {
+		if len(entity) <= longest || len(entity) > len(words) {
+			continue
+		}
+		matched := true
+		for i, word := range entity {
+			if strings.ToLower(words[i]) != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			longest = len(entity)
+		}
+	}
+	return longest
+}
+
+// entitySpans maps the start of every entity in words to its end. Entities
+// from the gazetteer take precedence over runs of capitalized words
+func (vtcrzr *Vectorizer) entitySpans(words []string) map[int]int {
+	spans := map[int]int{}
+	for start := 0; start < len(words); {
+		end := start + vtcrzr.entities.match(words[start:])
+		if end == start {
+			end = capitalizedRun(words[start:]) + start
+		}
+		if end-start < 2 {
+			start++
+			continue
+		}
+		spans[start] = end
+		start = end
+	}
+	return spans
+}
+
+// capitalizedRun returns the length of the run of capitalized words at the
+// start of words, allowing lowercase connectors between capitalized words
+func capitalizedRun(words []string) int {
+	n := 0
+	for i := 0; i < len(words); i++ {
+		if isCapitalized(words[i]) {
+			n = i + 1
+			continue
+		}
+		if n == 0 || !entityConnectors[words[i]] {
+			break
+		}
+	}
+	return n
+}
+
+func isCapitalized(word string) bool {
+	for _, r := range word {
+		return unicode.IsUpper(r)
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// bounds of the expansion of a query over the k-NN graph
+const (
+	// maxExpandTerms is the largest number of terms returned
+	maxExpandTerms = 100
+	// maxExpandDepth is the largest number of hops from the query words
+	maxExpandDepth = 3
+	// maxExpandNodes caps the words whose neighbors are read, so a deep
+	// expansion of a long query reads a bounded part of the graph
+	maxExpandNodes = 5000
+	// expandIterations is the number of power iterations of the PageRank
+	expandIterations = 30
+)
+
+// expandRequest is the body accepted by the expand endpoint. The query is
+// tokenized with the options of the vectorize endpoint
+type expandRequest struct {
+	// K is the number of terms returned
+	K *int `json:"k,omitempty"`
+	// Depth is the number of hops the walks go from the query words
+	Depth *int `json:"depth,omitempty"`
+	// Restart is the probability of a walk to jump back to the query words
+	// at every step, lower values find terms further away
+	Restart *float64 `json:"restart,omitempty"`
+	vectorizeRequest
+}
+
+// expandTerm is a term related to the query
+type expandTerm struct {
+	Word string `json:"word"`
+	// Score is the probability of the walks from the query words to end on
+	// the term
+	Score float64 `json:"score"`
+}
+
+// expandResponse is the body returned by the expand endpoint
+type expandResponse struct {
+	Terms []expandTerm `json:"terms"`
+	// Seeds are the query words the walks started from, Unknown the ones
+	// without neighbors in the graph
+	Seeds    []string `json:"seeds"`
+	Unknown  []string `json:"unknown,omitempty"`
+	Degraded bool     `json:"degraded,omitempty"`
+}
+
+// expandHandler returns terms related to the query for search query
+// expansion, ranked by personalized PageRank over the k-NN graph
+func (vtcrzr *Vectorizer) expandHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	g := vtcrzr.graph
+	if g == nil {
+		http.Error(w, "No k-NN graph is served, set VECTORIZER_KNN_GRAPH to serve one", http.StatusNotFound)
+		return
+	}
+
+	var requestBody expandRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Query == nil {
+		http.Error(w, "Missing 'query' field in request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Fields != nil {
+		http.Error(w, "'fields' is not supported when expanding queries", http.StatusBadRequest)
+		return
+	}
+	k, depth, restart := 10, 2, 0.15
+	if requestBody.K != nil {
+		k = *requestBody.K
+	}
+	if requestBody.Depth != nil {
+		depth = *requestBody.Depth
+	}
+	if requestBody.Restart != nil {
+		restart = *requestBody.Restart
+	}
+	if k < 1 || k > maxExpandTerms {
+		http.Error(w, fmt.Sprintf("k must be between 1 and %d", maxExpandTerms), http.StatusBadRequest)
+		return
+	}
+	if depth < 1 || depth > maxExpandDepth {
+		http.Error(w, fmt.Sprintf("depth must be between 1 and %d", maxExpandDepth), http.StatusBadRequest)
+		return
+	}
+	if restart <= 0 || restart >= 1 {
+		http.Error(w, "restart must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	// stopwords never seed the walks, they are related to everything
+	var words []string
+	for _, text := range requestBody.Query {
+		tokens := tokenize(vtcrzr.preprocess(text, opts), opts)
+		textOpts := opts
+		textOpts.Lang = vtcrzr.stopwords.resolve(opts.Lang, tokens)
+		for _, word := range tokens {
+			if textOpts.keepToken(word) && !vtcrzr.isStopWord(word, textOpts) {
+				words = append(words, word)
+			}
+		}
+	}
+	if opts.MaxTokens > 0 && len(words) > opts.MaxTokens {
+		words = words[:opts.MaxTokens]
+	}
+	opts.tenant.addTokens(len(words))
+
+	walk, err := g.expand(words, depth)
+	if err != nil {
+		http.Error(w, "Failed to read neighbors "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(walk.seeds) == 0 {
+		vectorizeError(w, &noVectorsError{tokens: len(words), oov: walk.unknown})
+		return
+	}
+
+	responseBody := expandResponse{
+		Terms:    walk.rank(restart, k, vtcrzr.blocklist),
+		Seeds:    walk.seedWords(),
+		Unknown:  walk.unknown,
+		Degraded: degraded,
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// graphWalk is the part of the k-NN graph within reach of the query words
+type graphWalk struct {
+	words []string
+	index map[string]int
+	// edges are the neighbors of the words read, by index, with weights
+	// adding up to 1
+	edges [][]weightedEdge
+	// seeds are the indexes of the query words with their share of the
+	// restarts
+	seeds   map[int]float64
+	unknown []string
+}
+
+type weightedEdge struct {
+	to     int
+	weight float64
+}
+
+// node returns the index of word, adding it
+func (walk *graphWalk) node(word string) int {
+	i, ok := walk.index[word]
+	if !ok {
+		i = len(walk.words)
+		walk.index[word] = i
+		walk.words = append(walk.words, word)
+		walk.edges = append(walk.edges, nil)
+	}
+	return i
+}
+
+// expand reads the neighbors of words and of their neighbors up to depth
+// hops away. Repeated query words weigh more
+func (g *knnGraph) expand(words []string, depth int) (*graphWalk, error) {
+	walk := &graphWalk{index: map[string]int{}, seeds: map[int]float64{}}
+	var frontier []int
+	for _, word := range words {
+		neighbors, err := g.neighbors(word)
+		if err != nil {
+			return nil, err
+		}
+		if neighbors == nil {
+			walk.unknown = appendOOV(walk.unknown, word)
+			continue
+		}
+		i := walk.node(word)
+		if walk.edges[i] == nil {
+			walk.edges[i] = walk.link(neighbors)
+			frontier = append(frontier, i)
+		}
+		walk.seeds[i]++
+	}
+	for _, i := range frontier {
+		walk.seeds[i] /= float64(len(words) - len(walk.unknown))
+	}
+
+	read := len(frontier)
+	for hop := 1; hop < depth; hop++ {
+		var next []int
+		for _, i := range frontier {
+			for _, edge := range walk.edges[i] {
+				if walk.edges[edge.to] != nil || read == maxExpandNodes {
+					continue
+				}
+				neighbors, err := g.neighbors(walk.words[edge.to])
+				if err != nil {
+					return nil, err
+				}
+				walk.edges[edge.to] = walk.link(neighbors)
+				next = append(next, edge.to)
+				read++
+			}
+		}
+		frontier = next
+	}
+	return walk, nil
+}
+
+// link returns the edges to neighbors. Nearer neighbors weigh more, by the
+// inverse of their distance so cosine and Euclidean graphs work alike
+func (walk *graphWalk) link(neighbors []pkg.GraphNeighbor) []weightedEdge {
+	edges := make([]weightedEdge, 0, len(neighbors))
+	var sum float64
+	for _, n := range neighbors {
+		weight := 1 / (1 + float64(n.Distance))
+		edges = append(edges, weightedEdge{to: walk.node(n.Word), weight: weight})
+		sum += weight
+	}
+	for i := range edges {
+		edges[i].weight /= sum
+	}
+	return edges
+}
+
+// rank returns the k words other than the query words and the blocked
+// words the walks most likely end on. Walks reaching a word whose neighbors
+// weren't read jump back to the query words, like the restarts. Walks still
+// pass through blocked words
+func (walk *graphWalk) rank(restart float64, k int, blocklist *wordBlocklist) []expandTerm {
+	scores := make([]float64, len(walk.words))
+	for i, share := range walk.seeds {
+		scores[i] = share
+	}
+	next := make([]float64, len(scores))
+	for iteration := 0; iteration < expandIterations; iteration++ {
+		for i := range next {
+			next[i] = 0
+		}
+		jumps := restart
+		for i, score := range scores {
+			if len(walk.edges[i]) == 0 {
+				jumps += (1 - restart) * score
+				continue
+			}
+			for _, edge := range walk.edges[i] {
+				next[edge.to] += (1 - restart) * score * edge.weight
+			}
+		}
+		for i, share := range walk.seeds {
+			next[i] += jumps * share
+		}
+		scores, next = next, scores
+	}
+
+	// the query words and their case variants are no expansion
+	query := map[string]bool{}
+	for i := range walk.seeds {
+		query[strings.ToLower(walk.words[i])] = true
+	}
+	var terms []expandTerm
+	for i, score := range scores {
+		if score <= 0 || query[strings.ToLower(walk.words[i])] {
+			continue
+		}
+		if blocklist.blocked(walk.words[i]) {
+			blocklist.filtered.Add(1)
+			continue
+		}
+		terms = append(terms, expandTerm{Word: walk.words[i], Score: score})
+	}
+	sort.SliceStable(terms, func(a, b int) bool { return terms[a].Score > terms[b].Score })
+	if len(terms) > k {
+		terms = terms[:k]
+	}
+	return terms
+}
+
+// seedWords returns the query words the walks start from, in query order
+func (walk *graphWalk) seedWords() []string {
+	var words []string
+	for i, word := range walk.words {
+		if _, ok := walk.seeds[i]; ok {
+			words = append(words, word)
+		}
+	}
+	return words
+}
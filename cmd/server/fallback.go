@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// vectors returned by /vectorize when no word of the input has one,
+// VECTORIZER_FALLBACK_VECTOR
+const (
+	// fallbackNone answers with 422 like before
+	fallbackNone = "none"
+	// fallbackZero returns a zero vector
+	fallbackZero = "zero"
+	// fallbackMean returns the mean of all vectors of the vocabulary
+	fallbackMean = "mean"
+	// fallbackWeightedMean returns their frequency-weighted mean, the mean
+	// if the database has no frequencies
+	fallbackWeightedMean = "weighted_mean"
+	// fallbackWord returns the vector of VECTORIZER_FALLBACK_WORD, like
+	// the <unk> vector some models are trained with
+	fallbackWord = "word"
+)
+
+// fallbackVector replaces the 422 answers to input without any known word,
+// so pipelines embedding noisy documents don't fail midway. A nil
+// fallbackVector keeps the errors
+type fallbackVector struct {
+	policy string
+	// word is the word whose vector is returned by fallbackWord
+	word string
+	used atomic.Uint64
+}
+
+func fallbackVectorFromEnv() (*fallbackVector, error) {
+	f := &fallbackVector{policy: fallbackNone, word: "<unk>"}
+	for _, err := range []error{
+		envString("VECTORIZER_FALLBACK_VECTOR", &f.policy),
+		envString("VECTORIZER_FALLBACK_WORD", &f.word),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch f.policy {
+	case fallbackNone:
+		return nil, nil
+	case fallbackZero, fallbackMean, fallbackWeightedMean, fallbackWord:
+		return f, nil
+	}
+	return nil, fmt.Errorf("VECTORIZER_FALLBACK_VECTOR must be %s, %s, %s, %s or %s, got %q", fallbackNone, fallbackZero, fallbackMean, fallbackWeightedMean, fallbackWord, f.policy)
+}
+
+// replace returns the fallback vector instead of err if err means that no
+// word of the input has a vector, and err otherwise. The mean and the word
+// are taken from the database of the model of opts, ensembles and projected
+// models of other dimensions fall back to a zero vector
+func (f *fallbackVector) replace(vtcrzr *Vectorizer, opts vectorizeOptions, err error) (*vectorization, error) {
+	var noVectorsErr *noVectorsError
+	if f == nil || !errors.As(err, &noVectorsErr) {
+		return nil, err
+	}
+	// the vector is truncated to opts.Dims like any other
+	untruncated := opts
+	untruncated.Dims = 0
+	dims := vtcrzr.modelInfo(untruncated).Dims
+
+	var vector *pkg.Vector
+	db := vtcrzr.modelDB(opts)
+	switch f.policy {
+	case fallbackMean, fallbackWeightedMean:
+		mean, weighted, meansErr := db.vocabularyMeans()
+		if meansErr != nil {
+			return nil, meansErr
+		}
+		vector = mean
+		if f.policy == fallbackWeightedMean && weighted != nil {
+			vector = weighted
+		}
+	case fallbackWord:
+		var readErr error
+		vector, readErr = vtcrzr.readVector(db, f.word, opts.timing)
+		if readErr != nil {
+			return nil, readErr
+		}
+		if vector == nil {
+			return nil, fmt.Errorf("%w, the fallback word %q isn't either", err, f.word)
+		}
+	}
+	if vector == nil || vector.Len() != dims {
+		zero := pkg.NewVector(make([]float32, dims))
+		vector = &zero
+	}
+	f.used.Add(1)
+	vectorized := &vectorization{vector: vector, quality: quality{Tokens: noVectorsErr.tokens}, fallback: true}
+	if !opts.Debias {
+		return vectorized, nil
+	}
+	return vtcrzr.debias(vectorized, opts)
+}
+
+func (f *fallbackVector) writeMetrics(m *metricsWriter) {
+	if f == nil {
+		return
+	}
+	m.counter("vectorizer_fallback_vectors_total", "Number of /vectorize requests without a known word answered with the fallback vector", float64(f.used.Load()))
+}
+
+// meansOnce loads the means of a database once
+type meansOnce struct {
+	once           sync.Once
+	mean, weighted *pkg.Vector
+	err            error
+}
+
+// vocabularyMeans returns the mean of all finite vectors of db and their
+// frequency-weighted mean, nil if db has no frequencies. They are read from
+// the pkg.MeansFile of db or, if it has none, computed from the whole
+// vocabulary on the first call
+func (db *servedDB) vocabularyMeans() (mean, weighted *pkg.Vector, err error) {
+	db.means.once.Do(func() {
+		mean, weighted, err := pkg.ReadMeans(db.path)
+		if err == nil && mean == nil {
+			log.Printf("%s has no %s, computing the means of its vectors", db.path, pkg.MeansFile)
+			mean, weighted, err = db.store.means()
+		}
+		if err != nil {
+			db.means.err = err
+			return
+		}
+		if mean != nil {
+			v := pkg.NewVector(mean)
+			db.means.mean = &v
+		}
+		if weighted != nil {
+			v := pkg.NewVector(weighted)
+			db.means.weighted = &v
+		}
+	})
+	return db.means.mean, db.means.weighted, db.means.err
+}
+
+// means computes the means of all finite vectors of the store, see
+// pkg.MeanAccumulator
+func (s *store) means() (mean, weighted []float32, err error) {
+	var acc pkg.MeanAccumulator
+	for _, db := range s.shards {
+		iter := db.NewIterator(nil, nil)
+		for iter.Next() {
+			if err := acc.Add(iter.Value()); err != nil {
+				iter.Release()
+				return nil, nil, fmt.Errorf("%q: %v", iter.Key(), err)
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, nil, err
+		}
+	}
+	mean, weighted = acc.Means()
+	if mean == nil {
+		return nil, nil, errors.New("the vocabulary has no finite vectors")
+	}
+	return mean, weighted, nil
+}
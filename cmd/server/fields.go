@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// vectorizeField is a weighted part of a structured document, e.g. its title
+type vectorizeField struct {
+	Text   string   `json:"text"`
+	Weight *float32 `json:"weight,omitempty"`
+}
+
+// vectorizeFields computes the weighted average of the centroids of every
+// field. The vectors of a field are scaled so they add up to the weight of the
+// field, which keeps a long body from outweighing a boosted title
+func (vtcrzr *Vectorizer) vectorizeFields(fields map[string]vectorizeField, opts vectorizeOptions) (*vectorization, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	corpus := &corpusVectors{}
+	for _, name := range names {
+		field := fields[name]
+		var fieldWeight float32 = 1
+		if field.Weight != nil {
+			fieldWeight = *field.Weight
+		}
+		if fieldWeight <= 0 {
+			return nil, fmt.Errorf("weight of field %q must be positive", name)
+		}
+
+		fieldCorpus, err := vtcrzr.collect([]string{field.Text}, opts)
+		if err != nil {
+			return nil, fmt.Errorf("at field %q: %w", name, err)
+		}
+
+		var weightSum float32
+		for _, weight := range fieldCorpus.weights {
+			weightSum += weight
+		}
+		for i, vector := range fieldCorpus.vectors {
+			corpus.add(vector, fieldCorpus.weights[i]/weightSum*fieldWeight)
+		}
+		corpus.tokens += fieldCorpus.tokens
+		corpus.found += fieldCorpus.found
+		corpus.oov = appendOOV(corpus.oov, fieldCorpus.oov...)
+	}
+
+	return vtcrzr.centroid(corpus, opts)
+}
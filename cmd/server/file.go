@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// file formats accepted by the upload endpoint
+const (
+	formatText     = "text"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+	formatPDF      = "pdf"
+)
+
+// fileExtraction describes how the text of an uploaded file was obtained
+type fileExtraction struct {
+	Filename   string `json:"filename"`
+	Format     string `json:"format"`
+	Bytes      int    `json:"bytes"`
+	TextLength int    `json:"text_length"`
+}
+
+// fileChunk is the vector of a consecutive part of an uploaded file
+type fileChunk struct {
+	Index   int            `json:"index"`
+	Text    string         `json:"text"`
+	Vector  *encodedVector `json:"vector,omitempty"`
+	Quality *quality       `json:"quality,omitempty"`
+	// Error is set instead of the vector if the chunk could not be vectorized
+	Error string `json:"error,omitempty"`
+}
+
+// fileResponse is the body returned by the upload endpoint
+type fileResponse struct {
+	Chunks     []fileChunk    `json:"chunks"`
+	Extraction fileExtraction `json:"extraction"`
+	Manifest   *manifest      `json:"manifest,omitempty"`
+	Degraded   bool           `json:"degraded,omitempty"`
+}
+
+// detectFormat decides the format of an upload by its content and name
+func detectFormat(filename, contentType string, data []byte) (string, error) {
+	if strings.HasPrefix(string(data), "%PDF-") {
+		return formatPDF, nil
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("file is neither a PDF nor UTF-8 text")
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".md", ".markdown":
+		return formatMarkdown, nil
+	case ".html", ".htm":
+		return formatHTML, nil
+	}
+	switch contentType {
+	case "text/markdown":
+		return formatMarkdown, nil
+	case "text/html":
+		return formatHTML, nil
+	}
+	return formatText, nil
+}
+
+// extractText returns the readable text of an upload
+func extractText(format string, data []byte) (string, error) {
+	switch format {
+	case formatPDF:
+		return extractPDFText(data)
+	case formatMarkdown:
+		return stripMarkdown(string(data), false), nil
+	case formatHTML:
+		return stripHTML(string(data), true), nil
+	default:
+		return string(data), nil
+	}
+}
+
+// chunkWords splits text into chunks of size whitespace separated words,
+// consecutive chunks share overlap words
+func chunkWords(text string, size, overlap int) []string {
+	words := strings.Fields(text)
+	var chunks []string
+	for start := 0; start < len(words); start += size - overlap {
+		end := start + size
+		if end > len(words) {
+			end = len(words)
+		}
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+	}
+	return chunks
+}
+
+// formInt reads an integer form value, returning def if it is not set
+func formInt(r *http.Request, name string, def int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return n, nil
+}
+
+// vectorizeFileHandler accepts a multipart upload with the document in the
+// "file" part, the options of the vectorize endpoint as JSON in the "options"
+// part and the "chunk_size" and "chunk_overlap" in words
+func (vtcrzr *Vectorizer) vectorizeFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, vtcrzr.maxUploadBytes)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to parse multipart form "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var requestBody vectorizeRequest
+	if s := r.FormValue("options"); s != "" {
+		if err := json.Unmarshal([]byte(s), &requestBody); err != nil {
+			http.Error(w, "Failed to decode options "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	chunkSize, err := formInt(r, "chunk_size", 200)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	chunkOverlap, err := formInt(r, "chunk_overlap", 0)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if chunkSize < 1 || chunkOverlap < 0 || chunkOverlap >= chunkSize {
+		http.Error(w, "Invalid options chunk_size must be positive and larger than chunk_overlap", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing 'file' part "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read file "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := detectFormat(header.Filename, header.Header.Get("Content-Type"), data)
+	if err != nil {
+		http.Error(w, "Unsupported file "+err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	text, err := extractText(format, data)
+	if err != nil {
+		http.Error(w, "Failed to extract text "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// the text is already extracted
+	opts.Markup = markupNone
+	responseBody := fileResponse{
+		Chunks: []fileChunk{},
+		Extraction: fileExtraction{
+			Filename:   header.Filename,
+			Format:     format,
+			Bytes:      len(data),
+			TextLength: len(text),
+		},
+		Degraded: vtcrzr.degraded(r, &opts),
+	}
+	for i, chunk := range chunkWords(text, chunkSize, chunkOverlap) {
+		result := fileChunk{Index: i, Text: chunk}
+		vectorized, err := vtcrzr.vectorize([]string{chunk}, opts)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Vector = newEncodedVector(vectorized.vector, opts)
+			result.Quality = &vectorized.quality
+		}
+		responseBody.Chunks = append(responseBody.Chunks, result)
+	}
+
+	m, err := vtcrzr.manifest(opts)
+	if err != nil {
+		http.Error(w, "Failed to create manifest "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(configHashHeader, m.Hash)
+	if opts.Manifest {
+		responseBody.Manifest = m
+	}
+
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// corpusSeeds are inputs the tokenizer fuzz targets start from
+var corpusSeeds = []string{
+	"",
+	"The quick brown fox",
+	"state-of-the-art TCP/IP getUserName HTTPServer v2",
+	"naïve café Ärger ß İstanbul ǅemal",
+	"日本語のテキスト 中文 한국어",
+	"\xff\xfe invalid \xc3\x28 utf-8 \xed\xa0\x80",
+	strings.Repeat("\U0010FFFF", 64),
+	"--//-a/b-- /-/",
+	"<p>Hello <b>world</b> &amp; &#x1F600; &bogus;</p><script>x()</script>",
+	"# Title\n\n* item [link](http://x) `code` ![img](y)\n> quote",
+}
+
+func FuzzSplit(f *testing.F) {
+	for _, seed := range corpusSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, corpus string) {
+		for _, word := range split(corpus) {
+			if word == "" {
+				t.Fatalf("empty word in split(%q)", corpus)
+			}
+			if !strings.Contains(corpus, word) {
+				t.Fatalf("split(%q) returned %q, which isn't part of the corpus", corpus, word)
+			}
+			for _, c := range word {
+				if !unicode.IsLetter(c) && !unicode.IsNumber(c) {
+					t.Fatalf("split(%q) returned %q containing %q", corpus, word, c)
+				}
+			}
+		}
+	})
+}
+
+func FuzzTokenize(f *testing.F) {
+	for _, seed := range corpusSeeds {
+		f.Add(seed, uint8(0))
+	}
+	policies := []string{compoundsSplit, compoundsKeep, compoundsBoth}
+	f.Fuzz(func(t *testing.T, corpus string, mode uint8) {
+		opts := vectorizeOptions{
+			Compounds:        policies[int(mode)%len(policies)],
+			SplitIdentifiers: mode&4 != 0,
+		}
+		for _, word := range tokenize(corpus, opts) {
+			if word == "" {
+				t.Fatalf("empty word in tokenize(%q, %+v)", corpus, opts)
+			}
+			if strings.TrimFunc(word, isCompoundSeparator) != word {
+				t.Fatalf("tokenize(%q, %+v) returned %q with a leading or trailing separator", corpus, opts, word)
+			}
+		}
+	})
+}
+
+func FuzzSplitCamelCase(f *testing.F) {
+	for _, seed := range corpusSeeds {
+		for _, word := range split(seed) {
+			f.Add(word)
+		}
+	}
+	f.Fuzz(func(t *testing.T, word string) {
+		parts := splitCamelCase(word)
+		if len(parts) == 0 {
+			t.Fatalf("splitCamelCase(%q) returned nothing", word)
+		}
+		if len(parts) == 1 {
+			return
+		}
+		// the parts only differ from the word by case
+		joined := strings.Join(parts, "")
+		if strings.ToLower(joined) != strings.ToLower(string([]rune(word))) {
+			t.Fatalf("splitCamelCase(%q) = %q, joined %q", word, parts, joined)
+		}
+	})
+}
+
+// FuzzStripMarkup covers the normalization of text before tokenization,
+// which must turn any input into valid text for the tokenizer
+func FuzzStripMarkup(f *testing.F) {
+	for _, seed := range corpusSeeds {
+		f.Add(seed, false)
+	}
+	f.Fuzz(func(t *testing.T, corpus string, boilerplate bool) {
+		for _, markup := range []string{markupHTML, markupMarkdown} {
+			stripped := stripMarkup(corpus, vectorizeOptions{Markup: markup, StripBoilerplate: boilerplate})
+			if utf8.ValidString(corpus) && !utf8.ValidString(stripped) {
+				t.Fatalf("stripping %s from valid %q returned invalid %q", markup, corpus, stripped)
+			}
+			tokenize(stripped, vectorizeOptions{Compounds: compoundsSplit})
+		}
+	})
+}
+
+// FuzzDecodeRequest sends bodies through the schema validation, the
+// decoding and the options of /vectorize, the path every JSON endpoint
+// takes before it reads the database
+func FuzzDecodeRequest(f *testing.F) {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		f.Fatal(err)
+	}
+	defaults := vectorizeOptions{NGrams: 1, NGramWeight: 1, EntityWeight: 2, Compounds: compoundsSplit, Markup: markupNone}
+	for _, seed := range []string{
+		`{"query":["hello world"]}`,
+		`{"v":2,"query":["a"],"ngrams":2,"compounds":"keep"}`,
+		`{"v":2,"query":["a"],"unknown":1}`,
+		`{"v":3}`,
+		`{"query":"not a list"}`,
+		`{"fields":{"title":{"text":"x","weight":2}}}`,
+		`{"query":["a"]} trailing`,
+		`[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]`,
+		`{"query":[` + strings.Repeat(`{"a":`, 1000) + `1` + strings.Repeat(`}`, 1000) + `]}`,
+		"{\"query\":[\"\xff\xfe\"]}",
+		`{"v":1e400}`,
+		``,
+	} {
+		f.Add([]byte(seed), uint8(requestV1))
+	}
+	f.Fuzz(func(t *testing.T, body []byte, version uint8) {
+		defaultVersion := requestV1
+		if version%2 == 0 {
+			defaultVersion = requestV2
+		}
+		handler := spec.validated(func(w http.ResponseWriter, r *http.Request) {
+			var requestBody vectorizeRequest
+			if err := decodeRequest(r.Body, &requestBody, defaultVersion); err != nil {
+				http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := requestBody.options(defaults); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			requestBody.input()
+		})
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/vectorize", bytes.NewReader(body)))
+		if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+			t.Fatalf("body %q answered %d", body, w.Code)
+		}
+	})
+}
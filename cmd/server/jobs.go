@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// job input formats
+const (
+	jobFormatJSONL = "jsonl"
+	jobFormatCSV   = "csv"
+)
+
+// job output formats
+const (
+	jobOutputJSONL = "jsonl"
+	jobOutputArrow = "arrow"
+	jobOutputNpy   = "npy"
+)
+
+const (
+	jobInputFile = "input"
+	// jobIDsFile lists the ids of the rows of npy results
+	jobIDsFile = "ids.txt"
+)
+
+// jobResultsFile returns the name of the results file of an output format
+func jobResultsFile(output string) string {
+	switch output {
+	case jobOutputArrow:
+		return "results.arrows"
+	case jobOutputNpy:
+		return "results.npy"
+	default:
+		return "results.jsonl"
+	}
+}
+
+// jobStatus is reported when polling a job
+type jobStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Format string `json:"format"`
+	Output string `json:"output"`
+	// Sink is set if the vectors are pushed to the configured vector database
+	Sink bool `json:"sink,omitempty"`
+	// Rows is the number of rows processed so far, Failed the number of
+	// them that could not be vectorized
+	Rows   int `json:"rows"`
+	Failed int `json:"failed"`
+	// InputBytes is the size of the upload, BytesRead how much of it was
+	// processed
+	InputBytes int64      `json:"input_bytes"`
+	BytesRead  int64      `json:"bytes_read"`
+	Error      string     `json:"error,omitempty"`
+	Created    time.Time  `json:"created"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+}
+
+// jobPosition is how far the input of a job was read
+type jobPosition struct {
+	// Offset is the input offset after the last row read, Line the number of
+	// the last line, or CSV record, used to number rows without id
+	Offset int64 `json:"offset"`
+	Line   int   `json:"line"`
+}
+
+// jobCheckpoint is the progress of a job at the moment its results were last
+// flushed. Jobs resume from their checkpoint after a restart
+type jobCheckpoint struct {
+	Input        jobPosition `json:"input"`
+	ResultsBytes int64       `json:"results_bytes"`
+	IDsBytes     int64       `json:"ids_bytes,omitempty"`
+}
+
+// jobRecord is what is persisted of a job
+type jobRecord struct {
+	Status     jobStatus        `json:"status"`
+	Options    vectorizeOptions `json:"options"`
+	Checkpoint jobCheckpoint    `json:"checkpoint"`
+}
+
+// jobCheckpointRows is the number of rows between two checkpoints
+const jobCheckpointRows = 1000
+
+// job is a bulk vectorization of an uploaded file. The input and the results
+// are spooled to its directory
+type job struct {
+	mu         sync.Mutex
+	status     jobStatus
+	opts       vectorizeOptions
+	checkpoint jobCheckpoint
+	dir        string
+	bytesRead  atomic.Int64
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// snapshot returns a copy of the status that is safe to encode
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.BytesRead = j.bytesRead.Load()
+	return status
+}
+
+// record returns what is persisted of the job, j.mu must be held
+func (j *job) record() jobRecord {
+	return jobRecord{Status: j.status, Options: j.opts, Checkpoint: j.checkpoint}
+}
+
+// jobQueue holds the submitted jobs. Up to maxQueued jobs wait for one of the
+// workers, finished jobs are dropped with their files after ttl. If the jobs
+// directory is configured the state of every job is kept in a LevelDB in it,
+// so jobs survive restarts. Otherwise every instance spools its jobs to a
+// temporary directory of its own and keeps their state in memory
+type jobQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	dir   string
+	ttl   time.Duration
+	queue chan *job
+	// state is nil without a jobs directory
+	state *leveldb.DB
+}
+
+func jobQueueFromEnv() (*jobQueue, int, error) {
+	q := &jobQueue{
+		jobs: map[string]*job{},
+		ttl:  24 * time.Hour,
+	}
+	workers, maxQueued := 2, 100
+	for _, err := range []error{
+		envString("VECTORIZER_JOBS_DIR", &q.dir),
+		envDuration("VECTORIZER_JOB_TTL", &q.ttl),
+		envInt("VECTORIZER_JOB_WORKERS", &workers),
+		envInt("VECTORIZER_MAX_JOBS", &maxQueued),
+	} {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if workers < 1 || maxQueued < 1 {
+		return nil, 0, fmt.Errorf("VECTORIZER_JOB_WORKERS and VECTORIZER_MAX_JOBS must be positive")
+	}
+
+	// the state DB is locked by the instance that opens it, so it is only
+	// kept in a directory chosen for this instance
+	var pending []*job
+	var err error
+	if q.dir == "" {
+		if q.dir, err = os.MkdirTemp("", "vectorizer-jobs-"); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		if err = os.MkdirAll(q.dir, 0o755); err != nil {
+			return nil, 0, err
+		}
+		q.state, err = leveldb.OpenFile(filepath.Join(q.dir, jobStateDir), nil)
+		if err != nil {
+			return nil, 0, fmt.Errorf("opening job state: %v", err)
+		}
+		if pending, err = q.load(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(pending) > maxQueued {
+		maxQueued = len(pending)
+	}
+	q.queue = make(chan *job, maxQueued)
+	for _, j := range pending {
+		q.queue <- j
+	}
+	if len(pending) > 0 {
+		log.Printf("resuming %d bulk jobs", len(pending))
+	}
+
+	go q.expire()
+	return q, workers, nil
+}
+
+const (
+	jobStateDir    = "state"
+	jobStatePrefix = "job/"
+)
+
+// load restores the persisted jobs and returns the ones that didn't finish
+// in the order they were created
+func (q *jobQueue) load() ([]*job, error) {
+	var pending []*job
+	iter := q.state.NewIterator(util.BytesPrefix([]byte(jobStatePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var record jobRecord
+		if err := json.Unmarshal(iter.Value(), &record); err != nil {
+			return nil, fmt.Errorf("job state %s: %v", iter.Key(), err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		j := &job{
+			status:     record.Status,
+			opts:       record.Options,
+			checkpoint: record.Checkpoint,
+			dir:        filepath.Join(q.dir, record.Status.ID),
+			ctx:        ctx,
+			cancel:     cancel,
+		}
+		j.bytesRead.Store(record.Checkpoint.Input.Offset)
+		q.jobs[record.Status.ID] = j
+
+		if record.Status.Finished == nil {
+			j.status.Status = jobQueued
+			j.status.Started = nil
+			pending = append(pending, j)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(pending, func(a, b int) bool {
+		return pending[a].status.Created.Before(pending[b].status.Created)
+	})
+	return pending, nil
+}
+
+// save persists the job, j.mu must be held
+func (q *jobQueue) save(j *job) {
+	if q.state == nil {
+		return
+	}
+	value, err := json.Marshal(j.record())
+	if err == nil {
+		err = q.state.Put([]byte(jobStatePrefix+j.status.ID), value, nil)
+	}
+	if err != nil {
+		log.Printf("saving job %s: %v", j.status.ID, err)
+	}
+}
+
+// forget deletes the persisted state and the files of the job
+func (q *jobQueue) forget(j *job) {
+	if q.state == nil {
+		os.RemoveAll(j.dir)
+		return
+	}
+	if err := q.state.Delete([]byte(jobStatePrefix+j.status.ID), nil); err != nil {
+		log.Printf("deleting job %s: %v", j.status.ID, err)
+	}
+	os.RemoveAll(j.dir)
+}
+
+// close deletes the temporary directory of the jobs if their state is not
+// persisted, they can't be resumed
+func (q *jobQueue) close() {
+	if q.state == nil {
+		os.RemoveAll(q.dir)
+	}
+}
+
+func (q *jobQueue) expire() {
+	for range time.Tick(time.Minute) {
+		q.mu.Lock()
+		for id, j := range q.jobs {
+			j.mu.Lock()
+			if j.status.Finished != nil && time.Since(*j.status.Finished) > q.ttl {
+				delete(q.jobs, id)
+				q.forget(j)
+			}
+			j.mu.Unlock()
+		}
+		q.mu.Unlock()
+	}
+}
+
+var errTooManyJobs = errors.New("too many queued jobs")
+
+// create makes the directory of a new job, it is not queued until submitted
+func (q *jobQueue) create() (*job, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+
+	dir := filepath.Join(q.dir, id)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &job{
+		status: jobStatus{ID: id, Status: jobQueued, Created: time.Now().UTC()},
+		dir:    dir,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// submit persists the job and queues it for the workers
+func (q *jobQueue) submit(j *job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) == cap(q.queue) {
+		return errTooManyJobs
+	}
+
+	j.mu.Lock()
+	q.save(j)
+	j.mu.Unlock()
+	q.jobs[j.status.ID] = j
+	q.queue <- j
+	return nil
+}
+
+func (q *jobQueue) get(id string) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs[id]
+}
+
+// remove cancels the job and deletes it. The files of a running job are
+// deleted by its worker once it stopped
+func (q *jobQueue) remove(j *job) {
+	q.mu.Lock()
+	delete(q.jobs, j.status.ID)
+	q.mu.Unlock()
+
+	j.cancel()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.Status != jobRunning {
+		q.forget(j)
+	}
+	j.status.Status = jobCancelled
+}
+
+// runJobs processes queued jobs until the queue is closed
+func (vtcrzr *Vectorizer) runJobs() {
+	for j := range vtcrzr.jobs.queue {
+		j.mu.Lock()
+		if j.status.Status == jobCancelled {
+			j.mu.Unlock()
+			continue
+		}
+		started := time.Now().UTC()
+		j.status.Status = jobRunning
+		j.status.Started = &started
+		vtcrzr.jobs.save(j)
+		j.mu.Unlock()
+
+		err := vtcrzr.runJob(j)
+
+		finished := time.Now().UTC()
+		j.mu.Lock()
+		j.status.Finished = &finished
+		switch {
+		case j.ctx.Err() != nil:
+			j.status.Status = jobCancelled
+			vtcrzr.jobs.forget(j)
+		case err != nil:
+			j.status.Status = jobFailed
+			j.status.Error = err.Error()
+			vtcrzr.jobs.save(j)
+			log.Printf("job %s failed: %v", j.status.ID, err)
+		default:
+			j.status.Status = jobDone
+			vtcrzr.jobs.save(j)
+		}
+		j.mu.Unlock()
+	}
+}
+
+// jobRow is a text of a job with the id it is reported under
+type jobRow struct {
+	ID   json.RawMessage `json:"id"`
+	Text string          `json:"text"`
+}
+
+// jobResult is a line of the results file
+type jobResult struct {
+	ID     json.RawMessage `json:"id"`
+	Vector []float32       `json:"vector,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	text   string
+}
+
+// id returns the id of the result as text, string ids are unquoted and others
+// kept as their JSON
+func (result jobResult) id() string {
+	var id string
+	if err := json.Unmarshal(result.ID, &id); err != nil {
+		id = string(result.ID)
+	}
+	return id
+}
+
+// resultWriter writes the results of a job in its output format
+type resultWriter interface {
+	write(result jobResult) error
+	// flush writes everything buffered, it is called before checkpoints
+	flush() error
+	// close ends the output after the last result
+	close() error
+}
+
+type jsonlResultWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONLResultWriter(w io.Writer) *jsonlResultWriter {
+	buffered := bufio.NewWriter(w)
+	return &jsonlResultWriter{w: buffered, encoder: json.NewEncoder(buffered)}
+}
+
+func (r *jsonlResultWriter) write(result jobResult) error { return r.encoder.Encode(result) }
+func (r *jsonlResultWriter) flush() error                 { return r.w.Flush() }
+func (r *jsonlResultWriter) close() error                 { return r.w.Flush() }
+
+type arrowResultWriter struct {
+	*arrowWriter
+}
+
+func (r arrowResultWriter) write(result jobResult) error {
+	r.add(result.id(), result.Vector, result.Error)
+	return nil
+}
+
+// npyResultWriter writes the vectors as a float32 matrix and their ids to a
+// separate file, one per line. Failed rows are left out of both
+type npyResultWriter struct {
+	f       *os.File
+	vectors *bufio.Writer
+	ids     *bufio.Writer
+	dims    int
+	rows    int
+}
+
+func (r *npyResultWriter) write(result jobResult) error {
+	if result.Vector == nil {
+		return nil
+	}
+	if len(result.Vector) != r.dims {
+		return fmt.Errorf("vector of %d dimensions, expected %d", len(result.Vector), r.dims)
+	}
+	if _, err := r.vectors.Write(pkg.AppendFloat32s(nil, result.Vector)); err != nil {
+		return err
+	}
+	if _, err := r.ids.WriteString(result.id() + "\n"); err != nil {
+		return err
+	}
+	r.rows++
+	return nil
+}
+
+func (r *npyResultWriter) flush() error {
+	if err := r.vectors.Flush(); err != nil {
+		return err
+	}
+	return r.ids.Flush()
+}
+
+// close writes the final number of rows to the header
+func (r *npyResultWriter) close() error {
+	if err := r.flush(); err != nil {
+		return err
+	}
+	_, err := r.f.WriteAt(pkg.NpyHeader(r.rows, r.dims), 0)
+	return err
+}
+
+// sinkResultWriter pushes the vectors to a vector database in batches while
+// writing the results. Everything buffered is pushed before a checkpoint, so
+// resumed jobs push at most the rows after it again
+type sinkResultWriter struct {
+	resultWriter
+	ctx    context.Context
+	sink   *vectorSink
+	points []sinkPoint
+}
+
+func (r *sinkResultWriter) write(result jobResult) error {
+	if err := r.resultWriter.write(result); err != nil {
+		return err
+	}
+	if result.Vector == nil {
+		return nil
+	}
+	r.points = append(r.points, sinkPoint{id: result.id(), vector: result.Vector, text: result.text})
+	if len(r.points) < r.sink.batchSize {
+		return nil
+	}
+	return r.push()
+}
+
+func (r *sinkResultWriter) push() error {
+	if len(r.points) == 0 {
+		return nil
+	}
+	if err := r.sink.push(r.ctx, r.points); err != nil {
+		return err
+	}
+	r.points = r.points[:0]
+	return nil
+}
+
+func (r *sinkResultWriter) flush() error {
+	if err := r.push(); err != nil {
+		return err
+	}
+	return r.resultWriter.flush()
+}
+
+func (r *sinkResultWriter) close() error {
+	if err := r.push(); err != nil {
+		return err
+	}
+	return r.resultWriter.close()
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runJob vectorizes the rows of the job input after its checkpoint into its
+// results file. A panic fails the job
+func (vtcrzr *Vectorizer) runJob(j *job) (err error) {
+	defer vtcrzr.recoverPanic("job "+j.status.ID, &err)
+
+	j.mu.Lock()
+	checkpoint := j.checkpoint
+	format, output := j.status.Format, j.status.Output
+	j.mu.Unlock()
+
+	in, err := os.Open(filepath.Join(j.dir, jobInputFile))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := openAt(filepath.Join(j.dir, jobResultsFile(output)), checkpoint.ResultsBytes)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	counter := &countingWriter{w: out, n: checkpoint.ResultsBytes}
+	idsCounter := &countingWriter{}
+	var w resultWriter
+	switch output {
+	case jobOutputNpy:
+		ids, err := openAt(filepath.Join(j.dir, jobIDsFile), checkpoint.IDsBytes)
+		if err != nil {
+			return err
+		}
+		defer ids.Close()
+		idsCounter = &countingWriter{w: ids, n: checkpoint.IDsBytes}
+
+		dims := vtcrzr.modelInfo(j.opts).Dims
+		if checkpoint.ResultsBytes == 0 {
+			if _, err := counter.Write(pkg.NpyHeader(0, dims)); err != nil {
+				return err
+			}
+		}
+		w = &npyResultWriter{
+			f:       out,
+			vectors: bufio.NewWriter(counter),
+			ids:     bufio.NewWriter(idsCounter),
+			dims:    dims,
+			rows:    int(counter.n-pkg.NpyHeaderSize) / (4 * dims),
+		}
+	case jobOutputArrow:
+		arrow := newArrowWriter(counter, vtcrzr.modelInfo(j.opts).Dims)
+		if checkpoint.ResultsBytes == 0 {
+			if err := arrow.writeSchema(); err != nil {
+				return err
+			}
+		}
+		w = arrowResultWriter{arrow}
+	default:
+		w = newJSONLResultWriter(counter)
+	}
+	if j.status.Sink {
+		if vtcrzr.sink == nil {
+			return fmt.Errorf("sink is not configured")
+		}
+		w = &sinkResultWriter{resultWriter: w, ctx: j.ctx, sink: vtcrzr.sink}
+	}
+
+	var rows, failed int
+	save := func(position jobPosition) error {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.status.Rows += rows
+		j.status.Failed += failed
+		j.checkpoint = jobCheckpoint{Input: position, ResultsBytes: counter.n, IDsBytes: idsCounter.n}
+		vtcrzr.jobs.save(j)
+		rows, failed = 0, 0
+		return nil
+	}
+
+	position := checkpoint.Input
+	err = readJobRows(in, format, position, func(row jobRow, next jobPosition) error {
+		if err := j.ctx.Err(); err != nil {
+			return err
+		}
+
+		result := jobResult{ID: row.ID, text: row.Text}
+		vectorized, err := vtcrzr.vectorize([]string{row.Text}, j.opts)
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		} else {
+			result.Vector = roundVector(truncateVector(vectorized.vector.ToArray(), j.opts.Dims), j.opts.Precision)
+		}
+		if err := w.write(result); err != nil {
+			return err
+		}
+		rows++
+		position = next
+		j.bytesRead.Store(next.Offset)
+
+		if rows == jobCheckpointRows {
+			return save(position)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := save(position); err != nil {
+		return err
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// openAt opens the file at path for writing at offset, anything after offset
+// was written after the last checkpoint and is written again
+func openAt(path string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readJobRows calls fn for every row of in after from with the position
+// following the row. JSONL rows are objects with "id" and "text", CSV needs a
+// header with a "text" and optionally an "id" column. Rows without an id are
+// numbered by their line, or CSV record, starting from 1
+func readJobRows(in *os.File, format string, from jobPosition, fn func(jobRow, jobPosition) error) error {
+	if format == jobFormatCSV {
+		return readCSVRows(in, from, fn)
+	}
+
+	if _, err := in.Seek(from.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(in)
+	position := from
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		position.Offset += int64(len(line))
+		if len(line) > 0 {
+			position.Line++
+		}
+		if trimmed := strings.TrimSpace(string(line)); trimmed != "" {
+			var row jobRow
+			if err := json.Unmarshal([]byte(trimmed), &row); err != nil {
+				return fmt.Errorf("line %d: %v", position.Line, err)
+			}
+			if row.ID == nil {
+				row.ID = json.RawMessage(strconv.Itoa(position.Line))
+			}
+			if err := fn(row, position); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func readCSVRows(in *os.File, from jobPosition, fn func(jobRow, jobPosition) error) error {
+	reader := csv.NewReader(in)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	idColumn, textColumn := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "id":
+			idColumn = i
+		case "text":
+			textColumn = i
+		}
+	}
+	if textColumn < 0 {
+		return fmt.Errorf("header has no 'text' column")
+	}
+
+	position := from
+	if position.Offset == 0 {
+		position.Offset = reader.InputOffset()
+	}
+	if _, err := in.Seek(position.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	start := position.Offset
+	reader = csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		position.Offset = start + reader.InputOffset()
+		position.Line++
+
+		var row jobRow
+		if textColumn < len(record) {
+			row.Text = record[textColumn]
+		}
+		if idColumn >= 0 && idColumn < len(record) {
+			row.ID, _ = json.Marshal(record[idColumn])
+		} else {
+			row.ID = json.RawMessage(strconv.Itoa(position.Line))
+		}
+		if err := fn(row, position); err != nil {
+			return err
+		}
+	}
+}
+
+// jobsHandler serves POST /jobs, GET and DELETE /jobs/{id},
+// GET /jobs/{id}/results and GET /jobs/{id}/ids
+func (vtcrzr *Vectorizer) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if path == "" {
+		vtcrzr.submitJob(w, r)
+		return
+	}
+
+	id, action, _ := strings.Cut(path, "/")
+	j := vtcrzr.jobs.get(id)
+	if j == nil {
+		http.Error(w, "Unknown job "+id, http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			writeJobStatus(w, http.StatusOK, j.snapshot())
+		case http.MethodDelete:
+			vtcrzr.jobs.remove(j)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case "results", "ids":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		jobResults(w, r, j, action == "ids")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// submitJob spools the multipart upload to disk and queues it. The form takes
+// the input in the "file" part, the options of the vectorize endpoint as JSON
+// in the "options" part and the input "format", which otherwise follows the
+// file extension, and the "output" format of the results
+func (vtcrzr *Vectorizer) submitJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Failed to parse multipart form "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := vtcrzr.jobs.create()
+	if err != nil {
+		http.Error(w, "Failed to create job "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	submitted := false
+	defer func() {
+		if !submitted {
+			os.RemoveAll(j.dir)
+		}
+	}()
+
+	var requestBody vectorizeRequest
+	var format, output, filename string
+	var uploaded bool
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Failed to parse multipart form "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "file":
+			filename = part.FileName()
+			n, err := spool(filepath.Join(j.dir, jobInputFile), part)
+			if err != nil {
+				http.Error(w, "Failed to store file "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			j.status.InputBytes = n
+			uploaded = true
+		case "options":
+			if err := decodeRequest(part, &requestBody, vtcrzr.requestVersion); err != nil {
+				http.Error(w, "Failed to decode options "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		case "format", "output", "sink":
+			b, err := io.ReadAll(io.LimitReader(part, 16))
+			if err != nil {
+				http.Error(w, "Failed to parse multipart form "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			value := strings.ToLower(strings.TrimSpace(string(b)))
+			switch part.FormName() {
+			case "format":
+				format = value
+			case "output":
+				output = value
+			default:
+				if j.status.Sink, err = strconv.ParseBool(value); err != nil {
+					http.Error(w, "Invalid options sink "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+	}
+	if !uploaded {
+		http.Error(w, "Missing 'file' part", http.StatusBadRequest)
+		return
+	}
+
+	if format == "" {
+		format = jobFormatJSONL
+		if strings.EqualFold(filepath.Ext(filename), ".csv") {
+			format = jobFormatCSV
+		}
+	}
+	if format != jobFormatJSONL && format != jobFormatCSV {
+		http.Error(w, "Invalid options format must be jsonl or csv", http.StatusBadRequest)
+		return
+	}
+	j.status.Format = format
+
+	if output == "" {
+		output = jobOutputJSONL
+	}
+	if output != jobOutputJSONL && output != jobOutputArrow && output != jobOutputNpy {
+		http.Error(w, "Invalid options output must be jsonl, arrow or npy", http.StatusBadRequest)
+		return
+	}
+	j.status.Output = output
+
+	if j.status.Sink && vtcrzr.sink == nil {
+		http.Error(w, "Invalid options sink is not configured", http.StatusBadRequest)
+		return
+	}
+
+	if requestBody.Encoding != nil && *requestBody.Encoding != encodingFloat {
+		http.Error(w, "Invalid options encoding is not supported by jobs, use output instead", http.StatusBadRequest)
+		return
+	}
+	j.opts, err = requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j.opts.tenant = tenantOf(r)
+
+	if err := vtcrzr.jobs.submit(j); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errTooManyJobs) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "Failed to submit job "+err.Error(), status)
+		return
+	}
+	submitted = true
+
+	w.Header().Set("Location", "/jobs/"+j.status.ID)
+	writeJobStatus(w, http.StatusAccepted, j.snapshot())
+}
+
+// spool copies r to a new file at path
+func spool(path string, r io.Reader) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	return n, f.Close()
+}
+
+// jobResults sends the results file of a finished job, or the ids of npy
+// results
+func jobResults(w http.ResponseWriter, r *http.Request, j *job, ids bool) {
+	status := j.snapshot()
+	if status.Status != jobDone {
+		http.Error(w, "Job is "+status.Status, http.StatusConflict)
+		return
+	}
+
+	name := jobResultsFile(status.Output)
+	contentType := "application/x-ndjson"
+	switch {
+	case ids && status.Output != jobOutputNpy:
+		http.Error(w, "Ids are only separate from npy results", http.StatusNotFound)
+		return
+	case ids:
+		name, contentType = jobIDsFile, "text/plain; charset=utf-8"
+	case status.Output == jobOutputArrow:
+		contentType = "application/vnd.apache.arrow.stream"
+	case status.Output == jobOutputNpy:
+		contentType = "application/octet-stream"
+	}
+
+	f, err := os.Open(filepath.Join(j.dir, name))
+	if err != nil {
+		http.Error(w, "Failed to open results "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, name, *status.Finished, f)
+}
+
+func writeJobStatus(w http.ResponseWriter, code int, status jobStatus) {
+	response, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// limiterConfig bounds the requests an endpoint processes at once
+type limiterConfig struct {
+	// Concurrency is the number of requests processed at the same time
+	Concurrency int
+	// Queue is the number of requests waiting for a slot, further requests
+	// are rejected right away
+	Queue int
+	// Wait is how long a queued request waits for a slot before it is rejected
+	Wait time.Duration
+	// DegradeQueued is the number of queued requests from which requests
+	// are degraded, 0 disables it
+	DegradeQueued int
+	// DegradeLatency is the average latency from which requests are
+	// degraded, 0 disables it
+	DegradeLatency time.Duration
+	// DegradeMaxTokens caps the tokens of every text of a degraded request
+	DegradeMaxTokens int
+}
+
+func limiterConfigFromEnv() (limiterConfig, error) {
+	config := limiterConfig{
+		Concurrency:      4 * runtime.NumCPU(),
+		Wait:             time.Second,
+		DegradeMaxTokens: 1000,
+	}
+	config.Queue = config.Concurrency
+	for _, err := range []error{
+		envInt("VECTORIZER_MAX_CONCURRENT", &config.Concurrency),
+		envInt("VECTORIZER_MAX_QUEUED", &config.Queue),
+		envDuration("VECTORIZER_QUEUE_TIMEOUT", &config.Wait),
+		envInt("VECTORIZER_DEGRADE_QUEUED", &config.DegradeQueued),
+		envDuration("VECTORIZER_DEGRADE_LATENCY", &config.DegradeLatency),
+		envInt("VECTORIZER_DEGRADE_MAX_TOKENS", &config.DegradeMaxTokens),
+	} {
+		if err != nil {
+			return config, err
+		}
+	}
+	if config.Concurrency < 1 || config.Queue < 0 || config.Wait < 0 ||
+		config.DegradeQueued < 0 || config.DegradeLatency < 0 || config.DegradeMaxTokens < 1 {
+		return config, fmt.Errorf("invalid concurrency limits %+v", config)
+	}
+	return config, nil
+}
+
+// limiter sheds the load of an endpoint beyond its concurrency and queue,
+// so latency stays bounded when the database or the CPU saturates
+type limiter struct {
+	endpoint string
+	slots    chan struct{}
+	// waiting admits the requests in the queue and those holding a slot
+	waiting chan struct{}
+	wait    time.Duration
+	config  limiterConfig
+
+	queued atomic.Int64
+	shed   atomic.Uint64
+	// latency is the moving average of the request latency in nanoseconds
+	latency  atomic.Int64
+	degraded atomic.Uint64
+}
+
+func newLimiter(endpoint string, config limiterConfig) *limiter {
+	return &limiter{
+		endpoint: endpoint,
+		slots:    make(chan struct{}, config.Concurrency),
+		waiting:  make(chan struct{}, config.Concurrency+config.Queue),
+		wait:     config.Wait,
+		config:   config,
+	}
+}
+
+// limit runs next within the limits, rejecting requests with 503 and a
+// Retry-After header once the queue is full or the wait is over
+func (l *limiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.waiting <- struct{}{}:
+		default:
+			l.reject(w)
+			return
+		}
+		defer func() { <-l.waiting }()
+
+		l.queued.Add(1)
+		timer := time.NewTimer(l.wait)
+		select {
+		case l.slots <- struct{}{}:
+			timer.Stop()
+			l.queued.Add(-1)
+		case <-timer.C:
+			l.queued.Add(-1)
+			l.reject(w)
+			return
+		case <-r.Context().Done():
+			timer.Stop()
+			l.queued.Add(-1)
+			return
+		}
+		defer func() { <-l.slots }()
+
+		if l.overloaded() {
+			l.degraded.Add(1)
+			r = r.WithContext(context.WithValue(r.Context(), degradedKey{}, l.config.DegradeMaxTokens))
+		}
+		start := time.Now()
+		next(w, r)
+		l.observe(time.Since(start))
+	}
+}
+
+// overloaded reports whether requests should take the cheaper path
+func (l *limiter) overloaded() bool {
+	if l.config.DegradeQueued > 0 && l.queued.Load() >= int64(l.config.DegradeQueued) {
+		return true
+	}
+	return l.config.DegradeLatency > 0 && time.Duration(l.latency.Load()) >= l.config.DegradeLatency
+}
+
+// observe adds the latency of a request to the moving average
+func (l *limiter) observe(d time.Duration) {
+	for {
+		old := l.latency.Load()
+		avg := old + (int64(d)-old)/10
+		if old == 0 {
+			avg = int64(d)
+		}
+		if l.latency.CompareAndSwap(old, avg) {
+			return
+		}
+	}
+}
+
+// degradedKey is the context key marking degraded requests, its value is
+// the token cap
+type degradedKey struct{}
+
+// degraded switches opts to the cheaper path if the request was degraded by
+// its limiter and reports whether it did. It also accounts the tokens of opts
+// to the tenant of the request
+func (*Vectorizer) degraded(r *http.Request, opts *vectorizeOptions) bool {
+	opts.tenant = tenantOf(r)
+	maxTokens, ok := r.Context().Value(degradedKey{}).(int)
+	if ok {
+		*opts = opts.degrade(maxTokens)
+	}
+	return ok
+}
+
+func (l *limiter) reject(w http.ResponseWriter) {
+	l.shed.Add(1)
+	retry := int(math.Ceil(l.wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	http.Error(w, "Server overloaded, retry later", http.StatusServiceUnavailable)
+}
+
+// limiters are the limiters of all endpoints
+type limiters []*limiter
+
+// limit bounds the concurrency of an endpoint with its own limiter
+func (vtcrzr *Vectorizer) limit(endpoint string, config limiterConfig, next http.HandlerFunc) http.HandlerFunc {
+	l := newLimiter(endpoint, config)
+	vtcrzr.limiters = append(vtcrzr.limiters, l)
+	return l.limit(next)
+}
+
+func (ls limiters) writeMetrics(m *metricsWriter) {
+	m.family("vectorizer_requests_in_flight", "gauge", "Requests being processed")
+	for _, l := range ls {
+		m.sample("vectorizer_requests_in_flight", float64(len(l.slots)), "endpoint", l.endpoint)
+	}
+	m.family("vectorizer_requests_queued", "gauge", "Requests waiting for a slot")
+	for _, l := range ls {
+		m.sample("vectorizer_requests_queued", float64(l.queued.Load()), "endpoint", l.endpoint)
+	}
+	m.family("vectorizer_requests_shed_total", "counter", "Requests rejected because the endpoint was overloaded")
+	for _, l := range ls {
+		m.sample("vectorizer_requests_shed_total", float64(l.shed.Load()), "endpoint", l.endpoint)
+	}
+	m.family("vectorizer_requests_degraded_total", "counter", "Requests processed on the cheaper path because the endpoint was overloaded")
+	for _, l := range ls {
+		m.sample("vectorizer_requests_degraded_total", float64(l.degraded.Load()), "endpoint", l.endpoint)
+	}
+	m.family("vectorizer_request_latency_seconds", "gauge", "Moving average of the request latency")
+	for _, l := range ls {
+		m.sample("vectorizer_request_latency_seconds", time.Duration(l.latency.Load()).Seconds(), "endpoint", l.endpoint)
+	}
+}
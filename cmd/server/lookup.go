@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// steps of the lookup pipeline resolving a word to a vector
+const (
+	// stepExact looks up the word as it is
+	stepExact = "exact"
+	// stepLowercase looks up the lowercase word, then the word the index of
+	// the database maps its lowercase to, "nasa" as "NASA"
+	stepLowercase = "lowercase"
+	// stepFold looks up the word without diacritics, "café" as "cafe",
+	// then the word the index maps its folded form to, "cafe" as "café"
+	stepFold = "fold"
+	// stepStem looks up the word without an inflection suffix, "walked" as
+	// "walk"
+	stepStem = "stem"
+	// stepSpell looks up the words one edit away, "recieve" as "receive"
+	stepSpell = "spell"
+	// stepSubword averages two known words the word is made of,
+	// "sunflower" as "sun" and "flower"
+	stepSubword = "subword"
+	// stepContext synthesizes a vector from the context of the word, see
+	// synthesizeOOV. It can only be the last step
+	stepContext = "context"
+)
+
+// defaultLookupPipeline is the pipeline before it was configurable
+const defaultLookupPipeline = "exact,lowercase,context"
+
+// spell correction is limited to words of these lengths, shorter words are
+// one edit away from too many others and longer ones take too many reads
+const (
+	minSpellRunes = 4
+	maxSpellRunes = 12
+)
+
+// minSubwordRunes is the shortest part a word is split into
+const minSubwordRunes = 3
+
+// lookupStep returns the vector of word in db by one strategy, nil if it
+// has none
+type lookupStep func(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error)
+
+var lookupSteps = map[string]lookupStep{
+	stepExact: func(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+		return vtcrzr.readVector(db, word, timing)
+	},
+	stepLowercase: func(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+		if lower := strings.ToLower(word); lower != word {
+			vector, err := vtcrzr.readVector(db, lower, timing)
+			if vector != nil || err != nil {
+				return vector, err
+			}
+		}
+		return vtcrzr.readIndexed(db, pkg.IndexLowercaseKey(word), word, timing)
+	},
+	stepFold: func(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+		vector, err := vtcrzr.readFirst(db, timing, foldCandidates(word))
+		if vector != nil || err != nil {
+			return vector, err
+		}
+		return vtcrzr.readIndexed(db, pkg.IndexFoldKey(word), word, timing)
+	},
+	stepStem: func(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+		return vtcrzr.readFirst(db, timing, stemCandidates(word))
+	},
+	stepSpell: func(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+		return vtcrzr.readFirst(db, timing, spellCandidates(word))
+	},
+	stepSubword: (*Vectorizer).subwordVector,
+}
+
+// lookupPipeline is the ordered list of steps of VECTORIZER_LOOKUP_PIPELINE,
+// tried until one finds a vector
+type lookupPipeline struct {
+	steps []string
+	// context is set if the pipeline ends with stepContext
+	context bool
+	// normalization names the pipeline in the keys of the vector cache
+	normalization string
+	// resolved counts the words every step found a vector for, misses
+	// those none did
+	resolved map[string]*atomic.Uint64
+	misses   atomic.Uint64
+}
+
+func lookupPipelineFromEnv() (*lookupPipeline, error) {
+	spec := os.Getenv("VECTORIZER_LOOKUP_PIPELINE")
+	if spec == "" {
+		spec = defaultLookupPipeline
+	}
+	p, err := newLookupPipeline(spec)
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_LOOKUP_PIPELINE: %w", err)
+	}
+	return p, nil
+}
+
+func newLookupPipeline(spec string) (*lookupPipeline, error) {
+	p := &lookupPipeline{resolved: map[string]*atomic.Uint64{}}
+	names := strings.Split(spec, ",")
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if _, ok := p.resolved[name]; ok {
+			return nil, fmt.Errorf("step %q repeated", name)
+		}
+		p.resolved[name] = new(atomic.Uint64)
+		if name == stepContext {
+			if i != len(names)-1 {
+				return nil, fmt.Errorf("step %q must be the last", stepContext)
+			}
+			p.context = true
+			continue
+		}
+		if lookupSteps[name] == nil {
+			return nil, fmt.Errorf("unknown step %q", name)
+		}
+		p.steps = append(p.steps, name)
+	}
+	if len(p.steps) == 0 {
+		return nil, fmt.Errorf("no lookup steps")
+	}
+	p.normalization = "pipeline:" + strings.Join(p.steps, ",")
+	if p.normalization == "pipeline:exact,lowercase" {
+		// cache snapshots written before the pipeline stay valid
+		p.normalization = normCaseFallback
+	}
+	return p, nil
+}
+
+// manifestName returns the steps for the manifest, empty for the default
+// pipeline so earlier manifests keep their hashes
+func (p *lookupPipeline) manifestName() string {
+	name := strings.Join(p.steps, ",")
+	if p.context {
+		name += "," + stepContext
+	}
+	if name == defaultLookupPipeline {
+		return ""
+	}
+	return name
+}
+
+// resolve runs the steps on word until one finds a vector
+func (p *lookupPipeline) resolve(vtcrzr *Vectorizer, db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+	for _, name := range p.steps {
+		vector, err := lookupSteps[name](vtcrzr, db, word, timing)
+		if err != nil {
+			return nil, err
+		}
+		if vector != nil {
+			p.resolved[name].Add(1)
+			return vector, nil
+		}
+	}
+	p.misses.Add(1)
+	return nil, nil
+}
+
+func (p *lookupPipeline) writeMetrics(m *metricsWriter) {
+	name := "vectorizer_lookup_resolved_total"
+	m.family(name, "counter", "Number of words missing from the cache each step of the lookup pipeline found a vector for")
+	for _, step := range append(append([]string{}, p.steps...), stepContext) {
+		if resolved, ok := p.resolved[step]; ok {
+			m.sample(name, float64(resolved.Load()), "step", step)
+		}
+	}
+	m.counter("vectorizer_lookup_misses_total", "Number of words missing from the cache no step of the lookup pipeline found a vector for", float64(p.misses.Load()))
+}
+
+// readVector reads the vector stored for word in db, nil if there is none
+func (vtcrzr *Vectorizer) readVector(db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+	value, err := db.store.Get([]byte(word))
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start := timing.now()
+	vector, err := decodeVector(value)
+	timing.add(phaseDecode, start)
+	if err != nil {
+		return nil, err
+	}
+	return vtcrzr.nonFinite.stored(word, vector), nil
+}
+
+// readIndexed reads the vector of the word the index of db maps key to, nil
+// if db has no index, key no entry or it maps to word itself
+func (vtcrzr *Vectorizer) readIndexed(db *servedDB, key []byte, word string, timing *requestTiming) (*pkg.Vector, error) {
+	indexed, err := db.store.indexed(key)
+	if indexed == "" || indexed == word || err != nil {
+		return nil, err
+	}
+	return vtcrzr.readVector(db, indexed, timing)
+}
+
+// readFirst returns the vector of the first of candidates stored in db
+func (vtcrzr *Vectorizer) readFirst(db *servedDB, timing *requestTiming, candidates []string) (*pkg.Vector, error) {
+	for _, candidate := range candidates {
+		vector, err := vtcrzr.readVector(db, candidate, timing)
+		if vector != nil || err != nil {
+			return vector, err
+		}
+	}
+	return nil, nil
+}
+
+// foldCandidates returns word without diacritics, with its capital and
+// lowercase
+func foldCandidates(word string) []string {
+	lower := strings.ToLower(word)
+	folded := pkg.FoldDiacritics(lower)
+	if folded == lower {
+		return nil
+	}
+	var candidates []string
+	// keep the capital of names like "Zürich"
+	if first, _ := utf8.DecodeRuneInString(word); unicode.IsUpper(first) {
+		r, size := utf8.DecodeRuneInString(folded)
+		candidates = append(candidates, string(unicode.ToUpper(r))+folded[size:])
+	}
+	return append(candidates, folded)
+}
+
+// stemSuffixes are the inflection suffixes stripped by stepStem with their
+// replacements, in the order they are tried
+var stemSuffixes = [][2]string{
+	{"ies", "y"}, {"ing", ""}, {"ing", "e"}, {"ness", ""}, {"ment", ""},
+	{"es", ""}, {"ed", ""}, {"ed", "e"}, {"ly", ""}, {"s", ""},
+}
+
+// stemCandidates returns the lowercase word without an inflection suffix.
+// It is a light suffix stripper for English, not a full stemmer
+func stemCandidates(word string) []string {
+	lower := strings.ToLower(word)
+	if !isLetters(lower) {
+		return nil
+	}
+	var candidates []string
+	for _, suffix := range stemSuffixes {
+		stem, ok := strings.CutSuffix(lower, suffix[0])
+		if !ok || utf8.RuneCountInString(stem) < 3 {
+			continue
+		}
+		candidates = append(candidates, stem+suffix[1])
+		// "running" to "run"
+		if n := len(stem); suffix[1] == "" && n >= 2 && stem[n-1] == stem[n-2] {
+			candidates = append(candidates, stem[:n-1])
+		}
+	}
+	return candidates
+}
+
+// spellCandidates returns the lowercase words one edit away from word:
+// transpositions first, the most common typos, then deletions,
+// substitutions and insertions
+func spellCandidates(word string) []string {
+	lower := []rune(strings.ToLower(word))
+	if len(lower) < minSpellRunes || len(lower) > maxSpellRunes || !isLetters(string(lower)) {
+		return nil
+	}
+	const alphabet = "abcdefghijklmnopqrstuvwxyz"
+	var candidates []string
+	edit := func(runes []rune) {
+		candidates = append(candidates, string(runes))
+	}
+	for i := 0; i+1 < len(lower); i++ {
+		if lower[i] != lower[i+1] {
+			runes := append([]rune{}, lower...)
+			runes[i], runes[i+1] = runes[i+1], runes[i]
+			edit(runes)
+		}
+	}
+	for i := range lower {
+		edit(append(append([]rune{}, lower[:i]...), lower[i+1:]...))
+	}
+	for i := range lower {
+		for _, r := range alphabet {
+			if r != lower[i] {
+				runes := append([]rune{}, lower...)
+				runes[i] = r
+				edit(runes)
+			}
+		}
+	}
+	for i := 0; i <= len(lower); i++ {
+		for _, r := range alphabet {
+			runes := append(append(append([]rune{}, lower[:i]...), r), lower[i:]...)
+			edit(runes)
+		}
+	}
+	return candidates
+}
+
+// subwordVector returns the average of the vectors of the two known words
+// the lowercase word is made of, trying the most even splits first
+func (vtcrzr *Vectorizer) subwordVector(db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+	lower := []rune(strings.ToLower(word))
+	if len(lower) < 2*minSubwordRunes || !isLetters(string(lower)) {
+		return nil, nil
+	}
+	mid := len(lower) / 2
+	var splits []int
+	for d := 0; d <= mid; d++ {
+		for _, i := range []int{mid - d, mid + d} {
+			if i >= minSubwordRunes && i <= len(lower)-minSubwordRunes && (d > 0 || len(splits) == 0) {
+				splits = append(splits, i)
+			}
+		}
+	}
+
+	for _, i := range splits {
+		head, err := vtcrzr.readVector(db, string(lower[:i]), timing)
+		if err != nil {
+			return nil, err
+		}
+		if head == nil {
+			continue
+		}
+		tail, err := vtcrzr.readVector(db, string(lower[i:]), timing)
+		if err != nil {
+			return nil, err
+		}
+		if tail == nil {
+			continue
+		}
+		headValues, tailValues := head.ToArray(), tail.ToArray()
+		mean := make([]float32, len(headValues))
+		for j := range mean {
+			mean[j] = (headValues[j] + tailValues[j]) / 2
+		}
+		vector := pkg.NewVector(mean)
+		return &vector, nil
+	}
+	return nil, nil
+}
+
+// isLetters reports whether word consists of letters only
+func isLetters(word string) bool {
+	for _, r := range word {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return word != ""
+}
@@ -1,78 +1,125 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"unicode"
 
 	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 // Vectorizer returns vectorized text
 type Vectorizer struct {
-	db        *leveldb.DB
-	stopWords map[string]int
+	// served is the database being served, replaced when another version
+	// is activated
+	served atomic.Pointer[servedDB]
+	// models holds the versions that can be activated, nil if the
+	// database isn't versioned
+	models    *modelRoot
+	stopwords *stopwordLists
+	entities  *gazetteer
+	redactor  *redactor
+	sessions  *sessionStore
+	fetcher   *urlFetcher
+	sentiment *sentimentModel
+	// bias is the bias direction of the debias option and /bias
+	bias     *biasAxis
+	jobs     *jobQueue
+	limiters limiters
+	// sink receives the vectors of bulk jobs, nil if not configured
+	sink *vectorSink
+	// maxUploadBytes limits the size of uploaded files
+	maxUploadBytes int64
+	// maxDedupeTexts limits the number of texts compared by a dedupe request
+	maxDedupeTexts int
+	// maxMatrixTexts limits the number of texts of a similarity matrix
+	maxMatrixTexts int
+	vocab          vocabConfig
+	// usage authenticates API keys, nil if they are disabled
+	usage *usageMeter
+	// breaker stops reading the database while it keeps failing
+	breaker *breaker
+	// reporter receives the recovered panics, nil if not configured
+	reporter *errorReporter
+	panics   atomic.Uint64
+	// coalescer shares vectorizations between identical concurrent
+	// requests, nil if disabled
+	coalescer *coalescer
+	// graph serves the precomputed nearest neighbors, nil if not
+	// configured
+	graph *knnGraph
+	// blocklist filters the words of /neighbors and /expand, nil if not
+	// configured
+	blocklist *wordBlocklist
+	// neighborCache keeps the results of /neighbors, nil if disabled
+	neighborCache *neighborCache
+	// aliases are the additional models and ensembles requests can select,
+	// nil if none are configured
+	aliases *modelAliases
+	// serverTiming reports the durations of the phases of /vectorize
+	// requests in the Server-Timing header
+	serverTiming bool
+	// emptyInput is how /vectorize answers requests without any text, see
+	// VECTORIZER_EMPTY_INPUT
+	emptyInput string
+	// fallback answers requests without any known word, nil if they fail
+	fallback *fallbackVector
+	// signer signs the vectors of /vectorize responses, nil if they aren't
+	// signed
+	signer *responseSigner
+	// tokens caches the vectors of words of every model served
+	tokens *tokenCache
+	// results caches the vectorizations of requests on disk, nil if
+	// disabled
+	results *resultCache
+	// nonFinite checks vectors for NaN and infinite values
+	nonFinite *nonFiniteGuard
+	// segment exports the vectors to shared memory, nil if not configured
+	segment *segmentExporter
+	// oov counts the out of vocabulary tokens of the default model, nil if
+	// disabled
+	oov *oovLog
+	// lookups resolves words to vectors
+	lookups *lookupPipeline
+	// simhash signs vectors with their simhash
+	simhash *simHasher
+	// pq quantizes vectors with a product quantization codebook, nil
+	// without one
+	pq *pqEncoder
+	// requestVersion is the schema version of requests without "v"
+	requestVersion int
+	defaults       vectorizeOptions
 }
 
 var (
-	// basic English stopwords
-	stopWords = []string{
-		"the",
-		"an",
-		"of",
-		"in",
-		"and",
-		"to",
-		"was",
-		"is",
-		"for",
-		"on",
-		"as",
-		"a",
-		"b",
-		"c",
-		"d",
-		"e",
-		"f",
-		"g",
-		"h",
-		"i",
-		"j",
-		"k",
-		"l",
-		"m",
-		"n",
-		"o",
-		"p",
-		"q",
-		"r",
-		"s",
-		"t",
-		"u",
-		"v",
-		"w",
-		"x",
-		"y",
-		"z",
-	}
 	v *Vectorizer
 )
 
 // initDB initializes the LevelDB database in read-only mode
-func initDB(dbPath string) (*leveldb.DB, error) {
+func initDB(dbPath string, tuning levelDBTuning) (*leveldb.DB, error) {
 	opts := &opt.Options{
-		ReadOnly: true,
+		ReadOnly:               true,
+		BlockCacheCapacity:     tuning.BlockCacheMB * opt.MiB,
+		OpenFilesCacheCapacity: tuning.OpenFiles,
+	}
+	if tuning.BloomBits > 0 {
+		opts.Filter = filter.NewBloomFilter(tuning.BloomBits)
 	}
 	db, err := leveldb.OpenFile(dbPath, opts)
 	if err != nil {
@@ -97,26 +144,438 @@ func main() {
 		log.Fatal("LevelDB path is required. Use -dbpath flag to provide it.")
 	}
 
-	db, err := initDB(dbPath)
+	tuning, err := levelDBTuningFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer func() {
-		db.Close()
-	}()
-	stopWordsMap := map[string]int{}
-	for _, word := range stopWords {
-		stopWordsMap[word] = 1
+	breaker, err := breakerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cache, err := tokenCacheFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config := dbConfig{tuning: tuning, cache: cache, verify: true, breaker: breaker}
+	if err := envBool("VECTORIZER_VERIFY_CHECKSUMS", &config.verify); err != nil {
+		log.Fatal(err)
+	}
+
+	replica, err := replicaFromEnv(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var modelsRoot string
+	if err := envString("VECTORIZER_MODELS_ROOT", &modelsRoot); err != nil {
+		log.Fatal(err)
+	}
+	var model string
+	if err := envString("MODEL", &model); err != nil {
+		log.Fatal(err)
+	}
+	if model != "" && model != demoModel {
+		log.Fatalf("unknown model %q, MODEL can only select %q", model, demoModel)
+	}
+	var models *modelRoot
+	var db *servedDB
+	switch {
+	case model == demoModel:
+		db, err = openDemoDB(config)
+	case replica != nil:
+		models = replica.root
+		db, err = replica.start()
+	case modelsRoot != "":
+		models = &modelRoot{dir: modelsRoot, config: config}
+		db, err = models.start()
+	default:
+		db, err = openServedDB(dbPath, "", config)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stopwords, err := stopwordListsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defaults, err := defaultOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaults.stopwords = stopwords
+
+	aliases, err := modelAliasesFromEnv(config, db.info.Dims)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaults.aliases = aliases
+	if err := defaults.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	entities := &gazetteer{}
+	if entitiesPath := os.Getenv("VECTORIZER_ENTITIES"); entitiesPath != "" {
+		entities, err = loadGazetteer(entitiesPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var redact bool
+	if err := envBool("VECTORIZER_REDACT", &redact); err != nil {
+		log.Fatal(err)
+	}
+	var redactor *redactor
+	if redact {
+		redactor, err = newRedactor(os.Getenv("VECTORIZER_REDACT_WORDS"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sessionTTL := 10 * time.Minute
+	if err := envDuration("VECTORIZER_SESSION_TTL", &sessionTTL); err != nil {
+		log.Fatal(err)
+	}
+	maxSessions := 1000
+	if err := envInt("VECTORIZER_MAX_SESSIONS", &maxSessions); err != nil {
+		log.Fatal(err)
+	}
+
+	fetcher, err := urlFetcherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sentiment, err := sentimentFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bias, err := biasAxisFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxUploadBytes := 20 << 20
+	if err := envInt("VECTORIZER_UPLOAD_MAX_BYTES", &maxUploadBytes); err != nil {
+		log.Fatal(err)
+	}
+
+	maxDedupeTexts := 1000
+	if err := envInt("VECTORIZER_DEDUPE_MAX_TEXTS", &maxDedupeTexts); err != nil {
+		log.Fatal(err)
+	}
+
+	maxMatrixTexts := 500
+	if err := envInt("VECTORIZER_MATRIX_MAX_TEXTS", &maxMatrixTexts); err != nil {
+		log.Fatal(err)
+	}
+
+	requestVersion := requestV1
+	if err := envInt("VECTORIZER_REQUEST_VERSION", &requestVersion); err != nil {
+		log.Fatal(err)
+	}
+	if requestVersion != requestV1 && requestVersion != requestV2 {
+		log.Fatalf("VECTORIZER_REQUEST_VERSION must be %d or %d", requestV1, requestV2)
+	}
+
+	vocab, err := vocabConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	usage, err := usageMeterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	segment, err := segmentExporterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reporter, err := errorReporterFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	nonFinite, err := nonFiniteGuardFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	oov, err := oovLogFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lookups, err := lookupPipelineFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	simhash, err := simHasherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pq, err := pqEncoderFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	coalescer, err := coalescerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results, err := resultCacheFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	graph, err := knnGraphFromEnv(db.info.Dims)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	blocklist, err := blocklistFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	neighborCache, err := neighborCacheFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var serverTiming bool
+	if err := envBool("VECTORIZER_SERVER_TIMING", &serverTiming); err != nil {
+		log.Fatal(err)
 	}
 
-	v = &Vectorizer{db: db, stopWords: stopWordsMap}
+	emptyInput, err := emptyInputFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fallback, err := fallbackVectorFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signer, err := responseSignerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobs, jobWorkers, err := jobQueueFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sink, err := sinkFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var respAddr string
+	if err := envString("VECTORIZER_RESP_ADDR", &respAddr); err != nil {
+		log.Fatal(err)
+	}
+	var respListener net.Listener
+	if respAddr != "" {
+		respListener, err = net.Listen("tcp", respAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var adminAddr string
+	if err := envString("VECTORIZER_ADMIN_ADDR", &adminAddr); err != nil {
+		log.Fatal(err)
+	}
+	var adminListener net.Listener
+	if adminAddr != "" {
+		adminListener, err = listen(adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	natsConsumer, err := natsConsumerFromEnv(usage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limits, err := limiterConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var cacheSnapshot string
+	if err := envString("VECTORIZER_CACHE_SNAPSHOT", &cacheSnapshot); err != nil {
+		log.Fatal(err)
+	}
+
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cacheSnapshot != "" {
+		n, err := db.cache.load(cacheSnapshot, db.info.Hash)
+		if err != nil {
+			log.Printf("ignoring cache snapshot: %v", err)
+		} else {
+			fmt.Printf("Loaded %d words from cache snapshot %s\n", n, cacheSnapshot)
+		}
+	}
+
+	v = &Vectorizer{
+		models:         models,
+		stopwords:      stopwords,
+		entities:       entities,
+		redactor:       redactor,
+		sessions:       newSessionStore(sessionTTL, maxSessions),
+		fetcher:        fetcher,
+		sentiment:      sentiment,
+		bias:           bias,
+		jobs:           jobs,
+		sink:           sink,
+		maxUploadBytes: int64(maxUploadBytes),
+		maxDedupeTexts: maxDedupeTexts,
+		maxMatrixTexts: maxMatrixTexts,
+		vocab:          vocab,
+		usage:          usage,
+		breaker:        breaker,
+		reporter:       reporter,
+		coalescer:      coalescer,
+		graph:          graph,
+		blocklist:      blocklist,
+		neighborCache:  neighborCache,
+		serverTiming:   serverTiming,
+		emptyInput:     emptyInput,
+		fallback:       fallback,
+		signer:         signer,
+		aliases:        aliases,
+		tokens:         cache,
+		results:        results,
+		nonFinite:      nonFinite,
+		segment:        segment,
+		oov:            oov,
+		lookups:        lookups,
+		simhash:        simhash,
+		pq:             pq,
+		requestVersion: requestVersion,
+		defaults:       defaults,
+	}
+	v.served.Store(db)
+	go v.recoverDB(config)
+	go segment.export(db)
+	if replica != nil {
+		go v.followSnapshots(replica)
+	}
+
+	for i := 0; i < jobWorkers; i++ {
+		go v.runJobs()
+	}
+
+	if respListener != nil {
+		go func() {
+			log.Fatal(v.serveRESP(respListener))
+		}()
+		fmt.Printf("Redis protocol listening on %s...\n", respAddr)
+	}
+	if natsConsumer != nil {
+		go v.consumeNATS(natsConsumer)
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		if err := usage.flush(); err != nil {
+			log.Printf("failed to store usage: %v", err)
+		}
+		jobs.close()
+		if cacheSnapshot != "" {
+			db := v.db()
+			if err := db.cache.save(cacheSnapshot, db.info.Hash); err != nil {
+				log.Fatalf("failed to save cache snapshot: %v", err)
+			}
+		}
+		os.Exit(0)
+	}()
 
 	http.HandleFunc("/health", v.healthHandler)
-	http.HandleFunc("/vectorize", v.vectorizeHandler)
+	http.HandleFunc("/readyz", v.readyHandler)
+	http.HandleFunc("/vectorize", v.limit("/vectorize", limits, spec.validated(v.vectorizeHandler)))
+	http.HandleFunc("/vectorize/url", v.limit("/vectorize/url", limits, spec.validated(v.vectorizeURLHandler)))
+	http.HandleFunc("/vectorize/file", v.limit("/vectorize/file", limits, v.vectorizeFileHandler))
+	http.HandleFunc("/centroid/", v.limit("/centroid/", limits, spec.validated(v.centroidHandler)))
+	http.HandleFunc("/dedupe", v.limit("/dedupe", limits, spec.validated(v.dedupeHandler)))
+	http.HandleFunc("/classify", v.limit("/classify", limits, spec.validated(v.classifyHandler)))
+	http.HandleFunc("/sentiment", v.limit("/sentiment", limits, spec.validated(v.sentimentHandler)))
+	http.HandleFunc("/bias", v.limit("/bias", limits, spec.validated(v.biasHandler)))
+	http.HandleFunc("/drift", v.limit("/drift", limits, spec.validated(v.driftHandler)))
+	http.HandleFunc("/wmd", v.limit("/wmd", limits, spec.validated(v.wmdHandler)))
+	http.HandleFunc("/similarity", v.limit("/similarity", limits, spec.validated(v.matrixHandler)))
+	http.HandleFunc("/vocab", v.vocabHandler)
+	http.HandleFunc("/vocab/", v.vocabHandler)
+	http.HandleFunc("/neighbors", v.neighborsHandler)
+	http.HandleFunc("/expand", v.limit("/expand", limits, spec.validated(v.expandHandler)))
+	http.HandleFunc("/jobs", v.jobsHandler)
+	http.HandleFunc("/jobs/", v.jobsHandler)
+	http.HandleFunc("/version", v.versionHandler)
+	http.HandleFunc("/signing-key", v.signingKeyHandler)
+	http.HandleFunc("/openapi.json", v.openAPIHandler)
+
+	// with an admin listener the metrics and the admin endpoints are only
+	// served there, probes work on both
+	admin := http.DefaultServeMux
+	if adminListener != nil {
+		admin = http.NewServeMux()
+		admin.HandleFunc("/health", v.healthHandler)
+		admin.HandleFunc("/readyz", v.readyHandler)
+	}
+	admin.HandleFunc("/metrics", v.metricsHandler)
+	admin.HandleFunc("/admin/dbstats", v.dbStatsHandler)
+	admin.HandleFunc("/admin/models", v.modelsHandler)
+	admin.HandleFunc("/admin/activate", v.activateHandler)
+	admin.HandleFunc("/admin/usage", v.usageHandler)
+	admin.HandleFunc("/admin/oov/top", v.oovTopHandler)
+	admin.HandleFunc("/admin/cache/flush", v.cacheFlushHandler)
+	if adminListener != nil {
+		go func() {
+			log.Fatal(http.Serve(adminListener, v.recoverPanics(usage.authenticate(admin))))
+		}()
+		fmt.Printf("Admin endpoints listening on %s...\n", adminAddr)
+	}
 
 	fmt.Printf("Server listening on port %d...\n", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), v.recoverPanics(usage.authenticate(http.DefaultServeMux))))
+}
+
+// listen listens on addr, a TCP address like 127.0.0.1:9877 or the path of
+// a Unix socket prefixed with unix:, replacing a socket left by an earlier
+// process
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
 }
 
 func (*Vectorizer) healthHandler(w http.ResponseWriter, _ *http.Request) {
@@ -125,78 +584,280 @@ func (*Vectorizer) healthHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 func (vtcrzr *Vectorizer) vectorizeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	var timing *requestTiming
+	if vtcrzr.serverTiming {
+		timing = newRequestTiming()
+	}
 
-	var requestBody map[string][]string
+	var requestBody vectorizeRequest
 
-	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	err := decodeVectorizeRequest(r, &requestBody, vtcrzr.requestVersion)
+	if err != nil && r.Method == http.MethodGet {
+		http.Error(w, "Invalid query "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	queryStrings, ok := requestBody["query"]
-	if !ok {
-		http.Error(w, "Missing 'query' field in request body", http.StatusBadRequest)
+	if err := requestBody.checkInput(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	empty := vtcrzr.emptyInput != emptyUnusable && requestBody.empty()
+	if empty && vtcrzr.emptyInput == emptyError {
+		writeEmptyInput(w)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+	opts.timing = timing
+
+	m, err := vtcrzr.manifest(opts)
+	if err != nil {
+		http.Error(w, "Failed to create manifest "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the encoding, the simhash and the codes change the response but not
+	// the vector
+	etagHash := m.Hash
+	if opts.Encoding != encodingFloat {
+		etagHash += " " + opts.Encoding
+	}
+	if opts.SimHashBits > 0 {
+		etagHash += " simhash " + strconv.Itoa(opts.SimHashBits)
+	}
+	if opts.PQ {
+		etagHash += " pq"
+	}
+	etag, err := vectorETag(etagHash, requestBody.input())
+	if err != nil {
+		http.Error(w, "Failed to create etag "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set(configHashHeader, m.Hash)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	vectorized, err := vtcrzr.Corpi(queryStrings)
+	// the etag covers the input and everything affecting the vector
+	var cached bool
+	vectorized, err, shared := vtcrzr.coalescer.do(etag, func() (*vectorization, error) {
+		if empty {
+			return emptyVectorization(m.Dims), nil
+		}
+		if vectorized, ok := vtcrzr.results.get(m.ModelHash, etag); ok {
+			cached = true
+			return vectorized, nil
+		}
+		vectorized, err := vtcrzr.vectorizeBody(&requestBody, opts)
+		if err != nil {
+			vectorized, err = vtcrzr.fallback.replace(vtcrzr, opts, err)
+		}
+		if err == nil {
+			vtcrzr.results.put(m.ModelHash, etag, vectorized)
+		}
+		return vectorized, err
+	})
 	if err != nil {
-		http.Error(w, "Failed to vectorize "+err.Error(), http.StatusBadRequest)
+		vectorizeError(w, err)
 		return
 	}
+	if shared || cached {
+		opts.tenant.addTokens(vectorized.quality.Tokens)
+	}
 
-	responseBody := make(map[string][]float32)
-	responseBody["vector"] = vectorized.ToArray()
+	start := timing.now()
+	responseBody := vectorizeResponse{
+		Vector:   newEncodedVector(vectorized.vector, opts),
+		Quality:  vectorized.quality,
+		Degraded: degraded,
+		Empty:    empty,
+		Fallback: vectorized.fallback,
+	}
+	if opts.Manifest {
+		responseBody.Manifest = m
+	}
+	responseBody.SimHash, err = vtcrzr.simhash.sign(responseBody.Vector.values, opts.SimHashBits)
+	if err != nil {
+		http.Error(w, "Failed to compute simhash "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseBody.PQ, err = vtcrzr.pq.encode(responseBody.Vector.values, opts.PQ)
+	if err != nil {
+		http.Error(w, "Failed to quantize vector "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseBody.Signature, err = vtcrzr.signer.sign(requestBody.input(), responseBody.Vector.values, m)
+	if err != nil {
+		http.Error(w, "Failed to sign response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 	response, err := json.Marshal(responseBody)
 	if err != nil {
 		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	timing.add(phaseSerialize, start)
+	timing.header(w)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(response)
 }
 
+// vectorizeError reports a failed vectorization, distinguishing corpora
+// without usable vocabulary and failed database reads from invalid requests
+func vectorizeError(w http.ResponseWriter, err error) {
+	if writeUnusableCorpus(w, err) {
+		return
+	}
+	if errors.Is(err, errReadFailed) {
+		http.Error(w, "Failed to vectorize "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errNonFinite) {
+		http.Error(w, "Failed to vectorize "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "Failed to vectorize "+err.Error(), http.StatusBadRequest)
+}
+
 func split(corpus string) []string {
 	return strings.FieldsFunc(corpus, func(c rune) bool {
 		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
 	})
 }
 
+// Corpi returns the centroid of the words of corpi with the server default
+// options
 func (vtcrzr *Vectorizer) Corpi(corpi []string) (*pkg.Vector, error) {
-	var (
-		corpusVectors []pkg.Vector
-		err           error
-	)
-	for i, corpus := range corpi {
-		parts := split(corpus)
+	res, err := vtcrzr.vectorize(corpi, vtcrzr.defaults)
+	if err != nil {
+		return nil, err
+	}
+	return res.vector, nil
+}
+
+// vectorization is the centroid of a corpus along with its quality
+type vectorization struct {
+	vector  *pkg.Vector
+	quality quality
+	// fallback is set if no word had a vector and vector is the fallback
+	fallback bool
+}
+
+// corpusVectors collects the vectors contributing to a centroid along with
+// the token counts used to judge its quality
+type corpusVectors struct {
+	vectors []pkg.Vector
+	weights []float32
+	// tokens counts the words that are looked up, i.e. all but stopwords
+	tokens int
+	// found counts the tokens that have a vector
+	found int
+	// oov holds the distinct tokens that have no vector, see appendOOV
+	oov []string
+}
+
+func (c *corpusVectors) add(vector pkg.Vector, weight float32) {
+	c.vectors = append(c.vectors, vector)
+	c.weights = append(c.weights, weight)
+}
+
+func (vtcrzr *Vectorizer) vectorize(corpi []string, opts vectorizeOptions) (*vectorization, error) {
+	if e := vtcrzr.aliases.ensemble(opts.Model); e != nil {
+		return vtcrzr.vectorizeEnsemble(e, opts, func(opts vectorizeOptions) (*vectorization, error) {
+			return vtcrzr.vectorize(corpi, opts)
+		})
+	}
+	vectorized, err := vtcrzr.pool(corpi, opts)
+	if err != nil {
+		return nil, err
+	}
+	return vtcrzr.finish(vectorized, opts)
+}
+
+// pool is vectorize without the projection, in the space of the model
+func (vtcrzr *Vectorizer) pool(corpi []string, opts vectorizeOptions) (*vectorization, error) {
+	corpus, err := vtcrzr.collect(corpi, opts)
+	if err != nil {
+		return nil, err
+	}
+	return vtcrzr.centroid(corpus, opts)
+}
+
+// collect gathers the vectors of all words in corpi
+func (vtcrzr *Vectorizer) collect(corpi []string, opts vectorizeOptions) (*corpusVectors, error) {
+	corpus := &corpusVectors{}
+	for i, text := range corpi {
+		start := opts.timing.now()
+		parts := tokenize(vtcrzr.preprocess(text, opts), opts)
+		opts.timing.add(phaseTokenize, start)
 		if len(parts) == 0 {
 			continue
 		}
+		if opts.MaxTokens > 0 && len(parts) > opts.MaxTokens {
+			parts = parts[:opts.MaxTokens]
+		}
 
-		corpusVectors, err = vtcrzr.vectors(parts)
+		start = opts.timing.now()
+		first := len(corpus.vectors)
+		err := vtcrzr.vectors(parts, opts, corpus)
+		opts.timing.add(phaseLookup, start)
 		if err != nil {
-			return nil, fmt.Errorf("at corpus %d: %v", i, err)
+			return nil, fmt.Errorf("at corpus %d: %w", i, err)
+		}
+		disambiguate(corpus.vectors[first:], corpus.weights[first:], opts.Disambiguation)
+		if recency := opts.recencyWeight(i, len(corpi)); recency != 1 {
+			for j := first; j < len(corpus.weights); j++ {
+				corpus.weights[j] *= recency
+			}
 		}
 	}
-	if len(corpusVectors) == 0 {
-		return nil, fmt.Errorf("no vectors found for corpus")
+	opts.tenant.addTokens(corpus.tokens)
+	return corpus, nil
+}
+
+// centroid computes the centroid of the collected vectors and checks its quality
+func (vtcrzr *Vectorizer) centroid(corpus *corpusVectors, opts vectorizeOptions) (*vectorization, error) {
+	defer opts.timing.add(phaseCentroid, opts.timing.now())
+	if len(corpus.vectors) == 0 {
+		return nil, &noVectorsError{tokens: corpus.tokens, oov: corpus.oov}
 	}
 
-	vector, err := computeCentroid(corpusVectors)
+	vector, err := computeCentroid(corpus.vectors, corpus.weights, opts.Accumulation)
+	if err != nil {
+		return nil, err
+	}
+	vector, err = vtcrzr.nonFinite.centroid(vector)
 	if err != nil {
 		return nil, err
 	}
 
-	return vector, nil
+	q := computeQuality(corpus, vector)
+	if q.Coverage < opts.MinCoverage {
+		return nil, &coverageError{coverage: q.Coverage, minCoverage: opts.MinCoverage, tokens: q.Tokens, oov: corpus.oov}
+	}
+
+	return &vectorization{vector: vector, quality: q}, nil
 }
 
-func computeCentroid(vectors []pkg.Vector) (*pkg.Vector, error) {
+// computeCentroid weighs every vector by its occurrence weight multiplied by
+// the matching boost, e.g. the configured weight of an n-gram
+func computeCentroid(vectors []pkg.Vector, boosts []float32, accumulation string) (*pkg.Vector, error) {
 	var occr = make([]uint64, len(vectors))
 
 	for i := 0; i < len(vectors); i++ {
@@ -206,8 +867,11 @@ func computeCentroid(vectors []pkg.Vector) (*pkg.Vector, error) {
 	if err != nil {
 		return nil, err
 	}
+	for i := range weights {
+		weights[i] *= boosts[i]
+	}
 
-	return ComputeWeightedCentroid(vectors, weights)
+	return computeWeightedCentroid(vectors, weights, accumulation)
 }
 
 func occurrencesToWeight(occs []uint64) ([]float32, error) {
@@ -248,6 +912,12 @@ func makeLogWeigher(min, max uint64) func(uint64) float32 {
 }
 
 func ComputeWeightedCentroid(vectors []pkg.Vector, weights []float32) (*pkg.Vector, error) {
+	return computeWeightedCentroid(vectors, weights, accumulateFloat32)
+}
+
+// computeWeightedCentroid is ComputeWeightedCentroid accumulating the sums
+// as accumulation says
+func computeWeightedCentroid(vectors []pkg.Vector, weights []float32, accumulation string) (*pkg.Vector, error) {
 
 	if len(vectors) == 0 {
 		return nil, fmt.Errorf("can not compute centroid of empty slice")
@@ -257,24 +927,22 @@ func ComputeWeightedCentroid(vectors []pkg.Vector, weights []float32) (*pkg.Vect
 		return &vectors[0], nil
 	} else {
 		vectorLen := vectors[0].Len()
-
-		var newVector = make([]float32, vectorLen)
-		var weightSum float32 = 0.0
-
-		for vectorI, v := range vectors {
+		for _, v := range vectors {
 			if v.Len() != vectorLen {
-				return nil, fmt.Errorf("vectors have different lengths", v.Len(), vectorLen)
-			}
-
-			weightSum += weights[vectorI]
-			vector := v.ToArray()
-			for i := 0; i < vectorLen; i++ {
-				newVector[i] += vector[i] * weights[vectorI]
+				return nil, fmt.Errorf("vectors have different lengths; %v vs %v", v.Len(), vectorLen)
 			}
 		}
 
-		for i := 0; i < vectorLen; i++ {
-			newVector[i] /= weightSum
+		var newVector []float32
+		switch accumulation {
+		case accumulateFloat64:
+			newVector = weightedMeanFloat64(vectors, weights)
+		case accumulateKahan:
+			newVector = weightedMeanKahan(vectors, weights)
+		case accumulateFixed:
+			newVector = weightedMeanFixed(vectors, weights)
+		default:
+			newVector = weightedMeanFloat32(vectors, weights)
 		}
 
 		result := pkg.NewVector(newVector)
@@ -282,21 +950,50 @@ func ComputeWeightedCentroid(vectors []pkg.Vector, weights []float32) (*pkg.Vect
 	}
 }
 
-func (vtcrzr *Vectorizer) getVectorForWord(word string) (*pkg.Vector, error) {
-	if _, ok := vtcrzr.stopWords[strings.ToLower(word)]; ok {
+// isStopWord reports whether word is a stopword of the language of opts
+func (vtcrzr *Vectorizer) isStopWord(word string, opts vectorizeOptions) bool {
+	return vtcrzr.stopwords.isStopWord(word, opts.Lang)
+}
+
+// skipWord reports whether word is filtered out or a stopword that is left
+// out of the centroid
+func (vtcrzr *Vectorizer) skipWord(word string, opts vectorizeOptions) bool {
+	return !opts.keepToken(word) || opts.SkipStopwords && vtcrzr.isStopWord(word, opts)
+}
+
+func (vtcrzr *Vectorizer) getVectorForWord(word string, opts vectorizeOptions) (*pkg.Vector, error) {
+	if vtcrzr.skipWord(word, opts) {
 		return nil, nil
 	}
-	var value []byte
-	value, err := vtcrzr.db.Get([]byte(word), nil)
-	if errors.Is(err, leveldb.ErrNotFound) {
-		value, err = vtcrzr.db.Get([]byte(strings.ToLower(word)), nil)
-		if err != nil {
-			return nil, nil
-		}
+	return vtcrzr.lookupIn(vtcrzr.modelDB(opts), word, opts.timing)
+}
+
+// lookup reads the vector of word in the default model, see
+// lookupPipeline. It returns nil if the word is not in the vocabulary
+func (vtcrzr *Vectorizer) lookup(word string) (*pkg.Vector, error) {
+	return vtcrzr.lookupIn(vtcrzr.db(), word, nil)
+}
+
+// lookupIn is lookup in db by the steps of the lookup pipeline, adding the
+// time spent decoding to timing
+func (vtcrzr *Vectorizer) lookupIn(db *servedDB, word string, timing *requestTiming) (*pkg.Vector, error) {
+	key := cacheKey(vtcrzr.lookups.normalization, word)
+	if vector, ok := db.cache.get(key); ok {
+		return vector, nil
 	}
 
-	vector := make([]float32, 300)
-	err = gob.NewDecoder(bytes.NewBuffer(value)).Decode(&vector)
+	vector, err := vtcrzr.lookups.resolve(vtcrzr, db, word, timing)
+	// failed reads are not cached, the word may be readable after a reopen
+	if err != nil {
+		return nil, err
+	}
+	db.cache.put(key, vector)
+	return vector, nil
+}
+
+// decodeVector decodes a gob encoded vector as stored in the database
+func decodeVector(value []byte) (*pkg.Vector, error) {
+	vector, err := pkg.DecodeVector(value)
 	if err != nil {
 		return nil, err
 	}
@@ -305,24 +1002,147 @@ func (vtcrzr *Vectorizer) getVectorForWord(word string) (*pkg.Vector, error) {
 	return &v, nil
 }
 
-func (vtcrzr *Vectorizer) vectors(words []string) ([]pkg.Vector, error) {
-	vectors := make([]pkg.Vector, len(words))
-	for wordPos := 0; wordPos < len(words); wordPos++ {
-		vector, err := vtcrzr.getVectorForWord(words[wordPos])
+// prefetch looks up the words concurrently across the shards of the store.
+// Words that are not in the vocabulary map to nil
+func (vtcrzr *Vectorizer) prefetch(words []string, opts vectorizeOptions) (map[string]*pkg.Vector, error) {
+	known := map[string]*pkg.Vector{}
+	var unique []string
+	for _, word := range words {
+		if _, ok := known[word]; ok || vtcrzr.skipWord(word, opts) {
+			continue
+		}
+		known[word] = nil
+		unique = append(unique, word)
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	db := vtcrzr.modelDB(opts)
+	db.store.parallel(unique, func(word string) {
+		vector, err := vtcrzr.lookupIn(db, word, opts.timing)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		known[word] = vector
+	})
+	return known, firstErr
+}
+
+// wordVectors returns the vector of word. Compound words that are not in the
+// vocabulary are resolved through their parts if the policy allows it
+func (vtcrzr *Vectorizer) wordVectors(word string, opts vectorizeOptions, known map[string]*pkg.Vector) ([]pkg.Vector, error) {
+	vector, ok := known[word]
+	if !ok {
+		var err error
+		vector, err = vtcrzr.getVectorForWord(word, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if vector != nil {
+		return []pkg.Vector{*vector}, nil
+	}
+	if opts.Compounds != compoundsBoth || !isCompound(word) {
+		return nil, nil
+	}
+
+	var vectors []pkg.Vector
+	for _, part := range split(word) {
+		vector, err := vtcrzr.getVectorForWord(part, opts)
 		if err != nil {
 			return nil, err
 		}
 		if vector != nil {
-			// this compound word exists, use its vector and occurrence
-			vectors[wordPos] = *vector
+			vectors = append(vectors, *vector)
 		}
 	}
+	return vectors, nil
+}
+
+func (vtcrzr *Vectorizer) vectors(words []string, opts vectorizeOptions, corpus *corpusVectors) error {
+	opts.Lang = vtcrzr.stopwords.resolve(opts.Lang, words)
+	var spans map[int]int
+	if opts.Entities {
+		spans = vtcrzr.entitySpans(words)
+	}
+
+	known, err := vtcrzr.prefetch(words, opts)
+	if err != nil {
+		return err
+	}
+	context := vtcrzr.newOOVContext(opts)
+
+	for wordPos := 0; wordPos < len(words); wordPos++ {
+		if end, ok := spans[wordPos]; ok {
+			vector, err := vtcrzr.phraseVector(words[wordPos:end], opts)
+			if err != nil {
+				return err
+			}
+			if vector != nil {
+				// the entity is kept as a single unit instead of its words
+				corpus.add(*vector, opts.EntityWeight*opts.positionWeight(wordPos))
+				tokens := vtcrzr.countTokens(words[wordPos:end], opts)
+				corpus.tokens += tokens
+				corpus.found += tokens
+				wordPos = end - 1
+				continue
+			}
+		}
+
+		if vtcrzr.skipWord(words[wordPos], opts) {
+			continue
+		}
+		corpus.tokens++
+
+		wordVectors, err := vtcrzr.wordVectors(words[wordPos], opts, known)
+		if err != nil {
+			return err
+		}
+		if len(wordVectors) > 0 {
+			corpus.found++
+			context.known(wordPos, wordVectors)
+		} else {
+			if normalizeModel(opts.Model) == "" {
+				vtcrzr.oov.record(vtcrzr.db().info.Hash, words[wordPos])
+			}
+			if context != nil {
+				// synthesized once the context after it is known too
+				context.unknown = append(context.unknown, wordPos)
+				continue
+			}
+			corpus.oov = appendOOV(corpus.oov, words[wordPos])
+		}
+		weight := opts.positionWeight(wordPos)
+		for _, vector := range wordVectors {
+			corpus.add(vector, weight)
+		}
+	}
+
+	if err := vtcrzr.synthesizeOOV(words, context, opts, corpus); err != nil {
+		return err
+	}
+
+	ngramVectors, err := vtcrzr.ngramVectors(words, opts)
+	if err != nil {
+		return err
+	}
+	for _, v := range ngramVectors {
+		corpus.add(v, opts.NGramWeight)
+	}
+	return nil
+}
 
-	finalVectors := []pkg.Vector{}
-	for _, v := range vectors {
-		if v.Len() > 0 {
-			finalVectors = append(finalVectors, v)
+// countTokens returns the number of words that are not skipped
+func (vtcrzr *Vectorizer) countTokens(words []string, opts vectorizeOptions) int {
+	n := 0
+	for _, word := range words {
+		if !vtcrzr.skipWord(word, opts) {
+			n++
 		}
 	}
-	return finalVectors, nil
+	return n
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// tokenizerVersion changes whenever tokenization changes in a way that
+	// affects vectors
+	tokenizerVersion = "1"
+	// weighting is the scheme used to weigh word vectors in the centroid
+	weighting = "uniform"
+)
+
+// modelInfo identifies the database being served
+type modelInfo struct {
+	// Hash covers the names and sizes of the database files, which are
+	// immutable once written
+	Hash string
+	// Dims is the dimensionality of the stored vectors
+	Dims int
+}
+
+// inspectModel hashes the files of all shards of the store and reads the
+// dimensionality of its first vector
+func inspectModel(s *store) (modelInfo, error) {
+	var info modelInfo
+
+	h := sha256.New()
+	for i, dbPath := range s.paths {
+		entries, err := os.ReadDir(dbPath)
+		if err != nil {
+			return info, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			// the lock and the info log change without the data changing
+			if entry.IsDir() || name == "LOCK" || strings.HasPrefix(name, "LOG") {
+				continue
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				return info, err
+			}
+			fmt.Fprintf(h, "%d %s %d\n", i, name, fi.Size())
+		}
+		current, err := os.ReadFile(filepath.Join(dbPath, "CURRENT"))
+		if err != nil {
+			return info, err
+		}
+		h.Write(current)
+	}
+	info.Hash = hex.EncodeToString(h.Sum(nil))
+
+	iter := s.shards[0].NewIterator(nil, nil)
+	defer iter.Release()
+	if iter.First() {
+		vector, err := decodeVector(iter.Value())
+		if err != nil {
+			return info, fmt.Errorf("decode %q: %v", iter.Key(), err)
+		}
+		info.Dims = vector.Len()
+	}
+	return info, iter.Error()
+}
+
+// hashWords returns a hash of the sorted words
+func hashWords(words []string) string {
+	sorted := append([]string{}, words...)
+	sort.Strings(sorted)
+	h := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// manifest describes everything that affected a vector, so pipelines can
+// prove two vectors were produced under identical settings
+type manifest struct {
+	// Hash covers all other fields
+	Hash             string `json:"hash"`
+	ModelHash        string `json:"model_hash"`
+	Dims             int    `json:"dims"`
+	Weighting        string `json:"weighting"`
+	TokenizerVersion string `json:"tokenizer_version"`
+	StopwordsHash    string `json:"stopwords_hash"`
+	EntitiesHash     string `json:"entities_hash,omitempty"`
+	RedactionHash    string `json:"redaction_hash,omitempty"`
+	// BiasHash identifies the seed pairs of the bias direction removed with
+	// the debias option
+	BiasHash string `json:"bias_hash,omitempty"`
+	// FallbackVector is VECTORIZER_FALLBACK_VECTOR and FallbackWord the
+	// word of its word policy, empty without a fallback vector
+	FallbackVector string `json:"fallback_vector,omitempty"`
+	FallbackWord   string `json:"fallback_word,omitempty"`
+	// LookupPipeline is VECTORIZER_LOOKUP_PIPELINE, empty for the default
+	LookupPipeline string           `json:"lookup_pipeline,omitempty"`
+	Options        vectorizeOptions `json:"options"`
+}
+
+func (vtcrzr *Vectorizer) manifest(opts vectorizeOptions) (*manifest, error) {
+	info := vtcrzr.modelInfo(opts)
+	m := &manifest{
+		ModelHash:        info.Hash,
+		Dims:             info.Dims,
+		Weighting:        weighting,
+		TokenizerVersion: tokenizerVersion,
+		StopwordsHash:    vtcrzr.stopwords.hash,
+		EntitiesHash:     vtcrzr.entities.hash,
+		LookupPipeline:   vtcrzr.lookups.manifestName(),
+		Options:          opts,
+	}
+	if vtcrzr.redactor != nil {
+		m.RedactionHash = vtcrzr.redactor.hash
+	}
+	if opts.Debias {
+		m.BiasHash = vtcrzr.bias.hash
+	}
+	if f := vtcrzr.fallback; f != nil {
+		m.FallbackVector = f.policy
+		if f.policy == fallbackWord {
+			m.FallbackWord = f.word
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	m.Hash = hex.EncodeToString(h[:])
+	return m, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+)
+
+// markup formats that can be stripped before tokenization
+const (
+	markupNone     = "none"
+	markupHTML     = "html"
+	markupMarkdown = "markdown"
+)
+
+var (
+	htmlComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	// htmlCode holds elements whose content is never readable text
+	htmlCode = regexp.MustCompile(`(?is)<(script|style|noscript|template)\b.*?</(script|style|noscript|template)\s*>`)
+	// htmlBoilerplate holds elements that usually contain navigation
+	htmlBoilerplate = regexp.MustCompile(`(?is)<(nav|header|footer|aside|form)\b.*?</(nav|header|footer|aside|form)\s*>`)
+	htmlTag         = regexp.MustCompile(`(?s)<[^>]*>`)
+
+	markdownFence     = regexp.MustCompile("(?m)^\\s*(```|~~~).*$")
+	markdownImage     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink      = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownReference = regexp.MustCompile(`(?m)^\s*\[[^\]]+\]:\s*\S+.*$`)
+	markdownAutolink  = regexp.MustCompile(`<(https?://|mailto:)[^>]*>`)
+	markdownBlock     = regexp.MustCompile(`(?m)^\s*(#{1,6}|>+|[-*+]|\d+[.)])\s+`)
+	markdownRule      = regexp.MustCompile(`(?m)^\s*([-*_]\s*){3,}$`)
+	markdownEmphasis  = regexp.MustCompile("[*_~`]+")
+)
+
+func validMarkup(markup string) error {
+	switch markup {
+	case markupNone, markupHTML, markupMarkdown:
+		return nil
+	default:
+		return fmt.Errorf("markup must be one of %q, %q or %q", markupNone, markupHTML, markupMarkdown)
+	}
+}
+
+// stripMarkup removes the syntax of the markup format from corpus so only
+// the readable text is tokenized
+func stripMarkup(corpus string, opts vectorizeOptions) string {
+	switch opts.Markup {
+	case markupHTML:
+		return stripHTML(corpus, opts.StripBoilerplate)
+	case markupMarkdown:
+		return stripMarkdown(corpus, opts.StripBoilerplate)
+	default:
+		return corpus
+	}
+}
+
+// stripHTML drops tags, comments and scripts and unescapes entities. With
+// boilerplate set navigation, headers, footers and forms are dropped as well
+func stripHTML(corpus string, boilerplate bool) string {
+	corpus = htmlComment.ReplaceAllString(corpus, " ")
+	corpus = htmlCode.ReplaceAllString(corpus, " ")
+	if boilerplate {
+		corpus = htmlBoilerplate.ReplaceAllString(corpus, " ")
+	}
+	corpus = htmlTag.ReplaceAllString(corpus, " ")
+	return html.UnescapeString(corpus)
+}
+
+// stripMarkdown keeps the text of links and images but drops their targets
+// along with emphasis, headings, lists and quotes. Markdown may embed HTML
+// which is stripped too
+func stripMarkdown(corpus string, boilerplate bool) string {
+	corpus = markdownFence.ReplaceAllString(corpus, " ")
+	corpus = markdownReference.ReplaceAllString(corpus, " ")
+	corpus = markdownImage.ReplaceAllString(corpus, "$1")
+	corpus = markdownLink.ReplaceAllString(corpus, "$1")
+	corpus = markdownAutolink.ReplaceAllString(corpus, " ")
+	corpus = markdownRule.ReplaceAllString(corpus, " ")
+	corpus = markdownBlock.ReplaceAllString(corpus, " ")
+	corpus = markdownEmphasis.ReplaceAllString(corpus, " ")
+	return stripHTML(corpus, boilerplate)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/metric"
+)
+
+// matrixWMD compares texts by the relaxed word mover's distance, the other
+// metrics compare their centroids, see pkg/metric
+const matrixWMD = "wmd"
+
+// matrixRequest is the body accepted by the similarity matrix endpoint. It
+// takes the options of the vectorize endpoint
+type matrixRequest struct {
+	Texts []string `json:"texts"`
+	// Metric is wmd, the relaxed word mover's distance, or a metric of
+	// pkg/metric comparing the centroids, cosine by default
+	Metric string `json:"metric"`
+	vectorizeRequest
+}
+
+// matrixResponse is the body returned by the similarity matrix endpoint
+type matrixResponse struct {
+	Metric string `json:"metric"`
+	// Matrix holds the value of the metric for every pair of texts. The rows
+	// and columns of skipped texts are null
+	Matrix [][]*float32 `json:"matrix"`
+	// Skipped holds the indexes of texts that could not be vectorized
+	Skipped  []int `json:"skipped,omitempty"`
+	Degraded bool  `json:"degraded,omitempty"`
+}
+
+// matrixHandler compares every pair of a list of texts, sparing clients a
+// request per pair
+func (vtcrzr *Vectorizer) matrixHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody matrixRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Texts == nil {
+		http.Error(w, "Missing 'texts' field in request body", http.StatusBadRequest)
+		return
+	}
+	if len(requestBody.Texts) > vtcrzr.maxMatrixTexts {
+		http.Error(w, fmt.Sprintf("Too many texts, at most %d are compared", vtcrzr.maxMatrixTexts), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if requestBody.Query != nil || requestBody.Fields != nil {
+		http.Error(w, "'query' and 'fields' are not supported when comparing texts", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Metric == "" {
+		requestBody.Metric = metric.Cosine
+	}
+	// m is nil for matrixWMD
+	var m metric.Metric
+	if requestBody.Metric != matrixWMD {
+		var err error
+		m, err = metric.Get(requestBody.Metric)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v or %q", err, matrixWMD), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	n := len(requestBody.Texts)
+	clouds := make([]*wordCloud, n)
+	prepared := make([][]float32, n)
+	parallel(n, func(i int) {
+		// texts that can't be vectorized are skipped
+		clouds[i], _ = vtcrzr.wordCloud(requestBody.Texts[i], opts)
+		if clouds[i] != nil && m != nil {
+			prepared[i] = m.Prepare(clouds[i].mean)
+		}
+	})
+
+	responseBody := matrixResponse{
+		Metric:   requestBody.Metric,
+		Matrix:   make([][]*float32, n),
+		Degraded: degraded,
+	}
+	values := make([]float32, n*n)
+	for i := range responseBody.Matrix {
+		responseBody.Matrix[i] = make([]*float32, n)
+		if clouds[i] == nil {
+			responseBody.Skipped = append(responseBody.Skipped, i)
+		}
+	}
+	parallel(n, func(i int) {
+		if clouds[i] == nil {
+			return
+		}
+		for j := i; j < n; j++ {
+			if clouds[j] == nil {
+				continue
+			}
+			var value float32
+			switch {
+			case m == nil && i == j:
+				value = 0
+			case m == nil:
+				value = float32(math.Max(clouds[i].relaxedDistance(clouds[j]), clouds[j].relaxedDistance(clouds[i])))
+			case i == j && m.Name() != metric.Dot:
+				// exactly, without the rounding of the distance
+				value = m.Score(0)
+			default:
+				value = m.Score(m.Distance(prepared[i], prepared[j]))
+			}
+			values[i*n+j], values[j*n+i] = value, value
+			responseBody.Matrix[i][j], responseBody.Matrix[j][i] = &values[i*n+j], &values[j*n+i]
+		}
+	})
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// parallel calls f for 0 to n-1 on a worker per CPU. Workers take the next
+// index when done, so uneven work like the rows of a triangle is balanced
+func parallel(n int, f func(i int)) {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// family starts a metric with the given type, samples follow with sample
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a value of the current family, labels alternate names and values
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		sort.Strings(pairs)
+		m.w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(m.w, " %g\n", value)
+}
+
+func (m *metricsWriter) counter(name, help string, value float64) {
+	m.family(name, "counter", help)
+	m.sample(name, value)
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.family(name, "gauge", help)
+	m.sample(name, value)
+}
+
+func (vtcrzr *Vectorizer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	db := vtcrzr.db()
+	if db.version != "" {
+		m.family("vectorizer_snapshot_info", "gauge", "Version of the snapshot being served")
+		m.sample("vectorizer_snapshot_info", 1, "version", db.version)
+	}
+	db.store.writeMetrics(m)
+	vtcrzr.breaker.writeMetrics(m)
+	m.counter("vectorizer_panics_total", "Number of panics recovered in handlers, Redis protocol connections, NATS messages and bulk jobs", float64(vtcrzr.panics.Load()))
+	vtcrzr.nonFinite.writeMetrics(m)
+	vtcrzr.coalescer.writeMetrics(m)
+	vtcrzr.results.writeMetrics(m)
+	db.cache.writeMetrics(m)
+	vtcrzr.limiters.writeMetrics(m)
+	vtcrzr.oov.writeMetrics(m)
+	vtcrzr.lookups.writeMetrics(m)
+	vtcrzr.fallback.writeMetrics(m)
+	vtcrzr.blocklist.writeMetrics(m)
+	vtcrzr.neighborCache.writeMetrics(m)
+	m.w.Flush()
+}
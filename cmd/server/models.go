@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modelsManifestFile records the active version of a models root
+const modelsManifestFile = "models.json"
+
+// maxActivations is the number of activations kept in the manifest
+const maxActivations = 100
+
+// modelsManifest is the manifest of a models root
+type modelsManifest struct {
+	Active string `json:"active"`
+	// Activations are the versions activated, oldest first
+	Activations []activation `json:"activations"`
+}
+
+type activation struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// modelRoot is a directory holding a database for every version, so the
+// served version can be switched and rolled back without copying files
+type modelRoot struct {
+	// mu serializes activations
+	mu     sync.Mutex
+	dir    string
+	config dbConfig
+}
+
+// modelVersion describes a version of a models root
+type modelVersion struct {
+	Version       string     `json:"version"`
+	Active        bool       `json:"active"`
+	SizeBytes     int64      `json:"size_bytes"`
+	Created       time.Time  `json:"created"`
+	LastActivated *time.Time `json:"last_activated,omitempty"`
+}
+
+// validVersion reports whether version can name a directory of the root
+func validVersion(version string) bool {
+	return version != "" && version == filepath.Base(version) && !strings.HasPrefix(version, ".")
+}
+
+func (root *modelRoot) readManifest() (*modelsManifest, error) {
+	b, err := os.ReadFile(filepath.Join(root.dir, modelsManifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &modelsManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m modelsManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", modelsManifestFile, err)
+	}
+	return &m, nil
+}
+
+// record marks version as active in the manifest
+func (root *modelRoot) record(version string) error {
+	m, err := root.readManifest()
+	if err != nil {
+		return err
+	}
+	m.Active = version
+	m.Activations = append(m.Activations, activation{Version: version, Time: time.Now().UTC()})
+	if len(m.Activations) > maxActivations {
+		m.Activations = m.Activations[len(m.Activations)-maxActivations:]
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(root.dir, modelsManifestFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(root.dir, modelsManifestFile))
+}
+
+// open opens version and records it as active
+func (root *modelRoot) open(version string) (*servedDB, error) {
+	if !validVersion(version) {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+	dir := filepath.Join(root.dir, version)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("unknown version %q", version)
+	}
+	db, err := openServedDB(dir, version, root.config)
+	if err != nil {
+		return nil, err
+	}
+	if err := root.record(version); err != nil {
+		db.store.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// start opens the active version, or the last one by name if none was
+// activated yet
+func (root *modelRoot) start() (*servedDB, error) {
+	m, err := root.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	version := m.Active
+	if version == "" {
+		versions, err := root.versions()
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, fmt.Errorf("no versions below %s", root.dir)
+		}
+		version = versions[len(versions)-1].Version
+	}
+	return root.open(version)
+}
+
+// versions lists the versions sorted by name
+func (root *modelRoot) versions() ([]modelVersion, error) {
+	m, err := root.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	lastActivated := map[string]time.Time{}
+	for _, a := range m.Activations {
+		lastActivated[a.Version] = a.Time
+	}
+
+	entries, err := os.ReadDir(root.dir)
+	if err != nil {
+		return nil, err
+	}
+	versions := []modelVersion{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validVersion(entry.Name()) || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		version := modelVersion{Version: entry.Name(), Active: entry.Name() == m.Active, Created: info.ModTime().UTC()}
+		if t, ok := lastActivated[entry.Name()]; ok {
+			version.LastActivated = &t
+		}
+		err = filepath.Walk(filepath.Join(root.dir, entry.Name()), func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				version.SizeBytes += info.Size()
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, nil
+}
+
+// activate swaps db in. The replaced database is closed once the requests
+// reading it are done, then retired is called
+func (vtcrzr *Vectorizer) activate(db *servedDB, retired func(old *servedDB)) {
+	old := vtcrzr.served.Swap(db)
+	log.Printf("activated version %s", db.version)
+	go vtcrzr.segment.export(db)
+	go func() {
+		time.Sleep(retireDelay)
+		old.store.Close()
+		if retired != nil {
+			retired(old)
+		}
+	}()
+}
+
+// modelsHandler lists the versions of the models root
+func (vtcrzr *Vectorizer) modelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if vtcrzr.models == nil {
+		http.Error(w, "Versioning is disabled, set VECTORIZER_MODELS_ROOT to enable it", http.StatusNotFound)
+		return
+	}
+
+	versions, err := vtcrzr.models.versions()
+	if err != nil {
+		http.Error(w, "Failed to list versions "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response, err := json.Marshal(map[string]interface{}{"active": vtcrzr.db().version, "versions": versions})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// activateHandler switches to the version of the query, e.g. to roll back
+func (vtcrzr *Vectorizer) activateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if vtcrzr.models == nil {
+		http.Error(w, "Versioning is disabled, set VECTORIZER_MODELS_ROOT to enable it", http.StatusNotFound)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		http.Error(w, "Missing 'version' query parameter", http.StatusBadRequest)
+		return
+	}
+
+	vtcrzr.models.mu.Lock()
+	defer vtcrzr.models.mu.Unlock()
+	if version != vtcrzr.db().version {
+		db, err := vtcrzr.models.open(version)
+		if err != nil {
+			http.Error(w, "Failed to activate "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		vtcrzr.activate(db, nil)
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"active": version, "model_hash": vtcrzr.db().info.Hash})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// movement moves a vector towards or away from the centroid of concepts,
+// like moveTo and moveAwayFrom of Weaviate's contextionary
+type movement struct {
+	Concepts []string `json:"concepts"`
+	// Force is the share of the distance to the concepts moved, between 0
+	// and 1
+	Force *float32 `json:"force"`
+}
+
+func (m *movement) validate(name string) error {
+	if len(m.Concepts) == 0 {
+		return fmt.Errorf("%s needs concepts", name)
+	}
+	if m.Force == nil || *m.Force < 0 || *m.Force > 1 {
+		return fmt.Errorf("%s needs a force between 0 and 1", name)
+	}
+	return nil
+}
+
+// checkInput checks that the request has exactly one input, turning a
+// single text into a query
+func (r *vectorizeRequest) checkInput() error {
+	inputs := 0
+	for _, set := range []bool{r.Text != nil, r.Query != nil, r.Fields != nil} {
+		if set {
+			inputs++
+		}
+	}
+	if inputs == 0 {
+		return errors.New("Missing 'text', 'query' or 'fields' field in request body")
+	}
+	if inputs > 1 {
+		return errors.New("Only one of 'text', 'query' and 'fields' may be set in request body")
+	}
+	if r.Text != nil {
+		r.Query, r.Text = []string{*r.Text}, nil
+	}
+	if r.MoveTo != nil {
+		if err := r.MoveTo.validate("moveTo"); err != nil {
+			return err
+		}
+	}
+	if r.MoveAwayFrom != nil {
+		if err := r.MoveAwayFrom.validate("moveAwayFrom"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move moves the vectorization towards the centroid of the concepts of m by
+// its force, or away from it if away is set. Moving towards with force 1
+// returns the centroid of the concepts, moving away goes the same distance
+// in the opposite direction
+func (vtcrzr *Vectorizer) move(vectorized *vectorization, m *movement, away bool, opts vectorizeOptions) (*vectorization, error) {
+	name := "moveTo"
+	if away {
+		name = "moveAwayFrom"
+	}
+	corpus, err := vtcrzr.collect(m.Concepts, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(corpus.vectors) == 0 {
+		return nil, fmt.Errorf("%s: %w", name, &noVectorsError{tokens: corpus.tokens, oov: corpus.oov})
+	}
+	target, err := computeCentroid(corpus.vectors, corpus.weights, opts.Accumulation)
+	if err != nil {
+		return nil, err
+	}
+
+	force := *m.Force
+	if away {
+		force = -force
+	}
+	values := vectorized.vector.ToArray()
+	result := make([]float32, len(values))
+	for i, value := range target.ToArray() {
+		result[i] = values[i] + force*(value-values[i])
+	}
+	v := pkg.NewVector(result)
+	vector, err := vtcrzr.nonFinite.centroid(&v)
+	if err != nil {
+		return nil, err
+	}
+	return &vectorization{vector: vector, quality: vectorized.quality}, nil
+}
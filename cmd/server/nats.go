@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsConsumer reads texts from a JetStream pull consumer and publishes their
+// vectors to an output subject. A message is acknowledged once its result was
+// stored by JetStream, so every text is vectorized at least once. Only a
+// batch of messages is fetched at a time, which keeps a slow vectorizer from
+// being flooded
+type natsConsumer struct {
+	url      string
+	stream   string
+	consumer string
+	output   string
+	batch    int
+	// account is the tenant the messages count to, nil if API keys are
+	// disabled
+	account *tenantAccount
+}
+
+// natsConsumerFromEnv returns the configured consumer or nil if there is
+// none. With API keys enabled the consumer needs a key of its own, messages
+// carry none
+func natsConsumerFromEnv(usage *usageMeter) (*natsConsumer, error) {
+	c := &natsConsumer{batch: 10}
+	var key string
+	for _, err := range []error{
+		envString("VECTORIZER_NATS_URL", &c.url),
+		envString("VECTORIZER_NATS_STREAM", &c.stream),
+		envString("VECTORIZER_NATS_CONSUMER", &c.consumer),
+		envString("VECTORIZER_NATS_OUTPUT", &c.output),
+		envInt("VECTORIZER_NATS_BATCH", &c.batch),
+		envString("VECTORIZER_NATS_API_KEY", &key),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.url == "" {
+		return nil, nil
+	}
+	if c.stream == "" || c.consumer == "" || c.output == "" {
+		return nil, fmt.Errorf("VECTORIZER_NATS_STREAM, VECTORIZER_NATS_CONSUMER and VECTORIZER_NATS_OUTPUT are required")
+	}
+	if c.batch < 1 {
+		return nil, fmt.Errorf("VECTORIZER_NATS_BATCH must be positive")
+	}
+	if usage != nil {
+		if c.account = usage.account(key); c.account == nil {
+			return nil, fmt.Errorf("VECTORIZER_NATS_API_KEY must be one of VECTORIZER_API_KEYS")
+		}
+	}
+	return c, nil
+}
+
+// natsMsg is a message delivered to a subscription. Status is set for
+// JetStream status messages like 408 Request Timeout
+type natsMsg struct {
+	subject string
+	reply   string
+	status  string
+	data    []byte
+}
+
+// natsConn is a minimal client of the NATS protocol
+type natsConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+	msgs chan natsMsg
+	err  error
+}
+
+func dialNATS(rawURL string) (*natsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", info)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"lang":          "go",
+		"version":       "1",
+		"protocol":      1,
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			options["user"], options["pass"] = u.User.Username(), password
+		} else {
+			options["auth_token"] = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &natsConn{conn: conn, w: bufio.NewWriter(conn), msgs: make(chan natsMsg, 64)}
+	if err := c.write("CONNECT " + string(connect) + "\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop(r)
+	return c, nil
+}
+
+func (c *natsConn) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(s)
+	return c.w.Flush()
+}
+
+func (c *natsConn) subscribe(subject string, sid int) error {
+	return c.write(fmt.Sprintf("SUB %s %d\r\n", subject, sid))
+}
+
+func (c *natsConn) publish(subject, reply string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reply != "" {
+		fmt.Fprintf(c.w, "PUB %s %s %d\r\n", subject, reply, len(data))
+	} else {
+		fmt.Fprintf(c.w, "PUB %s %d\r\n", subject, len(data))
+	}
+	c.w.Write(data)
+	c.w.WriteString("\r\n")
+	return c.w.Flush()
+}
+
+// next returns the next message delivered to the subscriptions
+func (c *natsConn) next(timeout time.Duration) (natsMsg, error) {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			return natsMsg{}, c.err
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return natsMsg{}, fmt.Errorf("timeout waiting for message")
+	}
+}
+
+func (c *natsConn) close() {
+	c.conn.Close()
+}
+
+// readLoop answers pings and delivers messages until the connection fails
+func (c *natsConn) readLoop(r *bufio.Reader) {
+	defer close(c.msgs)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.err = err
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			if err := c.write("PONG\r\n"); err != nil {
+				c.err = err
+				return
+			}
+		case "-ERR":
+			c.err = fmt.Errorf("server error %s", args)
+			return
+		case "MSG", "HMSG":
+			msg, err := readNATSMsg(r, strings.ToUpper(op) == "HMSG", strings.Fields(args))
+			if err != nil {
+				c.err = err
+				return
+			}
+			c.msgs <- msg
+		}
+	}
+}
+
+// readNATSMsg reads the payload of MSG <subject> <sid> [reply] <size> or
+// HMSG <subject> <sid> [reply] <header size> <total size>
+func readNATSMsg(r *bufio.Reader, headers bool, args []string) (natsMsg, error) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(args) != 2+sizes && len(args) != 3+sizes {
+		return natsMsg{}, fmt.Errorf("invalid message arguments %q", args)
+	}
+	msg := natsMsg{subject: args[0]}
+	if len(args) == 3+sizes {
+		msg.reply = args[2]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return natsMsg{}, err
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil {
+			return natsMsg{}, err
+		}
+	}
+
+	payload := make([]byte, total+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return natsMsg{}, err
+	}
+	if headers {
+		// NATS/1.0 503 No Responders
+		status, _, _ := bytes.Cut(payload[:headerSize], []byte("\r\n"))
+		if fields := strings.Fields(string(status)); len(fields) > 1 {
+			msg.status = fields[1]
+		}
+	}
+	msg.data = payload[headerSize:total]
+	return msg, nil
+}
+
+// consumeNATS runs the consumer, reconnecting after failures
+func (vtcrzr *Vectorizer) consumeNATS(c *natsConsumer) {
+	for {
+		err := vtcrzr.runNATS(c)
+		log.Printf("nats consumer: %v, reconnecting", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// natsExpires is how long a fetch waits for messages
+const natsExpires = 30 * time.Second
+
+func (vtcrzr *Vectorizer) runNATS(c *natsConsumer) error {
+	conn, err := dialNATS(c.url)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	inbox := "_INBOX." + hex.EncodeToString(b)
+	if err := conn.subscribe(inbox+".>", 1); err != nil {
+		return err
+	}
+
+	next := "$JS.API.CONSUMER.MSG.NEXT." + c.stream + "." + c.consumer
+	request, err := json.Marshal(map[string]int64{"batch": int64(c.batch), "expires": int64(natsExpires)})
+	if err != nil {
+		return err
+	}
+	for {
+		if err := conn.publish(next, inbox+".fetch", request); err != nil {
+			return err
+		}
+
+		// the fetch ends with the batch or a status like 408 Request Timeout
+		var batch []natsMsg
+		for len(batch) < c.batch {
+			msg, err := conn.next(natsExpires + 10*time.Second)
+			if err != nil {
+				return err
+			}
+			if msg.status != "" {
+				if msg.status != "404" && msg.status != "408" {
+					return fmt.Errorf("fetching messages: status %s %s", msg.status, msg.data)
+				}
+				break
+			}
+			batch = append(batch, msg)
+		}
+
+		for _, msg := range batch {
+			if err := vtcrzr.processNATS(conn, c, inbox, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// processNATS vectorizes a message, publishes the result and acknowledges
+// the message once JetStream stored the result
+func (vtcrzr *Vectorizer) processNATS(conn *natsConn, c *natsConsumer, inbox string, msg natsMsg) error {
+	if c.account != nil {
+		// redeliver the message once the quota resets
+		now := time.Now()
+		if exceeded, resets := c.account.admit(now); exceeded != "" {
+			nak, err := json.Marshal(map[string]int64{"delay": int64(resets.Sub(now))})
+			if err != nil {
+				return err
+			}
+			return conn.publish(msg.reply, "", append([]byte("-NAK "), nak...))
+		}
+	}
+
+	out, err := json.Marshal(vtcrzr.natsResult(c, msg))
+	if err != nil {
+		return err
+	}
+
+	if err := conn.publish(c.output, inbox+".ack", out); err != nil {
+		return err
+	}
+	ack, err := conn.next(10 * time.Second)
+	if err == nil {
+		err = natsPubAckError(ack)
+	}
+	if err != nil {
+		// redeliver the message later
+		conn.publish(msg.reply, "", []byte("-NAK"))
+		return fmt.Errorf("publishing to %s: %v", c.output, err)
+	}
+	return conn.publish(msg.reply, "", []byte("+ACK"))
+}
+
+// natsResult vectorizes the text of a message. A panic is returned as the
+// error of the result, redelivering the message would panic again
+func (vtcrzr *Vectorizer) natsResult(c *natsConsumer, msg natsMsg) (result jobResult) {
+	var row jobRow
+	if err := json.Unmarshal(msg.data, &row); err != nil {
+		result.Error = "Failed to decode message " + err.Error()
+		return result
+	}
+	result.ID = row.ID
+
+	var err error
+	defer func() {
+		if err != nil {
+			result.Vector, result.Error = nil, err.Error()
+		}
+	}()
+	defer vtcrzr.recoverPanic("NATS message", &err)
+
+	opts := vtcrzr.defaults
+	opts.tenant = c.account
+	vectorized, err := vtcrzr.vectorize([]string{row.Text}, opts)
+	if err != nil {
+		return result
+	}
+	result.Vector = roundVector(truncateVector(vectorized.vector.ToArray(), vtcrzr.defaults.Dims), vtcrzr.defaults.Precision)
+	return result
+}
+
+// natsPubAckError returns the error of a JetStream publish acknowledgement
+func natsPubAckError(ack natsMsg) error {
+	if ack.status == "503" {
+		return errors.New("no stream captures the subject")
+	}
+	var response struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(ack.data, &response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return errors.New(response.Error.Description)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// defaultNegationWeight is the share of the centroid of the negative terms
+// subtracted from the centroid of a query
+const defaultNegationWeight = 0.5
+
+// normalizeNegationWeight maps the default to 0, so vectors computed before
+// the option existed keep their manifests
+func normalizeNegationWeight(weight float32) float32 {
+	if weight == defaultNegationWeight {
+		return 0
+	}
+	return weight
+}
+
+// negationWeight returns the weight of the negative terms of opts
+func (opts vectorizeOptions) negationWeight() float32 {
+	if opts.NegationWeight == 0 {
+		return defaultNegationWeight
+	}
+	return opts.NegationWeight
+}
+
+// splitNegation removes the negated terms of text, the words prefixed with
+// a "-" like "apple -fruit", and returns them. A dash not directly followed
+// by a letter or number, like " - ", negates nothing
+func splitNegation(text string) (string, []string) {
+	var kept, negative []string
+	for _, word := range strings.Fields(text) {
+		if rest, ok := strings.CutPrefix(word, "-"); ok && rest != "" {
+			if r, _ := utf8.DecodeRuneInString(rest); unicode.IsLetter(r) || unicode.IsNumber(r) {
+				negative = append(negative, rest)
+				continue
+			}
+		}
+		kept = append(kept, word)
+	}
+	if negative == nil {
+		return text, nil
+	}
+	return strings.Join(kept, " "), negative
+}
+
+// vectorizeBody vectorizes the query or the fields of a request, steered
+// away from its negative terms, moved and debiased as it asks
+func (vtcrzr *Vectorizer) vectorizeBody(r *vectorizeRequest, opts vectorizeOptions) (*vectorization, error) {
+	// every member steers in its own space before the vectors are combined
+	if e := vtcrzr.aliases.ensemble(opts.Model); e != nil {
+		return vtcrzr.vectorizeEnsemble(e, opts, func(opts vectorizeOptions) (*vectorization, error) {
+			return vtcrzr.vectorizeBody(r, opts)
+		})
+	}
+	vectorized, err := vtcrzr.vectorizeNegated(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	// moved towards first and away second, like Weaviate does
+	if r.MoveTo != nil {
+		if vectorized, err = vtcrzr.move(vectorized, r.MoveTo, false, opts); err != nil {
+			return nil, err
+		}
+	}
+	if r.MoveAwayFrom != nil {
+		if vectorized, err = vtcrzr.move(vectorized, r.MoveAwayFrom, true, opts); err != nil {
+			return nil, err
+		}
+	}
+	// negation and moves work in the space of the model
+	return vtcrzr.finish(vectorized, opts)
+}
+
+// vectorizeNegated vectorizes the query or the fields of a request, steered
+// away from its negative terms
+func (vtcrzr *Vectorizer) vectorizeNegated(r *vectorizeRequest, opts vectorizeOptions) (*vectorization, error) {
+	negative := r.Negative
+	var vectorized *vectorization
+	var err error
+	if r.Fields != nil {
+		vectorized, err = vtcrzr.vectorizeFields(r.Fields, opts)
+	} else {
+		query := r.Query
+		if opts.Negation {
+			query = make([]string, len(r.Query))
+			for i, text := range r.Query {
+				var terms []string
+				query[i], terms = splitNegation(text)
+				negative = append(negative, terms...)
+			}
+		}
+		vectorized, err = vtcrzr.pool(query, opts)
+	}
+	if err != nil || len(negative) == 0 {
+		return vectorized, err
+	}
+	return vtcrzr.negate(vectorized, negative, opts)
+}
+
+// negate subtracts the centroid of the negative texts, scaled by the
+// negation weight, from the vectorization. Negative texts without known
+// words change nothing
+func (vtcrzr *Vectorizer) negate(vectorized *vectorization, negative []string, opts vectorizeOptions) (*vectorization, error) {
+	corpus, err := vtcrzr.collect(negative, opts)
+	if err != nil {
+		return nil, fmt.Errorf("negative: %w", err)
+	}
+	if len(corpus.vectors) == 0 {
+		return vectorized, nil
+	}
+	away, err := computeCentroid(corpus.vectors, corpus.weights, opts.Accumulation)
+	if err != nil {
+		return nil, err
+	}
+
+	values := vectorized.vector.ToArray()
+	result := make([]float32, len(values))
+	weight := opts.negationWeight()
+	for i, value := range away.ToArray() {
+		result[i] = values[i] - weight*value
+	}
+	v := pkg.NewVector(result)
+	vector, err := vtcrzr.nonFinite.centroid(&v)
+	if err != nil {
+		return nil, err
+	}
+	q := vectorized.quality
+	q.Negated = corpus.found
+	return &vectorization{vector: vector, quality: q}, nil
+}
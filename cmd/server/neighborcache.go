@@ -0,0 +1,143 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// neighborCache keeps the results of /neighbors by word and k, filtered by
+// the blocklist, so hot words of exploratory workloads are answered without
+// reading and filtering the graph. The least frequently used result is
+// evicted once it holds size results, the least recently used of those
+// equally frequent. The graph and the blocklist don't change while the
+// server runs, so results never go stale. A nil cache caches nothing
+type neighborCache struct {
+	mu   sync.Mutex
+	size int
+	// entries maps the keys to their elements in the list of their use
+	// count
+	entries map[string]*list.Element
+	// uses holds a list per use count, most recently used first
+	uses map[int]*list.List
+	// minUses is the smallest use count of an entry
+	minUses int
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// neighborEntry is a cached result
+type neighborEntry struct {
+	key       string
+	neighbors []pkg.GraphNeighbor
+	uses      int
+}
+
+func neighborCacheFromEnv() (*neighborCache, error) {
+	size := 10000
+	if err := envInt("VECTORIZER_NEIGHBOR_CACHE_SIZE", &size); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("VECTORIZER_NEIGHBOR_CACHE_SIZE must not be negative")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	return &neighborCache{size: size, entries: map[string]*list.Element{}, uses: map[int]*list.List{}}, nil
+}
+
+// neighborKey is the key of the k neighbors of word
+func neighborKey(word string, k int) string {
+	return strconv.Itoa(k) + "\x00" + word
+}
+
+// get returns the cached neighbors of word, counting the use
+func (c *neighborCache) get(word string, k int) ([]pkg.GraphNeighbor, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[neighborKey(word, k)]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	entry := elem.Value.(*neighborEntry)
+	c.remove(elem)
+	entry.uses++
+	c.entries[entry.key] = c.list(entry.uses).PushFront(entry)
+	return entry.neighbors, true
+}
+
+// put caches the neighbors of word, evicting the least frequently used
+// result if the cache is full
+func (c *neighborCache) put(word string, k int, neighbors []pkg.GraphNeighbor) {
+	if c == nil {
+		return
+	}
+	key := neighborKey(word, k)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// concurrent misses of a word store the same result
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.entries) >= c.size {
+		victims := c.uses[c.minUses]
+		c.remove(victims.Back())
+		c.evictions.Add(1)
+	}
+	entry := &neighborEntry{key: key, neighbors: neighbors, uses: 1}
+	c.entries[key] = c.list(1).PushFront(entry)
+	c.minUses = 1
+}
+
+// list returns the list of the entries used uses times
+func (c *neighborCache) list(uses int) *list.List {
+	l, ok := c.uses[uses]
+	if !ok {
+		l = list.New()
+		c.uses[uses] = l
+	}
+	return l
+}
+
+// remove takes elem out of the cache, minUses is kept up to date by get
+// moving the entry to the next count and by put resetting it to 1
+func (c *neighborCache) remove(elem *list.Element) {
+	entry := elem.Value.(*neighborEntry)
+	l := c.uses[entry.uses]
+	l.Remove(elem)
+	delete(c.entries, entry.key)
+	if l.Len() == 0 {
+		delete(c.uses, entry.uses)
+		if c.minUses == entry.uses {
+			c.minUses++
+		}
+	}
+}
+
+func (c *neighborCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *neighborCache) writeMetrics(m *metricsWriter) {
+	if c == nil {
+		return
+	}
+	m.counter("vectorizer_neighbor_cache_hits_total", "Number of /neighbors requests answered from the neighbor cache", float64(c.hits.Load()))
+	m.counter("vectorizer_neighbor_cache_misses_total", "Number of /neighbors requests that read the k-NN graph", float64(c.misses.Load()))
+	m.counter("vectorizer_neighbor_cache_evictions_total", "Number of results evicted from the neighbor cache as the least frequently used", float64(c.evictions.Load()))
+	m.gauge("vectorizer_neighbor_cache_entries", "Number of results in the neighbor cache", float64(c.len()))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// neighborStep is a put, or a get expected to hit or miss
+type neighborStep struct {
+	op   string
+	word string
+	k    int
+	hit  bool
+}
+
+func TestNeighborCacheEviction(t *testing.T) {
+	put := func(word string) neighborStep { return neighborStep{op: "put", word: word, k: 10} }
+	hit := func(word string) neighborStep { return neighborStep{op: "get", word: word, k: 10, hit: true} }
+	miss := func(word string) neighborStep { return neighborStep{op: "get", word: word, k: 10} }
+
+	for _, test := range []struct {
+		name      string
+		size      int
+		steps     []neighborStep
+		evictions uint64
+	}{
+		{
+			name:      "least frequently used is evicted",
+			size:      2,
+			steps:     []neighborStep{put("a"), put("b"), hit("a"), put("c"), miss("b"), hit("a"), hit("c")},
+			evictions: 1,
+		},
+		{
+			name:      "ties evict the least recently used",
+			size:      2,
+			steps:     []neighborStep{put("a"), put("b"), put("c"), miss("a"), hit("b"), hit("c")},
+			evictions: 1,
+		},
+		{
+			name:      "ties by recency of use",
+			size:      3,
+			steps:     []neighborStep{put("a"), put("b"), put("c"), hit("a"), hit("b"), hit("c"), hit("a"), hit("c"), hit("b"), put("d"), put("e"), miss("a"), miss("d"), hit("b"), hit("c"), hit("e")},
+			evictions: 2,
+		},
+		{
+			name:      "smallest use count follows gets",
+			size:      2,
+			steps:     []neighborStep{put("a"), hit("a"), put("b"), hit("b"), hit("b"), put("c"), miss("a"), hit("b"), hit("c")},
+			evictions: 1,
+		},
+		{
+			name:      "new results have the smallest use count",
+			size:      2,
+			steps:     []neighborStep{put("a"), hit("a"), hit("a"), put("b"), put("c"), miss("b"), hit("a"), hit("c")},
+			evictions: 1,
+		},
+		{
+			name:      "repeated puts keep the use count",
+			size:      2,
+			steps:     []neighborStep{put("a"), hit("a"), put("a"), put("b"), put("c"), miss("b"), hit("a"), hit("c")},
+			evictions: 1,
+		},
+		{
+			name:      "k is part of the key",
+			size:      2,
+			steps:     []neighborStep{put("a"), {op: "get", word: "a", k: 5}, {op: "put", word: "a", k: 5}, {op: "get", word: "a", k: 5, hit: true}, hit("a")},
+			evictions: 0,
+		},
+		{
+			name:      "a cache of one",
+			size:      1,
+			steps:     []neighborStep{put("a"), hit("a"), put("b"), miss("a"), hit("b")},
+			evictions: 1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := &neighborCache{size: test.size, entries: map[string]*list.Element{}, uses: map[int]*list.List{}}
+			var hits, misses uint64
+			for i, step := range test.steps {
+				if step.op == "put" {
+					c.put(step.word, step.k, []pkg.GraphNeighbor{{Word: step.word + "-neighbor"}})
+					continue
+				}
+				neighbors, ok := c.get(step.word, step.k)
+				if ok != step.hit {
+					t.Fatalf("step %d: get(%q, %d) hit %v, expected %v", i, step.word, step.k, ok, step.hit)
+				}
+				if ok {
+					hits++
+					if len(neighbors) != 1 || neighbors[0].Word != step.word+"-neighbor" {
+						t.Fatalf("step %d: get(%q, %d) returned %v", i, step.word, step.k, neighbors)
+					}
+				} else {
+					misses++
+				}
+				if c.len() > test.size {
+					t.Fatalf("step %d: %d entries, the size is %d", i, c.len(), test.size)
+				}
+			}
+			if c.hits.Load() != hits || c.misses.Load() != misses || c.evictions.Load() != test.evictions {
+				t.Errorf("%d hits, %d misses and %d evictions, expected %d, %d and %d",
+					c.hits.Load(), c.misses.Load(), c.evictions.Load(), hits, misses, test.evictions)
+			}
+		})
+	}
+}
+
+func TestNeighborCacheNil(t *testing.T) {
+	var c *neighborCache
+	c.put("a", 10, []pkg.GraphNeighbor{{Word: "b"}})
+	if _, ok := c.get("a", 10); ok {
+		t.Error("a nil cache returned a result")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/metric"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// knnGraph serves the nearest neighbors precomputed by cmd/knngraph
+type knnGraph struct {
+	db   *leveldb.DB
+	meta pkg.GraphMeta
+}
+
+// knnGraphFromEnv opens the graph of VECTORIZER_KNN_GRAPH, nil if it isn't
+// set. The graph must have the dimensions of the model served
+func knnGraphFromEnv(dims int) (*knnGraph, error) {
+	var path string
+	if err := envString("VECTORIZER_KNN_GRAPH", &path); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, nil
+	}
+
+	db, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("k-NN graph: %v", err)
+	}
+	b, err := db.Get([]byte(pkg.GraphMetaKey), nil)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("k-NN graph %s: %v", path, err)
+	}
+	g := &knnGraph{db: db}
+	if err := json.Unmarshal(b, &g.meta); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("k-NN graph %s: %v", path, err)
+	}
+	if g.meta.Dims != dims {
+		db.Close()
+		return nil, fmt.Errorf("k-NN graph %s is of %d dimensions, the model of %d", path, g.meta.Dims, dims)
+	}
+	if g.meta.Done < g.meta.Words {
+		log.Printf("k-NN graph %s is incomplete, %d of %d words have neighbors", path, g.meta.Done, g.meta.Words)
+	}
+	return g, nil
+}
+
+// neighbors returns the neighbors of word, nearest first, falling back to
+// its lowercase form like lookup. It returns nil if the word isn't in the
+// graph
+func (g *knnGraph) neighbors(word string) ([]pkg.GraphNeighbor, error) {
+	value, err := g.db.Get([]byte(pkg.GraphNeighborsPrefix+word), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		value, err = g.db.Get([]byte(pkg.GraphNeighborsPrefix+strings.ToLower(word)), nil)
+	}
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pkg.DecodeNeighbors(value)
+}
+
+// neighborsResponse is the body returned by the neighbors endpoint
+type neighborsResponse struct {
+	Word      string              `json:"word"`
+	Metric    string              `json:"metric"`
+	Neighbors []pkg.GraphNeighbor `json:"neighbors"`
+}
+
+// neighborsHandler returns the k nearest neighbors of the word of the query
+func (vtcrzr *Vectorizer) neighborsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	g := vtcrzr.graph
+	if g == nil {
+		http.Error(w, "No k-NN graph is served, set VECTORIZER_KNN_GRAPH to serve one", http.StatusNotFound)
+		return
+	}
+	word := r.URL.Query().Get("word")
+	if word == "" {
+		http.Error(w, "Missing 'word' query parameter", http.StatusBadRequest)
+		return
+	}
+	// the graph is ranked by a single metric, asking for another one is an
+	// error rather than a silently different ranking
+	if name := r.URL.Query().Get("metric"); name != "" {
+		m, err := metric.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if graphMetric, err := metric.Get(g.meta.Metric); err != nil || graphMetric.Name() != m.Name() {
+			http.Error(w, fmt.Sprintf("The k-NN graph is ranked by %s, build one with cmd/knngraph --metric %s", g.meta.Metric, m.Name()), http.StatusBadRequest)
+			return
+		}
+	}
+	k := g.meta.K
+	if value := r.URL.Query().Get("k"); value != "" {
+		var err error
+		k, err = strconv.Atoi(value)
+		if err != nil || k < 1 || k > g.meta.K {
+			http.Error(w, fmt.Sprintf("k must be between 1 and %d", g.meta.K), http.StatusBadRequest)
+			return
+		}
+	}
+
+	neighbors, ok := vtcrzr.neighborCache.get(word, k)
+	if !ok {
+		var err error
+		neighbors, err = g.neighbors(word)
+		if err != nil {
+			http.Error(w, "Failed to read neighbors "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if neighbors == nil {
+			http.Error(w, "Word "+word+" is not in the k-NN graph", http.StatusNotFound)
+			return
+		}
+		// blocked neighbors make room for the next ones the graph has
+		neighbors = vtcrzr.blocklist.filterNeighbors(neighbors)
+		if len(neighbors) > k {
+			neighbors = neighbors[:k]
+		}
+		vtcrzr.neighborCache.put(word, k, neighbors)
+	}
+
+	response, err := json.Marshal(neighborsResponse{Word: word, Metric: g.meta.Metric, Neighbors: neighbors})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
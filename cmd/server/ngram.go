@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// phraseSeparators are tried in order when looking up a phrase as a single
+// vocabulary entry, e.g. "machine_learning" or "machine-learning"
+var phraseSeparators = []string{"_", "-"}
+
+// ngramVectors returns a vector for every run of 2 up to opts.NGrams
+// consecutive words. Runs starting or ending with a stopword are skipped as
+// they rarely form a collocation
+func (vtcrzr *Vectorizer) ngramVectors(words []string, opts vectorizeOptions) ([]pkg.Vector, error) {
+	var vectors []pkg.Vector
+	for size := 2; size <= opts.NGrams; size++ {
+		for start := 0; start+size <= len(words); start++ {
+			gram := words[start : start+size]
+			if vtcrzr.isStopWord(gram[0], opts) || vtcrzr.isStopWord(gram[size-1], opts) {
+				continue
+			}
+
+			vector, err := vtcrzr.phraseVector(gram, opts)
+			if err != nil {
+				return nil, err
+			}
+			if vector != nil {
+				vectors = append(vectors, *vector)
+			}
+		}
+	}
+	return vectors, nil
+}
+
+// phraseVector looks up the words joined as a single vocabulary entry and
+// otherwise averages the vectors of its constituents. It returns nil if fewer
+// than two constituents are known as the phrase would only repeat a word
+func (vtcrzr *Vectorizer) phraseVector(words []string, opts vectorizeOptions) (*pkg.Vector, error) {
+	db := vtcrzr.modelDB(opts)
+	for _, sep := range phraseSeparators {
+		vector, err := vtcrzr.lookupIn(db, strings.Join(words, sep), opts.timing)
+		if err != nil {
+			return nil, err
+		}
+		if vector != nil {
+			return vector, nil
+		}
+	}
+
+	var constituents []pkg.Vector
+	for _, word := range words {
+		vector, err := vtcrzr.lookupIn(db, word, opts.timing)
+		if err != nil {
+			return nil, err
+		}
+		if vector != nil {
+			constituents = append(constituents, *vector)
+		}
+	}
+	if len(constituents) < 2 {
+		return nil, nil
+	}
+
+	weights := make([]float32, len(constituents))
+	for i := range weights {
+		weights[i] = 1
+	}
+	return ComputeWeightedCentroid(constituents, weights)
+}
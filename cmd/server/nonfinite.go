@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// policies for vectors with NaN or infinite values, which would otherwise
+// propagate into every centroid they are part of
+const (
+	// nonFiniteSanitize replaces the values by 0
+	nonFiniteSanitize = "sanitize"
+	// nonFiniteReject treats stored vectors as missing and fails centroids
+	nonFiniteReject = "reject"
+)
+
+// errNonFinite is returned for centroids with NaN or infinite values if
+// they are rejected
+var errNonFinite = errors.New("centroid has NaN or infinite values")
+
+// nonFiniteGuard checks stored vectors as they are read and the computed
+// centroids
+type nonFiniteGuard struct {
+	policy string
+	// storedVectors and centroids count the vectors found with non-finite
+	// values
+	storedVectors atomic.Uint64
+	centroids     atomic.Uint64
+}
+
+func nonFiniteGuardFromEnv() (*nonFiniteGuard, error) {
+	g := &nonFiniteGuard{policy: nonFiniteSanitize}
+	if err := envString("VECTORIZER_NON_FINITE", &g.policy); err != nil {
+		return nil, err
+	}
+	if g.policy != nonFiniteSanitize && g.policy != nonFiniteReject {
+		return nil, fmt.Errorf("VECTORIZER_NON_FINITE must be %q or %q", nonFiniteSanitize, nonFiniteReject)
+	}
+	return g, nil
+}
+
+// stored checks the vector of word read from the database. It returns the
+// vector to use, nil if the word is treated as missing
+func (g *nonFiniteGuard) stored(word string, vector *pkg.Vector) *pkg.Vector {
+	if g == nil {
+		return vector
+	}
+	values := vector.ToArray()
+	n := pkg.Sanitize(values)
+	if n == 0 {
+		return vector
+	}
+	g.storedVectors.Add(1)
+	if g.policy == nonFiniteReject {
+		log.Printf("vector of %q has %d NaN or infinite values, treating the word as missing", word, n)
+		return nil
+	}
+	log.Printf("vector of %q has %d NaN or infinite values, replaced by 0", word, n)
+	sanitized := pkg.NewVector(values)
+	return &sanitized
+}
+
+// centroid checks a computed centroid, it returns the centroid to use or
+// errNonFinite
+func (g *nonFiniteGuard) centroid(vector *pkg.Vector) (*pkg.Vector, error) {
+	if g == nil {
+		return vector, nil
+	}
+	values := vector.ToArray()
+	n := pkg.Sanitize(values)
+	if n == 0 {
+		return vector, nil
+	}
+	g.centroids.Add(1)
+	if g.policy == nonFiniteReject {
+		log.Printf("centroid has %d NaN or infinite values, rejecting it", n)
+		return nil, errNonFinite
+	}
+	log.Printf("centroid has %d NaN or infinite values, replaced by 0", n)
+	sanitized := pkg.NewVector(values)
+	return &sanitized, nil
+}
+
+func (g *nonFiniteGuard) writeMetrics(m *metricsWriter) {
+	if g == nil {
+		return
+	}
+	m.family("vectorizer_non_finite_vectors_total", "counter", "Number of vectors found with NaN or infinite values, by source")
+	m.sample("vectorizer_non_finite_vectors_total", float64(g.storedVectors.Load()), "source", "stored")
+	m.sample("vectorizer_non_finite_vectors_total", float64(g.centroids.Load()), "source", "centroid")
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// oovPrefix keys the counts of out of vocabulary tokens by the hash of
+// their model, so the report follows the model served
+const oovPrefix = "oov/"
+
+// maxOOVTop limits the tokens of a gap report
+const maxOOVTop = 10000
+
+// oovLog counts the out of vocabulary tokens of the default model in a
+// writable side database, so operators can see which domain terms are
+// missing. Counts are collected in memory and added to the database every
+// interval
+type oovLog struct {
+	db *leveldb.DB
+	// hashed stores a hash of every token instead of the token, for texts
+	// that must not be kept
+	hashed bool
+	// maxPending limits the distinct tokens collected between flushes
+	maxPending int
+	// synthesisWindow is the number of tokens on either side of an out of
+	// vocabulary token its vector is synthesized from
+	synthesisWindow int
+	// synthesisMinContext is the number of known tokens in the window
+	// needed to synthesize a vector
+	synthesisMinContext int
+
+	mu sync.Mutex
+	// pending maps the key of a token to the count since the last flush
+	pending map[string]uint64
+
+	// synthMu serializes the updates of the synthesized vectors
+	synthMu sync.Mutex
+
+	recorded    atomic.Uint64
+	dropped     atomic.Uint64
+	synthesized atomic.Uint64
+}
+
+// oovCount is a token of the gap report
+type oovCount struct {
+	Token string `json:"token"`
+	Count uint64 `json:"count"`
+}
+
+func oovLogFromEnv() (*oovLog, error) {
+	var dbPath string
+	interval := 10 * time.Second
+	l := &oovLog{maxPending: 100000, pending: map[string]uint64{}, synthesisWindow: 5, synthesisMinContext: 3}
+	for _, err := range []error{
+		envString("VECTORIZER_OOV_LOG", &dbPath),
+		envBool("VECTORIZER_OOV_LOG_HASHED", &l.hashed),
+		envDuration("VECTORIZER_OOV_LOG_INTERVAL", &interval),
+		envInt("VECTORIZER_OOV_SYNTHESIS_WINDOW", &l.synthesisWindow),
+		envInt("VECTORIZER_OOV_SYNTHESIS_MIN_CONTEXT", &l.synthesisMinContext),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dbPath == "" {
+		return nil, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("VECTORIZER_OOV_LOG_INTERVAL must be positive")
+	}
+	if l.synthesisWindow < 1 || l.synthesisMinContext < 1 {
+		return nil, fmt.Errorf("VECTORIZER_OOV_SYNTHESIS_WINDOW and VECTORIZER_OOV_SYNTHESIS_MIN_CONTEXT must be positive")
+	}
+
+	var err error
+	l.db, err = leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("OOV log: %v", err)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := l.flush(); err != nil {
+				log.Printf("failed to store OOV counts: %v", err)
+			}
+		}
+	}()
+	return l, nil
+}
+
+// tokenKey returns the key of token under prefix and the model with the
+// given hash. Tokens are lowercased as the lookups fall back to lowercase
+func (l *oovLog) tokenKey(prefix, modelHash, token string) string {
+	token = strings.ToLower(token)
+	if l.hashed {
+		h := sha256.Sum256([]byte(token))
+		token = "sha256:" + hex.EncodeToString(h[:16])
+	}
+	return prefix + modelHash + "/" + token
+}
+
+// record counts token as out of vocabulary of the model with the given
+// hash. Tokens new since the last flush are dropped once maxPending are
+// collected. A nil log records nothing
+func (l *oovLog) record(modelHash, token string) {
+	if l == nil {
+		return
+	}
+	key := l.tokenKey(oovPrefix, modelHash, token)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.pending[key]; !ok && len(l.pending) >= l.maxPending {
+		l.dropped.Add(1)
+		return
+	}
+	l.pending[key]++
+	l.recorded.Add(1)
+}
+
+// flush adds the pending counts to the stored ones
+func (l *oovLog) flush() error {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = map[string]uint64{}
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	for key, count := range pending {
+		stored, err := l.db.Get([]byte(key), nil)
+		if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+			return err
+		}
+		if len(stored) == 8 {
+			count += binary.BigEndian.Uint64(stored)
+		}
+		batch.Put([]byte(key), binary.BigEndian.AppendUint64(nil, count))
+	}
+	return l.db.Write(batch, nil)
+}
+
+// top returns the n most frequent tokens of the model with the given hash,
+// most frequent first
+func (l *oovLog) top(modelHash string, n int) ([]oovCount, int, error) {
+	if err := l.flush(); err != nil {
+		return nil, 0, err
+	}
+	prefix := oovPrefix + modelHash + "/"
+	iter := l.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	h := &oovHeap{}
+	distinct := 0
+	for iter.Next() {
+		if len(iter.Value()) != 8 {
+			continue
+		}
+		distinct++
+		c := oovCount{Token: string(iter.Key()[len(prefix):]), Count: binary.BigEndian.Uint64(iter.Value())}
+		if h.Len() < n {
+			heap.Push(h, c)
+		} else if c.Count > (*h)[0].Count {
+			(*h)[0] = c
+			heap.Fix(h, 0)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, 0, err
+	}
+
+	top := make([]oovCount, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(h).(oovCount)
+	}
+	return top, distinct, nil
+}
+
+// oovHeap is a min-heap of counts, the least frequent of the top tokens
+// is replaced first
+type oovHeap []oovCount
+
+func (h oovHeap) Len() int            { return len(h) }
+func (h oovHeap) Less(i, j int) bool  { return h[i].Count < h[j].Count }
+func (h oovHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *oovHeap) Push(x interface{}) { *h = append(*h, x.(oovCount)) }
+func (h *oovHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (l *oovLog) writeMetrics(m *metricsWriter) {
+	if l == nil {
+		return
+	}
+	m.counter("vectorizer_oov_tokens_total", "Number of out of vocabulary tokens recorded in the OOV log", float64(l.recorded.Load()))
+	m.counter("vectorizer_oov_tokens_dropped_total", "Number of out of vocabulary tokens not recorded as too many distinct tokens were pending", float64(l.dropped.Load()))
+	m.counter("vectorizer_oov_tokens_synthesized_total", "Number of out of vocabulary tokens given a vector synthesized from their context", float64(l.synthesized.Load()))
+}
+
+// oovTopHandler reports the most frequent out of vocabulary tokens of the
+// default model, ?n= of them
+func (vtcrzr *Vectorizer) oovTopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if vtcrzr.oov == nil {
+		http.Error(w, "OOV log is disabled, set VECTORIZER_OOV_LOG to enable it", http.StatusNotFound)
+		return
+	}
+	n := 100
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxOOVTop {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", maxOOVTop), http.StatusBadRequest)
+			return
+		}
+	}
+
+	modelHash := vtcrzr.db().info.Hash
+	top, distinct, err := vtcrzr.oov.top(modelHash, n)
+	if err != nil {
+		http.Error(w, "Failed to read OOV log "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response, err := json.Marshal(map[string]interface{}{
+		"model_hash": modelHash,
+		"hashed":     vtcrzr.oov.hashed,
+		"distinct":   distinct,
+		"tokens":     top,
+	})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// openAPIJSON is the OpenAPI 3 specification of the HTTP API
+//
+//go:embed openapi.json
+var openAPIJSON []byte
+
+// schema is a JSON schema as decoded from the specification
+type schema = map[string]interface{}
+
+// openAPIBody is the JSON request body of an operation
+type openAPIBody struct {
+	path     string
+	method   string
+	required bool
+	schema   schema
+}
+
+// openAPISpec validates request bodies against the specification
+type openAPISpec struct {
+	bodies  []openAPIBody
+	schemas map[string]schema
+}
+
+func loadOpenAPISpec() (*openAPISpec, error) {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPIJSON, &doc); err != nil {
+		return nil, fmt.Errorf("openapi.json: %v", err)
+	}
+
+	spec := &openAPISpec{schemas: doc.Components.Schemas}
+	for path, item := range doc.Paths {
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			var operation struct {
+				RequestBody *struct {
+					Required bool `json:"required"`
+					Content  map[string]struct {
+						Schema schema `json:"schema"`
+					} `json:"content"`
+				} `json:"requestBody"`
+			}
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				return nil, fmt.Errorf("openapi.json: %s %s: %v", method, path, err)
+			}
+			if operation.RequestBody == nil {
+				continue
+			}
+			if content, ok := operation.RequestBody.Content["application/json"]; ok {
+				spec.bodies = append(spec.bodies, openAPIBody{
+					path:     path,
+					method:   strings.ToUpper(method),
+					required: operation.RequestBody.Required,
+					schema:   content.Schema,
+				})
+			}
+		}
+	}
+	return spec, nil
+}
+
+// openAPIHandler serves the specification
+func (*Vectorizer) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIJSON)
+}
+
+// matchPath reports whether path matches a path template like /centroid/{id}/add
+func matchPath(template, path string) bool {
+	want := strings.Split(strings.Trim(template, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i, segment := range want {
+		if !strings.HasPrefix(segment, "{") && segment != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validated checks JSON request bodies against the specification before
+// passing requests to next, so schema errors are reported precisely
+func (spec *openAPISpec) validated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var operation *openAPIBody
+		for i := range spec.bodies {
+			if spec.bodies[i].method == r.Method && matchPath(spec.bodies[i].path, r.URL.Path) {
+				operation = &spec.bodies[i]
+			}
+		}
+		// plain text bodies have no schema
+		if operation == nil || isPlainText(r) {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(bytes.TrimSpace(body)) > 0 || operation.required {
+			var value interface{}
+			if err := json.Unmarshal(body, &value); err != nil {
+				http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errs := spec.validate(operation.schema, value, "$"); len(errs) > 0 {
+				http.Error(w, "Invalid request body "+strings.Join(errs, "; "), http.StatusBadRequest)
+				return
+			}
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// validate returns the violations of s by value, path is the JSON path of
+// value. The keywords used by the specification are supported
+func (spec *openAPISpec) validate(s schema, value interface{}, path string) []string {
+	if ref, ok := s["$ref"].(string); ok {
+		return spec.validate(spec.schemas[strings.TrimPrefix(ref, "#/components/schemas/")], value, path)
+	}
+
+	var errs []string
+	if typ, ok := s["type"].(string); ok && !hasType(value, typ) {
+		return []string{fmt.Sprintf("%s: must be of type %s", path, typ)}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		var values []string
+		for _, v := range enum {
+			found = found || v == value
+			values = append(values, fmt.Sprint(v))
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: must be one of %s", path, strings.Join(values, ", ")))
+		}
+	}
+
+	if n, ok := value.(float64); ok {
+		if min, ok := s["minimum"].(float64); ok && n < min {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %v", path, min))
+		}
+		if max, ok := s["maximum"].(float64); ok && n > max {
+			errs = append(errs, fmt.Sprintf("%s: must be at most %v", path, max))
+		}
+		if min, ok := s["exclusiveMinimum"].(float64); ok && n <= min {
+			errs = append(errs, fmt.Sprintf("%s: must be greater than %v", path, min))
+		}
+		if max, ok := s["exclusiveMaximum"].(float64); ok && n >= max {
+			errs = append(errs, fmt.Sprintf("%s: must be less than %v", path, max))
+		}
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := object[name.(string)]; !ok {
+					errs = append(errs, fmt.Sprintf("%s: missing required property '%s'", path, name))
+				}
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		additional, _ := s["additionalProperties"].(map[string]interface{})
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				errs = append(errs, spec.validate(property, object[name], path+"."+name)...)
+			} else if additional != nil {
+				errs = append(errs, spec.validate(additional, object[name], path+"."+name)...)
+			}
+		}
+	}
+
+	if array, ok := value.([]interface{}); ok {
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				errs = append(errs, spec.validate(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+
+	if allOf, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, spec.validate(sub.(map[string]interface{}), value, path)...)
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		var matched int
+		var titles []string
+		for _, sub := range oneOf {
+			sub := sub.(map[string]interface{})
+			if len(spec.validate(sub, value, path)) == 0 {
+				matched++
+			}
+			if title, ok := sub["title"].(string); ok {
+				titles = append(titles, title)
+			}
+		}
+		if matched != 1 {
+			errs = append(errs, fmt.Sprintf("%s: must match exactly one of %s, matched %d", path, strings.Join(titles, ", "), matched))
+		}
+	}
+	return errs
+}
+
+// hasType reports whether a decoded JSON value is of a JSON schema type
+func hasType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case float64:
+		return typ == "number" || (typ == "integer" && v == math.Trunc(v))
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	}
+	return false
+}
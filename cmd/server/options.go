@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const maxNGrams = 3
+
+// vectorizeOptions controls how a corpus is turned into a vector. The server
+// defaults are read from the environment and can be overridden per request
+type vectorizeOptions struct {
+	// NGrams is the largest number of consecutive tokens looked up as a
+	// phrase, 1 disables phrase lookups
+	NGrams int `json:"ngrams"`
+	// NGramWeight is the weight of a phrase vector relative to a single word
+	NGramWeight float32 `json:"ngram_weight"`
+	// Entities keeps multi-word named entities together as a single unit
+	Entities bool `json:"entities"`
+	// EntityWeight is the weight of an entity relative to a single word
+	EntityWeight float32 `json:"entity_weight"`
+	// Compounds is the policy for words joined by hyphens or slashes
+	Compounds string `json:"compounds"`
+	// SplitIdentifiers splits camelCase identifiers into their words
+	SplitIdentifiers bool `json:"split_identifiers"`
+	// Markup is the format whose syntax is stripped before tokenization
+	Markup string `json:"markup"`
+	// StripBoilerplate additionally drops navigation, headers and footers
+	StripBoilerplate bool `json:"strip_boilerplate"`
+	// MinCoverage is the smallest fraction of words that must be found in
+	// the vocabulary for a vector to be returned
+	MinCoverage float32 `json:"min_coverage"`
+	// SkipStopwords leaves stopwords out of the centroid
+	SkipStopwords bool `json:"skip_stopwords"`
+	// MinTokenLength drops tokens of fewer characters, 0 keeps all
+	MinTokenLength int `json:"min_token_length,omitempty"`
+	// MaxTokenLength drops tokens of more characters, 0 keeps all
+	MaxTokenLength int `json:"max_token_length,omitempty"`
+	// KeepSingleLetters keeps tokens of a single letter, like "C" the
+	// language or vitamin "D", regardless of MinTokenLength
+	KeepSingleLetters bool `json:"keep_single_letters,omitempty"`
+	// IncludeTokens keeps only the tokens matching one of its regular
+	// expressions, empty keeps all
+	IncludeTokens []string `json:"include_tokens,omitempty"`
+	// ExcludeTokens drops the tokens matching one of its regular expressions
+	ExcludeTokens []string `json:"exclude_tokens,omitempty"`
+	// SynthesizeOOV gives out of vocabulary tokens a vector synthesized
+	// from their context, see synthesizeOOV
+	SynthesizeOOV bool `json:"synthesize_oov,omitempty"`
+	// Model is the alias of the model or ensemble of VECTORIZER_MODELS_CONFIG
+	// vectorizing, empty for the default model
+	Model string `json:"model,omitempty"`
+	// Lang selects the stopwords, empty for those of VECTORIZER_LANG and
+	// langAuto for those of the language detected in every text
+	Lang string `json:"lang,omitempty"`
+	// Accumulation is how the weighted sum of the centroid is accumulated,
+	// empty for float32
+	Accumulation string `json:"accumulation,omitempty"`
+	// Negation subtracts the words of a query prefixed with "-"
+	Negation bool `json:"negation,omitempty"`
+	// NegationWeight scales the negative terms subtracted, 0 for
+	// defaultNegationWeight
+	NegationWeight float32 `json:"negation_weight,omitempty"`
+	// Disambiguation moves the vector of every word towards its context in
+	// the text, 0 disables it and 1 keeps only the part along the context
+	Disambiguation float32 `json:"disambiguation,omitempty"`
+	// PositionDecay is the curve weighting the tokens of a text by their
+	// position, empty for none
+	PositionDecay string `json:"position_decay,omitempty"`
+	// PositionScale is the position in tokens at which PositionDecay halves
+	// the weight, 0 for defaultPositionScale
+	PositionScale float32 `json:"position_scale,omitempty"`
+	// RecencyHalfLife weights later texts of a query more, like the latest
+	// messages of a conversation: a text weighs half as much as the one
+	// RecencyHalfLife texts after it. 0 weights all texts alike
+	RecencyHalfLife float32 `json:"recency_half_life,omitempty"`
+	// Debias removes the bias direction of VECTORIZER_BIAS_PAIRS from the
+	// vector, see biasAxis
+	Debias bool `json:"debias,omitempty"`
+	// MaxTokens caps the number of tokens of every text, 0 disables the cap.
+	// It is only set when the server is degraded
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// Dims truncates the returned vectors to their first Dims dimensions,
+	// scaled to unit length, 0 returns all dimensions. See truncateVector
+	Dims int `json:"dims,omitempty"`
+	// Precision rounds the returned vectors to this many decimals, 0 keeps
+	// full float32 precision
+	Precision int `json:"precision,omitempty"`
+	// Encoding is the representation of the returned vectors. It does not
+	// change the vector itself
+	Encoding string `json:"-"`
+	// SimHashBits adds a simhash signature of this many bits of the returned
+	// vector to the response, 0 adds none. It does not change the vector
+	// itself
+	SimHashBits int `json:"-"`
+	// PQ adds the product quantization codes of the returned vector to the
+	// response. It does not change the vector itself
+	PQ bool `json:"-"`
+	// Manifest adds a description of everything that affected the vector
+	// to the response. It does not change the vector itself
+	Manifest bool `json:"-"`
+	// tenant is the account the looked up tokens are counted to, nil if
+	// API keys are disabled
+	tenant *tenantAccount
+	// stopwords checks that Lang has stopwords, nil skips the check
+	stopwords *stopwordLists
+	// aliases checks that Model is known
+	aliases *modelAliases
+	// timing collects the durations of the phases of the request, nil if
+	// they aren't reported
+	timing *requestTiming
+}
+
+// vectorizeRequest is the body accepted by the vectorize endpoint
+type vectorizeRequest struct {
+	// V is the version of the request schema, see decodeRequest
+	V *int `json:"v,omitempty"`
+	// Text is a single text, the same as a query of it
+	Text              *string                   `json:"text,omitempty"`
+	Query             []string                  `json:"query"`
+	Fields            map[string]vectorizeField `json:"fields,omitempty"`
+	Negative          []string                  `json:"negative,omitempty"`
+	MoveTo            *movement                 `json:"moveTo,omitempty"`
+	MoveAwayFrom      *movement                 `json:"moveAwayFrom,omitempty"`
+	NGrams            *int                      `json:"ngrams,omitempty"`
+	NGramWeight       *float32                  `json:"ngram_weight,omitempty"`
+	Entities          *bool                     `json:"entities,omitempty"`
+	EntityWeight      *float32                  `json:"entity_weight,omitempty"`
+	Compounds         *string                   `json:"compounds,omitempty"`
+	SplitIdentifiers  *bool                     `json:"split_identifiers,omitempty"`
+	Markup            *string                   `json:"markup,omitempty"`
+	StripBoilerplate  *bool                     `json:"strip_boilerplate,omitempty"`
+	MinCoverage       *float32                  `json:"min_coverage,omitempty"`
+	SkipStopwords     *bool                     `json:"skip_stopwords,omitempty"`
+	Lang              *string                   `json:"lang,omitempty"`
+	Model             *string                   `json:"model,omitempty"`
+	MinTokenLength    *int                      `json:"min_token_length,omitempty"`
+	MaxTokenLength    *int                      `json:"max_token_length,omitempty"`
+	KeepSingleLetters *bool                     `json:"keep_single_letters,omitempty"`
+	IncludeTokens     *[]string                 `json:"include_tokens,omitempty"`
+	ExcludeTokens     *[]string                 `json:"exclude_tokens,omitempty"`
+	SynthesizeOOV     *bool                     `json:"synthesize_oov,omitempty"`
+	Accumulation      *string                   `json:"accumulation,omitempty"`
+	Negation          *bool                     `json:"negation,omitempty"`
+	NegationWeight    *float32                  `json:"negation_weight,omitempty"`
+	Disambiguation    *float32                  `json:"disambiguation,omitempty"`
+	PositionDecay     *string                   `json:"position_decay,omitempty"`
+	PositionScale     *float32                  `json:"position_scale,omitempty"`
+	RecencyHalfLife   *float32                  `json:"recency_half_life,omitempty"`
+	Debias            *bool                     `json:"debias,omitempty"`
+	Dims              *int                      `json:"dims,omitempty"`
+	Precision         *int                      `json:"precision,omitempty"`
+	Encoding          *string                   `json:"encoding,omitempty"`
+	SimHashBits       *int                      `json:"simhash_bits,omitempty"`
+	PQ                *bool                     `json:"pq,omitempty"`
+	Manifest          *bool                     `json:"manifest,omitempty"`
+}
+
+// input returns the part of the request that is vectorized
+func (r *vectorizeRequest) input() interface{} {
+	var input interface{} = r.Query
+	if r.Fields != nil {
+		input = r.Fields
+	}
+	if r.Negative == nil && r.MoveTo == nil && r.MoveAwayFrom == nil {
+		return input
+	}
+	return map[string]interface{}{"input": input, "negative": r.Negative, "moveTo": r.MoveTo, "moveAwayFrom": r.MoveAwayFrom}
+}
+
+// vectorizeResponse is the body returned by the vectorize endpoint
+type vectorizeResponse struct {
+	Vector   *encodedVector `json:"vector"`
+	Quality  quality        `json:"quality"`
+	Manifest *manifest      `json:"manifest,omitempty"`
+	// Signature proves that the vector was produced by this server, it is
+	// only set if VECTORIZER_SIGNING_KEY is configured
+	Signature *signature `json:"signature,omitempty"`
+	// SimHash is the locality sensitive signature of the vector, only set
+	// if simhash_bits is
+	SimHash *lshSignature `json:"simhash,omitempty"`
+	// PQ holds the product quantization codes of the vector, only set if
+	// pq is
+	PQ *pqCodes `json:"pq,omitempty"`
+	// Degraded is set if the vector was computed on the cheaper path of an
+	// overloaded server
+	Degraded bool `json:"degraded,omitempty"`
+	// Empty is set if the request had no text and the vector is zero, with
+	// VECTORIZER_EMPTY_INPUT=zero
+	Empty bool `json:"empty,omitempty"`
+	// Fallback is set if no word of the input has a vector and the vector
+	// is that of VECTORIZER_FALLBACK_VECTOR
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// defaultOptions reads the server wide defaults from the environment
+func defaultOptions() (vectorizeOptions, error) {
+	opts := vectorizeOptions{
+		NGrams:        1,
+		NGramWeight:   1,
+		EntityWeight:  2,
+		Compounds:     compoundsSplit,
+		Markup:        markupNone,
+		SkipStopwords: true,
+		Encoding:      encodingFloat,
+	}
+
+	var include, exclude string
+	for _, err := range []error{
+		envInt("VECTORIZER_NGRAMS", &opts.NGrams),
+		envFloat32("VECTORIZER_NGRAM_WEIGHT", &opts.NGramWeight),
+		envBool("VECTORIZER_ENTITIES_ENABLED", &opts.Entities),
+		envFloat32("VECTORIZER_ENTITY_WEIGHT", &opts.EntityWeight),
+		envString("VECTORIZER_COMPOUNDS", &opts.Compounds),
+		envBool("VECTORIZER_SPLIT_IDENTIFIERS", &opts.SplitIdentifiers),
+		envString("VECTORIZER_MARKUP", &opts.Markup),
+		envBool("VECTORIZER_STRIP_BOILERPLATE", &opts.StripBoilerplate),
+		envFloat32("VECTORIZER_MIN_COVERAGE", &opts.MinCoverage),
+		envBool("VECTORIZER_SKIP_STOPWORDS", &opts.SkipStopwords),
+		envString("VECTORIZER_LANG", &opts.Lang),
+		envString("VECTORIZER_MODEL", &opts.Model),
+		envInt("VECTORIZER_MIN_TOKEN_LENGTH", &opts.MinTokenLength),
+		envInt("VECTORIZER_MAX_TOKEN_LENGTH", &opts.MaxTokenLength),
+		envBool("VECTORIZER_KEEP_SINGLE_LETTERS", &opts.KeepSingleLetters),
+		envBool("VECTORIZER_SYNTHESIZE_OOV", &opts.SynthesizeOOV),
+		envString("VECTORIZER_INCLUDE_TOKENS", &include),
+		envString("VECTORIZER_EXCLUDE_TOKENS", &exclude),
+		envString("VECTORIZER_ACCUMULATION", &opts.Accumulation),
+		envBool("VECTORIZER_NEGATION", &opts.Negation),
+		envFloat32("VECTORIZER_NEGATION_WEIGHT", &opts.NegationWeight),
+		envFloat32("VECTORIZER_DISAMBIGUATION", &opts.Disambiguation),
+		envString("VECTORIZER_POSITION_DECAY", &opts.PositionDecay),
+		envFloat32("VECTORIZER_POSITION_SCALE", &opts.PositionScale),
+		envFloat32("VECTORIZER_RECENCY_HALF_LIFE", &opts.RecencyHalfLife),
+		envBool("VECTORIZER_DEBIAS", &opts.Debias),
+		envInt("VECTORIZER_PRECISION", &opts.Precision),
+		envInt("VECTORIZER_DIMS", &opts.Dims),
+		envString("VECTORIZER_ENCODING", &opts.Encoding),
+		envInt("VECTORIZER_SIMHASH_BITS", &opts.SimHashBits),
+		envBool("VECTORIZER_PQ", &opts.PQ),
+		envBool("VECTORIZER_MANIFEST", &opts.Manifest),
+	} {
+		if err != nil {
+			return opts, err
+		}
+	}
+	opts.Accumulation = normalizeAccumulation(opts.Accumulation)
+	opts.Lang = normalizeLang(opts.Lang)
+	opts.Model = normalizeModel(opts.Model)
+	if include != "" {
+		opts.IncludeTokens = []string{include}
+	}
+	if exclude != "" {
+		opts.ExcludeTokens = []string{exclude}
+	}
+	if os.Getenv("VECTORIZER_NEGATION_WEIGHT") != "" && opts.NegationWeight <= 0 {
+		return opts, fmt.Errorf("VECTORIZER_NEGATION_WEIGHT must be positive")
+	}
+	opts.NegationWeight = normalizeNegationWeight(opts.NegationWeight)
+	opts.PositionDecay = normalizePositionDecay(opts.PositionDecay)
+	if os.Getenv("VECTORIZER_POSITION_SCALE") != "" && opts.PositionScale <= 0 {
+		return opts, fmt.Errorf("VECTORIZER_POSITION_SCALE must be positive")
+	}
+	opts.PositionScale = normalizePositionScale(opts.PositionScale)
+
+	return opts, opts.validate()
+}
+
+// options merges the overrides of the request into the defaults
+func (r *vectorizeRequest) options(defaults vectorizeOptions) (vectorizeOptions, error) {
+	opts := defaults
+	if r.NGrams != nil {
+		opts.NGrams = *r.NGrams
+	}
+	if r.NGramWeight != nil {
+		opts.NGramWeight = *r.NGramWeight
+	}
+	if r.Entities != nil {
+		opts.Entities = *r.Entities
+	}
+	if r.EntityWeight != nil {
+		opts.EntityWeight = *r.EntityWeight
+	}
+	if r.Compounds != nil {
+		opts.Compounds = *r.Compounds
+	}
+	if r.SplitIdentifiers != nil {
+		opts.SplitIdentifiers = *r.SplitIdentifiers
+	}
+	if r.Markup != nil {
+		opts.Markup = *r.Markup
+	}
+	if r.StripBoilerplate != nil {
+		opts.StripBoilerplate = *r.StripBoilerplate
+	}
+	if r.MinCoverage != nil {
+		opts.MinCoverage = *r.MinCoverage
+	}
+	if r.SkipStopwords != nil {
+		opts.SkipStopwords = *r.SkipStopwords
+	}
+	if r.Lang != nil {
+		opts.Lang = normalizeLang(*r.Lang)
+	}
+	if r.Model != nil {
+		opts.Model = normalizeModel(*r.Model)
+	}
+	if r.MinTokenLength != nil {
+		opts.MinTokenLength = *r.MinTokenLength
+	}
+	if r.MaxTokenLength != nil {
+		opts.MaxTokenLength = *r.MaxTokenLength
+	}
+	if r.KeepSingleLetters != nil {
+		opts.KeepSingleLetters = *r.KeepSingleLetters
+	}
+	if r.IncludeTokens != nil {
+		opts.IncludeTokens = *r.IncludeTokens
+	}
+	if r.ExcludeTokens != nil {
+		opts.ExcludeTokens = *r.ExcludeTokens
+	}
+	if r.SynthesizeOOV != nil {
+		opts.SynthesizeOOV = *r.SynthesizeOOV
+	}
+	if r.Accumulation != nil {
+		opts.Accumulation = normalizeAccumulation(*r.Accumulation)
+	}
+	if r.Negation != nil {
+		opts.Negation = *r.Negation
+	}
+	if r.NegationWeight != nil {
+		if *r.NegationWeight <= 0 {
+			return opts, fmt.Errorf("negation_weight must be positive")
+		}
+		opts.NegationWeight = normalizeNegationWeight(*r.NegationWeight)
+	}
+	if r.Disambiguation != nil {
+		opts.Disambiguation = *r.Disambiguation
+	}
+	if r.PositionDecay != nil {
+		opts.PositionDecay = normalizePositionDecay(*r.PositionDecay)
+	}
+	if r.PositionScale != nil {
+		if *r.PositionScale <= 0 {
+			return opts, fmt.Errorf("position_scale must be positive")
+		}
+		opts.PositionScale = normalizePositionScale(*r.PositionScale)
+	}
+	if r.RecencyHalfLife != nil {
+		opts.RecencyHalfLife = *r.RecencyHalfLife
+	}
+	if r.Debias != nil {
+		opts.Debias = *r.Debias
+	}
+	if r.Dims != nil {
+		opts.Dims = *r.Dims
+	}
+	if r.Precision != nil {
+		opts.Precision = *r.Precision
+	}
+	if r.Encoding != nil {
+		opts.Encoding = *r.Encoding
+	}
+	if r.SimHashBits != nil {
+		opts.SimHashBits = *r.SimHashBits
+	}
+	if r.PQ != nil {
+		opts.PQ = *r.PQ
+	}
+	if r.Manifest != nil {
+		opts.Manifest = *r.Manifest
+	}
+
+	return opts, opts.validate()
+}
+
+// degrade switches to the cheaper path used under load: no phrase or entity
+// lookups, no manifest and at most maxTokens tokens per text
+func (opts vectorizeOptions) degrade(maxTokens int) vectorizeOptions {
+	opts.NGrams = 1
+	opts.Entities = false
+	opts.Manifest = false
+	opts.MaxTokens = maxTokens
+	return opts
+}
+
+func (opts vectorizeOptions) validate() error {
+	if opts.NGrams < 1 || opts.NGrams > maxNGrams {
+		return fmt.Errorf("ngrams must be between 1 and %d", maxNGrams)
+	}
+	if opts.NGramWeight <= 0 {
+		return fmt.Errorf("ngram_weight must be positive")
+	}
+	if opts.EntityWeight <= 0 {
+		return fmt.Errorf("entity_weight must be positive")
+	}
+	if err := validCompoundPolicy(opts.Compounds); err != nil {
+		return err
+	}
+	if err := validMarkup(opts.Markup); err != nil {
+		return err
+	}
+	if opts.MinCoverage < 0 || opts.MinCoverage > 1 {
+		return fmt.Errorf("min_coverage must be between 0 and 1")
+	}
+	if err := validTokenLengths(opts.MinTokenLength, opts.MaxTokenLength); err != nil {
+		return err
+	}
+	if err := validTokenPatterns("include_tokens", opts.IncludeTokens); err != nil {
+		return err
+	}
+	if err := validTokenPatterns("exclude_tokens", opts.ExcludeTokens); err != nil {
+		return err
+	}
+	if opts.Disambiguation < 0 || opts.Disambiguation > 1 {
+		return fmt.Errorf("disambiguation must be between 0 and 1")
+	}
+	if err := validPositionDecay(opts.PositionDecay); err != nil {
+		return err
+	}
+	if opts.RecencyHalfLife < 0 {
+		return fmt.Errorf("recency_half_life must not be negative")
+	}
+	if opts.Dims < 0 {
+		return fmt.Errorf("dims must not be negative")
+	}
+	if opts.Precision < 0 || opts.Precision > maxPrecision {
+		return fmt.Errorf("precision must be between 0 and %d", maxPrecision)
+	}
+	if err := validSimHashBits(opts.SimHashBits); err != nil {
+		return err
+	}
+	if err := validEncoding(opts.Encoding); err != nil {
+		return err
+	}
+	if err := validAccumulation(opts.Accumulation); err != nil {
+		return err
+	}
+	if err := opts.stopwords.validLang(opts.Lang); err != nil {
+		return err
+	}
+	if err := opts.aliases.validModel(opts.Model); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pdfStream matches the dictionary and the data of a stream object
+var pdfStream = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+
+// extractPDFText extracts the text drawn by the content streams of a PDF.
+// It supports text based documents using Flate compressed or uncompressed
+// streams and literal strings, which covers most generated documents.
+// Scanned documents and fonts without a standard encoding yield no text
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", fmt.Errorf("not a PDF document")
+	}
+
+	var text strings.Builder
+	for _, loc := range pdfStream.FindAllSubmatchIndex(data, -1) {
+		dict := string(data[loc[2]:loc[3]])
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content := data[start : start+end]
+
+		if strings.Contains(dict, "/Subtype/Image") || strings.Contains(dict, "/Subtype /Image") {
+			continue
+		}
+		if strings.Contains(dict, "/FlateDecode") {
+			r, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// truncated streams still yield the text decoded so far
+			content, _ = io.ReadAll(r)
+		} else if strings.Contains(dict, "/Filter") {
+			continue
+		}
+
+		pdfContentText(content, &text)
+	}
+	return text.String(), nil
+}
+
+// pdfContentText appends the strings shown by the text operators of a
+// content stream to text
+func pdfContentText(content []byte, text *strings.Builder) {
+	var pending []string
+	inText := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '(':
+			s, n := pdfLiteral(content[i:])
+			pending = append(pending, s)
+			i += n - 1
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '/' || c == '<':
+			// names and hex strings, glyph ids can't be mapped to text
+			// without parsing the fonts
+			end := byte('>')
+			if c == '/' {
+				end = ' '
+			}
+			for i+1 < len(content) && content[i+1] != end && !(c == '/' && pdfDelimiter(content[i+1])) {
+				i++
+			}
+		case c == '\'' || c == '"':
+			if inText {
+				text.WriteString(" " + strings.Join(pending, "") + " ")
+			}
+			pending = pending[:0]
+		case isPDFOperatorStart(c):
+			j := i + 1
+			for j < len(content) && (isPDFOperatorStart(content[j]) || content[j] == '*') {
+				j++
+			}
+			switch op := string(content[i:j]); op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteString("\n")
+			case "Tj", "TJ":
+				if inText {
+					text.WriteString(strings.Join(pending, "") + " ")
+				}
+			case "T*", "Td", "TD", "Tm":
+				if inText {
+					text.WriteString(" ")
+				}
+			}
+			pending = pending[:0]
+			i = j - 1
+		case c == '-' || c == '.' || c >= '0' && c <= '9':
+			// large negative adjustments in TJ arrays separate words
+			j := i + 1
+			for j < len(content) && (content[j] == '.' || content[j] >= '0' && content[j] <= '9') {
+				j++
+			}
+			kern, err := strconv.ParseFloat(string(content[i:j]), 64)
+			if err == nil && kern < -200 && len(pending) > 0 {
+				pending = append(pending, " ")
+			}
+			i = j - 1
+		}
+	}
+}
+
+func pdfDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n()<>[]{}/%", c) >= 0
+}
+
+func isPDFOperatorStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// pdfLiteral decodes the literal string at the start of b and returns it
+// along with the number of bytes it spans
+func pdfLiteral(b []byte) (string, int) {
+	var s strings.Builder
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '(':
+			if depth > 0 {
+				s.WriteByte(c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s.String(), i + 1
+			}
+			s.WriteByte(c)
+		case '\\':
+			if i+1 >= len(b) {
+				return s.String(), len(b)
+			}
+			i++
+			switch e := b[i]; e {
+			case 'n', 'r':
+				s.WriteByte(' ')
+			case 't':
+				s.WriteByte('\t')
+			case 'b', 'f':
+			case '\r', '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					n := 0
+					for n < 3 && i < len(b) && b[i] >= '0' && b[i] <= '7' {
+						v = v*8 + int(b[i]-'0')
+						i++
+						n++
+					}
+					i--
+					s.WriteRune(rune(v))
+				} else {
+					s.WriteByte(e)
+				}
+			}
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String(), len(b)
+}
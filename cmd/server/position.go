@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// position decay curves weight the tokens of a text by their position, as
+// the start of a document usually carries most of its topic
+const (
+	positionNone        = "none"
+	positionExponential = "exponential"
+	positionLinear      = "linear"
+	positionReciprocal  = "reciprocal"
+)
+
+// defaultPositionScale is the position in tokens at which every curve
+// halves the weight
+const defaultPositionScale = 100
+
+func validPositionDecay(decay string) error {
+	switch decay {
+	case "", positionNone, positionExponential, positionLinear, positionReciprocal:
+		return nil
+	default:
+		return fmt.Errorf("position_decay must be one of %q, %q, %q or %q", positionNone, positionExponential, positionLinear, positionReciprocal)
+	}
+}
+
+// normalizePositionDecay maps the default to the empty string, so vectors
+// computed before the option existed keep their manifests
+func normalizePositionDecay(decay string) string {
+	if decay == positionNone {
+		return ""
+	}
+	return decay
+}
+
+// normalizePositionScale maps the default to 0 like normalizePositionDecay
+func normalizePositionScale(scale float32) float32 {
+	if scale == defaultPositionScale {
+		return 0
+	}
+	return scale
+}
+
+// positionWeight returns the weight of the token at pos, counted from 0 at
+// the start of the text. The weight is 1 at the start and 0.5 at the scale:
+// exponential halves it every scale tokens, linear reaches 0 at twice the
+// scale and reciprocal is 1/(1+pos/scale)
+func (opts vectorizeOptions) positionWeight(pos int) float32 {
+	scale := float64(opts.PositionScale)
+	if scale == 0 {
+		scale = defaultPositionScale
+	}
+	x := float64(pos) / scale
+	switch opts.PositionDecay {
+	case positionExponential:
+		return float32(math.Exp2(-x))
+	case positionLinear:
+		return float32(math.Max(0, 1-x/2))
+	case positionReciprocal:
+		return float32(1 / (1 + x))
+	default:
+		return 1
+	}
+}
+
+// recencyWeight returns the weight of text i of n: the last text weighs 1
+// and every RecencyHalfLife texts before it weigh half as much. It is 1 for
+// every text if RecencyHalfLife is 0
+func (opts vectorizeOptions) recencyWeight(i, n int) float32 {
+	if opts.RecencyHalfLife == 0 {
+		return 1
+	}
+	return float32(math.Exp2(-float64(n-1-i) / float64(opts.RecencyHalfLife)))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// pqCodes are the product quantization codes of a vector, one byte per
+// subspace of the codebook
+type pqCodes struct {
+	// Codebook identifies the codebook, the first 16 hex digits of the
+	// SHA-256 of its file
+	Codebook string `json:"codebook"`
+	// Codes holds the codes in base64
+	Codes string `json:"codes"`
+}
+
+// pqEncoder quantizes vectors with the codebook of VECTORIZER_PQ_CODEBOOK,
+// as trained by cmd/pqtrain. A nil encoder has no codebook
+type pqEncoder struct {
+	codebook *pkg.PQCodebook
+	hash     string
+}
+
+func pqEncoderFromEnv() (*pqEncoder, error) {
+	var path string
+	if err := envString("VECTORIZER_PQ_CODEBOOK", &path); err != nil || path == "" {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_PQ_CODEBOOK: %v", err)
+	}
+	defer f.Close()
+	sum := sha256.New()
+	codebook, err := pkg.ReadPQCodebook(bufio.NewReader(io.TeeReader(f, sum)))
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_PQ_CODEBOOK: %v", err)
+	}
+	return &pqEncoder{codebook: codebook, hash: hex.EncodeToString(sum.Sum(nil))[:16]}, nil
+}
+
+// encode returns the codes of values if enabled, nil otherwise
+func (e *pqEncoder) encode(values []float32, enabled bool) (*pqCodes, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if e == nil {
+		return nil, errors.New("pq needs a codebook, VECTORIZER_PQ_CODEBOOK is not set")
+	}
+	codes, err := e.codebook.Encode(values)
+	if err != nil {
+		return nil, err
+	}
+	return &pqCodes{Codebook: e.hash, Codes: base64.StdEncoding.EncodeToString(codes)}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// projection is a learned linear map applied to the pooled vectors of a
+// model or ensemble, e.g. onto the space and dimensions a target index
+// expects
+type projection struct {
+	// in and out are the dimensions before and after the projection
+	in, out int
+	// matrix holds in rows of out values, a vector v is mapped to v·matrix
+	matrix []float32
+	// hash identifies the matrix
+	hash string
+}
+
+// loadProjection reads the in x out float32 matrix of the .npy file path,
+// as written by numpy.save
+func loadProjection(path string) (*projection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rows, cols, values, err := pkg.ReadNpyMatrix(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	h := sha256.Sum256(pkg.AppendFloat32s(nil, values))
+	return &projection{in: rows, out: cols, matrix: values, hash: hex.EncodeToString(h[:])}, nil
+}
+
+// apply returns v·matrix
+func (p *projection) apply(values []float32) []float32 {
+	result := make([]float32, p.out)
+	for i, value := range values {
+		row := p.matrix[i*p.out : (i+1)*p.out]
+		for j, weight := range row {
+			result[j] += value * weight
+		}
+	}
+	return result
+}
+
+// project maps the vector of vectorized with the projection of the model of
+// opts, if it has one
+func (vtcrzr *Vectorizer) project(vectorized *vectorization, opts vectorizeOptions) (*vectorization, error) {
+	p := vtcrzr.aliases.projection(opts.Model)
+	if p == nil {
+		return vectorized, nil
+	}
+	values := vectorized.vector.ToArray()
+	if len(values) != p.in {
+		return nil, fmt.Errorf("projection takes %d dimensions, the vector has %d", p.in, len(values))
+	}
+	v := pkg.NewVector(p.apply(values))
+	vector, err := vtcrzr.nonFinite.centroid(&v)
+	if err != nil {
+		return nil, err
+	}
+	return &vectorization{vector: vector, quality: vectorized.quality}, nil
+}
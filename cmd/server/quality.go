@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// quality describes how much a centroid can be trusted
+type quality struct {
+	// Tokens is the number of words that were looked up
+	Tokens int `json:"tokens"`
+	// Found is the number of words that have a vector
+	Found int `json:"found"`
+	// Coverage is the fraction of words that have a vector
+	Coverage float32 `json:"coverage"`
+	// Dispersion is the weighted mean cosine distance of the contributing
+	// vectors to the centroid. High values mean unrelated words were averaged
+	Dispersion float32 `json:"dispersion"`
+	// EffectiveTokens is the number of equally weighted vectors that would
+	// carry the same information as the weighted ones
+	EffectiveTokens float32 `json:"effective_tokens"`
+	// Negated is the number of negative words whose vectors were
+	// subtracted
+	Negated int `json:"negated,omitempty"`
+}
+
+func computeQuality(corpus *corpusVectors, centroid *pkg.Vector) quality {
+	q := quality{Tokens: corpus.tokens, Found: corpus.found}
+	if corpus.tokens > 0 {
+		q.Coverage = float32(corpus.found) / float32(corpus.tokens)
+	}
+
+	var weightSum, squaredSum, distanceSum float32
+	for i, vector := range corpus.vectors {
+		weight := corpus.weights[i]
+		similarity, err := vector.CosineSimilarity(centroid)
+		if err != nil {
+			continue
+		}
+		weightSum += weight
+		squaredSum += weight * weight
+		distanceSum += weight * (1 - similarity)
+	}
+	if weightSum > 0 {
+		q.Dispersion = distanceSum / weightSum
+		q.EffectiveTokens = weightSum * weightSum / squaredSum
+	}
+	return q
+}
+
+// maxOOVReported caps the out of vocabulary words reported for a corpus
+const maxOOVReported = 100
+
+// appendOOV adds the words to the out of vocabulary words of a corpus unless
+// they are in it already or it is full
+func appendOOV(oov []string, words ...string) []string {
+next:
+	for _, word := range words {
+		if len(oov) == maxOOVReported {
+			break
+		}
+		for _, w := range oov {
+			if w == word {
+				continue next
+			}
+		}
+		oov = append(oov, word)
+	}
+	return oov
+}
+
+// reasons a corpus can't be vectorized, reported to clients
+const (
+	// reasonNoTokens means the corpus had no words to look up, e.g. it was
+	// empty or all stopwords
+	reasonNoTokens = "no_tokens"
+	// reasonOutOfVocabulary means none of the words are in the vocabulary
+	reasonOutOfVocabulary = "out_of_vocabulary"
+	// reasonInsufficientCoverage means too few words are in the vocabulary
+	reasonInsufficientCoverage = "insufficient_coverage"
+)
+
+// noVectorsError is returned when no word of a corpus has a vector
+type noVectorsError struct {
+	tokens int
+	oov    []string
+}
+
+func (e *noVectorsError) Error() string {
+	return "no vectors found for corpus"
+}
+
+// coverageError is returned when too few words of a corpus were found in the
+// vocabulary for its centroid to be meaningful
+type coverageError struct {
+	coverage    float32
+	minCoverage float32
+	tokens      int
+	oov         []string
+}
+
+func (e *coverageError) Error() string {
+	return fmt.Sprintf("insufficient vocabulary coverage %.2f, at least %.2f required", e.coverage, e.minCoverage)
+}
+
+// unusableCorpus is the body of 422 responses, telling clients why their
+// input could not be vectorized
+type unusableCorpus struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	// Tokens is the number of words that were looked up
+	Tokens      int      `json:"tokens"`
+	Coverage    *float32 `json:"coverage,omitempty"`
+	MinCoverage *float32 `json:"min_coverage,omitempty"`
+	// OOV holds the distinct words not in the vocabulary, at most
+	// maxOOVReported of them
+	OOV []string `json:"oov"`
+}
+
+// writeUnusableCorpus answers with 422 if err means the corpus had no usable
+// vocabulary, reporting whether it is false otherwise
+func writeUnusableCorpus(w http.ResponseWriter, err error) bool {
+	body := unusableCorpus{Error: "Failed to vectorize " + err.Error()}
+	var noVectorsErr *noVectorsError
+	var coverageErr *coverageError
+	switch {
+	case errors.As(err, &noVectorsErr):
+		body.Reason, body.Tokens, body.OOV = reasonOutOfVocabulary, noVectorsErr.tokens, noVectorsErr.oov
+		if noVectorsErr.tokens == 0 {
+			body.Reason = reasonNoTokens
+		}
+	case errors.As(err, &coverageErr):
+		body.Reason, body.Tokens, body.OOV = reasonInsufficientCoverage, coverageErr.tokens, coverageErr.oov
+		body.Coverage, body.MinCoverage = &coverageErr.coverage, &coverageErr.minCoverage
+	default:
+		return false
+	}
+	if body.OOV == nil {
+		body.OOV = []string{}
+	}
+
+	response, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(response)
+	return true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// errorReporter sends panics to Sentry or any service accepting its store
+// API, like GlitchTip. Events are sent in the background and dropped if the
+// service can't keep up
+type errorReporter struct {
+	// endpoint is the store API of the project of the DSN
+	endpoint    string
+	auth        string
+	environment string
+	events      chan *sentryEvent
+	client      *http.Client
+}
+
+// errorReporterFromEnv returns the configured reporter or nil if there is none
+func errorReporterFromEnv() (*errorReporter, error) {
+	var dsn string
+	r := &errorReporter{client: &http.Client{Timeout: 10 * time.Second}}
+	for _, err := range []error{
+		envString("VECTORIZER_SENTRY_DSN", &dsn),
+		envString("VECTORIZER_SENTRY_ENVIRONMENT", &r.environment),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dsn == "" {
+		return nil, nil
+	}
+
+	// DSNs look like https://<key>@<host>/<project>
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid VECTORIZER_SENTRY_DSN")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("VECTORIZER_SENTRY_DSN has no project")
+	}
+	r.endpoint = u.Scheme + "://" + u.Host + u.Path[:i] + "/api/" + project + "/store/"
+	r.auth = "Sentry sentry_version=7, sentry_client=glove-vectorizer/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		r.auth += ", sentry_secret=" + secret
+	}
+
+	r.events = make(chan *sentryEvent, 100)
+	go r.send()
+	return r, nil
+}
+
+// sentryEvent is an event of the Sentry store API
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Request *sentryRequest `json:"request,omitempty"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		// Frames are ordered from the outermost call to the panic
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	// InApp marks the frames of the server itself
+	InApp bool `json:"in_app"`
+}
+
+// sentryRequest describes the request that panicked. The body and the
+// headers are left out, they may hold texts or API keys
+type sentryRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+// report queues an event for a panic with the value recovered, called in the
+// deferred function so the stack is that of the panic
+func (r *errorReporter) report(recovered interface{}, req *http.Request, tags map[string]string) {
+	if r == nil {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := &sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "fatal",
+		Platform:    "go",
+		Logger:      "panic",
+		Environment: r.environment,
+		Tags:        tags,
+	}
+	event.ServerName, _ = os.Hostname()
+	if req != nil {
+		event.Request = &sentryRequest{URL: req.URL.Path, Method: req.Method}
+	}
+	exception := sentryException{Type: fmt.Sprintf("%T", recovered), Value: fmt.Sprint(recovered)}
+	exception.Stacktrace.Frames = panicFrames()
+	event.Exception.Values = []sentryException{exception}
+
+	select {
+	case r.events <- event:
+	default:
+		log.Printf("dropping error report %s, the queue is full", event.EventID)
+	}
+}
+
+// panicFrames returns the frames of the goroutine below the panic, oldest
+// first as Sentry expects
+func panicFrames() []sentryFrame {
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(1, pcs)]
+	frames := runtime.CallersFrames(pcs)
+
+	var stack []sentryFrame
+	panicked := false
+	for {
+		frame, more := frames.Next()
+		if panicked {
+			stack = append(stack, sentryFrame{
+				Function: frame.Function,
+				Filename: frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(frame.Function, "main.") || strings.Contains(frame.Function, "glove-840B-leveldb"),
+			})
+		}
+		// the frames above are the recovery itself
+		panicked = panicked || frame.Function == "runtime.gopanic"
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// send posts the queued events
+func (r *errorReporter) send() {
+	for event := range r.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("failed to encode error report: %v", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), r.client.Timeout)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			log.Printf("failed to send error report: %v", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", r.auth)
+		resp, err := r.client.Do(req)
+		cancel()
+		if err != nil {
+			log.Printf("failed to send error report: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("failed to send error report: %s", resp.Status)
+		}
+	}
+}
+
+// recordingWriter remembers whether the response was started, so a panic
+// after it can't be answered with a 500
+type recordingWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// recoverPanics answers requests whose handler panicked with 500, logs the
+// stack and reports the panic. Without it net/http drops the connection
+// and the client sees a reset instead of an error
+func (vtcrzr *Vectorizer) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// aborting a response on purpose is no failure
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			vtcrzr.panics.Add(1)
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, recovered, debug.Stack())
+			vtcrzr.reporter.report(recovered, r, map[string]string{"model_hash": vtcrzr.db().info.Hash})
+			if rw.started {
+				// the client sees a truncated response
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoverPanic recovers a panic outside of the HTTP handlers, where net/http
+// doesn't catch it and it would end the process. It is deferred by the
+// goroutines serving a Redis protocol connection, a NATS message or a bulk
+// job, source names them in the log and the report. The panic is counted,
+// logged and reported like one of a handler, and returned in err if it is
+// not nil
+func (vtcrzr *Vectorizer) recoverPanic(source string, err *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	vtcrzr.panics.Add(1)
+	log.Printf("panic in %s: %v\n%s", source, recovered, debug.Stack())
+	vtcrzr.reporter.report(recovered, nil, map[string]string{"model_hash": vtcrzr.db().info.Hash, "source": source})
+	if err != nil {
+		*err = fmt.Errorf("internal error: %v", recovered)
+	}
+}
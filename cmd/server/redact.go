@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// redactionVersion changes whenever the built-in patterns change
+const redactionVersion = "1"
+
+// redactionMask replaces redacted text. It contains no letters or digits so
+// the tokenizer drops it entirely
+const redactionMask = "***"
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]?\d{3}[\s.-]?\d{4}\b`)
+	cardPattern  = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+// redactor masks personal data and blocked words in text before it is
+// tokenized, so they never reach lookups or logs
+type redactor struct {
+	words *regexp.Regexp
+	// hash identifies the patterns and blocked words
+	hash string
+}
+
+// newRedactor creates a redactor, wordsPath optionally names a file with one
+// blocked word per line
+func newRedactor(wordsPath string) (*redactor, error) {
+	r := &redactor{hash: hashWords([]string{"version " + redactionVersion})}
+	if wordsPath == "" {
+		return r, nil
+	}
+
+	f, err := os.Open(wordsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	r.hash = hashWords(append(words, "version "+redactionVersion))
+	if len(words) > 0 {
+		r.words = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+	}
+	return r, nil
+}
+
+// redact masks emails, credit card numbers, phone numbers and blocked words
+func (r *redactor) redact(text string) string {
+	if r == nil {
+		return text
+	}
+
+	text = emailPattern.ReplaceAllString(text, redactionMask)
+	text = cardPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if luhn(match) {
+			return redactionMask
+		}
+		return match
+	})
+	text = phonePattern.ReplaceAllString(text, redactionMask)
+	if r.words != nil {
+		text = r.words.ReplaceAllString(text, redactionMask)
+	}
+	return text
+}
+
+// luhn reports whether the digits in number pass the Luhn checksum used by
+// payment cards
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
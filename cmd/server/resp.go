@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// The Redis protocol façade lets Redis clients read vectors:
+//
+//	GET word                   vector of a word
+//	MGET word [word ...]       vectors of several words
+//	EXISTS word [word ...]     number of words in the vocabulary
+//	VEC.TEXT text [JSON]       vector of a text
+//	VEC.DIM                    dimensions of the vectors
+//	AUTH [tenant] key          authenticates the connection by API key
+//
+// Vectors are returned as little endian float32 blobs, the format Redis
+// vector search uses, or as JSON arrays with the JSON argument. With API keys
+// enabled a connection has to AUTH first, and its commands and the words they
+// look up count to the quotas of the tenant of the key.
+
+// maxRESPBulk limits the size of a single argument
+const maxRESPBulk = 16 << 20
+
+// serveRESP accepts Redis protocol connections
+func (vtcrzr *Vectorizer) serveRESP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go vtcrzr.handleRESP(conn)
+	}
+}
+
+func (vtcrzr *Vectorizer) handleRESP(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	// a panic closes the connection after an error reply
+	var panicErr error
+	defer func() {
+		if panicErr != nil {
+			writeRESPError(w, "ERR "+panicErr.Error())
+			w.Flush()
+		}
+	}()
+	defer vtcrzr.recoverPanic("Redis protocol connection", &panicErr)
+	// account is the tenant the connection authenticated as
+	var account *tenantAccount
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				writeRESPError(w, "ERR Protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := vtcrzr.respCommand(w, args, &account)
+		// flush only once pipelined commands were answered
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readRESPCommand reads an array of bulk strings or an inline command
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > 1<<20 {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxRESPBulk {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRESPError(w *bufio.Writer, message string) {
+	w.WriteString("-" + message + "\r\n")
+}
+
+func writeRESPBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// respVector encodes a vector as blob or JSON, nil stays nil
+func respVector(vector *pkg.Vector, asJSON bool) ([]byte, error) {
+	if vector == nil {
+		return nil, nil
+	}
+	if asJSON {
+		return json.Marshal(vector.ToArray())
+	}
+	return pkg.AppendFloat32s(nil, vector.ToArray()), nil
+}
+
+// respCommand answers a command of the connection authenticated as account
+// and returns true if the connection is to be closed
+func (vtcrzr *Vectorizer) respCommand(w *bufio.Writer, args []string, account **tenantAccount) bool {
+	command := strings.ToUpper(args[0])
+	switch command {
+	case "AUTH", "QUIT":
+	default:
+		if vtcrzr.usage == nil {
+			break
+		}
+		if *account == nil {
+			writeRESPError(w, "NOAUTH Authentication required.")
+			return false
+		}
+		switch command {
+		case "PING", "SELECT", "CLIENT", "COMMAND":
+		default:
+			if exceeded, _ := (*account).admit(time.Now()); exceeded != "" {
+				writeRESPError(w, "ERR Quota exceeded, "+exceeded)
+				return false
+			}
+		}
+	}
+
+	switch command {
+	case "AUTH":
+		if len(args) != 2 && len(args) != 3 {
+			writeRESPError(w, "ERR wrong number of arguments for 'auth' command")
+			break
+		}
+		if vtcrzr.usage == nil {
+			writeRESPError(w, "ERR AUTH called without API keys, set VECTORIZER_API_KEYS to enable them")
+			break
+		}
+		// like Redis ACLs the key is the last argument, the tenant is
+		// implied by it
+		a := vtcrzr.usage.account(args[len(args)-1])
+		if a == nil {
+			writeRESPError(w, "WRONGPASS unknown API key")
+			break
+		}
+		*account = a
+		w.WriteString("+OK\r\n")
+	case "PING":
+		if len(args) > 1 {
+			writeRESPBulk(w, []byte(args[1]))
+		} else {
+			w.WriteString("+PONG\r\n")
+		}
+	case "QUIT":
+		w.WriteString("+OK\r\n")
+		return true
+	case "SELECT", "CLIENT":
+		w.WriteString("+OK\r\n")
+	case "COMMAND":
+		w.WriteString("*0\r\n")
+	case "GET":
+		if len(args) != 2 {
+			writeRESPError(w, "ERR wrong number of arguments for 'get' command")
+			break
+		}
+		vector, err := vtcrzr.lookup(args[1])
+		(*account).addTokens(1)
+		if err == nil {
+			var b []byte
+			if b, err = respVector(vector, false); err == nil {
+				writeRESPBulk(w, b)
+			}
+		}
+		if err != nil {
+			writeRESPError(w, "ERR "+err.Error())
+		}
+	case "MGET", "EXISTS":
+		if len(args) < 2 {
+			writeRESPError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+			break
+		}
+		words := args[1:]
+		known, err := vtcrzr.prefetch(words, vectorizeOptions{})
+		(*account).addTokens(len(words))
+		if err != nil {
+			writeRESPError(w, "ERR "+err.Error())
+			break
+		}
+		if command == "EXISTS" {
+			n := 0
+			for _, word := range words {
+				if known[word] != nil {
+					n++
+				}
+			}
+			fmt.Fprintf(w, ":%d\r\n", n)
+			break
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(words))
+		for _, word := range words {
+			b, _ := respVector(known[word], false)
+			writeRESPBulk(w, b)
+		}
+	case "VEC.TEXT":
+		asJSON := len(args) == 3 && strings.EqualFold(args[2], "JSON")
+		if len(args) < 2 || len(args) > 3 || (len(args) == 3 && !asJSON) {
+			writeRESPError(w, "ERR usage: VEC.TEXT text [JSON]")
+			break
+		}
+		opts := vtcrzr.defaults
+		opts.tenant = *account
+		vectorized, err := vtcrzr.vectorize([]string{args[1]}, opts)
+		if err != nil {
+			writeRESPError(w, "ERR "+err.Error())
+			break
+		}
+		b, err := respVector(vectorized.vector, asJSON)
+		if err != nil {
+			writeRESPError(w, "ERR "+err.Error())
+			break
+		}
+		writeRESPBulk(w, b)
+	case "VEC.DIM":
+		fmt.Fprintf(w, ":%d\r\n", vtcrzr.db().info.Dims)
+	default:
+		writeRESPError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return false
+}
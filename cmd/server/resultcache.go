@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// prefixes of the keys of the result cache
+const (
+	// resultPrefix keys the cached vectorizations by the hash of their
+	// model and their etag, so the results of a model can be flushed
+	resultPrefix = "result/"
+	// expiryPrefix keys the results by their expiry, oldest first, so
+	// expired and evicted results are found without a scan
+	expiryPrefix = "expiry/"
+)
+
+// resultCache keeps the vectorizations of whole requests in a LevelDB of
+// its own, so re-indexing a mostly unchanged corpus after a restart reads
+// few words. Results expire after ttl, and the ones expiring first are
+// evicted once the cache holds maxEntries
+type resultCache struct {
+	mu         sync.Mutex
+	db         *leveldb.DB
+	ttl        time.Duration
+	maxEntries int
+	// entries is the number of results stored
+	entries int
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func resultCacheFromEnv() (*resultCache, error) {
+	var dbPath string
+	c := &resultCache{ttl: 24 * time.Hour, maxEntries: 1000000}
+	for _, err := range []error{
+		envString("VECTORIZER_RESULT_CACHE", &dbPath),
+		envDuration("VECTORIZER_RESULT_CACHE_TTL", &c.ttl),
+		envInt("VECTORIZER_RESULT_CACHE_ENTRIES", &c.maxEntries),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dbPath == "" {
+		return nil, nil
+	}
+	if c.ttl <= 0 {
+		return nil, fmt.Errorf("VECTORIZER_RESULT_CACHE_TTL must be positive")
+	}
+	if c.maxEntries < 1 {
+		return nil, fmt.Errorf("VECTORIZER_RESULT_CACHE_ENTRIES must be positive")
+	}
+
+	var err error
+	c.db, err = leveldb.OpenFile(dbPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("result cache: %v", err)
+	}
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(expiryPrefix)), nil)
+	for iter.Next() {
+		c.entries++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("result cache: %v", err)
+	}
+	if err := c.evict(time.Now()); err != nil {
+		return nil, fmt.Errorf("result cache: %v", err)
+	}
+
+	interval := c.ttl / 10
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	go func() {
+		for now := range time.Tick(interval) {
+			if err := c.evict(now); err != nil {
+				log.Printf("failed to evict cached results: %v", err)
+			}
+		}
+	}()
+	return c, nil
+}
+
+// resultID identifies the result of etag computed with the model of
+// modelHash
+func resultID(modelHash, etag string) string {
+	return modelHash + "/" + etag
+}
+
+// expiryKey is the index key of the result id expiring at expiry
+func expiryKey(expiry int64, id string) []byte {
+	key := binary.BigEndian.AppendUint64([]byte(expiryPrefix), uint64(expiry))
+	return append(key, id...)
+}
+
+// get returns the cached vectorization of etag, if it hasn't expired
+func (c *resultCache) get(modelHash, etag string) (*vectorization, bool) {
+	if c == nil {
+		return nil, false
+	}
+	value, err := c.db.Get([]byte(resultPrefix+resultID(modelHash, etag)), nil)
+	if err != nil {
+		if !errors.Is(err, leveldb.ErrNotFound) {
+			log.Printf("failed to read cached result: %v", err)
+		}
+		c.misses.Add(1)
+		return nil, false
+	}
+	expiry, vectorized, err := decodeResult(value)
+	if err != nil {
+		log.Printf("ignoring cached result: %v", err)
+		c.misses.Add(1)
+		return nil, false
+	}
+	if time.Now().UnixNano() >= expiry {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return vectorized, true
+}
+
+// put caches the vectorization of etag. Failures are logged, the cache only
+// saves work
+func (c *resultCache) put(modelHash, etag string, vectorized *vectorization) {
+	if c == nil {
+		return
+	}
+	expiry := time.Now().Add(c.ttl).UnixNano()
+	value, err := encodeResult(expiry, vectorized)
+	if err != nil {
+		log.Printf("failed to cache result: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	batch := new(leveldb.Batch)
+	id := resultID(modelHash, etag)
+	key := []byte(resultPrefix + id)
+	// a result cached before is replaced along with its index key
+	old, err := c.db.Get(key, nil)
+	switch {
+	case err == nil:
+		if oldExpiry, _, err := decodeResult(old); err == nil {
+			batch.Delete(expiryKey(oldExpiry, id))
+			c.entries--
+		}
+	case !errors.Is(err, leveldb.ErrNotFound):
+		log.Printf("failed to cache result: %v", err)
+		return
+	}
+	batch.Put(key, value)
+	batch.Put(expiryKey(expiry, id), nil)
+	if err := c.db.Write(batch, nil); err != nil {
+		log.Printf("failed to cache result: %v", err)
+		return
+	}
+	c.entries++
+	if c.entries > c.maxEntries {
+		if err := c.evictLocked(time.Now()); err != nil {
+			log.Printf("failed to evict cached results: %v", err)
+		}
+	}
+}
+
+// evict deletes the expired results, and the ones expiring first while the
+// cache holds more than maxEntries
+func (c *resultCache) evict(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evictLocked(now)
+}
+
+func (c *resultCache) evictLocked(now time.Time) error {
+	batch := new(leveldb.Batch)
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(expiryPrefix)), nil)
+	for iter.Next() && batch.Len() < 2*c.entries {
+		key := iter.Key()
+		expiry := int64(binary.BigEndian.Uint64(key[len(expiryPrefix):]))
+		if expiry > now.UnixNano() && c.entries-batch.Len()/2 <= c.maxEntries {
+			break
+		}
+		batch.Delete(append([]byte{}, key...))
+		batch.Delete([]byte(resultPrefix + string(key[len(expiryPrefix)+8:])))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := c.db.Write(batch, nil); err != nil {
+		return err
+	}
+	c.entries -= batch.Len() / 2
+	return nil
+}
+
+// flush deletes the results of the model of modelHash, or all results if
+// modelHash is empty. It returns the number of results deleted
+func (c *resultCache) flush(modelHash string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := resultPrefix
+	if modelHash != "" {
+		prefix += modelHash + "/"
+	}
+	// n counts the index keys deleted, which are the entries
+	n := 0
+	batch := new(leveldb.Batch)
+	iter := c.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+		// corrupt results have no index key to delete
+		if expiry, _, err := decodeResult(iter.Value()); err == nil && modelHash != "" {
+			batch.Delete(expiryKey(expiry, string(iter.Key()[len(resultPrefix):])))
+			n++
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if modelHash == "" {
+		iter := c.db.NewIterator(util.BytesPrefix([]byte(expiryPrefix)), nil)
+		for iter.Next() {
+			batch.Delete(append([]byte{}, iter.Key()...))
+			n++
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	c.entries -= n
+	return n, nil
+}
+
+// resultHeader is the JSON part of a cached result: the quality, with the
+// fallback flag next to its fields so results cached without it decode as
+// they are
+type resultHeader struct {
+	quality
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// encodeResult encodes a cached result as its expiry, the length of its
+// resultHeader in JSON, the header and the values of the vector
+func encodeResult(expiry int64, vectorized *vectorization) ([]byte, error) {
+	q, err := json.Marshal(resultHeader{quality: vectorized.quality, Fallback: vectorized.fallback})
+	if err != nil {
+		return nil, err
+	}
+	value := binary.BigEndian.AppendUint64(nil, uint64(expiry))
+	value = binary.AppendUvarint(value, uint64(len(q)))
+	value = append(value, q...)
+	return pkg.AppendFloat32s(value, vectorized.vector.ToArray()), nil
+}
+
+func decodeResult(value []byte) (int64, *vectorization, error) {
+	if len(value) < 8 {
+		return 0, nil, fmt.Errorf("corrupt cached result")
+	}
+	expiry := int64(binary.BigEndian.Uint64(value))
+	n, size := binary.Uvarint(value[8:])
+	// vectors have at least one dimension
+	if size <= 0 || uint64(len(value)-8-size) <= n || (uint64(len(value)-8-size)-n)%4 != 0 {
+		return 0, nil, fmt.Errorf("corrupt cached result")
+	}
+	rest := value[8+size:]
+	var header resultHeader
+	if err := json.Unmarshal(rest[:n], &header); err != nil {
+		return 0, nil, fmt.Errorf("corrupt cached result: %v", err)
+	}
+	vectorized := vectorization{quality: header.quality, fallback: header.Fallback}
+	data := rest[n:]
+	values := make([]float32, len(data)/4)
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	v := pkg.NewVector(values)
+	vectorized.vector = &v
+	return expiry, &vectorized, nil
+}
+
+func (c *resultCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries
+}
+
+func (c *resultCache) writeMetrics(m *metricsWriter) {
+	if c == nil {
+		return
+	}
+	m.counter("vectorizer_result_cache_hits_total", "Number of requests answered from the result cache", float64(c.hits.Load()))
+	m.counter("vectorizer_result_cache_misses_total", "Number of requests vectorized because their result was not cached", float64(c.misses.Load()))
+	m.gauge("vectorizer_result_cache_entries", "Number of results in the result cache", float64(c.len()))
+}
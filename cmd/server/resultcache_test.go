@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+func TestResultRoundTrip(t *testing.T) {
+	for _, fallback := range []bool{false, true} {
+		vector := pkg.NewVector([]float32{0.5, -1.25, 3e-7, 42})
+		in := &vectorization{
+			vector: &vector,
+			quality: quality{
+				Tokens:          7,
+				Found:           5,
+				Coverage:        5.0 / 7,
+				Dispersion:      0.31,
+				EffectiveTokens: 4.2,
+				Negated:         2,
+			},
+			fallback: fallback,
+		}
+		value, err := encodeResult(1234567890, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expiry, out, err := decodeResult(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expiry != 1234567890 {
+			t.Errorf("expiry %d, expected 1234567890", expiry)
+		}
+		if !reflect.DeepEqual(out.vector.ToArray(), in.vector.ToArray()) {
+			t.Errorf("vector %v, expected %v", out.vector.ToArray(), in.vector.ToArray())
+		}
+		// the vector is compared above, every other field here
+		out.vector, in.vector = nil, nil
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("decoded %+v, expected %+v", out, in)
+		}
+	}
+}
+
+// results cached before the fallback flag existed have the quality alone
+// as their header
+func TestResultWithoutFallback(t *testing.T) {
+	header := []byte(`{"tokens":1,"found":1,"coverage":1,"dispersion":0,"effective_tokens":1}`)
+	value := binary.BigEndian.AppendUint64(nil, 99)
+	value = binary.AppendUvarint(value, uint64(len(header)))
+	value = append(value, header...)
+	value = pkg.AppendFloat32s(value, []float32{1, 2})
+
+	_, out, err := decodeResult(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.fallback || out.quality.Tokens != 1 || !reflect.DeepEqual(out.vector.ToArray(), []float32{1, 2}) {
+		t.Errorf("decoded %+v with vector %v", out, out.vector.ToArray())
+	}
+}
+
+func TestResultCorrupt(t *testing.T) {
+	vector := pkg.NewVector([]float32{1, 2, 3})
+	value, err := encodeResult(1, &vectorization{vector: &vector, quality: quality{Tokens: 3, Found: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header length is a single byte
+	header := int(value[8])
+
+	for name, corrupt := range map[string][]byte{
+		"empty":               nil,
+		"truncated expiry":    value[:5],
+		"missing header size": value[:8],
+		"truncated header":    value[:9+header/2],
+		"header only":         value[:9+header],
+		"odd vector length":   value[:len(value)-1],
+		"truncated value":     value[:len(value)-2],
+		"header size too big": append(append(append([]byte{}, value[:8]...), byte(header+40)), value[9:]...),
+		"invalid header":      append(append(append([]byte{}, value[:9]...), 'x'), value[10:]...),
+	} {
+		_, out, err := decodeResult(corrupt)
+		if err == nil {
+			t.Errorf("%s: decoded %+v", name, out)
+		}
+	}
+}
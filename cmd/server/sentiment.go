@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// the seed words of Turney and Littman, whose vectors span the polarity
+// direction of the embedding
+var (
+	positiveSeeds = []string{"good", "nice", "excellent", "positive", "fortunate", "correct", "superior", "happy"}
+	negativeSeeds = []string{"bad", "nasty", "poor", "negative", "unfortunate", "wrong", "inferior", "sad"}
+)
+
+// sentimentModel scores the polarity of texts by the similarity of their
+// vectors to positive and negative seed words, optionally combined with the
+// scores of the words found in a lexicon
+type sentimentModel struct {
+	positive []string
+	negative []string
+	// lexicon maps lowercase words to their polarity between -1 and 1,
+	// nil if no lexicon is loaded
+	lexicon map[string]float64
+	// lexiconWeight is the share of the lexicon score in the polarity of
+	// texts with lexicon hits
+	lexiconWeight float64
+}
+
+func sentimentFromEnv() (*sentimentModel, error) {
+	var lexiconPath, positive, negative string
+	lexiconWeight := float32(0.5)
+	for _, err := range []error{
+		envString("VECTORIZER_SENTIMENT_LEXICON", &lexiconPath),
+		envString("VECTORIZER_SENTIMENT_POSITIVE", &positive),
+		envString("VECTORIZER_SENTIMENT_NEGATIVE", &negative),
+		envFloat32("VECTORIZER_SENTIMENT_LEXICON_WEIGHT", &lexiconWeight),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if lexiconWeight < 0 || lexiconWeight > 1 {
+		return nil, fmt.Errorf("VECTORIZER_SENTIMENT_LEXICON_WEIGHT must be between 0 and 1")
+	}
+
+	m := &sentimentModel{
+		positive:      positiveSeeds,
+		negative:      negativeSeeds,
+		lexiconWeight: float64(lexiconWeight),
+	}
+	if positive != "" {
+		m.positive = strings.FieldsFunc(positive, isSeedSeparator)
+	}
+	if negative != "" {
+		m.negative = strings.FieldsFunc(negative, isSeedSeparator)
+	}
+	if lexiconPath != "" {
+		lexicon, err := loadSentimentLexicon(lexiconPath)
+		if err != nil {
+			return nil, fmt.Errorf("sentiment lexicon: %v", err)
+		}
+		m.lexicon = lexicon
+	}
+	return m, nil
+}
+
+func isSeedSeparator(c rune) bool {
+	return c == ',' || unicode.IsSpace(c)
+}
+
+// loadSentimentLexicon reads one word and its score per line, separated by
+// whitespace like in AFINN. Lines starting with # are comments. The scores are
+// scaled to -1 to 1 by the largest absolute score
+func loadSentimentLexicon(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lexicon := map[string]float64{}
+	var largest float64
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.LastIndexAny(text, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: missing score", line)
+		}
+		score, err := strconv.ParseFloat(text[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		lexicon[strings.ToLower(strings.TrimSpace(text[:i]))] = score
+		largest = math.Max(largest, math.Abs(score))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if largest > 0 {
+		for word, score := range lexicon {
+			lexicon[word] = score / largest
+		}
+	}
+	return lexicon, nil
+}
+
+// sentimentResponse is the body returned by the sentiment endpoint
+type sentimentResponse struct {
+	// Polarity is negative for negative and positive for positive texts
+	Polarity float64 `json:"polarity"`
+	// Embedding is the similarity of the text to the positive seeds minus
+	// its similarity to the negative seeds
+	Embedding float64 `json:"embedding"`
+	// Lexicon is the average score of the words found in the lexicon
+	Lexicon *float64 `json:"lexicon,omitempty"`
+	// LexiconHits counts the words found in the lexicon
+	LexiconHits int     `json:"lexicon_hits"`
+	Quality     quality `json:"quality"`
+	Degraded    bool    `json:"degraded,omitempty"`
+}
+
+// sentimentHandler scores the polarity of a text
+func (vtcrzr *Vectorizer) sentimentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody vectorizeRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := requestBody.checkInput(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	texts := requestBody.Query
+	if requestBody.Fields != nil {
+		texts = nil
+		for _, field := range requestBody.Fields {
+			texts = append(texts, field.Text)
+		}
+	}
+	vectorized, err := vtcrzr.vectorizeBody(&requestBody, opts)
+	if err != nil {
+		vectorizeError(w, err)
+		return
+	}
+
+	// the seeds are single words, phrases and the coverage don't apply and
+	// they are not counted to the tenant
+	seedOpts := opts
+	seedOpts.NGrams = 1
+	seedOpts.Entities = false
+	seedOpts.MinCoverage = 0
+	seedOpts.tenant = nil
+	text := unitVector(vectorized.vector.ToArray())
+	var similarities [2]float64
+	for i, seeds := range [][]string{vtcrzr.sentiment.positive, vtcrzr.sentiment.negative} {
+		seedVector, err := vtcrzr.vectorize(seeds, seedOpts)
+		if err != nil {
+			http.Error(w, "Failed to vectorize sentiment seeds "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for j, value := range unitVector(seedVector.vector.ToArray()) {
+			similarities[i] += value * text[j]
+		}
+	}
+	embedding := similarities[0] - similarities[1]
+
+	responseBody := sentimentResponse{
+		Polarity:  embedding,
+		Embedding: embedding,
+		Quality:   vectorized.quality,
+		Degraded:  degraded,
+	}
+	if lexicon, hits := vtcrzr.sentiment.lexiconScore(vtcrzr, texts, opts); hits > 0 {
+		responseBody.Lexicon = &lexicon
+		responseBody.LexiconHits = hits
+		weight := vtcrzr.sentiment.lexiconWeight
+		responseBody.Polarity = (1-weight)*embedding + weight*lexicon
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// lexiconScore averages the scores of the words of texts found in the
+// lexicon and counts them
+func (m *sentimentModel) lexiconScore(vtcrzr *Vectorizer, texts []string, opts vectorizeOptions) (float64, int) {
+	if m.lexicon == nil {
+		return 0, 0
+	}
+
+	var sum float64
+	var hits int
+	for _, text := range texts {
+		for _, token := range tokenize(vtcrzr.preprocess(text, opts), opts) {
+			if score, ok := m.lexicon[strings.ToLower(token)]; ok {
+				sum += score
+				hits++
+			}
+		}
+	}
+	if hits == 0 {
+		return 0, 0
+	}
+	return sum / float64(hits), hits
+}
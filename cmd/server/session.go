@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// centroidSession keeps the running weighted sum of a document that is
+// vectorized in chunks, so the chunks don't have to be held in memory
+type centroidSession struct {
+	mu   sync.Mutex
+	opts vectorizeOptions
+	// sum is the weighted sum of all vectors
+	sum []float64
+	// unitSum is the weighted sum of all normalized vectors, used for the
+	// dispersion of the final centroid
+	unitSum    []float64
+	weightSum  float64
+	squaredSum float64
+	tokens     int
+	found      int
+	// oov holds the tokens without a vector, reported if there are too many
+	oov      []string
+	lastUsed time.Time
+}
+
+// add folds the collected vectors into the running sums
+func (s *centroidSession) add(corpus *corpusVectors) error {
+	for i, vector := range corpus.vectors {
+		values := vector.ToArray()
+		if s.sum == nil {
+			s.sum = make([]float64, len(values))
+			s.unitSum = make([]float64, len(values))
+		}
+		if len(values) != len(s.sum) {
+			return fmt.Errorf("vectors have different lengths; %v vs %v", len(values), len(s.sum))
+		}
+
+		var norm float64
+		for _, value := range values {
+			norm += float64(value) * float64(value)
+		}
+		norm = math.Sqrt(norm)
+
+		weight := float64(corpus.weights[i])
+		for j, value := range values {
+			s.sum[j] += weight * float64(value)
+			if norm > 0 {
+				s.unitSum[j] += weight * float64(value) / norm
+			}
+		}
+		s.weightSum += weight
+		s.squaredSum += weight * weight
+	}
+	s.tokens += corpus.tokens
+	s.found += corpus.found
+	s.oov = appendOOV(s.oov, corpus.oov...)
+	return nil
+}
+
+// finish computes the centroid of everything added to the session
+func (s *centroidSession) finish() (*vectorization, error) {
+	if s.weightSum == 0 {
+		return nil, &noVectorsError{tokens: s.tokens, oov: s.oov}
+	}
+
+	centroid := make([]float32, len(s.sum))
+	var norm float64
+	for i, value := range s.sum {
+		centroid[i] = float32(value / s.weightSum)
+		norm += value * value
+	}
+	norm = math.Sqrt(norm)
+
+	q := quality{
+		Tokens:          s.tokens,
+		Found:           s.found,
+		EffectiveTokens: float32(s.weightSum * s.weightSum / s.squaredSum),
+	}
+	if s.tokens > 0 {
+		q.Coverage = float32(s.found) / float32(s.tokens)
+	}
+	if norm > 0 {
+		// the weighted cosine similarities to the centroid add up to the
+		// projection of the normalized sum onto the normalized centroid
+		var projection float64
+		for i, value := range s.unitSum {
+			projection += value * s.sum[i] / norm
+		}
+		q.Dispersion = float32((s.weightSum - projection) / s.weightSum)
+	}
+	if q.Coverage < s.opts.MinCoverage {
+		return nil, &coverageError{coverage: q.Coverage, minCoverage: s.opts.MinCoverage, tokens: s.tokens, oov: s.oov}
+	}
+
+	vector := pkg.NewVector(centroid)
+	return &vectorization{vector: &vector, quality: q}, nil
+}
+
+// sessionStore holds the open centroid sessions. Sessions that are not used
+// for ttl are dropped
+type sessionStore struct {
+	mu          sync.Mutex
+	sessions    map[string]*centroidSession
+	ttl         time.Duration
+	maxSessions int
+}
+
+func newSessionStore(ttl time.Duration, maxSessions int) *sessionStore {
+	store := &sessionStore{
+		sessions:    map[string]*centroidSession{},
+		ttl:         ttl,
+		maxSessions: maxSessions,
+	}
+	go store.expire()
+	return store
+}
+
+func (store *sessionStore) expire() {
+	for range time.Tick(store.ttl / 2) {
+		store.mu.Lock()
+		for id, session := range store.sessions {
+			session.mu.Lock()
+			if time.Since(session.lastUsed) > store.ttl {
+				delete(store.sessions, id)
+			}
+			session.mu.Unlock()
+		}
+		store.mu.Unlock()
+	}
+}
+
+var errTooManySessions = errors.New("too many open sessions")
+
+func (store *sessionStore) start(opts vectorizeOptions) (string, *centroidSession, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(b)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.sessions) >= store.maxSessions {
+		return "", nil, errTooManySessions
+	}
+	session := &centroidSession{opts: opts, lastUsed: time.Now()}
+	store.sessions[id] = session
+	return id, session, nil
+}
+
+func (store *sessionStore) get(id string) *centroidSession {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sessions[id]
+}
+
+func (store *sessionStore) remove(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+}
+
+// sessionResponse is returned when a session is started or extended
+type sessionResponse struct {
+	ID     string `json:"id"`
+	Tokens int    `json:"tokens"`
+	Found  int    `json:"found"`
+}
+
+// centroidHandler serves POST /centroid/start, POST /centroid/{id}/add and
+// GET /centroid/{id}/finish
+func (vtcrzr *Vectorizer) centroidHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/centroid/"), "/")
+	if path == "start" {
+		vtcrzr.startSession(w, r)
+		return
+	}
+
+	id, action, ok := strings.Cut(path, "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch action {
+	case "add":
+		vtcrzr.addToSession(w, r, id)
+	case "finish":
+		vtcrzr.finishSession(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (vtcrzr *Vectorizer) startSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody vectorizeRequest
+	if r.ContentLength != 0 {
+		if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+			http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if requestBody.Fields != nil {
+		http.Error(w, "'fields' is not supported by centroid sessions", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the running sums hold the vectors of a single model
+	if vtcrzr.aliases.ensemble(opts.Model) != nil {
+		http.Error(w, "Ensemble "+opts.Model+" is not supported by centroid sessions", http.StatusBadRequest)
+		return
+	}
+	opts.tenant = tenantOf(r)
+
+	id, session, err := vtcrzr.sessions.start(opts)
+	if errors.Is(err, errTooManySessions) {
+		http.Error(w, "Failed to start session "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to start session "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vtcrzr.addQuery(w, id, session, requestBody.Query)
+}
+
+func (vtcrzr *Vectorizer) addToSession(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := vtcrzr.sessions.get(id)
+	if session == nil {
+		http.Error(w, "Unknown session "+id, http.StatusNotFound)
+		return
+	}
+
+	var requestBody vectorizeRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Query == nil {
+		http.Error(w, "Missing 'query' field in request body", http.StatusBadRequest)
+		return
+	}
+
+	vtcrzr.addQuery(w, id, session, requestBody.Query)
+}
+
+// addQuery adds the vectors of query to the session and reports its counts
+func (vtcrzr *Vectorizer) addQuery(w http.ResponseWriter, id string, session *centroidSession, query []string) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.lastUsed = time.Now()
+
+	corpus, err := vtcrzr.collect(query, session.opts)
+	if err != nil {
+		vectorizeError(w, err)
+		return
+	}
+	if err := session.add(corpus); err != nil {
+		http.Error(w, "Failed to vectorize "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(sessionResponse{ID: id, Tokens: session.tokens, Found: session.found})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (vtcrzr *Vectorizer) finishSession(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := vtcrzr.sessions.get(id)
+	if session == nil {
+		http.Error(w, "Unknown session "+id, http.StatusNotFound)
+		return
+	}
+	vtcrzr.sessions.remove(id)
+
+	session.mu.Lock()
+	vectorized, err := session.finish()
+	session.mu.Unlock()
+	if err == nil {
+		// the sums are in the space of the model
+		vectorized, err = vtcrzr.finish(vectorized, session.opts)
+	}
+	if err != nil {
+		vectorizeError(w, err)
+		return
+	}
+
+	m, err := vtcrzr.manifest(session.opts)
+	if err != nil {
+		http.Error(w, "Failed to create manifest "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(configHashHeader, m.Hash)
+
+	responseBody := vectorizeResponse{
+		Vector:  newEncodedVector(vectorized.vector, session.opts),
+		Quality: vectorized.quality,
+	}
+	if session.opts.Manifest {
+		responseBody.Manifest = m
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
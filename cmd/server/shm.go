@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/shm"
+)
+
+// segmentExporter writes the vectors of the served database to a shared
+// memory segment, see package shm, so co-located processes read them
+// without HTTP
+type segmentExporter struct {
+	path string
+	// mu serializes exports, an activation during an export waits for it
+	mu sync.Mutex
+	// exported is the model hash of the segment written last, a database
+	// reopened after read failures isn't exported again
+	exported string
+}
+
+// segmentExporterFromEnv returns the configured exporter or nil if there is
+// none
+func segmentExporterFromEnv() (*segmentExporter, error) {
+	e := &segmentExporter{}
+	if err := envString("VECTORIZER_SHM_PATH", &e.path); err != nil {
+		return nil, err
+	}
+	if e.path == "" {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// export replaces the segment with the vectors of db. Records that don't
+// decode to finite vectors of the model's dimensions are skipped
+func (e *segmentExporter) export(db *servedDB) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if db.info.Hash == e.exported {
+		return
+	}
+
+	start := time.Now()
+	w, err := shm.Create(e.path, db.info.Hash, db.info.Dims)
+	if err != nil {
+		log.Printf("failed to export vectors to %s: %v", e.path, err)
+		return
+	}
+	skipped := 0
+	for _, shard := range db.store.shards {
+		iter := shard.NewIterator(nil, nil)
+		for iter.Next() {
+			vector, err := decodeVector(iter.Value())
+			if err != nil || vector.Len() != db.info.Dims || pkg.NonFinite(vector.ToArray()) > 0 {
+				skipped++
+				continue
+			}
+			if err := w.Add(string(iter.Key()), vector.ToArray()); err != nil {
+				iter.Release()
+				w.Abort()
+				log.Printf("failed to export vectors to %s: %v", e.path, err)
+				return
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			w.Abort()
+			log.Printf("failed to export vectors to %s: %v", e.path, err)
+			return
+		}
+	}
+	if err := w.Commit(); err != nil {
+		log.Printf("failed to export vectors to %s: %v", e.path, err)
+		return
+	}
+	e.exported = db.info.Hash
+	log.Printf("exported %d vectors of version %s to %s in %s, skipped %d records", w.Rows(), db.version, e.path, time.Since(start).Round(time.Millisecond), skipped)
+}
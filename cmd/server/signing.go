@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// signatureVersion prefixes the signed message, so signatures can't be
+// replayed for another message format
+const signatureVersion = "glove-vectorizer-signature-v1"
+
+// responseSigner signs vectors with the Ed25519 key of the server, so
+// downstream systems can verify that a vector was produced by a trusted
+// vectorizer with a specific model
+type responseSigner struct {
+	key ed25519.PrivateKey
+	// keyID identifies the public key, the first 8 bytes of its SHA-256
+	keyID string
+}
+
+// signature is the part of a response proving its origin
+type signature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	// InputHash is the SHA-256 of the JSON of the vectorized input
+	InputHash string `json:"input_hash"`
+	// VectorHash is the SHA-256 of the little endian float32 values of the
+	// returned vector, as rounded to the precision of the request
+	VectorHash string `json:"vector_hash"`
+	ModelHash  string `json:"model_hash"`
+	ConfigHash string `json:"config_hash"`
+	// Value is the base64 of the signature of message
+	Value string `json:"value"`
+}
+
+// signingKey is the body returned by the signing key endpoint
+type signingKey struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// responseSignerFromEnv reads the PKCS #8 PEM Ed25519 private key in
+// VECTORIZER_SIGNING_KEY, as written by
+// "openssl genpkey -algorithm ed25519". It returns nil if none is set
+func responseSignerFromEnv() (*responseSigner, error) {
+	path := os.Getenv("VECTORIZER_SIGNING_KEY")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_SIGNING_KEY: %v", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("VECTORIZER_SIGNING_KEY: %s has no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_SIGNING_KEY: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("VECTORIZER_SIGNING_KEY: %s is not an Ed25519 key", path)
+	}
+	h := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return &responseSigner{key: key, keyID: hex.EncodeToString(h[:8])}, nil
+}
+
+// message returns the bytes that are signed: the version and the hashes of
+// s, one per line
+func (s *signature) message() []byte {
+	return []byte(strings.Join([]string{signatureVersion, s.InputHash, s.VectorHash, s.ModelHash, s.ConfigHash}, "\n"))
+}
+
+// sign returns the signature of the vector values produced for input under
+// the manifest m. A nil signer signs nothing
+func (rs *responseSigner) sign(input interface{}, values []float32, m *manifest) (*signature, error) {
+	if rs == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	inputHash := sha256.Sum256(b)
+	vectorHash := sha256.Sum256(pkg.AppendFloat32s(nil, values))
+
+	s := &signature{
+		Algorithm:  "ed25519",
+		KeyID:      rs.keyID,
+		InputHash:  hex.EncodeToString(inputHash[:]),
+		VectorHash: hex.EncodeToString(vectorHash[:]),
+		ModelHash:  m.ModelHash,
+		ConfigHash: m.Hash,
+	}
+	s.Value = base64.StdEncoding.EncodeToString(ed25519.Sign(rs.key, s.message()))
+	return s, nil
+}
+
+// signingKeyHandler returns the public key verifying the signatures of the
+// server, 404 if responses aren't signed
+func (vtcrzr *Vectorizer) signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if vtcrzr.signer == nil {
+		http.Error(w, "responses are not signed", http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(signingKey{
+		Algorithm: "ed25519",
+		KeyID:     vtcrzr.signer.keyID,
+		PublicKey: base64.StdEncoding.EncodeToString(vtcrzr.signer.key.Public().(ed25519.PublicKey)),
+	})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+)
+
+// maxSimHashBits is the longest signature, and the number of hyperplanes
+// generated per dimensionality
+const maxSimHashBits = 1024
+
+// lshSignature is the simhash, a locality sensitive signature, of a vector:
+// bit i is set if the vector lies on the positive side of hyperplane i. The
+// Hamming distance of two signatures estimates the angle of their vectors,
+// signatures are only comparable under the same Planes
+type lshSignature struct {
+	Bits int `json:"bits"`
+	// Planes identifies the hyperplanes
+	Planes string `json:"planes"`
+	// Value holds the bits in hex, the first hyperplane in the highest bit
+	Value string `json:"value"`
+}
+
+// simHasher holds the hyperplanes of the signatures, either read from the
+// .npy matrix of VECTORIZER_SIMHASH_PLANES, one hyperplane per row, or
+// generated from VECTORIZER_SIMHASH_SEED for every dimensionality asked
+// for, so every server with the same seed signs alike
+type simHasher struct {
+	seed uint64
+	// planes holds the hyperplanes of the file, nil if they are generated
+	planes     []float32
+	rows, cols int
+	fileHash   string
+
+	mu sync.Mutex
+	// generated holds maxSimHashBits hyperplanes per dimensionality
+	generated map[int][]float32
+}
+
+func simHasherFromEnv() (*simHasher, error) {
+	h := &simHasher{generated: map[int][]float32{}}
+	seed := 1
+	var path string
+	for _, err := range []error{
+		envInt("VECTORIZER_SIMHASH_SEED", &seed),
+		envString("VECTORIZER_SIMHASH_PLANES", &path),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.seed = uint64(seed)
+	if path == "" {
+		return h, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_SIMHASH_PLANES: %v", err)
+	}
+	defer f.Close()
+	sum := sha256.New()
+	h.rows, h.cols, h.planes, err = pkg.ReadNpyMatrix(bufio.NewReader(io.TeeReader(f, sum)))
+	if err != nil {
+		return nil, fmt.Errorf("VECTORIZER_SIMHASH_PLANES: %v", err)
+	}
+	h.fileHash = hex.EncodeToString(sum.Sum(nil))[:16]
+	return h, nil
+}
+
+// validSimHashBits returns an error unless bits is 0, for no signature, or
+// a multiple of 8 up to maxSimHashBits
+func validSimHashBits(bits int) error {
+	if bits < 0 || bits > maxSimHashBits || bits%8 != 0 {
+		return fmt.Errorf("simhash_bits must be a multiple of 8 between 0 and %d", maxSimHashBits)
+	}
+	return nil
+}
+
+// hyperplanes returns the hyperplanes for vectors of dims dimensions and
+// their identifier
+func (h *simHasher) hyperplanes(dims, bits int) ([]float32, string, error) {
+	if h.planes != nil {
+		if h.cols != dims {
+			return nil, "", fmt.Errorf("the simhash hyperplanes are of %d dimensions, the vector has %d", h.cols, dims)
+		}
+		if bits > h.rows {
+			return nil, "", fmt.Errorf("simhash_bits must be at most %d, the number of hyperplanes", h.rows)
+		}
+		return h.planes, h.fileHash, nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	planes, ok := h.generated[dims]
+	if !ok {
+		planes = gaussianPlanes(h.seed, maxSimHashBits, dims)
+		h.generated[dims] = planes
+	}
+	return planes, "seed-" + strconv.FormatUint(h.seed, 10), nil
+}
+
+// sign returns the signature of bits bits of values, nil for 0 bits
+func (h *simHasher) sign(values []float32, bits int) (*lshSignature, error) {
+	if bits == 0 {
+		return nil, nil
+	}
+	planes, id, err := h.hyperplanes(len(values), bits)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, bits/8)
+	for i := 0; i < bits; i++ {
+		if vecmath.Dot(planes[i*len(values):(i+1)*len(values)], values) >= 0 {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return &lshSignature{Bits: bits, Planes: id, Value: hex.EncodeToString(b)}, nil
+}
+
+// gaussianPlanes returns n hyperplanes of dims standard normal values,
+// generated by splitmix64 and the Box-Muller transform. Both are fully
+// specified, so the planes of a seed never change
+func gaussianPlanes(seed uint64, n, dims int) []float32 {
+	state := seed
+	next := func() float64 {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		// 53 random bits in (0, 1]
+		return (float64(z>>11) + 1) / (1 << 53)
+	}
+	planes := make([]float32, n*dims)
+	for i := 0; i < len(planes); i += 2 {
+		r := math.Sqrt(-2 * math.Log(next()))
+		theta := 2 * math.Pi * next()
+		planes[i] = float32(r * math.Cos(theta))
+		if i+1 < len(planes) {
+			planes[i+1] = float32(r * math.Sin(theta))
+		}
+	}
+	return planes
+}
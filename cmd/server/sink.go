@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vector databases bulk job results can be pushed to
+const (
+	sinkQdrant   = "qdrant"
+	sinkMilvus   = "milvus"
+	sinkWeaviate = "weaviate"
+)
+
+// sinkPoint is a vectorized document pushed to a vector database
+type sinkPoint struct {
+	id     string
+	vector []float32
+	text   string
+}
+
+// vectorSink pushes vectors into a collection of a vector database through
+// its HTTP API. Points are upserted with an id derived from the document id,
+// so pushing a document again replaces it
+type vectorSink struct {
+	kind       string
+	url        string
+	collection string
+	apiKey     string
+	batchSize  int
+	retries    int
+	client     *http.Client
+}
+
+// sinkFromEnv returns the configured sink or nil if there is none
+func sinkFromEnv() (*vectorSink, error) {
+	s := &vectorSink{batchSize: 100, retries: 5, client: &http.Client{Timeout: 30 * time.Second}}
+	for _, err := range []error{
+		envString("VECTORIZER_SINK", &s.kind),
+		envString("VECTORIZER_SINK_URL", &s.url),
+		envString("VECTORIZER_SINK_COLLECTION", &s.collection),
+		envString("VECTORIZER_SINK_API_KEY", &s.apiKey),
+		envInt("VECTORIZER_SINK_BATCH_SIZE", &s.batchSize),
+		envInt("VECTORIZER_SINK_RETRIES", &s.retries),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.kind == "" {
+		return nil, nil
+	}
+	if s.kind != sinkQdrant && s.kind != sinkMilvus && s.kind != sinkWeaviate {
+		return nil, fmt.Errorf("VECTORIZER_SINK must be qdrant, milvus or weaviate")
+	}
+	if s.url == "" || s.collection == "" {
+		return nil, fmt.Errorf("VECTORIZER_SINK_URL and VECTORIZER_SINK_COLLECTION are required")
+	}
+	if s.batchSize < 1 || s.retries < 0 {
+		return nil, fmt.Errorf("VECTORIZER_SINK_BATCH_SIZE must be positive")
+	}
+	s.url = strings.TrimSuffix(s.url, "/")
+	return s, nil
+}
+
+// pointUUID derives a name based UUID from a document id, Qdrant and Weaviate
+// only accept UUIDs as ids
+func pointUUID(id string) string {
+	h := sha1.Sum([]byte(id))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// sinkError is an error of the vector database, temporary ones are retried
+type sinkError struct {
+	temporary bool
+	err       error
+}
+
+func (e *sinkError) Error() string {
+	return e.err.Error()
+}
+
+// push sends points to the database, retrying temporary failures with
+// exponential backoff
+func (s *vectorSink) push(ctx context.Context, points []sinkPoint) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := s.send(ctx, points)
+		if err == nil {
+			return nil
+		}
+		if serr, ok := err.(*sinkError); (ok && !serr.temporary) || attempt == s.retries {
+			return fmt.Errorf("pushing to %s: %v", s.kind, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// send makes a single request with the points
+func (s *vectorSink) send(ctx context.Context, points []sinkPoint) error {
+	var method, url string
+	var body interface{}
+	switch s.kind {
+	case sinkQdrant:
+		type qdrantPoint struct {
+			ID      string            `json:"id"`
+			Vector  []float32         `json:"vector"`
+			Payload map[string]string `json:"payload"`
+		}
+		batch := make([]qdrantPoint, len(points))
+		for i, p := range points {
+			batch[i] = qdrantPoint{ID: pointUUID(p.id), Vector: p.vector, Payload: map[string]string{"doc_id": p.id, "text": p.text}}
+		}
+		method, url = http.MethodPut, s.url+"/collections/"+s.collection+"/points?wait=true"
+		body = map[string]interface{}{"points": batch}
+	case sinkMilvus:
+		type milvusEntity struct {
+			ID     string    `json:"id"`
+			Vector []float32 `json:"vector"`
+			Text   string    `json:"text"`
+		}
+		batch := make([]milvusEntity, len(points))
+		for i, p := range points {
+			batch[i] = milvusEntity{ID: p.id, Vector: p.vector, Text: p.text}
+		}
+		method, url = http.MethodPost, s.url+"/v2/vectordb/entities/upsert"
+		body = map[string]interface{}{"collectionName": s.collection, "data": batch}
+	case sinkWeaviate:
+		type weaviateObject struct {
+			Class      string            `json:"class"`
+			ID         string            `json:"id"`
+			Vector     []float32         `json:"vector"`
+			Properties map[string]string `json:"properties"`
+		}
+		batch := make([]weaviateObject, len(points))
+		for i, p := range points {
+			batch[i] = weaviateObject{Class: s.collection, ID: pointUUID(p.id), Vector: p.vector, Properties: map[string]string{"doc_id": p.id, "text": p.text}}
+		}
+		method, url = http.MethodPost, s.url+"/v1/batch/objects"
+		body = map[string]interface{}{"objects": batch}
+	}
+
+	request, err := json.Marshal(body)
+	if err != nil {
+		return &sinkError{err: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(request))
+	if err != nil {
+		return &sinkError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		if s.kind == sinkQdrant {
+			req.Header.Set("api-key", s.apiKey)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+s.apiKey)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &sinkError{temporary: true, err: err}
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return &sinkError{temporary: true, err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		temporary := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return &sinkError{temporary: temporary, err: fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(response))}
+	}
+	return s.checkResponse(response)
+}
+
+// checkResponse finds the errors Milvus and Weaviate report with status 200
+func (s *vectorSink) checkResponse(response []byte) error {
+	switch s.kind {
+	case sinkMilvus:
+		var result struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(response, &result); err != nil {
+			return &sinkError{err: err}
+		}
+		if result.Code != 0 {
+			return &sinkError{err: fmt.Errorf("code %d: %s", result.Code, result.Message)}
+		}
+	case sinkWeaviate:
+		var results []struct {
+			ID     string `json:"id"`
+			Result struct {
+				Errors *struct {
+					Error []struct {
+						Message string `json:"message"`
+					} `json:"error"`
+				} `json:"errors"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(response, &results); err != nil {
+			return &sinkError{err: err}
+		}
+		for _, result := range results {
+			if errs := result.Result.Errors; errs != nil && len(errs.Error) > 0 {
+				return &sinkError{err: fmt.Errorf("object %s: %s", result.ID, errs.Error[0].Message)}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/snapshot"
+)
+
+// retireDelay is how long a replaced database stays open for the requests
+// still reading it
+const retireDelay = time.Minute
+
+// servedDB is a database along with everything derived from it. It is
+// replaced as a whole when another version is activated
+type servedDB struct {
+	store *store
+	info  modelInfo
+	cache *vectorCache
+	// version is the version of a models root, empty if the database isn't
+	// versioned
+	version string
+	// path is the directory of the database, to reopen it
+	path string
+	// means are the means of its vectors, loaded on first use
+	means meansOnce
+}
+
+// dbConfig is how databases are opened
+type dbConfig struct {
+	tuning levelDBTuning
+	cache  *tokenCache
+	// verify checks the files of databases against the checksums written
+	// by the importer before opening them
+	verify bool
+	// breaker is shared by the stores of all databases served
+	breaker *breaker
+}
+
+func openServedDB(path, version string, config dbConfig) (*servedDB, error) {
+	var checksums *pkg.Checksums
+	if config.verify {
+		var err error
+		checksums, err = pkg.ReadChecksums(path)
+		if err != nil {
+			return nil, err
+		}
+		if checksums == nil {
+			log.Printf("%s has no %s, skipping verification", path, pkg.ChecksumsFile)
+		} else if err := pkg.VerifyChecksums(path, checksums); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := openStore(path, config.tuning)
+	if err != nil {
+		return nil, err
+	}
+	info, err := inspectModel(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if checksums != nil && checksums.Dims != info.Dims {
+		s.Close()
+		return nil, fmt.Errorf("%s holds vectors of %d dimensions, %s lists %d", path, info.Dims, pkg.ChecksumsFile, checksums.Dims)
+	}
+	if version != "" {
+		// versions can consist of files with the same names and sizes
+		h := sha256.Sum256([]byte(version + "\n" + info.Hash))
+		info.Hash = hex.EncodeToString(h[:])
+	}
+	s.breaker = config.breaker
+	return &servedDB{store: s, info: info, cache: config.cache.model(info.Hash, version), version: version, path: path}, nil
+}
+
+// db returns the database currently served
+func (vtcrzr *Vectorizer) db() *servedDB {
+	return vtcrzr.served.Load()
+}
+
+// replica follows the snapshots a leader publishes to object storage. They
+// are fetched to the versions of a models root
+type replica struct {
+	location string
+	store    snapshot.Store
+	root     *modelRoot
+	interval time.Duration
+	// latest is the version of the latest snapshot seen, later snapshots
+	// are activated even if an older version was activated meanwhile
+	latest string
+}
+
+func replicaFromEnv(config dbConfig) (*replica, error) {
+	r := &replica{
+		root:     &modelRoot{dir: "./snapshots", config: config},
+		interval: time.Minute,
+	}
+	for _, err := range []error{
+		envString("VECTORIZER_SNAPSHOT_URL", &r.location),
+		envString("VECTORIZER_SNAPSHOT_DIR", &r.root.dir),
+		envDuration("VECTORIZER_SNAPSHOT_INTERVAL", &r.interval),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.location == "" {
+		return nil, nil
+	}
+	if r.interval <= 0 {
+		return nil, fmt.Errorf("VECTORIZER_SNAPSHOT_INTERVAL must be positive")
+	}
+
+	var err error
+	r.store, err = snapshot.Open(r.location)
+	if err != nil {
+		return nil, err
+	}
+	return r, os.MkdirAll(r.root.dir, 0o755)
+}
+
+// start opens the latest snapshot, falling back to the version served
+// before if the object storage can't be reached
+func (r *replica) start() (*servedDB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	m, err := snapshot.Latest(ctx, r.store)
+	if err == nil {
+		var db *servedDB
+		if db, err = r.fetch(ctx, m); err == nil {
+			r.latest = m.Version
+			return db, nil
+		}
+	}
+	log.Printf("failed to fetch the latest snapshot from %s: %v", r.location, err)
+
+	db, startErr := r.root.start()
+	if startErr != nil {
+		return nil, fmt.Errorf("no snapshot available: %v", err)
+	}
+	return db, nil
+}
+
+// fetch fetches the snapshot described by m unless it was fetched before
+// and opens it
+func (r *replica) fetch(ctx context.Context, m *snapshot.Manifest) (*servedDB, error) {
+	if !validVersion(m.Version) {
+		return nil, fmt.Errorf("invalid snapshot version %q", m.Version)
+	}
+	dir := filepath.Join(r.root.dir, m.Version)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		log.Printf("fetching snapshot %s of %d files", m.Version, len(m.Files))
+		if err := snapshot.Fetch(ctx, r.store, m, dir); err != nil {
+			return nil, err
+		}
+	}
+	return r.root.open(m.Version)
+}
+
+// prune removes all fetched versions but keep
+func (r *replica) prune(keep ...string) {
+	r.root.mu.Lock()
+	defer r.root.mu.Unlock()
+	entries, err := os.ReadDir(r.root.dir)
+	if err != nil {
+		log.Printf("failed to prune snapshots: %v", err)
+		return
+	}
+	kept := map[string]bool{}
+	for _, version := range keep {
+		kept[version] = true
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !kept[entry.Name()] {
+			if err := os.RemoveAll(filepath.Join(r.root.dir, entry.Name())); err != nil {
+				log.Printf("failed to prune snapshot %s: %v", entry.Name(), err)
+			}
+		}
+	}
+}
+
+// followSnapshots polls the object storage for new snapshots and activates
+// them. The replaced version is kept on disk to roll back to, older ones are
+// removed
+func (vtcrzr *Vectorizer) followSnapshots(r *replica) {
+	for range time.Tick(r.interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		m, err := snapshot.Latest(ctx, r.store)
+		if err != nil {
+			cancel()
+			log.Printf("failed to poll snapshots: %v", err)
+			continue
+		}
+		if m.Version == r.latest {
+			cancel()
+			continue
+		}
+
+		r.root.mu.Lock()
+		if m.Version == vtcrzr.db().version {
+			r.latest = m.Version
+			r.root.mu.Unlock()
+			cancel()
+			continue
+		}
+		db, err := r.fetch(ctx, m)
+		cancel()
+		if err != nil {
+			r.root.mu.Unlock()
+			log.Printf("failed to activate snapshot %s: %v", m.Version, err)
+			continue
+		}
+		r.latest = m.Version
+		vtcrzr.activate(db, func(old *servedDB) {
+			r.prune(db.version, old.version, vtcrzr.db().version)
+		})
+		r.root.mu.Unlock()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// langAuto selects the stopwords of the language detected in every text
+const langAuto = "auto"
+
+// defaultLang is the language whose stopwords are used if none is given
+const defaultLang = "en"
+
+// builtinStopwords holds one list per language, one word per line
+//
+//go:embed stopwords/*.txt
+var builtinStopwords embed.FS
+
+// stopwordLists maps a language to its stopwords. A regional language such
+// as "pt-br" inherits the list of its base language unless it has its own
+type stopwordLists struct {
+	lists map[string]map[string]bool
+	// fallback is the language of VECTORIZER_LANG, used for "" and when
+	// detection finds nothing
+	fallback string
+	// hash identifies all lists
+	hash string
+}
+
+// stopwordListsFromEnv loads the built-in lists and extends them with the
+// lists in VECTORIZER_STOPWORDS_DIR, see loadDir
+func stopwordListsFromEnv() (*stopwordLists, error) {
+	s := &stopwordLists{lists: map[string]map[string]bool{}, fallback: defaultLang}
+	if err := envString("VECTORIZER_LANG", &s.fallback); err != nil {
+		return nil, err
+	}
+	s.fallback = strings.ToLower(s.fallback)
+	if s.fallback == langAuto {
+		// detection still needs a language for texts without stopwords
+		s.fallback = defaultLang
+	}
+
+	files, err := builtinStopwords.ReadDir("stopwords")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		f, err := builtinStopwords.Open(path.Join("stopwords", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		err = s.read(strings.TrimSuffix(file.Name(), ".txt"), f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dir := os.Getenv("VECTORIZER_STOPWORDS_DIR"); dir != "" {
+		if err := s.loadDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.words(s.fallback) == nil {
+		return nil, fmt.Errorf("VECTORIZER_LANG: no stopwords for %q", s.fallback)
+	}
+	var entries []string
+	for lang, words := range s.lists {
+		for word := range words {
+			entries = append(entries, lang+":"+word)
+		}
+	}
+	s.hash = hashWords(entries)
+	return s, nil
+}
+
+// loadDir reads the <lang>.txt files of dir. A file adds its words to the
+// inherited list of the language, and a line starting with "-" removes the
+// word instead. Regional files are read after their base language
+func (s *stopwordLists) loadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return err
+	}
+	// "pt" sorts before "pt-br", so a base language is complete before
+	// anything inherits from it
+	sort.Strings(paths)
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		err = s.read(strings.ToLower(strings.TrimSuffix(filepath.Base(p), ".txt")), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// read adds the words of r to the list of lang, copying the inherited list
+// first if lang has none of its own
+func (s *stopwordLists) read(lang string, r io.Reader) error {
+	if lang == "" || lang == langAuto {
+		return fmt.Errorf("invalid language %q", lang)
+	}
+	list, ok := s.lists[lang]
+	if !ok {
+		list = map[string]bool{}
+		for word := range s.words(lang) {
+			list[word] = true
+		}
+		s.lists[lang] = list
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if removed, ok := strings.CutPrefix(word, "-"); ok {
+			delete(list, removed)
+			continue
+		}
+		list[word] = true
+	}
+	return scanner.Err()
+}
+
+// words returns the stopwords of lang, falling back from a regional
+// language to its base language. It returns nil for an unknown language
+func (s *stopwordLists) words(lang string) map[string]bool {
+	if s == nil {
+		return nil
+	}
+	if lang == "" || lang == langAuto {
+		lang = s.fallback
+	}
+	for {
+		if list, ok := s.lists[lang]; ok {
+			return list
+		}
+		i := strings.LastIndexAny(lang, "-_")
+		if i < 0 {
+			return nil
+		}
+		lang = lang[:i]
+	}
+}
+
+// normalizeLang lowercases lang, so "pt-BR" and "pt-br" share a manifest
+func normalizeLang(lang string) string {
+	return strings.ToLower(lang)
+}
+
+// validLang returns an error if there are no stopwords for lang
+func (s *stopwordLists) validLang(lang string) error {
+	if s == nil || lang == "" || lang == langAuto || s.words(lang) != nil {
+		return nil
+	}
+	return fmt.Errorf("no stopwords for lang %q", lang)
+}
+
+// isStopWord reports whether word is a stopword of lang
+func (s *stopwordLists) isStopWord(word, lang string) bool {
+	return s.words(lang)[strings.ToLower(word)]
+}
+
+// resolve returns the language whose stopwords apply to words. Only
+// langAuto is resolved, by the list that matches the most words
+func (s *stopwordLists) resolve(lang string, words []string) string {
+	if lang != langAuto || s == nil {
+		return lang
+	}
+	return s.detect(words)
+}
+
+// detect returns the language with the most stopwords among words. Ties go
+// to the fallback language and then to the first language alphabetically
+func (s *stopwordLists) detect(words []string) string {
+	langs := make([]string, 0, len(s.lists))
+	for lang := range s.lists {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	best, bestHits := s.fallback, countStopwords(s.words(s.fallback), words)
+	for _, lang := range langs {
+		if hits := countStopwords(s.lists[lang], words); hits > bestHits {
+			best, bestHits = lang, hits
+		}
+	}
+	return best
+}
+
+// countStopwords returns the number of words in list
+func countStopwords(list map[string]bool, words []string) int {
+	n := 0
+	for _, word := range words {
+		if list[strings.ToLower(word)] {
+			n++
+		}
+	}
+	return n
+}
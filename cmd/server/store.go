@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// store reads vectors from a single database or from the shards of a
+// database partitioned by word
+type store struct {
+	shards []*leveldb.DB
+	// paths are the directories of the shards
+	paths []string
+	// bloom rejects most keys that are not in the database without reading
+	// it, it is nil if the database has no filter
+	bloom *pkg.BloomFilter
+	// index maps the lowercase and folded forms of words to the words, it
+	// is nil if the database was imported without --index
+	index *leveldb.DB
+	// blockCacheBytes is the block cache capacity of every shard
+	blockCacheBytes int
+	// breaker fails reads fast while the database keeps failing, nil
+	// until the store is served
+	breaker *breaker
+
+	gets            atomic.Uint64
+	misses          atomic.Uint64
+	bloomRejections atomic.Uint64
+}
+
+// levelDBTuning holds the LevelDB options exposed through the environment
+type levelDBTuning struct {
+	// BlockCacheMB is the size of the block cache, shared by all shards
+	BlockCacheMB int
+	// OpenFiles caps the number of open table files of every shard
+	OpenFiles int
+	// BloomBits is the bits per key of the table filters written by the
+	// importer, 0 if the tables have no filter
+	BloomBits int
+}
+
+func levelDBTuningFromEnv() (levelDBTuning, error) {
+	tuning := levelDBTuning{
+		BlockCacheMB: 8,
+		OpenFiles:    500,
+		BloomBits:    10,
+	}
+	for _, err := range []error{
+		envInt("VECTORIZER_LEVELDB_BLOCK_CACHE_MB", &tuning.BlockCacheMB),
+		envInt("VECTORIZER_LEVELDB_OPEN_FILES", &tuning.OpenFiles),
+		envInt("VECTORIZER_LEVELDB_BLOOM_BITS", &tuning.BloomBits),
+	} {
+		if err != nil {
+			return tuning, err
+		}
+	}
+	if tuning.BlockCacheMB < 1 || tuning.OpenFiles < 1 || tuning.BloomBits < 0 {
+		return tuning, fmt.Errorf("invalid LevelDB tuning %+v", tuning)
+	}
+	return tuning, nil
+}
+
+// openStore opens the database at dbPath, which is sharded if it holds a
+// pkg.ShardsFile
+func openStore(dbPath string, tuning levelDBTuning) (*store, error) {
+	n, err := pkg.ReadShards(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{}
+	if n == 0 {
+		s.paths = []string{dbPath}
+	} else {
+		for i := 0; i < n; i++ {
+			s.paths = append(s.paths, pkg.ShardPath(dbPath, i))
+		}
+	}
+
+	shardTuning := tuning
+	shardTuning.BlockCacheMB = tuning.BlockCacheMB / len(s.paths)
+	if shardTuning.BlockCacheMB < 1 {
+		shardTuning.BlockCacheMB = 1
+	}
+	s.blockCacheBytes = shardTuning.BlockCacheMB * opt.MiB
+	for _, path := range s.paths {
+		db, err := initDB(path, shardTuning)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, db)
+	}
+
+	s.bloom, err = loadBloomFilter(dbPath)
+	if err != nil {
+		log.Printf("ignoring bloom filter: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dbPath, pkg.IndexDir)); err == nil {
+		s.index, err = initDB(filepath.Join(dbPath, pkg.IndexDir), shardTuning)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loadBloomFilter reads the filter of the database at dbPath. It returns nil
+// if the database has none
+func loadBloomFilter(dbPath string) (*pkg.BloomFilter, error) {
+	f, err := os.Open(filepath.Join(dbPath, pkg.BloomFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return pkg.ReadBloomFilter(bufio.NewReader(f))
+}
+
+func (s *store) shard(key []byte) *leveldb.DB {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	return s.shards[pkg.Shard(key, len(s.shards))]
+}
+
+// Get returns the value stored for key or leveldb.ErrNotFound. Other errors
+// wrap errReadFailed
+func (s *store) Get(key []byte) ([]byte, error) {
+	s.gets.Add(1)
+	if s.bloom != nil && !s.bloom.MayContain(key) {
+		s.bloomRejections.Add(1)
+		s.misses.Add(1)
+		return nil, leveldb.ErrNotFound
+	}
+	if err := s.breaker.allow(); err != nil {
+		return nil, err
+	}
+	value, err := s.shard(key).Get(key, nil)
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound):
+		s.misses.Add(1)
+	case err != nil:
+		s.breaker.record(err)
+		return nil, fmt.Errorf("%w: %v", errReadFailed, err)
+	}
+	s.breaker.record(nil)
+	return value, err
+}
+
+// indexed returns the word the index maps key to, empty if the database
+// has no index or it has no entry for key
+func (s *store) indexed(key []byte) (string, error) {
+	if s.index == nil {
+		return "", nil
+	}
+	if err := s.breaker.allow(); err != nil {
+		return "", err
+	}
+	word, err := s.index.Get(key, nil)
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound):
+		return "", nil
+	case err != nil:
+		s.breaker.record(err)
+		return "", fmt.Errorf("%w: %v", errReadFailed, err)
+	}
+	s.breaker.record(nil)
+	return string(word), nil
+}
+
+// levels is the number of levels of a LevelDB database
+const levels = 7
+
+// shardStats describes the LevelDB internals of a shard
+type shardStats struct {
+	Path            string `json:"path"`
+	IOReadBytes     uint64 `json:"io_read_bytes"`
+	BlockCacheBytes int    `json:"block_cache_bytes"`
+	OpenTables      int    `json:"open_tables"`
+	AliveIterators  int32  `json:"alive_iterators"`
+	// LevelTables is the number of tables of every level
+	LevelTables []int `json:"level_tables"`
+	// SizeBytes is the size of all tables
+	SizeBytes int64 `json:"size_bytes"`
+	// CompactionSeconds is the time spent compacting all levels
+	CompactionSeconds float64 `json:"compaction_seconds"`
+	// Compactions is the compaction table reported by LevelDB
+	Compactions string `json:"compactions"`
+}
+
+// storeStats describes the store and the LevelDB internals of its shards
+type storeStats struct {
+	Gets            uint64       `json:"gets"`
+	Misses          uint64       `json:"misses"`
+	BloomRejections uint64       `json:"bloom_rejections"`
+	BloomFilter     bool         `json:"bloom_filter"`
+	Index           bool         `json:"index"`
+	BlockCacheBytes int          `json:"block_cache_capacity_bytes"`
+	Shards          []shardStats `json:"shards"`
+}
+
+func (s *store) stats() (*storeStats, error) {
+	stats := &storeStats{
+		Gets:            s.gets.Load(),
+		Misses:          s.misses.Load(),
+		BloomRejections: s.bloomRejections.Load(),
+		BloomFilter:     s.bloom != nil,
+		Index:           s.index != nil,
+		BlockCacheBytes: s.blockCacheBytes,
+	}
+	for i, db := range s.shards {
+		var dbStats leveldb.DBStats
+		if err := db.Stats(&dbStats); err != nil {
+			return nil, err
+		}
+		shard := shardStats{
+			Path:            s.paths[i],
+			IOReadBytes:     dbStats.IORead,
+			BlockCacheBytes: dbStats.BlockCacheSize,
+			OpenTables:      dbStats.OpenedTablesCount,
+			AliveIterators:  dbStats.AliveIterators,
+		}
+		for j := range dbStats.LevelSizes {
+			shard.SizeBytes += dbStats.LevelSizes[j]
+			shard.CompactionSeconds += dbStats.LevelDurations[j].Seconds()
+		}
+		for level := 0; level < levels; level++ {
+			tables, err := db.GetProperty(fmt.Sprintf("leveldb.num-files-at-level%d", level))
+			if err != nil {
+				return nil, err
+			}
+			n, _ := strconv.Atoi(tables)
+			shard.LevelTables = append(shard.LevelTables, n)
+		}
+
+		compactions, err := db.GetProperty("leveldb.stats")
+		if err != nil {
+			return nil, err
+		}
+		shard.Compactions = compactions
+		stats.Shards = append(stats.Shards, shard)
+	}
+	return stats, nil
+}
+
+func (s *store) writeMetrics(m *metricsWriter) {
+	m.counter("vectorizer_store_gets_total", "Number of reads of the vocabulary", float64(s.gets.Load()))
+	m.counter("vectorizer_store_misses_total", "Number of reads of words that are not in the vocabulary", float64(s.misses.Load()))
+	m.counter("vectorizer_store_bloom_rejections_total", "Number of reads answered by the bloom filter without touching LevelDB", float64(s.bloomRejections.Load()))
+
+	stats, err := s.stats()
+	if err != nil {
+		log.Printf("failed to read LevelDB stats: %v", err)
+		return
+	}
+
+	shardMetrics := []struct {
+		name, typ, help string
+		value           func(shard shardStats) float64
+	}{
+		{"vectorizer_leveldb_io_read_bytes_total", "counter", "Bytes read from disk by LevelDB",
+			func(shard shardStats) float64 { return float64(shard.IOReadBytes) }},
+		{"vectorizer_leveldb_block_cache_bytes", "gauge", "Bytes held by the LevelDB block cache",
+			func(shard shardStats) float64 { return float64(shard.BlockCacheBytes) }},
+		{"vectorizer_leveldb_block_cache_capacity_bytes", "gauge", "Capacity of the LevelDB block cache",
+			func(shardStats) float64 { return float64(stats.BlockCacheBytes) }},
+		{"vectorizer_leveldb_open_tables", "gauge", "Number of open LevelDB table files",
+			func(shard shardStats) float64 { return float64(shard.OpenTables) }},
+		{"vectorizer_leveldb_alive_iterators", "gauge", "Number of open LevelDB iterators",
+			func(shard shardStats) float64 { return float64(shard.AliveIterators) }},
+		{"vectorizer_leveldb_size_bytes", "gauge", "Size of the LevelDB tables",
+			func(shard shardStats) float64 { return float64(shard.SizeBytes) }},
+		{"vectorizer_leveldb_compaction_seconds_total", "counter", "Time spent compacting",
+			func(shard shardStats) float64 { return shard.CompactionSeconds }},
+	}
+	for _, metric := range shardMetrics {
+		m.family(metric.name, metric.typ, metric.help)
+		for i, shard := range stats.Shards {
+			m.sample(metric.name, metric.value(shard), "shard", strconv.Itoa(i))
+		}
+	}
+
+	m.family("vectorizer_leveldb_level_tables", "gauge", "Number of LevelDB tables per level")
+	for i, shard := range stats.Shards {
+		for level, tables := range shard.LevelTables {
+			m.sample("vectorizer_leveldb_level_tables", float64(tables), "shard", strconv.Itoa(i), "level", strconv.Itoa(level))
+		}
+	}
+}
+func (s *store) Close() error {
+	var firstErr error
+	for _, db := range s.shards {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.index != nil {
+		if err := s.index.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// parallel calls fn for every word, running the words of different shards
+// concurrently. Words of the same shard are handled sequentially
+func (s *store) parallel(words []string, fn func(word string)) {
+	if len(s.shards) == 1 {
+		for _, word := range words {
+			fn(word)
+		}
+		return
+	}
+
+	byShard := make([][]string, len(s.shards))
+	for _, word := range words {
+		i := pkg.Shard([]byte(word), len(s.shards))
+		byShard[i] = append(byShard[i], word)
+	}
+
+	var wg sync.WaitGroup
+	for _, shardWords := range byShard {
+		if len(shardWords) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shardWords []string) {
+			defer wg.Done()
+			for _, word := range shardWords {
+				fn(word)
+			}
+		}(shardWords)
+	}
+	wg.Wait()
+}
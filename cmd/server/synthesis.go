@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// synthPrefix keys the vectors synthesized for out of vocabulary tokens by
+// the hash of their model, like oovPrefix
+const synthPrefix = "synth/"
+
+// maxSynthObservations caps the number of contexts a synthesized vector is
+// the mean of, so it keeps following how the token is used
+const maxSynthObservations = 1000
+
+// oovContext collects the vectors of the known tokens of a text by
+// position, to synthesize vectors for the unknown ones from their context
+type oovContext struct {
+	vectors map[int][]float32
+	// unknown are the positions of the out of vocabulary tokens
+	unknown []int
+}
+
+// newOOVContext returns nil unless opts synthesize vectors, the lookup
+// pipeline ends with stepContext and the OOV log stores the vectors
+func (vtcrzr *Vectorizer) newOOVContext(opts vectorizeOptions) *oovContext {
+	if !opts.SynthesizeOOV || !vtcrzr.lookups.context || vtcrzr.oov == nil {
+		return nil
+	}
+	return &oovContext{vectors: map[int][]float32{}}
+}
+
+// known adds the vectors of the token at pos, averaged
+func (c *oovContext) known(pos int, vectors []pkg.Vector) {
+	if c == nil {
+		return
+	}
+	var mean []float32
+	for _, vector := range vectors {
+		values := vector.ToArray()
+		if mean == nil {
+			mean = make([]float32, len(values))
+		}
+		for i, value := range values {
+			mean[i] += value / float32(len(vectors))
+		}
+	}
+	c.vectors[pos] = mean
+}
+
+// around returns the mean of the known vectors within window tokens of
+// pos, weighted by the inverse of their distance, and the number of them
+func (c *oovContext) around(pos, window int) ([]float32, int) {
+	var sum []float32
+	var weightSum float32
+	n := 0
+	for d := 1; d <= window; d++ {
+		for _, p := range []int{pos - d, pos + d} {
+			values, ok := c.vectors[p]
+			if !ok {
+				continue
+			}
+			if sum == nil {
+				sum = make([]float32, len(values))
+			}
+			weight := 1 / float32(d)
+			for i, value := range values {
+				sum[i] += weight * value
+			}
+			weightSum += weight
+			n++
+		}
+	}
+	for i := range sum {
+		sum[i] /= weightSum
+	}
+	return sum, n
+}
+
+// synthesizeOOV adds a vector for every out of vocabulary token of c to
+// corpus, if one can be synthesized. A token with enough known tokens
+// around it updates its stored vector with its context, the others fall
+// back to the stored vector. Tokens without one stay out of vocabulary
+func (vtcrzr *Vectorizer) synthesizeOOV(words []string, c *oovContext, opts vectorizeOptions, corpus *corpusVectors) error {
+	if c == nil {
+		return nil
+	}
+	modelHash := vtcrzr.modelDB(opts).info.Hash
+	for _, pos := range c.unknown {
+		var vector []float32
+		var err error
+		if context, n := c.around(pos, vtcrzr.oov.synthesisWindow); n >= vtcrzr.oov.synthesisMinContext {
+			vector, err = vtcrzr.oov.observe(modelHash, words[pos], context)
+		} else {
+			vector, _, err = vtcrzr.oov.synthesizedVector(vtcrzr.oov.tokenKey(synthPrefix, modelHash, words[pos]))
+		}
+		if err != nil {
+			return err
+		}
+		if vector == nil {
+			corpus.oov = appendOOV(corpus.oov, words[pos])
+			continue
+		}
+		vtcrzr.oov.synthesized.Add(1)
+		vtcrzr.lookups.resolved[stepContext].Add(1)
+		corpus.found++
+		corpus.add(pkg.NewVector(vector), opts.positionWeight(pos))
+	}
+	return nil
+}
+
+// synthesizedVector returns the vector stored under key and the number of
+// contexts it is the mean of, nil if there is none
+func (l *oovLog) synthesizedVector(key string) ([]float32, uint32, error) {
+	stored, err := l.db.Get([]byte(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(stored) < 4 {
+		return nil, 0, nil
+	}
+	vector, err := pkg.DecodeVector(stored[4:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return vector, binary.BigEndian.Uint32(stored), nil
+}
+
+// observe folds context into the running mean stored for token and
+// returns the updated vector
+func (l *oovLog) observe(modelHash, token string, context []float32) ([]float32, error) {
+	key := l.tokenKey(synthPrefix, modelHash, token)
+	l.synthMu.Lock()
+	defer l.synthMu.Unlock()
+
+	mean, n, err := l.synthesizedVector(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(mean) != len(context) {
+		// the first context, or a vector of other dimensions
+		mean, n = make([]float32, len(context)), 0
+	}
+	if n < maxSynthObservations {
+		n++
+	}
+	for i, value := range context {
+		mean[i] += (value - mean[i]) / float32(n)
+	}
+
+	encoded, err := pkg.EncodeVector(mean)
+	if err != nil {
+		return nil, err
+	}
+	value := binary.BigEndian.AppendUint32(nil, n)
+	if err := l.db.Put([]byte(key), append(value, encoded...), nil); err != nil {
+		return nil, err
+	}
+	return mean, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// phases of a vectorization reported in the Server-Timing header
+const (
+	phaseTokenize = iota
+	// phaseLookup is the time spent reading the vectors, including their
+	// decoding
+	phaseLookup
+	// phaseDecode sums the time spent decoding stored vectors, which may
+	// exceed phaseLookup as words are read in parallel
+	phaseDecode
+	phaseCentroid
+	phaseSerialize
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{"tokenize", "lookup", "decode", "centroid", "serialize"}
+
+// requestTiming collects where the time of a request goes. A nil timing
+// measures nothing, which is the case unless VECTORIZER_SERVER_TIMING is set
+type requestTiming struct {
+	start time.Time
+	// phases are the durations of the phases in nanoseconds
+	phases [phaseCount]atomic.Int64
+}
+
+func newRequestTiming() *requestTiming {
+	return &requestTiming{start: time.Now()}
+}
+
+// now returns the current time, the zero time if t is nil so requests that
+// aren't timed don't read the clock
+func (t *requestTiming) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// add adds the time since start to phase
+func (t *requestTiming) add(phase int, start time.Time) {
+	if t == nil {
+		return
+	}
+	t.phases[phase].Add(int64(time.Since(start)))
+}
+
+// header sets the Server-Timing header, in milliseconds, with the total
+// time of the request so far
+func (t *requestTiming) header(w http.ResponseWriter) {
+	if t == nil {
+		return
+	}
+	metrics := make([]string, 0, phaseCount+1)
+	for phase, name := range phaseNames {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", name, float64(t.phases[phase].Load())/1e6))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.3f", float64(time.Since(t.start))/1e6))
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxTokenPatterns limits the include and exclude patterns of a request
+	maxTokenPatterns = 16
+	// maxTokenPatternLength limits the length of a single pattern
+	maxTokenPatternLength = 256
+	// maxCachedPatterns limits the compiled patterns kept in tokenPatterns
+	maxCachedPatterns = 1024
+)
+
+// tokenPatterns holds the compiled include and exclude patterns, so they
+// are compiled once instead of for every token
+var tokenPatterns = &patternCache{patterns: map[string]*regexp.Regexp{}}
+
+type patternCache struct {
+	mu       sync.RWMutex
+	patterns map[string]*regexp.Regexp
+}
+
+// compile returns the compiled pattern, from the cache if it was compiled before
+func (c *patternCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.RLock()
+	re, ok := c.patterns[pattern]
+	c.mu.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.patterns) >= maxCachedPatterns {
+		c.patterns = map[string]*regexp.Regexp{}
+	}
+	c.patterns[pattern] = re
+	return re, nil
+}
+
+// matchesAny reports whether word matches one of patterns. Patterns are
+// validated with the options, so the ones that don't compile never match
+func matchesAny(patterns []string, word string) bool {
+	for _, pattern := range patterns {
+		re, err := tokenPatterns.compile(pattern)
+		if err == nil && re.MatchString(word) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepToken reports whether word passes the token filters of opts. A
+// single letter is dropped unless KeepSingleLetters is set, whatever the
+// length limits. The patterns apply after the length filters
+func (opts vectorizeOptions) keepToken(word string) bool {
+	if !opts.keepLength(word) {
+		return false
+	}
+	if len(opts.IncludeTokens) > 0 && !matchesAny(opts.IncludeTokens, word) {
+		return false
+	}
+	return !matchesAny(opts.ExcludeTokens, word)
+}
+
+func (opts vectorizeOptions) keepLength(word string) bool {
+	n := utf8.RuneCountInString(word)
+	if n == 1 {
+		r, _ := utf8.DecodeRuneInString(word)
+		if unicode.IsLetter(r) {
+			return opts.KeepSingleLetters
+		}
+	}
+	if n < opts.MinTokenLength {
+		return false
+	}
+	return opts.MaxTokenLength == 0 || n <= opts.MaxTokenLength
+}
+
+func validTokenLengths(min, max int) error {
+	if min < 0 {
+		return fmt.Errorf("min_token_length must not be negative")
+	}
+	if max < 0 {
+		return fmt.Errorf("max_token_length must not be negative")
+	}
+	if max > 0 && max < min {
+		return fmt.Errorf("max_token_length must not be less than min_token_length")
+	}
+	return nil
+}
+
+// validTokenPatterns checks that there are at most maxTokenPatterns
+// patterns named name and that all of them compile
+func validTokenPatterns(name string, patterns []string) error {
+	if len(patterns) > maxTokenPatterns {
+		return fmt.Errorf("%s takes at most %d patterns", name, maxTokenPatterns)
+	}
+	for _, pattern := range patterns {
+		if len(pattern) > maxTokenPatternLength {
+			return fmt.Errorf("%s patterns must not be longer than %d bytes", name, maxTokenPatternLength)
+		}
+		if _, err := tokenPatterns.compile(pattern); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// compound policies decide how tokens like "state-of-the-art" or "TCP/IP"
+// are looked up
+const (
+	// compoundsSplit looks up the parts only
+	compoundsSplit = "split"
+	// compoundsKeep looks up the whole token only
+	compoundsKeep = "keep"
+	// compoundsBoth looks up the whole token and falls back to its parts
+	compoundsBoth = "both"
+)
+
+func validCompoundPolicy(policy string) error {
+	switch policy {
+	case compoundsSplit, compoundsKeep, compoundsBoth:
+		return nil
+	default:
+		return fmt.Errorf("compounds must be one of %q, %q or %q", compoundsSplit, compoundsKeep, compoundsBoth)
+	}
+}
+
+// preprocess strips markup and redacts the corpus before it is tokenized
+func (vtcrzr *Vectorizer) preprocess(corpus string, opts vectorizeOptions) string {
+	return vtcrzr.redactor.redact(stripMarkup(corpus, opts))
+}
+
+// tokenize splits a corpus into the words that are looked up
+func tokenize(corpus string, opts vectorizeOptions) []string {
+	var words []string
+	if opts.Compounds == compoundsSplit {
+		words = split(corpus)
+	} else {
+		words = splitKeepCompounds(corpus)
+	}
+
+	if opts.SplitIdentifiers {
+		words = splitIdentifiers(words)
+	}
+	return words
+}
+
+// splitIdentifiers splits camelCase identifiers into their words, e.g.
+// getUserName becomes get user name. snake_case is already split by the
+// tokenizer as underscores are separators
+func splitIdentifiers(words []string) []string {
+	var result []string
+	for _, word := range words {
+		if isCompound(word) {
+			result = append(result, word)
+			continue
+		}
+		result = append(result, splitCamelCase(word)...)
+	}
+	return result
+}
+
+// splitCamelCase splits word at lower to upper case transitions, at the end
+// of an acronym (HTTPServer becomes HTTP server) and between letters and
+// digits. Title cased parts are lowercased, acronyms are kept as they are
+func splitCamelCase(word string) []string {
+	runes := []rune(word)
+	var parts []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		prev, curr := runes[i-1], runes[i]
+		boundary := unicode.IsLower(prev) && unicode.IsUpper(curr) ||
+			unicode.IsLetter(prev) != unicode.IsLetter(curr) ||
+			i+1 < len(runes) && unicode.IsUpper(prev) && unicode.IsUpper(curr) && unicode.IsLower(runes[i+1])
+		if boundary {
+			parts = append(parts, string(runes[start:i]))
+			start = i
+		}
+	}
+	if start == 0 {
+		return []string{word}
+	}
+	parts = append(parts, string(runes[start:]))
+
+	for i, part := range parts {
+		if !isAcronym(part) {
+			parts[i] = strings.ToLower(part)
+		}
+	}
+	return parts
+}
+
+func isAcronym(word string) bool {
+	if len([]rune(word)) < 2 {
+		return false
+	}
+	for _, r := range word {
+		if unicode.IsLower(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isCompoundSeparator(c rune) bool {
+	return c == '-' || c == '/'
+}
+
+// splitKeepCompounds splits like split, but keeps hyphens and slashes inside
+// of words
+func splitKeepCompounds(corpus string) []string {
+	fields := strings.FieldsFunc(corpus, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c) && !isCompoundSeparator(c)
+	})
+
+	words := fields[:0]
+	for _, field := range fields {
+		field = strings.TrimFunc(field, isCompoundSeparator)
+		if field != "" {
+			words = append(words, field)
+		}
+	}
+	return words
+}
+
+func isCompound(word string) bool {
+	return strings.IndexFunc(word, isCompoundSeparator) >= 0
+}
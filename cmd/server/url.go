@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var htmlTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// urlFetcher downloads documents from allowed hosts within size and time limits
+type urlFetcher struct {
+	// allowlist holds the allowed hosts, subdomains are allowed as well.
+	// "*" allows every host, an empty allowlist disables fetching
+	allowlist []string
+	maxBytes  int64
+	timeout   time.Duration
+	client    *http.Client
+}
+
+func urlFetcherFromEnv() (*urlFetcher, error) {
+	f := &urlFetcher{maxBytes: 5 << 20, timeout: 10 * time.Second}
+	if s := strings.TrimSpace(os.Getenv("VECTORIZER_URL_ALLOWLIST")); s != "" {
+		for _, host := range strings.Split(s, ",") {
+			f.allowlist = append(f.allowlist, strings.ToLower(strings.TrimSpace(host)))
+		}
+	}
+	var maxBytes int
+	for _, err := range []error{
+		envInt("VECTORIZER_URL_MAX_BYTES", &maxBytes),
+		envDuration("VECTORIZER_URL_TIMEOUT", &f.timeout),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if maxBytes > 0 {
+		f.maxBytes = int64(maxBytes)
+	}
+
+	f.client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			return f.check(req.URL)
+		},
+	}
+	return f, nil
+}
+
+// check returns an error unless u may be fetched
+func (f *urlFetcher) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.allowlist {
+		if allowed == "*" || host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q is not allowed", host)
+}
+
+// extraction describes how the text of a fetched document was obtained
+type extraction struct {
+	URL         string `json:"url"`
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type"`
+	Title       string `json:"title,omitempty"`
+	Bytes       int    `json:"bytes"`
+	// Truncated is set if the document exceeded the size limit
+	Truncated  bool `json:"truncated"`
+	TextLength int  `json:"text_length"`
+}
+
+// fetch downloads rawURL and extracts its readable text
+func (f *urlFetcher) fetch(ctx context.Context, rawURL string) (string, *extraction, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := f.check(u); err != nil {
+		return "", nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("fetching %s returned %s", u, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return "", nil, err
+	}
+	ext := &extraction{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Bytes:      len(body),
+	}
+	if int64(len(body)) > f.maxBytes {
+		body = body[:f.maxBytes]
+		ext.Bytes = len(body)
+		ext.Truncated = true
+	}
+
+	ext.ContentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	text := string(body)
+	switch {
+	case ext.ContentType == "text/html" || ext.ContentType == "application/xhtml+xml":
+		if m := htmlTitle.FindStringSubmatch(text); m != nil {
+			ext.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+		}
+		text = stripHTML(text, true)
+	case ext.ContentType == "text/markdown":
+		text = stripMarkdown(text, false)
+	case strings.HasPrefix(ext.ContentType, "text/"):
+	default:
+		return "", nil, fmt.Errorf("content type %q is not supported", ext.ContentType)
+	}
+	ext.TextLength = len(text)
+	return text, ext, nil
+}
+
+// urlRequest is the body accepted by the vectorize URL endpoint. It takes the
+// options of the vectorize endpoint
+type urlRequest struct {
+	URL string `json:"url"`
+	vectorizeRequest
+}
+
+// urlResponse is the body returned by the vectorize URL endpoint
+type urlResponse struct {
+	vectorizeResponse
+	Extraction *extraction `json:"extraction"`
+}
+
+// vectorizeURLHandler fetches a document, extracts its text and vectorizes it
+func (vtcrzr *Vectorizer) vectorizeURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(vtcrzr.fetcher.allowlist) == 0 {
+		http.Error(w, "Fetching URLs is disabled, set VECTORIZER_URL_ALLOWLIST to enable it", http.StatusNotFound)
+		return
+	}
+
+	var requestBody urlRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.URL == "" {
+		http.Error(w, "Missing 'url' field in request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Query != nil || requestBody.Fields != nil {
+		http.Error(w, "'query' and 'fields' are not supported when vectorizing a URL", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	text, ext, err := vtcrzr.fetcher.fetch(r.Context(), requestBody.URL)
+	if err != nil {
+		http.Error(w, "Failed to fetch "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// the text is already extracted
+	opts.Markup = markupNone
+	degraded := vtcrzr.degraded(r, &opts)
+	vectorized, err := vtcrzr.vectorize([]string{text}, opts)
+	if err != nil {
+		vectorizeError(w, err)
+		return
+	}
+
+	m, err := vtcrzr.manifest(opts)
+	if err != nil {
+		http.Error(w, "Failed to create manifest "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(configHashHeader, m.Hash)
+
+	responseBody := urlResponse{
+		vectorizeResponse: vectorizeResponse{
+			Vector:   newEncodedVector(vectorized.vector, opts),
+			Quality:  vectorized.quality,
+			Degraded: degraded,
+		},
+		Extraction: ext,
+	}
+	if opts.Manifest {
+		responseBody.Manifest = m
+	}
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
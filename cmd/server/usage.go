@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// apiKey is an entry of the API keys file. Quotas of 0 are unlimited
+type apiKey struct {
+	Key    string `json:"key"`
+	Tenant string `json:"tenant"`
+	// Admin allows the /admin endpoints
+	Admin           bool  `json:"admin,omitempty"`
+	DailyRequests   int64 `json:"daily_requests,omitempty"`
+	MonthlyRequests int64 `json:"monthly_requests,omitempty"`
+	DailyTokens     int64 `json:"daily_tokens,omitempty"`
+	MonthlyTokens   int64 `json:"monthly_tokens,omitempty"`
+}
+
+// usage counts the requests of a tenant and the tokens they looked up
+type usage struct {
+	Requests int64 `json:"requests"`
+	Tokens   int64 `json:"tokens"`
+}
+
+// tenantAccount holds the usage of a tenant in the current day and month.
+// Several keys of a tenant share the account and the quotas of the first
+type tenantAccount struct {
+	name   string
+	quotas apiKey
+
+	mu      sync.Mutex
+	day     string
+	month   string
+	daily   usage
+	monthly usage
+	// dirty is set if the usage changed since it was last stored
+	dirty bool
+	// stored is set if the usage is stored, closed then holds the usage of
+	// past days and months that changed since it was last stored
+	stored bool
+	closed map[string]usage
+}
+
+// roll starts a new day or month if now is past the current one
+func (a *tenantAccount) roll(now time.Time) {
+	if day := now.UTC().Format("2006-01-02"); day != a.day {
+		a.close(a.day, a.daily)
+		a.day, a.daily = day, usage{}
+	}
+	if month := now.UTC().Format("2006-01"); month != a.month {
+		a.close(a.month, a.monthly)
+		a.month, a.monthly = month, usage{}
+	}
+}
+
+// close keeps the usage of a past period until it is stored
+func (a *tenantAccount) close(period string, u usage) {
+	if !a.stored || !a.dirty || period == "" {
+		return
+	}
+	if a.closed == nil {
+		a.closed = map[string]usage{}
+	}
+	a.closed[period] = u
+}
+
+// exceeded returns the quota of the account that is used up, or "", and
+// when it resets, the next UTC day or month
+func (a *tenantAccount) exceeded(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	for _, quota := range []struct {
+		name        string
+		used, limit int64
+		resets      time.Time
+	}{
+		{"daily requests", a.daily.Requests, a.quotas.DailyRequests, tomorrow},
+		{"monthly requests", a.monthly.Requests, a.quotas.MonthlyRequests, nextMonth},
+		{"daily tokens", a.daily.Tokens, a.quotas.DailyTokens, tomorrow},
+		{"monthly tokens", a.monthly.Tokens, a.quotas.MonthlyTokens, nextMonth},
+	} {
+		if quota.limit > 0 && quota.used >= quota.limit {
+			return fmt.Sprintf("%d of %d %s used", quota.used, quota.limit, quota.name), quota.resets
+		}
+	}
+	return "", time.Time{}
+}
+
+// admit counts a request unless a quota is used up
+func (a *tenantAccount) admit(now time.Time) (string, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roll(now)
+	if exceeded, resets := a.exceeded(now); exceeded != "" {
+		return exceeded, resets
+	}
+	a.daily.Requests++
+	a.monthly.Requests++
+	a.dirty = true
+	return "", time.Time{}
+}
+
+// addTokens counts tokens looked up for the tenant. It does nothing on a nil
+// account, which is the case if API keys are disabled
+func (a *tenantAccount) addTokens(tokens int) {
+	if a == nil || tokens == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roll(time.Now())
+	a.daily.Tokens += int64(tokens)
+	a.monthly.Tokens += int64(tokens)
+	a.dirty = true
+}
+
+// usageMeter authenticates requests by API key and accounts their usage to
+// the tenant of the key. The usage is stored in a writable side database, so
+// it survives restarts
+type usageMeter struct {
+	keys     map[string]apiKey
+	accounts map[string]*tenantAccount
+	// db stores the usage, nil keeps it in memory only
+	db *leveldb.DB
+}
+
+func usageMeterFromEnv() (*usageMeter, error) {
+	var keysPath, dbPath string
+	interval := 5 * time.Second
+	for _, err := range []error{
+		envString("VECTORIZER_API_KEYS", &keysPath),
+		envString("VECTORIZER_USAGE_DB", &dbPath),
+		envDuration("VECTORIZER_USAGE_FLUSH_INTERVAL", &interval),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keysPath == "" {
+		return nil, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("VECTORIZER_USAGE_FLUSH_INTERVAL must be positive")
+	}
+
+	b, err := os.ReadFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", keysPath, err)
+	}
+
+	m := &usageMeter{keys: map[string]apiKey{}, accounts: map[string]*tenantAccount{}}
+	for i, key := range keys {
+		if key.Key == "" || key.Tenant == "" {
+			return nil, fmt.Errorf("%s: key %d needs a key and a tenant", keysPath, i)
+		}
+		if _, ok := m.keys[key.Key]; ok {
+			return nil, fmt.Errorf("%s: duplicate key of tenant %q", keysPath, key.Tenant)
+		}
+		m.keys[key.Key] = key
+		if _, ok := m.accounts[key.Tenant]; !ok {
+			m.accounts[key.Tenant] = &tenantAccount{name: key.Tenant, quotas: key}
+		}
+	}
+
+	if dbPath != "" {
+		m.db, err = leveldb.OpenFile(dbPath, nil)
+		if err != nil {
+			return nil, fmt.Errorf("usage database: %v", err)
+		}
+		for _, a := range m.accounts {
+			a.stored = true
+		}
+		if err := m.load(time.Now()); err != nil {
+			return nil, fmt.Errorf("usage database: %v", err)
+		}
+		go func() {
+			for range time.Tick(interval) {
+				if err := m.flush(); err != nil {
+					log.Printf("failed to store usage: %v", err)
+				}
+			}
+		}()
+	}
+	return m, nil
+}
+
+// usageKey is the key of the usage of a tenant in a day or month
+func usageKey(tenant, period string) []byte {
+	return []byte("usage/" + tenant + "/" + period)
+}
+
+// load reads the usage of the current day and month of every tenant
+func (m *usageMeter) load(now time.Time) error {
+	for _, a := range m.accounts {
+		a.roll(now)
+		for _, period := range []struct {
+			name  string
+			usage *usage
+		}{{a.day, &a.daily}, {a.month, &a.monthly}} {
+			value, err := m.db.Get(usageKey(a.name, period.name), nil)
+			if errors.Is(err, leveldb.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(value, period.usage); err != nil {
+				return fmt.Errorf("%s: %v", usageKey(a.name, period.name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// flush stores the usage of the tenants that changed since the last flush,
+// including the days and months that ended since. Past days and months stay
+// in the database. It does nothing if the usage is kept in memory
+func (m *usageMeter) flush() error {
+	if m == nil || m.db == nil {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	for _, a := range m.accounts {
+		a.mu.Lock()
+		for period, u := range a.closed {
+			value, _ := json.Marshal(u)
+			batch.Put(usageKey(a.name, period), value)
+		}
+		a.closed = nil
+		if a.dirty {
+			daily, _ := json.Marshal(a.daily)
+			monthly, _ := json.Marshal(a.monthly)
+			batch.Put(usageKey(a.name, a.day), daily)
+			batch.Put(usageKey(a.name, a.month), monthly)
+			a.dirty = false
+		}
+		a.mu.Unlock()
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return m.db.Write(batch, nil)
+}
+
+// account returns the account of the tenant of an API key, nil if the key
+// is unknown
+func (m *usageMeter) account(key string) *tenantAccount {
+	k, ok := m.keys[key]
+	if !ok {
+		return nil
+	}
+	return m.accounts[k.Tenant]
+}
+
+// usageKeyFromRequest reads the API key of the Authorization or X-API-Key
+// header
+func usageKeyFromRequest(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// tenantKey is the context key of the account of an authenticated request
+type tenantKey struct{}
+
+// tenantOf returns the account of the tenant that sent r, nil if API keys are
+// disabled
+func tenantOf(r *http.Request) *tenantAccount {
+	account, _ := r.Context().Value(tenantKey{}).(*tenantAccount)
+	return account
+}
+
+// authenticate rejects requests without a valid API key and requests of
+// tenants whose quota is used up. /health, /readyz, /metrics and /openapi.json stay
+// public, /admin needs an admin key
+func (m *usageMeter) authenticate(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health", "/readyz", "/metrics", "/openapi.json":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := m.keys[usageKeyFromRequest(r)]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing or unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/admin/") && !key.Admin {
+			http.Error(w, "API key is not allowed to use admin endpoints", http.StatusForbidden)
+			return
+		}
+
+		account := m.accounts[key.Tenant]
+		now := time.Now()
+		if exceeded, resets := account.admit(now); exceeded != "" {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(resets.Sub(now).Seconds()))))
+			http.Error(w, "Quota exceeded, "+exceeded, http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, account)))
+	})
+}
+
+// tenantUsage is the usage of a tenant reported by the admin endpoint
+type tenantUsage struct {
+	Tenant  string `json:"tenant"`
+	Day     string `json:"day"`
+	Daily   usage  `json:"daily"`
+	Month   string `json:"month"`
+	Monthly usage  `json:"monthly"`
+	// Quotas holds the limits that are set
+	Quotas map[string]int64 `json:"quotas,omitempty"`
+}
+
+// usageHandler reports the usage of every tenant, or the tenant named by the
+// tenant parameter
+func (vtcrzr *Vectorizer) usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if vtcrzr.usage == nil {
+		http.Error(w, "API keys are disabled, set VECTORIZER_API_KEYS to enable them", http.StatusNotFound)
+		return
+	}
+
+	filter := r.URL.Query().Get("tenant")
+	tenants := []tenantUsage{}
+	now := time.Now()
+	for _, a := range vtcrzr.usage.accounts {
+		if filter != "" && a.name != filter {
+			continue
+		}
+		a.mu.Lock()
+		a.roll(now)
+		t := tenantUsage{Tenant: a.name, Day: a.day, Daily: a.daily, Month: a.month, Monthly: a.monthly, Quotas: map[string]int64{}}
+		a.mu.Unlock()
+		for name, limit := range map[string]int64{
+			"daily_requests":   a.quotas.DailyRequests,
+			"monthly_requests": a.quotas.MonthlyRequests,
+			"daily_tokens":     a.quotas.DailyTokens,
+			"monthly_tokens":   a.quotas.MonthlyTokens,
+		} {
+			if limit > 0 {
+				t.Quotas[name] = limit
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	if filter != "" && len(tenants) == 0 {
+		http.Error(w, "Unknown tenant "+filter, http.StatusNotFound)
+		return
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Tenant < tenants[j].Tenant })
+
+	response, err := json.Marshal(map[string][]tenantUsage{"tenants": tenants})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// configHashHeader carries the hash of the serving configuration that
+// produced a response, see manifest
+const configHashHeader = "X-Config-Hash"
+
+// versionHandler returns the manifest of the server defaults. Downstream
+// caches can poll it or send If-None-Match to detect configuration changes
+func (vtcrzr *Vectorizer) versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	m, err := vtcrzr.manifest(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Failed to create manifest "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	etag := quoteETag(m.Hash)
+	w.Header().Set("ETag", etag)
+	w.Header().Set(configHashHeader, m.Hash)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	response, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// vectorETag identifies the vector produced for input under the configuration
+// with the given hash
+func vectorETag(configHash string, input interface{}) (string, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(configHash))
+	h.Write(b)
+	return quoteETag(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+func quoteETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// etagMatches reports whether the If-None-Match header of r lists etag
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
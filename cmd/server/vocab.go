@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// vocabConfig bounds the vocabulary introspection endpoints, so a single
+// request can't iterate over millions of keys
+type vocabConfig struct {
+	// Limit is the number of words of a page if the request doesn't ask
+	Limit int
+	// MaxLimit is the largest number of words of a page
+	MaxLimit int
+	// Timeout ends the iteration early, the page is cut short
+	Timeout time.Duration
+}
+
+func vocabConfigFromEnv() (vocabConfig, error) {
+	config := vocabConfig{Limit: 100, MaxLimit: 1000, Timeout: 5 * time.Second}
+	for _, err := range []error{
+		envInt("VECTORIZER_VOCAB_LIMIT", &config.Limit),
+		envInt("VECTORIZER_VOCAB_MAX_LIMIT", &config.MaxLimit),
+		envDuration("VECTORIZER_VOCAB_TIMEOUT", &config.Timeout),
+	} {
+		if err != nil {
+			return config, err
+		}
+	}
+	if config.Limit < 1 || config.MaxLimit < config.Limit || config.Timeout <= 0 {
+		return config, fmt.Errorf("invalid vocabulary limits %+v", config)
+	}
+	return config, nil
+}
+
+// limit reads the limit query parameter named name
+func (c vocabConfig) limit(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return c.Limit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > c.MaxLimit {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, c.MaxLimit)
+	}
+	return limit, nil
+}
+
+// vocabPage is the body returned by the vocabulary endpoints
+type vocabPage struct {
+	Words []string `json:"words"`
+	// NextCursor continues the listing after the last word, it is empty on
+	// the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Truncated is set if the timeout ended the page before the limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// vocabHandler lists the words of the vocabulary in byte order, a page at a
+// time. GET /vocab/sample returns random words instead
+func (vtcrzr *Vectorizer) vocabHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), vtcrzr.vocab.Timeout)
+	defer cancel()
+
+	var page *vocabPage
+	switch r.URL.Path {
+	case "/vocab":
+		limit, err := vtcrzr.vocab.limit(r, "limit")
+		if err != nil {
+			http.Error(w, "Invalid limit "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		after, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("cursor"))
+		if err != nil {
+			http.Error(w, "Invalid cursor "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err = vtcrzr.db().store.list(ctx, []byte(r.URL.Query().Get("prefix")), after, limit)
+		if err != nil {
+			http.Error(w, "Failed to list vocabulary "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "/vocab/frequency":
+		vtcrzr.frequencyHandler(w, r)
+		return
+	case "/vocab/sample":
+		n, err := vtcrzr.vocab.limit(r, "n")
+		if err != nil {
+			http.Error(w, "Invalid n "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		page, err = vtcrzr.db().store.sample(ctx, n)
+		if err != nil {
+			http.Error(w, "Failed to sample vocabulary "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	response, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// wordFrequency is the body returned by GET /vocab/frequency
+type wordFrequency struct {
+	Word string `json:"word"`
+	pkg.WordFrequency
+}
+
+// frequencyHandler returns the frequency stored with the vector of a word
+// by an import with --ranks or --counts
+func (vtcrzr *Vectorizer) frequencyHandler(w http.ResponseWriter, r *http.Request) {
+	word := r.URL.Query().Get("word")
+	if word == "" {
+		http.Error(w, "Missing word", http.StatusBadRequest)
+		return
+	}
+	value, err := vtcrzr.db().store.Get([]byte(word))
+	if errors.Is(err, leveldb.ErrNotFound) {
+		http.Error(w, "Unknown word", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read word "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, freq, ok, err := pkg.DecodeRecord(value)
+	if err != nil {
+		http.Error(w, "Failed to decode word "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No frequency is stored for the word, the database was imported without --ranks or --counts", http.StatusNotFound)
+		return
+	}
+
+	response, err := json.Marshal(wordFrequency{Word: word, WordFrequency: freq})
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// list returns up to limit words starting with prefix that sort after the
+// word after, merging the shards in byte order
+func (s *store) list(ctx context.Context, prefix, after []byte, limit int) (*vocabPage, error) {
+	keys := util.BytesPrefix(prefix)
+	if len(after) > 0 && bytes.Compare(after, keys.Start) >= 0 {
+		keys.Start = append(append([]byte{}, after...), 0)
+	}
+
+	iters := make([]iterator.Iterator, len(s.shards))
+	for i, db := range s.shards {
+		iters[i] = db.NewIterator(keys, nil)
+		defer iters[i].Release()
+		iters[i].First()
+	}
+
+	page := &vocabPage{Words: []string{}}
+	for {
+		next := -1
+		for i, iter := range iters {
+			if iter.Valid() && (next < 0 || bytes.Compare(iter.Key(), iters[next].Key()) < 0) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if len(page.Words) == limit || ctx.Err() != nil {
+			page.Truncated = len(page.Words) < limit
+			if len(page.Words) > 0 {
+				after = []byte(page.Words[len(page.Words)-1])
+			}
+			page.NextCursor = base64.RawURLEncoding.EncodeToString(after)
+			break
+		}
+		page.Words = append(page.Words, string(iters[next].Key()))
+		iters[next].Next()
+	}
+
+	for _, iter := range iters {
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// sample returns about n distinct random words. Every word is the first one
+// after a random key between the first and the last word of a random shard,
+// so words following sparse parts of the key space are more likely
+func (s *store) sample(ctx context.Context, n int) (*vocabPage, error) {
+	type keyRange struct{ first, last uint64 }
+	ranges := make([]*keyRange, len(s.shards))
+	iters := make([]iterator.Iterator, len(s.shards))
+	for i, db := range s.shards {
+		iters[i] = db.NewIterator(nil, nil)
+		defer iters[i].Release()
+		if iters[i].First() {
+			r := &keyRange{first: keyPosition(iters[i].Key())}
+			iters[i].Last()
+			r.last = keyPosition(iters[i].Key())
+			ranges[i] = r
+		}
+	}
+
+	page := &vocabPage{Words: []string{}}
+	seen := map[string]bool{}
+	// duplicates are retried, but not forever on tiny vocabularies
+	for attempts := 0; len(page.Words) < n && attempts < 4*n; attempts++ {
+		if ctx.Err() != nil {
+			page.Truncated = true
+			break
+		}
+		i := rand.Intn(len(s.shards))
+		if ranges[i] == nil {
+			continue
+		}
+		position := ranges[i].first
+		// Int63n takes no more than 63 bits
+		if span := (ranges[i].last - ranges[i].first) >> 1; span > 0 {
+			position += uint64(rand.Int63n(int64(span))) << 1
+		}
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], position)
+		if !iters[i].Seek(bytes.TrimRight(key[:], "\x00")) && !iters[i].First() {
+			continue
+		}
+		word := string(iters[i].Key())
+		if !seen[word] {
+			seen[word] = true
+			page.Words = append(page.Words, word)
+		}
+	}
+
+	for _, iter := range iters {
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// keyPosition maps the first 8 bytes of key to a number preserving their
+// order
+func keyPosition(key []byte) uint64 {
+	var b [8]byte
+	copy(b[:], key)
+	return binary.BigEndian.Uint64(b[:])
+}
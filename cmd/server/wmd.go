@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+)
+
+// wmdRequest is the body accepted by the word mover's distance endpoint. It
+// takes the options of the vectorize endpoint
+type wmdRequest struct {
+	A *string `json:"a"`
+	B *string `json:"b"`
+	vectorizeRequest
+}
+
+// wmdResponse is the body returned by the word mover's distance endpoint
+type wmdResponse struct {
+	// Distance is the relaxed word mover's distance, the larger of the
+	// directed distances
+	Distance float64 `json:"distance"`
+	// AToB is the average distance of the words of a to their nearest word
+	// of b, BToA the other way around
+	AToB float64 `json:"a_to_b"`
+	BToA float64 `json:"b_to_a"`
+	// Cosine is the cosine similarity of the centroids, for comparison
+	Cosine   float64 `json:"cosine"`
+	A        quality `json:"a_quality"`
+	B        quality `json:"b_quality"`
+	Degraded bool    `json:"degraded,omitempty"`
+}
+
+// wmdHandler computes the relaxed word mover's distance of two texts
+func (vtcrzr *Vectorizer) wmdHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody wmdRequest
+	if err := decodeRequest(r.Body, &requestBody, vtcrzr.requestVersion); err != nil {
+		http.Error(w, "Failed to decode request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.A == nil || requestBody.B == nil {
+		http.Error(w, "Missing 'a' or 'b' field in request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Query != nil || requestBody.Fields != nil {
+		http.Error(w, "'query' and 'fields' are not supported when comparing texts", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := requestBody.options(vtcrzr.defaults)
+	if err != nil {
+		http.Error(w, "Invalid options "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	degraded := vtcrzr.degraded(r, &opts)
+
+	a, err := vtcrzr.wordCloud(*requestBody.A, opts)
+	if err != nil {
+		vectorizeError(w, fmt.Errorf("a: %w", err))
+		return
+	}
+	b, err := vtcrzr.wordCloud(*requestBody.B, opts)
+	if err != nil {
+		vectorizeError(w, fmt.Errorf("b: %w", err))
+		return
+	}
+
+	responseBody := wmdResponse{
+		AToB:     a.relaxedDistance(b),
+		BToA:     b.relaxedDistance(a),
+		Cosine:   a.cosine(b),
+		A:        a.quality,
+		B:        b.quality,
+		Degraded: degraded,
+	}
+	responseBody.Distance = math.Max(responseBody.AToB, responseBody.BToA)
+	response, err := json.Marshal(responseBody)
+	if err != nil {
+		http.Error(w, "Failed to send response "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// wordCloud holds the vectors of the words of a text with their normalized
+// weights, the bag of words compared by the word mover's distance
+type wordCloud struct {
+	vectors [][]float32
+	// weights add up to 1
+	weights []float64
+	// mean is the centroid as returned by /vectorize, centroid the unit
+	// vector of it
+	mean     []float32
+	centroid []float64
+	quality  quality
+}
+
+// wordCloud collects the vectors of text. Phrases and entities are part of
+// the cloud with their weights like they are part of the centroid
+func (vtcrzr *Vectorizer) wordCloud(text string, opts vectorizeOptions) (*wordCloud, error) {
+	corpus, err := vtcrzr.collect([]string{text}, opts)
+	if err != nil {
+		return nil, err
+	}
+	vectorized, err := vtcrzr.centroid(corpus, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mean := vectorized.vector.ToArray()
+	cloud := &wordCloud{
+		vectors:  make([][]float32, len(corpus.vectors)),
+		weights:  make([]float64, len(corpus.vectors)),
+		mean:     mean,
+		centroid: unitVector(mean),
+		quality:  vectorized.quality,
+	}
+	var weightSum float64
+	for _, weight := range corpus.weights {
+		weightSum += float64(weight)
+	}
+	for i, vector := range corpus.vectors {
+		cloud.vectors[i] = vector.ToArray()
+		cloud.weights[i] = float64(corpus.weights[i]) / weightSum
+	}
+	return cloud, nil
+}
+
+// relaxedDistance is the lower bound of the word mover's distance of Kusner
+// et al., where every word of c moves all of its weight to the nearest word
+// of other instead of splitting it
+func (c *wordCloud) relaxedDistance(other *wordCloud) float64 {
+	var distance float64
+	for i, vector := range c.vectors {
+		nearest := math.Inf(1)
+		for _, otherVector := range other.vectors {
+			nearest = math.Min(nearest, float64(vecmath.SquaredDistance(vector, otherVector)))
+		}
+		distance += c.weights[i] * math.Sqrt(nearest)
+	}
+	return distance
+}
+
+// cosine is the cosine similarity of the centroids of two clouds
+func (c *wordCloud) cosine(other *wordCloud) float64 {
+	var similarity float64
+	for i, value := range c.centroid {
+		similarity += value * other.centroid[i]
+	}
+	return similarity
+}
@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+)
+
+// BiasFile holds the unit bias direction a database was debiased along by
+// the importer with --debias, as a 1×dims matrix in the space of the stored
+// vectors
+const BiasFile = "bias.npy"
+
+// ReadBiasPairs reads the seed pairs defining a bias direction, two words
+// separated by whitespace per line like "he she". Blank lines and lines
+// starting with # are skipped
+func ReadBiasPairs(r io.Reader) ([][2]string, error) {
+	var pairs [][2]string
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected 2 words, got %d", lineNo, len(fields))
+		}
+		pairs = append(pairs, [2]string{fields[0], fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no pairs")
+	}
+	return pairs, nil
+}
+
+// BiasDirection returns the bias direction of the vectors of seed pairs,
+// following Bolukbasi et al.: the first principal component of the pairs
+// centered on their means, oriented towards the first words. It is a unit
+// vector
+func BiasDirection(pairs [][2][]float32) ([]float32, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no pairs with vectors")
+	}
+	dims := len(pairs[0][0])
+	// with pairs centered on their means, a-μ = (a-b)/2 = -(b-μ), so the
+	// principal component is that of the differences
+	diffs := make([][]float64, len(pairs))
+	start := make([]float64, dims)
+	for i, pair := range pairs {
+		a, b := pair[0], pair[1]
+		if len(a) != dims || len(b) != dims {
+			return nil, fmt.Errorf("pair %d has vectors of %d and %d dimensions, expected %d", i+1, len(a), len(b), dims)
+		}
+		diff := make([]float64, dims)
+		for j := range diff {
+			diff[j] = float64(a[j]-b[j]) / 2
+			start[j] += diff[j]
+		}
+		diffs[i] = diff
+	}
+
+	// power iteration on the second moment matrix of the differences,
+	// starting from their sum
+	g := start
+	for iteration := 0; iteration < 100; iteration++ {
+		if normalize64(g) == 0 {
+			return nil, errors.New("the pairs have identical vectors")
+		}
+		next := make([]float64, dims)
+		for _, diff := range diffs {
+			var dot float64
+			for j, value := range diff {
+				dot += value * g[j]
+			}
+			for j, value := range diff {
+				next[j] += dot * value
+			}
+		}
+		g = next
+	}
+	if normalize64(g) == 0 {
+		return nil, errors.New("the pairs have identical vectors")
+	}
+
+	var orientation float64
+	for j, value := range start {
+		orientation += value * g[j]
+	}
+	direction := make([]float32, dims)
+	for j, value := range g {
+		if orientation < 0 {
+			value = -value
+		}
+		direction[j] = float32(value)
+	}
+	return direction, nil
+}
+
+// normalize64 scales v to unit length and returns its former length
+func normalize64(v []float64) float64 {
+	var sum float64
+	for _, value := range v {
+		sum += value * value
+	}
+	norm := math.Sqrt(sum)
+	if norm == 0 {
+		return 0
+	}
+	for i := range v {
+		v[i] /= norm
+	}
+	return norm
+}
+
+// Neutralize returns v without its component along the unit direction g,
+// v - (v·g)g
+func Neutralize(v, g []float32) []float32 {
+	projection := vecmath.Dot(v, g)
+	neutral := make([]float32, len(v))
+	for i, value := range v {
+		neutral[i] = value - projection*g[i]
+	}
+	return neutral
+}
+
+// Equalize returns the vectors of a seed pair with the same component
+// orthogonal to the unit direction g, the neutralized mean of the pair, and
+// opposite components along g, so every neutralized word is equally close
+// to both. Unlike Bolukbasi et al. the vectors aren't assumed to be of unit
+// length, the difference of the pair along g is kept
+func Equalize(a, b, g []float32) ([]float32, []float32) {
+	mean := make([]float32, len(a))
+	for i := range mean {
+		mean[i] = (a[i] + b[i]) / 2
+	}
+	neutral := Neutralize(mean, g)
+	half := (vecmath.Dot(a, g) - vecmath.Dot(b, g)) / 2
+	ea, eb := make([]float32, len(a)), make([]float32, len(b))
+	for i, value := range neutral {
+		ea[i] = value + half*g[i]
+		eb[i] = value - half*g[i]
+	}
+	return ea, eb
+}
+
+// WriteBias writes the BiasFile of the database at root
+func WriteBias(root string, direction []float32) error {
+	b := AppendFloat32s(NpyHeader(1, len(direction)), direction)
+	return os.WriteFile(filepath.Join(root, BiasFile), b, 0o644)
+}
+
+// ReadBias reads the BiasFile of the database at root, nil if it has none
+func ReadBias(root string) ([]float32, error) {
+	f, err := os.Open(filepath.Join(root, BiasFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rows, _, values, err := ReadNpyMatrix(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", BiasFile, err)
+	}
+	if rows != 1 {
+		return nil, fmt.Errorf("%s has %d rows, expected 1", BiasFile, rows)
+	}
+	return values, nil
+}
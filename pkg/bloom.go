@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// BloomFile is written to the root of a database and holds a BloomFilter of
+// all its keys
+const BloomFile = "vocabulary.bloom"
+
+// bloomMagic identifies serialized bloom filters
+const bloomMagic = "GLVBLOOM"
+
+// BloomFilter answers whether a key may be in a set. False positives are
+// possible, false negatives are not
+type BloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+// NewBloomFilter creates a filter for n keys using bitsPerKey bits per key
+func NewBloomFilter(n int, bitsPerKey int) *BloomFilter {
+	m := n * bitsPerKey
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), k: k}
+}
+
+// BloomHash hashes key for AddHash
+func BloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// Add adds key to the filter
+func (f *BloomFilter) Add(key []byte) {
+	f.AddHash(BloomHash(key))
+}
+
+// AddHash adds the key with the given BloomHash to the filter
+func (f *BloomFilter) AddHash(h uint64) {
+	m := uint64(len(f.bits) * 64)
+	h1, h2 := h&math.MaxUint32, h>>32
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain reports whether key may have been added to the filter
+func (f *BloomFilter) MayContain(key []byte) bool {
+	h := BloomHash(key)
+	m := uint64(len(f.bits) * 64)
+	h1, h2 := h&math.MaxUint32, h>>32
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo serializes the filter
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+	binary.LittleEndian.PutUint32(header[len(bloomMagic):], f.k)
+	binary.LittleEndian.PutUint64(header[len(bloomMagic)+4:], uint64(len(f.bits)))
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+
+	written := int64(n)
+	buf := make([]byte, 8)
+	for _, word := range f.bits {
+		binary.LittleEndian.PutUint64(buf, word)
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadBloomFilter deserializes a filter written by WriteTo
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(bloomMagic)]) != bloomMagic {
+		return nil, fmt.Errorf("not a bloom filter")
+	}
+
+	f := &BloomFilter{k: binary.LittleEndian.Uint32(header[len(bloomMagic):])}
+	words := binary.LittleEndian.Uint64(header[len(bloomMagic)+4:])
+	if f.k < 1 || words == 0 || words > math.MaxInt32 {
+		return nil, fmt.Errorf("corrupt bloom filter header")
+	}
+
+	data := make([]byte, words*8)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	f.bits = make([]uint64, words)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return f, nil
+}
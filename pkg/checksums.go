@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ChecksumsFile is written to the root of a database by the importer and
+// lists the files of the database with their checksums
+const ChecksumsFile = "checksums.json"
+
+// RotationFile holds the rotation of the vectors of a database imported
+// with --pca, a .npy matrix rotating vectors of the source by v·matrix
+const RotationFile = "rotation.npy"
+
+// FileChecksum is a file of a database, relative to its root
+type FileChecksum struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Checksums describes a database and its files, so copies can be verified
+type Checksums struct {
+	Words  int    `json:"words"`
+	Dims   int    `json:"dims"`
+	Shards int    `json:"shards"`
+	Source string `json:"source"`
+	// PCA is set if the vectors are rotated onto their principal axes, by
+	// the matrix of RotationFile
+	PCA bool `json:"pca,omitempty"`
+	// CaseMerge is the policy case variants of words were merged into
+	// their lowercase key by, average or frequent, empty if they weren't
+	CaseMerge string `json:"case_merge,omitempty"`
+	// Frequencies is set if the vectors are stored with their frequencies,
+	// see AppendFrequency: order if words are ranked by their position in
+	// the source, counts if by the counts of a counts file
+	Frequencies string `json:"frequencies,omitempty"`
+	// Index is set if the database has the index of IndexDir
+	Index bool `json:"index,omitempty"`
+	// Debiased is set if a bias direction, that of BiasFile, was removed
+	// from the vectors
+	Debiased bool           `json:"debiased,omitempty"`
+	Created  time.Time      `json:"created"`
+	Files    []FileChecksum `json:"files"`
+}
+
+// SkipFile reports whether a file of a database is left out of checksums
+// and copies. The lock and the info logs belong to the process that has the
+// database open
+func SkipFile(name string) bool {
+	return name == "LOCK" || strings.HasPrefix(name, "LOG") || name == ChecksumsFile
+}
+
+// ComputeChecksums hashes all files of the database at root
+func ComputeChecksums(root string) ([]FileChecksum, error) {
+	var files []FileChecksum
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || SkipFile(info.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileChecksum{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: sum})
+		return nil
+	})
+	return files, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteChecksums writes c to the root of the database
+func WriteChecksums(root string, c *Checksums) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, ChecksumsFile), b, 0o644)
+}
+
+// ReadChecksums reads the checksums of the database at root, nil if it has none
+func ReadChecksums(root string) (*Checksums, error) {
+	b, err := os.ReadFile(filepath.Join(root, ChecksumsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c Checksums
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", ChecksumsFile, err)
+	}
+	return &c, nil
+}
+
+// VerifyChecksums checks that every file listed in c exists below root with
+// its size and checksum
+func VerifyChecksums(root string, c *Checksums) error {
+	var problems []string
+	for _, file := range c.Files {
+		path := filepath.Join(root, filepath.FromSlash(file.Path))
+		info, err := os.Stat(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Path, err))
+			continue
+		}
+		if info.Size() != file.Size {
+			problems = append(problems, fmt.Sprintf("%s: size %d, expected %d", file.Path, info.Size(), file.Size))
+			continue
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.Path, err))
+		} else if sum != file.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", file.Path))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("corrupt database %s: %s", root, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// EncodeVector encodes a vector the way it is stored in the database
+func EncodeVector(vector []float32) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(vector); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeVector decodes a vector stored in the database
+func DecodeVector(value []byte) ([]float32, error) {
+	var vector []float32
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&vector); err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
+// frequencyVersion starts a WordFrequency appended to an encoded vector
+const frequencyVersion = 1
+
+// WordFrequency is how frequent a word is in the corpus its vector was
+// trained on, stored with the vector by the importer
+type WordFrequency struct {
+	// Rank is the position of the word by frequency, 1 is the most frequent
+	Rank int64 `json:"rank"`
+	// Count is the number of occurrences of the word, 0 if unknown
+	Count int64 `json:"count,omitempty"`
+}
+
+// AppendFrequency appends f to the encoded vector value. DecodeVector reads
+// the vector and ignores it, so databases with frequencies work everywhere
+func AppendFrequency(value []byte, f WordFrequency) []byte {
+	value = append(value, frequencyVersion)
+	value = binary.AppendUvarint(value, uint64(f.Rank))
+	return binary.AppendUvarint(value, uint64(f.Count))
+}
+
+// DecodeRecord decodes a vector stored in the database and its frequency,
+// ok is false if none is stored
+func DecodeRecord(value []byte) (vector []float32, f WordFrequency, ok bool, err error) {
+	r := bytes.NewReader(value)
+	// a bytes.Reader is read by gob without buffering, what remains is
+	// the frequency
+	if err := gob.NewDecoder(r).Decode(&vector); err != nil {
+		return nil, f, false, err
+	}
+	rest := value[len(value)-r.Len():]
+	if len(rest) == 0 {
+		return vector, f, false, nil
+	}
+	if rest[0] != frequencyVersion {
+		return nil, f, false, fmt.Errorf("unknown frequency version %d", rest[0])
+	}
+	rank, n := binary.Uvarint(rest[1:])
+	if n <= 0 {
+		return nil, f, false, errors.New("corrupt frequency")
+	}
+	count, m := binary.Uvarint(rest[1+n:])
+	if m <= 0 || 1+n+m != len(rest) {
+		return nil, f, false, errors.New("corrupt frequency")
+	}
+	return vector, WordFrequency{Rank: int64(rank), Count: int64(count)}, true, nil
+}
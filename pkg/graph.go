@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// keys of a k-NN graph database, written by cmd/knngraph
+const (
+	// GraphNeighborsPrefix starts the keys of the neighbors of the words
+	GraphNeighborsPrefix = "n/"
+	// GraphMetaKey holds the GraphMeta of the graph in JSON
+	GraphMetaKey = "meta"
+)
+
+// metrics of a k-NN graph
+const (
+	// GraphCosine ranks neighbors by cosine distance, 1 - cosine similarity
+	GraphCosine = "cosine"
+	// GraphL2 ranks neighbors by Euclidean distance
+	GraphL2 = "l2"
+)
+
+// GraphMeta describes a k-NN graph and how far it was computed
+type GraphMeta struct {
+	K      int    `json:"k"`
+	Metric string `json:"metric"`
+	Words  int    `json:"words"`
+	Dims   int    `json:"dims"`
+	// Done is the number of words whose neighbors are written, in the
+	// order of the keys of the source database. The graph is complete once
+	// it is Words
+	Done    int       `json:"done"`
+	Created time.Time `json:"created"`
+}
+
+// GraphNeighbor is a word close to another one in a k-NN graph
+type GraphNeighbor struct {
+	Word     string  `json:"word"`
+	Distance float32 `json:"distance"`
+}
+
+var errCorruptNeighbors = errors.New("corrupt neighbors")
+
+// EncodeNeighbors encodes the neighbors of a word, nearest first, as their
+// number followed by the length prefixed words and their distances
+func EncodeNeighbors(neighbors []GraphNeighbor) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(neighbors)))
+	for _, n := range neighbors {
+		b = binary.AppendUvarint(b, uint64(len(n.Word)))
+		b = append(b, n.Word...)
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(n.Distance))
+	}
+	return b
+}
+
+// DecodeNeighbors decodes neighbors encoded by EncodeNeighbors
+func DecodeNeighbors(b []byte) ([]GraphNeighbor, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)) {
+		return nil, errCorruptNeighbors
+	}
+	b = b[size:]
+	neighbors := make([]GraphNeighbor, 0, n)
+	for i := uint64(0); i < n; i++ {
+		length, size := binary.Uvarint(b)
+		if size <= 0 || uint64(len(b)-size) < length+4 {
+			return nil, errCorruptNeighbors
+		}
+		b = b[size:]
+		word := string(b[:length])
+		distance := math.Float32frombits(binary.LittleEndian.Uint32(b[length:]))
+		neighbors = append(neighbors, GraphNeighbor{Word: word, Distance: distance})
+		b = b[length+4:]
+	}
+	if len(b) > 0 {
+		return nil, errCorruptNeighbors
+	}
+	return neighbors, nil
+}
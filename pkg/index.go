@@ -0,0 +1,41 @@
+package pkg
+
+import "strings"
+
+// IndexDir is the LevelDB database below the root of a database imported
+// with --index. It maps the lowercase and the folded forms of words to the
+// word they are stored under, so fallbacks find "NASA" from "nasa" and
+// "café" from "cafe" with one read
+const IndexDir = "index"
+
+// IndexLowercaseKey returns the key of the index entry for the lowercase
+// form of word
+func IndexLowercaseKey(word string) []byte {
+	return []byte("l/" + strings.ToLower(word))
+}
+
+// IndexFoldKey returns the key of the index entry for the lowercase form of
+// word without diacritics
+func IndexFoldKey(word string) []byte {
+	return []byte("f/" + FoldDiacritics(strings.ToLower(word)))
+}
+
+// foldDiacritics maps the letters with diacritics of the Latin alphabets
+// to their base letters
+var foldDiacritics = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ā", "a", "ă", "a", "ą", "a",
+	"ç", "c", "ć", "c", "č", "c", "ď", "d", "đ", "d",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ē", "e", "ė", "e", "ę", "e", "ě", "e",
+	"ğ", "g", "ì", "i", "í", "i", "î", "i", "ï", "i", "ī", "i", "į", "i", "ı", "i",
+	"ł", "l", "ľ", "l", "ñ", "n", "ń", "n", "ň", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ō", "o", "ő", "o",
+	"ŕ", "r", "ř", "r", "ś", "s", "š", "s", "ş", "s", "ß", "ss", "ť", "t", "ţ", "t",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ū", "u", "ů", "u", "ű", "u", "ų", "u",
+	"ý", "y", "ÿ", "y", "ź", "z", "ż", "z", "ž", "z",
+)
+
+// FoldDiacritics replaces the lowercase letters with diacritics of the
+// Latin alphabets in s by their base letters, "café" by "cafe"
+func FoldDiacritics(s string) string {
+	return foldDiacritics.Replace(s)
+}
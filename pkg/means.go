@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// MeansFile holds the mean of the vectors of a database in its first row
+// and, if the database has frequencies, their frequency-weighted mean in the
+// second, written by the importer with --means and by dbcheck
+const MeansFile = "means.npy"
+
+// MeanAccumulator sums the vectors of a database for their means
+type MeanAccumulator struct {
+	sum, weighted []float64
+	n             int
+	weights       float64
+}
+
+// Add adds a record of the database. Vectors with NaN or infinite values
+// are left out. The frequency-weighted mean weighs a vector by its count,
+// or by 1/rank following Zipf's law if the count is unknown, vectors
+// without a frequency weigh nothing
+func (a *MeanAccumulator) Add(value []byte) error {
+	vector, f, ok, err := DecodeRecord(value)
+	if err != nil {
+		return err
+	}
+	if NonFinite(vector) > 0 {
+		return nil
+	}
+	if a.sum == nil {
+		a.sum = make([]float64, len(vector))
+		a.weighted = make([]float64, len(vector))
+	}
+	if len(vector) != len(a.sum) {
+		return fmt.Errorf("vector of %d dimensions, expected %d", len(vector), len(a.sum))
+	}
+
+	var weight float64
+	switch {
+	case ok && f.Count > 0:
+		weight = float64(f.Count)
+	case ok && f.Rank > 0:
+		weight = 1 / float64(f.Rank)
+	}
+	for i, value := range vector {
+		a.sum[i] += float64(value)
+		a.weighted[i] += weight * float64(value)
+	}
+	a.n++
+	a.weights += weight
+	return nil
+}
+
+// Means returns the mean of the vectors added and their frequency-weighted
+// mean, nil if no vector has a frequency. Both are nil if none was added
+func (a *MeanAccumulator) Means() (mean, weighted []float32) {
+	if a.n == 0 {
+		return nil, nil
+	}
+	mean = make([]float32, len(a.sum))
+	for i, value := range a.sum {
+		mean[i] = float32(value / float64(a.n))
+	}
+	if a.weights == 0 {
+		return mean, nil
+	}
+	weighted = make([]float32, len(a.weighted))
+	for i, value := range a.weighted {
+		weighted[i] = float32(value / a.weights)
+	}
+	return mean, weighted
+}
+
+// WriteMeans writes the MeansFile of the database at root, weighted may be
+// nil
+func WriteMeans(root string, mean, weighted []float32) error {
+	rows := 1
+	if weighted != nil {
+		rows = 2
+	}
+	b := AppendFloat32s(NpyHeader(rows, len(mean)), mean)
+	b = AppendFloat32s(b, weighted)
+	return os.WriteFile(filepath.Join(root, MeansFile), b, 0o644)
+}
+
+// ReadMeans reads the MeansFile of the database at root. The means are nil
+// if it has none, weighted is nil if the database has no frequencies
+func ReadMeans(root string) (mean, weighted []float32, err error) {
+	f, err := os.Open(filepath.Join(root, MeansFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	rows, cols, values, err := ReadNpyMatrix(bufio.NewReader(f))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", MeansFile, err)
+	}
+	if rows > 2 {
+		return nil, nil, fmt.Errorf("%s has %d rows, expected 1 or 2", MeansFile, rows)
+	}
+	if rows == 2 {
+		weighted = values[cols:]
+	}
+	return values[:cols], weighted, nil
+}
@@ -0,0 +1,153 @@
+// Package metric holds the distance metrics shared by the server endpoints
+// comparing vectors and the tools building indexes of them, so a vector is
+// compared the same way wherever it is used.
+//
+// Metrics are registered at compile time: a file of package metric, behind
+// a build tag of its own if it needs one, calls Register in its init
+// function and the metric is then available by name everywhere.
+package metric
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+)
+
+// names of the built-in metrics
+const (
+	Cosine    = "cosine"
+	Dot       = "dot"
+	Euclidean = "euclidean"
+	Manhattan = "manhattan"
+	// L2 is an alias of Euclidean, the name of k-NN graphs built before
+	// this package
+	L2 = "l2"
+)
+
+// Metric compares vectors
+type Metric interface {
+	// Name is the name the metric is registered under
+	Name() string
+	// Prepare returns vector as it is compared, e.g. scaled to unit length.
+	// Indexes store prepared vectors, so their distances only need Distance.
+	// It may return vector itself but never changes it
+	Prepare(vector []float32) []float32
+	// Distance returns the distance of two prepared vectors of the same
+	// length, smaller is closer
+	Distance(a, b []float32) float32
+	// Score returns the value reported for a distance: the similarity for
+	// cosine and dot, the distance itself for the others
+	Score(distance float32) float32
+}
+
+var (
+	mu      sync.RWMutex
+	metrics = map[string]Metric{}
+	aliases = map[string]string{L2: Euclidean}
+)
+
+func init() {
+	Register(cosine{})
+	Register(dot{})
+	Register(euclidean{})
+	Register(manhattan{})
+}
+
+// Register makes m available by its name. It panics if the name is taken,
+// as registering twice is a programming error
+func Register(m Metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := metrics[m.Name()]; ok {
+		panic("metric: " + m.Name() + " registered twice")
+	}
+	metrics[m.Name()] = m
+}
+
+// Get returns the metric registered as name or one of its aliases
+func Get(name string) (Metric, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	m, ok := metrics[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q, expected one of %v", name, namesLocked())
+	}
+	return m, nil
+}
+
+// Names returns the names of the registered metrics, sorted
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return namesLocked()
+}
+
+func namesLocked() []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Unit returns vector scaled to unit length, a zero vector as it is
+func Unit(vector []float32) []float32 {
+	norm := math.Sqrt(float64(vecmath.Dot(vector, vector)))
+	if norm == 0 {
+		return vector
+	}
+	unit := make([]float32, len(vector))
+	for i, value := range vector {
+		unit[i] = float32(float64(value) / norm)
+	}
+	return unit
+}
+
+// cosine is the cosine distance, 1 - cosine similarity. Vectors are
+// prepared to unit length, so the similarity is their dot product
+type cosine struct{}
+
+func (cosine) Name() string                       { return Cosine }
+func (cosine) Prepare(vector []float32) []float32 { return Unit(vector) }
+func (cosine) Distance(a, b []float32) float32    { return 1 - vecmath.Dot(a, b) }
+func (cosine) Score(distance float32) float32     { return 1 - distance }
+
+// dot ranks by inner product, the distance is its negative
+type dot struct{}
+
+func (dot) Name() string                       { return Dot }
+func (dot) Prepare(vector []float32) []float32 { return vector }
+func (dot) Distance(a, b []float32) float32    { return -vecmath.Dot(a, b) }
+func (dot) Score(distance float32) float32     { return -distance }
+
+type euclidean struct{}
+
+func (euclidean) Name() string                       { return Euclidean }
+func (euclidean) Prepare(vector []float32) []float32 { return vector }
+func (euclidean) Distance(a, b []float32) float32 {
+	return float32(math.Sqrt(float64(vecmath.SquaredDistance(a, b))))
+}
+func (euclidean) Score(distance float32) float32 { return distance }
+
+type manhattan struct{}
+
+func (manhattan) Name() string                       { return Manhattan }
+func (manhattan) Prepare(vector []float32) []float32 { return vector }
+func (manhattan) Distance(a, b []float32) float32 {
+	if len(a) != len(b) {
+		panic("metric: vectors have different lengths")
+	}
+	var sum float32
+	for i := range a {
+		sum += float32(math.Abs(float64(a[i] - b[i])))
+	}
+	return sum
+}
+func (manhattan) Score(distance float32) float32 { return distance }
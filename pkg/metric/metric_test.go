@@ -0,0 +1,39 @@
+package metric
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	a, b := []float32{3, 0}, []float32{0, 4}
+	for _, test := range []struct {
+		name            string
+		distance, score float32
+	}{
+		{Cosine, 1, 0},
+		{Dot, 0, 0},
+		{Euclidean, 5, 5},
+		{L2, 5, 5},
+		{Manhattan, 7, 7},
+	} {
+		m, err := Get(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		distance := m.Distance(m.Prepare(a), m.Prepare(b))
+		if math.Abs(float64(distance-test.distance)) > 1e-6 {
+			t.Errorf("%s distance = %v, want %v", test.name, distance, test.distance)
+		}
+		if score := m.Score(distance); math.Abs(float64(score-test.score)) > 1e-6 {
+			t.Errorf("%s score = %v, want %v", test.name, score, test.score)
+		}
+	}
+	if a[0] != 3 {
+		t.Errorf("Prepare changed its vector to %v", a)
+	}
+
+	if _, err := Get("hamming"); err == nil {
+		t.Error("Get of an unknown metric succeeded")
+	}
+}
@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// NpyHeaderSize is the size of the headers returned by NpyHeader. It is
+// fixed, so the header can be rewritten once the number of rows is known
+const NpyHeaderSize = 128
+
+// NpyHeader returns the header of a .npy file holding a little endian float32
+// matrix of rows x cols, the rows follow it one after the other
+func NpyHeader(rows, cols int) []byte {
+	header := []byte("\x93NUMPY\x01\x00\x00\x00")
+	binary.LittleEndian.PutUint16(header[8:], NpyHeaderSize-10)
+	header = append(header, fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", rows, cols)...)
+	for len(header) < NpyHeaderSize-1 {
+		header = append(header, ' ')
+	}
+	return append(header, '\n')
+}
+
+// AppendFloat32s appends the little endian encoding of values to b
+func AppendFloat32s(b []byte, values []float32) []byte {
+	for _, value := range values {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(value))
+	}
+	return b
+}
+
+// ReadNpyMatrix reads a .npy file holding a little endian float32 matrix in
+// C order, as written by numpy.save, and returns its values row after row
+func ReadNpyMatrix(r io.Reader) (rows, cols int, values []float32, err error) {
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, 0, nil, err
+	}
+	if string(magic[:6]) != "\x93NUMPY" {
+		return 0, 0, nil, fmt.Errorf("not a .npy file")
+	}
+	var headerLen int
+	switch magic[6] {
+	case 1:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, 0, nil, err
+		}
+		headerLen = int(binary.LittleEndian.Uint16(b))
+	case 2, 3:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, 0, nil, err
+		}
+		headerLen = int(binary.LittleEndian.Uint32(b))
+	default:
+		return 0, 0, nil, fmt.Errorf("unsupported .npy version %d", magic[6])
+	}
+	if headerLen > 1<<16 {
+		return 0, 0, nil, fmt.Errorf(".npy header of %d bytes is too long", headerLen)
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+
+	dict := strings.ReplaceAll(string(header), " ", "")
+	if !strings.Contains(dict, "'descr':'<f4'") {
+		return 0, 0, nil, fmt.Errorf(".npy data must be little endian float32")
+	}
+	if !strings.Contains(dict, "'fortran_order':False") {
+		return 0, 0, nil, fmt.Errorf(".npy data must be in C order")
+	}
+	_, shape, ok := strings.Cut(dict, "'shape':(")
+	if !ok {
+		return 0, 0, nil, fmt.Errorf(".npy header has no shape")
+	}
+	shape, _, _ = strings.Cut(shape, ")")
+	if _, err := fmt.Sscanf(shape, "%d,%d", &rows, &cols); err != nil || rows <= 0 || cols <= 0 {
+		return 0, 0, nil, fmt.Errorf(".npy data must be a matrix, not of shape (%s)", shape)
+	}
+	if rows > 1<<28/cols {
+		return 0, 0, nil, fmt.Errorf(".npy matrix of %d x %d is too large", rows, cols)
+	}
+
+	b := make([]byte, 4*rows*cols)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, 0, nil, err
+	}
+	values = make([]float32, rows*cols)
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return rows, cols, values, nil
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg/vecmath"
+)
+
+// PQCentroids is the number of centroids per subspace of a PQCodebook, so
+// every code is a byte
+const PQCentroids = 256
+
+// PQCodebook is a product quantizer, written by cmd/pqtrain: a vector is
+// split into M subvectors of Dims/M values and every subvector replaced by
+// the index of the nearest of the PQCentroids centroids of its subspace, so
+// a vector of 300 float32 takes M bytes
+type PQCodebook struct {
+	M    int
+	Dims int
+	// Centroids holds the centroids of subspace 0 first, PQCentroids rows of
+	// Dims/M values per subspace
+	Centroids []float32
+}
+
+// NewPQCodebook returns the codebook of m subspaces of vectors of dims
+// dimensions with the given centroids
+func NewPQCodebook(m, dims int, centroids []float32) (*PQCodebook, error) {
+	if m <= 0 || dims <= 0 || dims%m != 0 {
+		return nil, fmt.Errorf("%d dimensions can't be split into %d subspaces", dims, m)
+	}
+	if len(centroids) != PQCentroids*dims {
+		return nil, fmt.Errorf("%d subspaces of %d dimensions need %d centroid values, not %d", m, dims/m, PQCentroids*dims, len(centroids))
+	}
+	return &PQCodebook{M: m, Dims: dims, Centroids: centroids}, nil
+}
+
+// ReadPQCodebook reads a codebook written by Npy, a .npy matrix of
+// M*PQCentroids rows of Dims/M columns, the layout of the centroids of a
+// Faiss ProductQuantizer of 8 bits
+func ReadPQCodebook(r io.Reader) (*PQCodebook, error) {
+	rows, cols, values, err := ReadNpyMatrix(r)
+	if err != nil {
+		return nil, err
+	}
+	if rows%PQCentroids != 0 {
+		return nil, fmt.Errorf("a codebook has a multiple of %d rows, not %d", PQCentroids, rows)
+	}
+	m := rows / PQCentroids
+	return NewPQCodebook(m, m*cols, values)
+}
+
+// Npy returns the codebook as a .npy file
+func (c *PQCodebook) Npy() []byte {
+	return AppendFloat32s(NpyHeader(c.M*PQCentroids, c.Dims/c.M), c.Centroids)
+}
+
+// Centroid returns centroid k of subspace sub
+func (c *PQCodebook) Centroid(sub, k int) []float32 {
+	size := c.Dims / c.M
+	at := (sub*PQCentroids + k) * size
+	return c.Centroids[at : at+size]
+}
+
+// Nearest returns the index of the centroid of subspace sub nearest to the
+// subvector and its squared distance
+func (c *PQCodebook) Nearest(sub int, subvector []float32) (int, float32) {
+	best, bestDistance := 0, float32(0)
+	for k := 0; k < PQCentroids; k++ {
+		distance := vecmath.SquaredDistance(c.Centroid(sub, k), subvector)
+		if k == 0 || distance < bestDistance {
+			best, bestDistance = k, distance
+		}
+	}
+	return best, bestDistance
+}
+
+// Encode returns the M codes of vector, which must have Dims values
+func (c *PQCodebook) Encode(vector []float32) ([]byte, error) {
+	if len(vector) != c.Dims {
+		return nil, fmt.Errorf("the codebook quantizes vectors of %d dimensions, not %d", c.Dims, len(vector))
+	}
+	size := c.Dims / c.M
+	codes := make([]byte, c.M)
+	for sub := range codes {
+		k, _ := c.Nearest(sub, vector[sub*size:(sub+1)*size])
+		codes[sub] = byte(k)
+	}
+	return codes, nil
+}
+
+// Decode returns the vector approximated by codes, the concatenation of
+// their centroids
+func (c *PQCodebook) Decode(codes []byte) ([]float32, error) {
+	if len(codes) != c.M {
+		return nil, fmt.Errorf("the codebook decodes %d codes, not %d", c.M, len(codes))
+	}
+	vector := make([]float32, 0, c.Dims)
+	for sub, k := range codes {
+		vector = append(vector, c.Centroid(sub, int(k))...)
+	}
+	return vector, nil
+}
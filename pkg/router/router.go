@@ -0,0 +1,208 @@
+// Package router spreads requests over several vectorizer instances. Keys,
+// like a tenant or a model, are consistently hashed to an instance, so
+// every instance keeps its caches warm for the same keys, and requests fail
+// over to the next instance on the ring while an instance is unhealthy
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReplicas is the number of points of every instance on the ring
+const DefaultReplicas = 160
+
+// ErrNoInstances is returned if no instance is healthy
+var ErrNoInstances = errors.New("no healthy vectorizer instance")
+
+// point is a position of an instance on the ring
+type point struct {
+	hash     uint64
+	instance string
+}
+
+// Router maps keys to instances by consistent hashing. Adding or removing
+// an instance only moves the keys of its neighbours on the ring
+type Router struct {
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+
+	mu        sync.RWMutex
+	instances []string
+	ring      []point
+	down      map[string]bool
+}
+
+// New returns a router for the base URLs of the instances, like
+// http://10.0.0.1:9876, with replicas points per instance
+func New(instances []string, replicas int) (*Router, error) {
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no vectorizer instances")
+	}
+	if replicas < 1 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Router{down: map[string]bool{}}
+	for _, instance := range instances {
+		instance = strings.TrimSuffix(instance, "/")
+		for _, known := range r.instances {
+			if known == instance {
+				return nil, fmt.Errorf("duplicate instance %s", instance)
+			}
+		}
+		r.instances = append(r.instances, instance)
+		for i := 0; i < replicas; i++ {
+			r.ring = append(r.ring, point{hash: hash(instance + "#" + strconv.Itoa(i)), instance: instance})
+		}
+	}
+	sort.Slice(r.ring, func(i, j int) bool {
+		return r.ring[i].hash < r.ring[j].hash
+	})
+	return r, nil
+}
+
+// hash returns the position of s on the ring. FNV of similar strings like
+// the points of an instance are close, the finalizer of MurmurHash3 spreads them
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Candidates returns all instances in the order they are tried for key: the
+// owner of the key first, followed by the next instances on the ring.
+// Unhealthy instances are moved to the end
+func (r *Router) Candidates(key string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	start := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= hash(key)
+	})
+	seen := map[string]bool{}
+	var healthy, unhealthy []string
+	for i := 0; i < len(r.ring) && len(seen) < len(r.instances); i++ {
+		instance := r.ring[(start+i)%len(r.ring)].instance
+		if seen[instance] {
+			continue
+		}
+		seen[instance] = true
+		if r.down[instance] {
+			unhealthy = append(unhealthy, instance)
+		} else {
+			healthy = append(healthy, instance)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Pick returns the healthy instance key is routed to
+func (r *Router) Pick(key string) (string, error) {
+	candidates := r.Candidates(key)
+	if r.Healthy(candidates[0]) {
+		return candidates[0], nil
+	}
+	return "", ErrNoInstances
+}
+
+// Healthy reports whether instance is considered healthy
+func (r *Router) Healthy(instance string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.down[instance]
+}
+
+// SetHealthy marks instance as healthy or not. Keys of unhealthy instances
+// go to the next instance on the ring until it is healthy again
+func (r *Router) SetHealthy(instance string, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down[instance] = !healthy
+}
+
+func (r *Router) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return http.DefaultClient
+}
+
+// CheckHealth polls the /health endpoint of every instance each interval
+// until ctx is done
+func (r *Router) CheckHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, instance := range r.instances {
+			r.SetHealthy(instance, r.check(ctx, instance, interval))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Router) check(ctx context.Context, instance string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, instance+"/health", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// Post sends body to path, like /vectorize, of the instance key is routed
+// to. Instances that can't be reached are marked unhealthy, they and
+// overloaded instances answering 503 are failed over to the next instance
+func (r *Router) Post(ctx context.Context, key, path, contentType string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for _, instance := range r.Candidates(key) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, instance+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+
+		resp, err := r.client().Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			r.SetHealthy(instance, false)
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s: %s", instance, resp.Status)
+			continue
+		}
+		r.SetHealthy(instance, true)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoInstances, lastErr)
+}
@@ -0,0 +1,254 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// instances returns the base URLs of n instances
+func instances(n int) []string {
+	var urls []string
+	for i := 0; i < n; i++ {
+		urls = append(urls, fmt.Sprintf("http://10.0.0.%d:9876", i+1))
+	}
+	return urls
+}
+
+// owners returns the instance each of n keys is routed to
+func owners(t *testing.T, r *Router, n int) []string {
+	t.Helper()
+	var owners []string
+	for i := 0; i < n; i++ {
+		owner, err := r.Pick(fmt.Sprintf("tenant-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		owners = append(owners, owner)
+	}
+	return owners
+}
+
+func TestStable(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		a, b     []string
+		replicas int
+	}{
+		{"single instance", instances(1), instances(1), 0},
+		{"same order", instances(5), instances(5), 0},
+		{"other order", instances(5), []string{
+			"http://10.0.0.4:9876", "http://10.0.0.2:9876", "http://10.0.0.5:9876", "http://10.0.0.1:9876", "http://10.0.0.3:9876",
+		}, 0},
+		{"trailing slash", instances(3), []string{"http://10.0.0.1:9876/", "http://10.0.0.2:9876/", "http://10.0.0.3:9876"}, 0},
+		{"few replicas", instances(4), instances(4), 3},
+	} {
+		a, err := New(test.a, test.replicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(test.b, test.replicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := owners(t, a, 1000)
+		for i, owner := range owners(t, a, 1000) {
+			if owner != first[i] {
+				t.Errorf("%s: key %d routed to %s, then to %s", test.name, i, first[i], owner)
+				break
+			}
+		}
+		for i, owner := range owners(t, b, 1000) {
+			if owner != first[i] {
+				t.Errorf("%s: key %d routed to %s by one router and to %s by the other", test.name, i, first[i], owner)
+				break
+			}
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	const keys = 20000
+	for _, test := range []struct {
+		name          string
+		before, after []string
+		// moved is the instance added or removed, the only one keys may
+		// move to or from
+		moved string
+	}{
+		{"add to 2", instances(2), instances(3), instances(3)[2]},
+		{"add to 4", instances(4), instances(5), instances(5)[4]},
+		{"add to 9", instances(9), instances(10), instances(10)[9]},
+		{"remove from 3", instances(3), instances(2), instances(3)[2]},
+		{"remove from 5", instances(5), instances(4), instances(5)[4]},
+		{"remove the first of 5", instances(5), instances(5)[1:], instances(5)[0]},
+		{"remove from 10", instances(10), instances(9), instances(10)[9]},
+	} {
+		before, err := New(test.before, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := New(test.after, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		moved := 0
+		a := owners(t, after, keys)
+		for i, b := range owners(t, before, keys) {
+			if a[i] == b {
+				continue
+			}
+			moved++
+			if a[i] != test.moved && b != test.moved {
+				t.Errorf("%s: key %d moved from %s to %s", test.name, i, b, a[i])
+				break
+			}
+		}
+
+		// about the share of one instance of the larger ring moves
+		n := len(test.before)
+		if len(test.after) > n {
+			n = len(test.after)
+		}
+		share := float64(moved) / keys
+		if expected := 1 / float64(n); share < expected*0.7 || share > expected*1.3 {
+			t.Errorf("%s: %.3f of the keys moved, expected about %.3f", test.name, share, expected)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	urls := instances(4)
+	for _, test := range []struct {
+		name string
+		down []int
+	}{
+		{"all healthy", nil},
+		{"owner down", []int{0}},
+		{"owner and next down", []int{0, 1}},
+		{"other instance down", []int{2}},
+		{"one left", []int{0, 1, 2}},
+		{"all down", []int{0, 1, 2, 3}},
+	} {
+		r, err := New(urls, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("tenant-%d", i)
+			// the order of the instances on the ring after the owner
+			ring := r.Candidates(key)
+			down := map[string]bool{}
+			for _, j := range test.down {
+				down[ring[j]] = true
+				r.SetHealthy(ring[j], false)
+			}
+
+			var expected string
+			for _, instance := range ring {
+				if !down[instance] {
+					expected = instance
+					break
+				}
+			}
+			owner, err := r.Pick(key)
+			if expected == "" {
+				if !errors.Is(err, ErrNoInstances) {
+					t.Errorf("%s: key %d routed to %s, %v", test.name, i, owner, err)
+				}
+			} else if owner != expected {
+				t.Errorf("%s: key %d routed to %s, expected %s", test.name, i, owner, expected)
+			}
+
+			candidates := r.Candidates(key)
+			for j, instance := range candidates {
+				if healthy := j < len(ring)-len(down); healthy == down[instance] {
+					t.Errorf("%s: key %d has candidates %v with %v down", test.name, i, candidates, test.down)
+					break
+				}
+			}
+
+			for _, instance := range ring {
+				r.SetHealthy(instance, true)
+			}
+			if owner, _ := r.Pick(key); owner != ring[0] {
+				t.Errorf("%s: key %d routed to %s once healthy, expected %s", test.name, i, owner, ring[0])
+			}
+		}
+	}
+}
+
+func TestPostFailover(t *testing.T) {
+	answer := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			io.WriteString(w, name)
+		}))
+	}
+	unreachable := answer("unreachable", http.StatusOK)
+	unreachable.Close()
+	overloaded := answer("overloaded", http.StatusServiceUnavailable)
+	defer overloaded.Close()
+	first := answer("first", http.StatusOK)
+	defer first.Close()
+	second := answer("second", http.StatusOK)
+	defer second.Close()
+
+	for _, test := range []struct {
+		name string
+		// servers are the instances in the order of the candidates of the
+		// key
+		servers []*httptest.Server
+		answer  string
+		// down is the instance marked unhealthy
+		down string
+	}{
+		{"healthy owner", []*httptest.Server{first, second}, "first", ""},
+		{"unreachable owner", []*httptest.Server{unreachable, first, second}, "first", unreachable.URL},
+		{"overloaded owner", []*httptest.Server{overloaded, first}, "first", ""},
+		{"unreachable and overloaded", []*httptest.Server{unreachable, overloaded, second}, "second", unreachable.URL},
+		{"none answers", []*httptest.Server{unreachable, overloaded}, "", unreachable.URL},
+	} {
+		var urls []string
+		for _, server := range test.servers {
+			urls = append(urls, server.URL)
+		}
+		r, err := New(urls, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a key whose candidates are in the order of the servers
+		var key string
+		for i := 0; key == ""; i++ {
+			candidates := r.Candidates(fmt.Sprintf("tenant-%d", i))
+			if fmt.Sprint(candidates) == fmt.Sprint(urls) {
+				key = fmt.Sprintf("tenant-%d", i)
+			}
+		}
+
+		resp, err := r.Post(context.Background(), key, "/vectorize", "application/json", []byte(`{"text": "hello"}`))
+		if test.answer == "" {
+			if !errors.Is(err, ErrNoInstances) {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else {
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(b) != test.answer {
+				t.Errorf("%s: answered by %s, expected %s", test.name, b, test.answer)
+			}
+		}
+		for _, url := range urls {
+			if healthy := url != test.down; r.Healthy(url) != healthy {
+				t.Errorf("%s: %s healthy is %v", test.name, url, r.Healthy(url))
+			}
+		}
+	}
+}
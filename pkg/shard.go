@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ShardsFile is written to the root of a sharded database and holds the
+// number of shards
+const ShardsFile = "SHARDS"
+
+// Shard returns the shard in [0, n) holding key
+func Shard(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// ShardPath returns the directory of shard i below root
+func ShardPath(root string, i int) string {
+	return filepath.Join(root, fmt.Sprintf("shard-%03d", i))
+}
+
+// ReadShards returns the number of shards of the database at root, or 0 if
+// it is a single unsharded database
+func ReadShards(root string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(root, ShardsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s file %q", ShardsFile, b)
+	}
+	return n, nil
+}
+
+// WriteShards marks root as a database with n shards
+func WriteShards(root string, n int) error {
+	return os.WriteFile(filepath.Join(root, ShardsFile), []byte(strconv.Itoa(n)+"\n"), 0o644)
+}
@@ -0,0 +1,70 @@
+//go:build windows
+
+package shm
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// mapFile maps size bytes of f read-only with a file mapping object, views
+// of the same file share their pages across processes like on unix
+func mapFile(f *os.File, size int) ([]byte, func() error, error) {
+	if size == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	mapping, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, uint32(uint64(size)>>32), uint32(size), nil)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	// the view keeps the mapping alive
+	defer syscall.CloseHandle(mapping)
+	addr, err := syscall.MapViewOfFile(mapping, syscall.FILE_MAP_READ, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	data := unsafe.Slice(*(**byte)(unsafe.Pointer(&addr)), size)
+	return data, func() error { return syscall.UnmapViewOfFile(addr) }, nil
+}
+
+// replaceTimeout bounds how long replaceFile waits for readers
+const replaceTimeout = 10 * time.Second
+
+// replacingSuffix names the file that marks a pending replacement
+const replacingSuffix = ".replacing"
+
+// replaceFile renames tmp to path. Windows refuses to replace a file that
+// is mapped, then the replacement is marked pending, so readers close the
+// old segment, and retried until they did
+func replaceFile(tmp, path string) error {
+	err := os.Rename(tmp, path)
+	if err == nil {
+		return nil
+	}
+	marker, merr := os.Create(path + replacingSuffix)
+	if merr != nil {
+		return err
+	}
+	marker.Close()
+	defer os.Remove(marker.Name())
+
+	deadline := time.Now().Add(replaceTimeout)
+	for wait := 10 * time.Millisecond; time.Now().Before(deadline); {
+		time.Sleep(wait)
+		if err = os.Rename(tmp, path); err == nil {
+			return nil
+		}
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+	return err
+}
+
+// pending reports whether a writer waits to replace the file at path
+func pending(path string) bool {
+	_, err := os.Stat(path + replacingSuffix)
+	return err == nil
+}
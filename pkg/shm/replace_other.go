@@ -0,0 +1,17 @@
+//go:build !windows
+
+package shm
+
+import "os"
+
+// replaceFile renames tmp to path, readers still mapping the old file keep
+// it until they close it
+func replaceFile(tmp, path string) error {
+	return os.Rename(tmp, path)
+}
+
+// pending reports whether a writer waits to replace the file at path, it
+// never does where files can be replaced while mapped
+func pending(path string) bool {
+	return false
+}
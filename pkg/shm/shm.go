@@ -0,0 +1,365 @@
+// Package shm lays the vectors of a database out in a single file, usually
+// below /dev/shm, that co-located processes map into memory and read
+// without a request to the server.
+//
+// The file starts with a header of HeaderSize bytes, all numbers little
+// endian:
+//
+//	magic        [8]byte  "GLOVESHM"
+//	version      uint32   FormatVersion
+//	dims         uint32   dimensions of every vector
+//	rows         uint64   number of words
+//	slots        uint64   number of slots of the hash table, a power of 2
+//	offsetsStart uint64   rows+1 uint64 offsets of the words in words
+//	wordsStart   uint64   the words, concatenated
+//	tableStart   uint64   slots uint32, 0 for an empty slot or row+1
+//	matrixStart  uint64   rows x dims float32, row i is the vector of word i
+//	modelHash    [64]byte the model hash of the database, hex
+//
+// A word is found by hashing it with 64 bit FNV-1a and probing the table
+// linearly from the slot hash % slots until an empty slot. Sections start
+// at multiples of 64 bytes. The file is written to a temporary name and
+// renamed, so readers never see a partial one; they reopen the file once
+// Stale reports that it was replaced.
+//
+// Segments are mapped with mmap on unix and with file mapping objects on
+// Windows, elsewhere they are read into memory. Windows doesn't replace a
+// file that is mapped, so there Stale already reports a replacement that
+// is pending, Open fails with ErrReplacing until it is done and Commit
+// waits up to 10 seconds for the readers to close the old segment.
+package shm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// Magic starts every segment
+	Magic = "GLOVESHM"
+	// FormatVersion is the version of the layout
+	FormatVersion = 1
+	// HeaderSize is the size of the header, the matrix follows it
+	HeaderSize = 128
+)
+
+// ErrReplacing is returned by Open while a new segment waits for the old
+// one to be closed, only on Windows
+var ErrReplacing = errors.New("segment is being replaced")
+
+// align is the alignment of the sections
+const align = 64
+
+type header struct {
+	dims         uint32
+	rows         uint64
+	slots        uint64
+	offsetsStart uint64
+	wordsStart   uint64
+	tableStart   uint64
+	matrixStart  uint64
+	modelHash    string
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, HeaderSize)
+	copy(b, Magic)
+	binary.LittleEndian.PutUint32(b[8:], FormatVersion)
+	binary.LittleEndian.PutUint32(b[12:], h.dims)
+	for i, v := range []uint64{h.rows, h.slots, h.offsetsStart, h.wordsStart, h.tableStart, h.matrixStart} {
+		binary.LittleEndian.PutUint64(b[16+8*i:], v)
+	}
+	copy(b[64:], h.modelHash)
+	return b
+}
+
+func (h *header) unmarshal(b []byte) error {
+	if len(b) < HeaderSize || string(b[:8]) != Magic {
+		return errors.New("not a vector segment")
+	}
+	if version := binary.LittleEndian.Uint32(b[8:]); version != FormatVersion {
+		return fmt.Errorf("unsupported segment version %d", version)
+	}
+	h.dims = binary.LittleEndian.Uint32(b[12:])
+	for i, v := range []*uint64{&h.rows, &h.slots, &h.offsetsStart, &h.wordsStart, &h.tableStart, &h.matrixStart} {
+		*v = binary.LittleEndian.Uint64(b[16+8*i:])
+	}
+	h.modelHash = strings.TrimRight(string(b[64:HeaderSize]), "\x00")
+	return nil
+}
+
+func hash(word []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(word)
+	return h.Sum64()
+}
+
+func alignUp(n uint64) uint64 {
+	return (n + align - 1) / align * align
+}
+
+// Writer writes a segment. Vectors are added one by one, the index is
+// written by Commit
+type Writer struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	h    header
+	// offsets are those of the words added so far, starting with 0
+	offsets []uint64
+	words   []byte
+}
+
+// Create starts a segment at path for vectors of dims dimensions of the
+// model with modelHash
+func Create(path, modelHash string, dims int) (*Writer, error) {
+	if dims <= 0 {
+		return nil, fmt.Errorf("invalid dimensions %d", dims)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		path:    path,
+		f:       f,
+		w:       bufio.NewWriterSize(f, 1<<20),
+		h:       header{dims: uint32(dims), matrixStart: HeaderSize, modelHash: modelHash},
+		offsets: []uint64{0},
+	}
+	// the header is written once the layout is known
+	if _, err := w.w.Write(make([]byte, HeaderSize)); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Add appends the vector of word, words must be distinct
+func (w *Writer) Add(word string, vector []float32) error {
+	if len(vector) != int(w.h.dims) {
+		return fmt.Errorf("vector of %q has %d dimensions, expected %d", word, len(vector), w.h.dims)
+	}
+	var b [4]byte
+	for _, value := range vector {
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(value))
+		if _, err := w.w.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	w.words = append(w.words, word...)
+	w.offsets = append(w.offsets, uint64(len(w.words)))
+	w.h.rows++
+	return nil
+}
+
+// Rows returns the number of vectors added
+func (w *Writer) Rows() int {
+	return int(w.h.rows)
+}
+
+// Commit writes the index and the header and replaces the file at path
+func (w *Writer) Commit() error {
+	h := &w.h
+	h.slots = 1
+	for h.slots < 2*h.rows {
+		h.slots <<= 1
+	}
+	h.offsetsStart = alignUp(h.matrixStart + h.rows*uint64(h.dims)*4)
+	h.wordsStart = alignUp(h.offsetsStart + 8*uint64(len(w.offsets)))
+	h.tableStart = alignUp(h.wordsStart + uint64(len(w.words)))
+
+	table := make([]uint32, h.slots)
+	for row := uint64(0); row < h.rows; row++ {
+		slot := hash(w.words[w.offsets[row]:w.offsets[row+1]]) & (h.slots - 1)
+		for table[slot] != 0 {
+			slot = (slot + 1) & (h.slots - 1)
+		}
+		table[slot] = uint32(row + 1)
+	}
+
+	position := h.matrixStart + h.rows*uint64(h.dims)*4
+	pad := func(to uint64) error {
+		_, err := w.w.Write(make([]byte, to-position))
+		position = to
+		return err
+	}
+	var b [8]byte
+	err := pad(h.offsetsStart)
+	for _, offset := range w.offsets {
+		binary.LittleEndian.PutUint64(b[:], offset)
+		w.w.Write(b[:])
+	}
+	position += 8 * uint64(len(w.offsets))
+	if err == nil {
+		err = pad(h.wordsStart)
+	}
+	w.w.Write(w.words)
+	position += uint64(len(w.words))
+	if err == nil {
+		err = pad(h.tableStart)
+	}
+	for _, slot := range table {
+		binary.LittleEndian.PutUint32(b[:4], slot)
+		w.w.Write(b[:4])
+	}
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err == nil {
+		_, err = w.f.WriteAt(h.marshal(), 0)
+	}
+	if err == nil {
+		err = w.f.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if err := os.Chmod(w.f.Name(), 0o644); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := replaceFile(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort removes the unfinished segment
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Segment is a segment mapped into memory. Vectors returned by it point into
+// the mapping and are only valid until Close
+type Segment struct {
+	path string
+	info os.FileInfo
+	data []byte
+	h    header
+	// unmap releases data
+	unmap func() error
+}
+
+// Open maps the segment at path
+func Open(path string) (*Segment, error) {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) != 1 {
+		return nil, errors.New("segments can only be read on little endian machines")
+	}
+
+	if pending(path) {
+		return nil, ErrReplacing
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, unmap, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Segment{path: path, info: info, data: data, unmap: unmap}
+	if err := s.h.unmarshal(data); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	h := &s.h
+	if h.slots == 0 || h.slots&(h.slots-1) != 0 || h.tableStart+4*h.slots > uint64(len(data)) ||
+		h.offsetsStart < h.matrixStart+h.rows*uint64(h.dims)*4 || h.wordsStart < h.offsetsStart+8*(h.rows+1) {
+		s.Close()
+		return nil, fmt.Errorf("%s: corrupt vector segment", path)
+	}
+	return s, nil
+}
+
+// Close unmaps the segment
+func (s *Segment) Close() error {
+	return s.unmap()
+}
+
+// Rows returns the number of words
+func (s *Segment) Rows() int {
+	return int(s.h.rows)
+}
+
+// Dims returns the dimensions of the vectors
+func (s *Segment) Dims() int {
+	return int(s.h.dims)
+}
+
+// ModelHash returns the model hash of the database the segment was
+// written from, the one the server reports
+func (s *Segment) ModelHash() string {
+	return s.h.modelHash
+}
+
+// Stale reports whether the file at the path of the segment was replaced,
+// e.g. because the server activated another version. On Windows it also
+// reports a replacement waiting for the segment to be closed
+func (s *Segment) Stale() bool {
+	info, err := os.Stat(s.path)
+	return err != nil || !os.SameFile(info, s.info) || pending(s.path)
+}
+
+func (s *Segment) word(row uint64) []byte {
+	offsets := s.data[s.h.offsetsStart:]
+	start := binary.LittleEndian.Uint64(offsets[8*row:])
+	end := binary.LittleEndian.Uint64(offsets[8*row+8:])
+	return s.data[s.h.wordsStart+start : s.h.wordsStart+end]
+}
+
+// Word returns the word of row
+func (s *Segment) Word(row int) string {
+	return string(s.word(uint64(row)))
+}
+
+// Row returns the vector of row
+func (s *Segment) Row(row int) []float32 {
+	start := s.h.matrixStart + uint64(row)*uint64(s.h.dims)*4
+	return unsafe.Slice((*float32)(unsafe.Pointer(&s.data[start])), s.h.dims)
+}
+
+// Vector returns the vector of word, nil if the word is not in the segment
+func (s *Segment) Vector(word string) []float32 {
+	key := []byte(word)
+	table := s.data[s.h.tableStart:]
+	for slot := hash(key) & (s.h.slots - 1); ; slot = (slot + 1) & (s.h.slots - 1) {
+		row := binary.LittleEndian.Uint32(table[4*slot:])
+		if row == 0 {
+			return nil
+		}
+		if string(s.word(uint64(row-1))) == word {
+			return s.Row(int(row - 1))
+		}
+	}
+}
+
+// Lookup returns the vector of word falling back to its lowercase form, the
+// way the server looks words up
+func (s *Segment) Lookup(word string) []float32 {
+	if vector := s.Vector(word); vector != nil {
+		return vector
+	}
+	if lower := strings.ToLower(word); lower != word {
+		return s.Vector(lower)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package shm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// writeSegment writes rows words of dims dimensions, word i is "w<i>" with
+// every value i
+func writeSegment(path, modelHash string, rows, dims int) error {
+	w, err := Create(path, modelHash, dims)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < rows; i++ {
+		vector := make([]float32, dims)
+		for j := range vector {
+			vector[j] = float32(i)
+		}
+		if err := w.Add(fmt.Sprintf("w%d", i), vector); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.Commit()
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glove")
+	if err := writeSegment(path, "abc", 1000, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Rows() != 1000 || s.Dims() != 7 || s.ModelHash() != "abc" {
+		t.Fatalf("got %d rows of %d dimensions of model %q", s.Rows(), s.Dims(), s.ModelHash())
+	}
+	for i := 0; i < s.Rows(); i++ {
+		word := fmt.Sprintf("w%d", i)
+		if s.Word(i) != word {
+			t.Fatalf("word of row %d is %q, want %q", i, s.Word(i), word)
+		}
+		vector := s.Vector(word)
+		if len(vector) != 7 || vector[0] != float32(i) || vector[6] != float32(i) {
+			t.Fatalf("vector of %q is %v", word, vector)
+		}
+	}
+	if vector := s.Lookup("W42"); len(vector) != 7 || vector[0] != 42 {
+		t.Errorf("Lookup doesn't fall back to lowercase, got %v", vector)
+	}
+	if vector := s.Vector("missing"); vector != nil {
+		t.Errorf("vector of a missing word is %v", vector)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glove")
+	if err := writeSegment(path, "", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Rows() != 0 || s.Lookup("any") != nil {
+		t.Errorf("empty segment has %d rows", s.Rows())
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glove")
+	if _, err := Create(path, "", 0); err == nil {
+		t.Error("segment of 0 dimensions created")
+	}
+	w, err := Create(path, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("short", []float32{1}); err == nil {
+		t.Error("vector of the wrong dimensions added")
+	}
+	w.Abort()
+	if matches, _ := filepath.Glob(path + "*"); len(matches) != 0 {
+		t.Errorf("Abort left %v behind", matches)
+	}
+}
+
+// TestReplace replaces a segment that is open, on Windows the reader has
+// to close it before the replacement can land
+func TestReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glove")
+	if err := writeSegment(path, "v1", 10, 4); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Stale() {
+		t.Fatal("fresh segment is stale")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- writeSegment(path, "v2", 20, 4)
+	}()
+	if runtime.GOOS == "windows" {
+		for !s.Stale() {
+			select {
+			case err := <-done:
+				t.Fatalf("mapped segment was replaced right away: %v", err)
+			default:
+				runtime.Gosched()
+			}
+		}
+		s.Close()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if !s.Stale() {
+			t.Error("replaced segment isn't stale")
+		}
+		// the old mapping stays readable
+		if vector := s.Vector("w9"); len(vector) != 4 || vector[0] != 9 {
+			t.Errorf("vector of the replaced segment is %v", vector)
+		}
+		s.Close()
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.ModelHash() != "v2" || s.Rows() != 20 {
+		t.Errorf("reopened segment is %q with %d rows", s.ModelHash(), s.Rows())
+	}
+	if _, err := Open(path + ".missing"); err == nil || errors.Is(err, ErrReplacing) {
+		t.Errorf("opening a missing segment returned %v", err)
+	}
+}
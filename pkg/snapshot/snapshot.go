@@ -0,0 +1,158 @@
+// Package snapshot publishes databases to object storage and fetches them,
+// so a leader can import a database once and replicas pick it up
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// LatestFile is the object holding the manifest of the newest snapshot. It
+// is written last, so replicas never see a partially published snapshot
+const LatestFile = "latest.json"
+
+// ManifestFile is the object holding the manifest below every version
+const ManifestFile = "manifest.json"
+
+// Manifest describes a published snapshot
+type Manifest struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	Files   []File    `json:"files"`
+}
+
+// File is a file of the database, relative to its root
+type File = pkg.FileChecksum
+
+// skip reports whether a file of a database is left out of snapshots. The
+// lock and the info logs belong to the process that has it open
+func skip(name string) bool {
+	return name == "LOCK" || strings.HasPrefix(name, "LOG")
+}
+
+// Publish uploads the database in dir as version. Objects are named
+// <version>/<path>, the manifests are uploaded after all files
+func Publish(ctx context.Context, store Store, dir, version string) (*Manifest, error) {
+	if version == "" || strings.ContainsAny(version, `/\`) || version == "." || version == ".." {
+		return nil, fmt.Errorf("invalid snapshot version %q", version)
+	}
+
+	m := &Manifest{Version: version, Created: time.Now().UTC()}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || skip(info.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		file := File{Path: filepath.ToSlash(rel), Size: info.Size()}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if err := store.Put(ctx, version+"/"+file.Path, io.TeeReader(f, h), file.Size); err != nil {
+			return fmt.Errorf("upload %s: %v", file.Path, err)
+		}
+		file.SHA256 = hex.EncodeToString(h.Sum(nil))
+		m.Files = append(m.Files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Files) == 0 {
+		return nil, fmt.Errorf("%s has no files", dir)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{version + "/" + ManifestFile, LatestFile} {
+		if err := store.Put(ctx, name, strings.NewReader(string(b)), int64(len(b))); err != nil {
+			return nil, fmt.Errorf("upload %s: %v", name, err)
+		}
+	}
+	return m, nil
+}
+
+// Latest returns the manifest of the newest snapshot, ErrNotFound if none
+// was published
+func Latest(ctx context.Context, store Store) (*Manifest, error) {
+	r, err := store.Get(ctx, LatestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %v", LatestFile, err)
+	}
+	return &m, nil
+}
+
+// Fetch downloads the snapshot described by m to dir. The files are written
+// below dir.partial, which is renamed to dir once every file is verified
+func Fetch(ctx context.Context, store Store, m *Manifest, dir string) error {
+	partial := dir + ".partial"
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	for _, file := range m.Files {
+		// IsLocal also rejects volume names and reserved names like NUL
+		// on Windows
+		local := filepath.FromSlash(file.Path)
+		if !filepath.IsLocal(local) {
+			return fmt.Errorf("invalid path %q in manifest", file.Path)
+		}
+		path := filepath.Join(partial, local)
+		if err := fetchFile(ctx, store, m.Version+"/"+file.Path, path, file); err != nil {
+			os.RemoveAll(partial)
+			return fmt.Errorf("download %s: %v", file.Path, err)
+		}
+	}
+	return os.Rename(partial, dir)
+}
+
+func fetchFile(ctx context.Context, store Store, name, path string, file File) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	r, err := store.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if n != file.Size || hex.EncodeToString(h.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPublishFetch(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	for name, data := range map[string]string{"000001.ldb": "table", "LOCK": "", "sub/CURRENT": "MANIFEST-000002\n"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Publish(ctx, store, src, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 {
+		t.Fatalf("published %v, the lock should be left out", m.Files)
+	}
+	for _, file := range m.Files {
+		if file.Path != "000001.ldb" && file.Path != "sub/CURRENT" {
+			t.Errorf("published path %q isn't slash separated", file.Path)
+		}
+	}
+
+	latest, err := Latest(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "v1")
+	if err := Fetch(ctx, store, latest, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dst, "sub", "CURRENT")); err != nil || string(b) != "MANIFEST-000002\n" {
+		t.Errorf("fetched %q, %v", b, err)
+	}
+}
+
+func TestFetchRejectsPaths(t *testing.T) {
+	paths := []string{"../escape", "/abs", "sub/../../escape", ""}
+	if runtime.GOOS == "windows" {
+		paths = append(paths, `C:\abs`, "C:rel", "NUL", `..\escape`)
+	}
+	dir := filepath.Join(t.TempDir(), "v1")
+	for _, path := range paths {
+		m := &Manifest{Version: "v1", Files: []File{{Path: path}}}
+		if err := Fetch(context.Background(), dirStore(t.TempDir()), m, dir); err == nil {
+			t.Errorf("fetched a snapshot with the path %q", path)
+		}
+	}
+}
+
+func TestOpenDirectories(t *testing.T) {
+	locations := map[string]string{
+		"/shared/snapshots":        "/shared/snapshots",
+		"file:///shared/snapshots": "/shared/snapshots",
+	}
+	if runtime.GOOS == "windows" {
+		locations = map[string]string{
+			`C:\shared\snapshots`:         `C:\shared\snapshots`,
+			"C:/shared/snapshots":         "C:/shared/snapshots",
+			"file:///C:/shared/snapshots": `C:\shared\snapshots`,
+			`\\server\share\snapshots`:    `\\server\share\snapshots`,
+		}
+	}
+	for location, dir := range locations {
+		store, err := Open(location)
+		if err != nil {
+			t.Errorf("%s: %v", location, err)
+			continue
+		}
+		if got, ok := store.(dirStore); !ok || string(got) != dir {
+			t.Errorf("%s opened %#v, want the directory %s", location, store, dir)
+		}
+	}
+}
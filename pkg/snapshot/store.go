@@ -0,0 +1,142 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned for objects that don't exist
+var ErrNotFound = errors.New("object not found")
+
+// Store is the object storage snapshots are published to
+type Store interface {
+	// Put uploads size bytes of r as the object name
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get downloads the object name, ErrNotFound if it doesn't exist
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// Open returns the store at location, which is one of
+//
+//	s3://bucket/prefix    S3 or an S3 compatible storage, see NewS3Store
+//	https://host/prefix   a server accepting PUT and GET, like a bucket with write access
+//	/shared/snapshots     a directory, e.g. a network file system
+func Open(location string) (Store, error) {
+	// C:\snapshots would parse as a URL of scheme c
+	if filepath.VolumeName(location) != "" {
+		return dirStore(location), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		return NewS3Store(u.Host, strings.Trim(u.Path, "/"))
+	case "http", "https":
+		return &httpStore{base: strings.TrimSuffix(location, "/")}, nil
+	case "file":
+		// file:///C:/snapshots has the path /C:/snapshots
+		if path := strings.TrimPrefix(u.Path, "/"); filepath.VolumeName(path) != "" {
+			return dirStore(filepath.FromSlash(path)), nil
+		}
+		return dirStore(u.Path), nil
+	case "":
+		return dirStore(location), nil
+	}
+	return nil, fmt.Errorf("unsupported snapshot location %s", location)
+}
+
+// dirStore stores objects as files below a directory
+type dirStore string
+
+func (d dirStore) Put(_ context.Context, name string, r io.Reader, _ int64) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// objects appear atomically like they do in object storage
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d dirStore) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// httpStore stores objects with PUT and GET requests below a base URL
+type httpStore struct {
+	base string
+	// sign authenticates requests, nil if they are not
+	sign func(req *http.Request) error
+}
+
+func (s *httpStore) do(req *http.Request) (*http.Response, error) {
+	if s.sign != nil {
+		if err := s.sign(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+func (s *httpStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.base+"/"+name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *httpStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,39 @@
+//go:build avx2 && amd64
+
+package vecmath
+
+// Implementation names the implementation compiled in
+const Implementation = "avx2"
+
+// dotAVX2 and squaredDistanceAVX2 handle 8 floats at a time, n is a
+// multiple of 8. They are implemented in avx2_amd64.s
+//
+//go:noescape
+func dotAVX2(a, b *float32, n int) float32
+
+//go:noescape
+func squaredDistanceAVX2(a, b *float32, n int) float32
+
+func dot(a, b []float32) float32 {
+	n := len(a) &^ 7
+	var sum float32
+	if n > 0 {
+		sum = dotAVX2(&a[0], &b[0], n)
+	}
+	if n < len(a) {
+		sum += dotGeneric(a[n:], b[n:])
+	}
+	return sum
+}
+
+func squaredDistance(a, b []float32) float32 {
+	n := len(a) &^ 7
+	var sum float32
+	if n > 0 {
+		sum = squaredDistanceAVX2(&a[0], &b[0], n)
+	}
+	if n < len(a) {
+		sum += squaredDistanceGeneric(a[n:], b[n:])
+	}
+	return sum
+}
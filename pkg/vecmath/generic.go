@@ -0,0 +1,14 @@
+//go:build !(avx2 && amd64)
+
+package vecmath
+
+// Implementation names the implementation compiled in
+const Implementation = "generic"
+
+func dot(a, b []float32) float32 {
+	return dotGeneric(a, b)
+}
+
+func squaredDistance(a, b []float32) float32 {
+	return squaredDistanceGeneric(a, b)
+}
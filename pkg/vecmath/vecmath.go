@@ -0,0 +1,67 @@
+// Package vecmath holds the vector arithmetic of the hot paths.
+//
+// The default build is pure Go, needs no cgo and cross-compiles to every
+// platform Go supports. Faster implementations are opt-in with build tags:
+//
+//	avx2  AVX2 assembly on amd64, the binary then needs a CPU with AVX2
+//
+// Components needing cgo, like bindings to native ANN libraries, must be
+// behind a tag of their own as well, TestPureGoBuild enforces it.
+package vecmath
+
+// Dot returns the dot product of a and b, which must have the same length
+func Dot(a, b []float32) float32 {
+	if len(a) != len(b) {
+		panic("vecmath: vectors have different lengths")
+	}
+	if len(a) == 0 {
+		return 0
+	}
+	return dot(a, b)
+}
+
+// SquaredDistance returns the squared Euclidean distance of a and b, which
+// must have the same length
+func SquaredDistance(a, b []float32) float32 {
+	if len(a) != len(b) {
+		panic("vecmath: vectors have different lengths")
+	}
+	if len(a) == 0 {
+		return 0
+	}
+	return squaredDistance(a, b)
+}
+
+// dotGeneric is the pure Go dot product. Four accumulators break the
+// dependency between additions, so the loop runs about twice as fast
+func dotGeneric(a, b []float32) float32 {
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+func squaredDistanceGeneric(a, b []float32) float32 {
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		d0, d1, d2, d3 := a[i]-b[i], a[i+1]-b[i+1], a[i+2]-b[i+2], a[i+3]-b[i+3]
+		s0 += d0 * d0
+		s1 += d1 * d1
+		s2 += d2 * d2
+		s3 += d3 * d3
+	}
+	for ; i < len(a); i++ {
+		d := a[i] - b[i]
+		s0 += d * d
+	}
+	return s0 + s1 + s2 + s3
+}
@@ -0,0 +1,79 @@
+package vecmath
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDot(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n <= 40; n++ {
+		a, b := make([]float32, n), make([]float32, n)
+		var dot, distance float64
+		for i := range a {
+			a[i], b[i] = r.Float32()*2-1, r.Float32()*2-1
+			dot += float64(a[i]) * float64(b[i])
+			d := float64(a[i]) - float64(b[i])
+			distance += d * d
+		}
+		if got := Dot(a, b); math.Abs(float64(got)-dot) > 1e-5 {
+			t.Errorf("%s Dot of %d values = %v, want %v", Implementation, n, got, dot)
+		}
+		if got := SquaredDistance(a, b); math.Abs(float64(got)-distance) > 1e-5 {
+			t.Errorf("%s SquaredDistance of %d values = %v, want %v", Implementation, n, got, distance)
+		}
+	}
+}
+
+// moduleRoot returns the directory of go.mod
+func moduleRoot(t *testing.T) string {
+	out, err := exec.Command("go", "env", "GOMOD").Output()
+	if err != nil {
+		t.Skipf("go command not available: %v", err)
+	}
+	return filepath.Dir(strings.TrimSpace(string(out)))
+}
+
+// TestPureGoBuild guarantees that no package of the default build outside
+// the standard library needs cgo and that every tag combination
+// cross-compiles. The matrix takes a while the first time, -short skips it
+func TestPureGoBuild(t *testing.T) {
+	root := moduleRoot(t)
+
+	list := exec.Command("go", "list", "-deps", "-f", "{{if and .CgoFiles (not .Standard)}}{{.ImportPath}}{{end}}", "./...")
+	list.Dir = root
+	list.Env = append(os.Environ(), "CGO_ENABLED=1")
+	out, err := list.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go list: %v\n%s", err, out)
+	}
+	if cgo := strings.TrimSpace(string(out)); cgo != "" {
+		t.Errorf("packages of the default build use cgo, put them behind a build tag:\n%s", cgo)
+	}
+
+	if testing.Short() {
+		t.Skip("skipping the build matrix in short mode")
+	}
+	for _, target := range []struct{ goos, goarch, tags string }{
+		{"linux", "amd64", ""},
+		{"linux", "amd64", "avx2"},
+		{"linux", "arm64", ""},
+		{"linux", "arm64", "avx2"},
+		{"darwin", "arm64", ""},
+		{"windows", "amd64", ""},
+		{"windows", "amd64", "avx2"},
+		{"windows", "arm64", ""},
+	} {
+		build := exec.Command("go", "build", "-tags", target.tags, "./...")
+		build.Dir = root
+		build.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+target.goos, "GOARCH="+target.goarch)
+		if out, err := build.CombinedOutput(); err != nil {
+			t.Errorf("%s/%s with tags %q: %v\n%s", target.goos, target.goarch, target.tags, err, out)
+		}
+	}
+}
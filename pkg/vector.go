@@ -69,3 +69,44 @@ func (v *Vector) Distance(other *Vector) (float32, error) {
 
 	return float32(math.Sqrt(float64(sum))), nil
 }
+
+func (v *Vector) CosineSimilarity(other *Vector) (float32, error) {
+	if len(v.vector) != len(other.vector) {
+		return 0.0, fmt.Errorf("vectors have different dimensions")
+	}
+
+	var dot, normV, normOther float64
+	for i := 0; i < len(v.vector); i++ {
+		dot += float64(v.vector[i]) * float64(other.vector[i])
+		normV += float64(v.vector[i]) * float64(v.vector[i])
+		normOther += float64(other.vector[i]) * float64(other.vector[i])
+	}
+	if normV == 0 || normOther == 0 {
+		return 0.0, nil
+	}
+
+	return float32(dot / (math.Sqrt(normV) * math.Sqrt(normOther))), nil
+}
+
+// NonFinite returns the number of NaN or infinite values
+func NonFinite(values []float32) int {
+	n := 0
+	for _, value := range values {
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			n++
+		}
+	}
+	return n
+}
+
+// Sanitize replaces NaN and infinite values by 0 and returns their number
+func Sanitize(values []float32) int {
+	n := 0
+	for i, value := range values {
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			values[i] = 0
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,160 @@
+package vectorizer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// Fake is an in-memory Vectorizer for tests. The vector of a word is
+// derived from the word alone, so it is the same in every run and process,
+// unless it was set explicitly
+type Fake struct {
+	dims int
+
+	mu      sync.RWMutex
+	vectors map[string][]float32
+	// words holds the vocabulary in the order it was added, so neighbors
+	// at the same distance are returned in a stable order
+	words []string
+}
+
+var _ Vectorizer = (*Fake)(nil)
+
+// NewFake returns a Fake of vectors with dims dimensions knowing words
+func NewFake(dims int, words ...string) *Fake {
+	if dims <= 0 {
+		panic(fmt.Sprintf("vectorizer: invalid dimensions %d", dims))
+	}
+	f := &Fake{dims: dims, vectors: make(map[string][]float32)}
+	f.Add(words...)
+	return f
+}
+
+// FakeVector returns the vector Fake assigns to word, values are uniform in
+// [-1, 1) and seeded by the FNV-1a hash of word
+func FakeVector(word string, dims int) []float32 {
+	h := fnv.New64a()
+	h.Write([]byte(word))
+	r := rand.New(rand.NewSource(int64(h.Sum64())))
+	vector := make([]float32, dims)
+	for i := range vector {
+		vector[i] = r.Float32()*2 - 1
+	}
+	return vector
+}
+
+// Add adds words with their derived vectors
+func (f *Fake) Add(words ...string) {
+	for _, word := range words {
+		f.Set(word, FakeVector(word, f.dims))
+	}
+}
+
+// Set sets the vector of word, e.g. to place words close to each other
+func (f *Fake) Set(word string, vector []float32) {
+	if len(vector) != f.dims {
+		panic(fmt.Sprintf("vectorizer: vector of %q has %d dimensions, expected %d", word, len(vector), f.dims))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.vectors[word]; !ok {
+		f.words = append(f.words, word)
+	}
+	f.vectors[word] = append([]float32(nil), vector...)
+}
+
+// lookup returns the vector of word falling back to its lowercase form,
+// along with the form found
+func (f *Fake) lookup(word string) (string, []float32, bool) {
+	if vector, ok := f.vectors[word]; ok {
+		return word, vector, true
+	}
+	word = strings.ToLower(word)
+	vector, ok := f.vectors[word]
+	return word, vector, ok
+}
+
+// VectorForWord returns the vector of word
+func (f *Fake) VectorForWord(word string) (*pkg.Vector, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, vector, ok := f.lookup(word)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownWord, word)
+	}
+	v := pkg.NewVector(append([]float32(nil), vector...))
+	return &v, nil
+}
+
+// Corpi returns the mean of the vectors of the words of corpi, split at
+// every character that is neither a letter nor a number like the server
+// does. Unknown words are skipped
+func (f *Fake) Corpi(corpi []string) (*pkg.Vector, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	sum := make([]float32, f.dims)
+	n := 0
+	for _, corpus := range corpi {
+		words := strings.FieldsFunc(corpus, func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+		})
+		for _, word := range words {
+			_, vector, ok := f.lookup(word)
+			if !ok {
+				continue
+			}
+			for i, value := range vector {
+				sum[i] += value
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, ErrNoVectors
+	}
+	for i := range sum {
+		sum[i] /= float32(n)
+	}
+	v := pkg.NewVector(sum)
+	return &v, nil
+}
+
+// Neighbors returns the k words closest to word by a scan of the vocabulary
+func (f *Fake) Neighbors(word string, k int) ([]Neighbor, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("invalid number of neighbors %d", k)
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	found, vector, ok := f.lookup(word)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownWord, word)
+	}
+	neighbors := make([]Neighbor, 0, len(f.words))
+	for _, other := range f.words {
+		if other == found {
+			continue
+		}
+		var sum float64
+		for i, value := range f.vectors[other] {
+			d := float64(value) - float64(vector[i])
+			sum += d * d
+		}
+		neighbors = append(neighbors, Neighbor{Word: other, Distance: float32(math.Sqrt(sum))})
+	}
+	sort.SliceStable(neighbors, func(i, j int) bool {
+		return neighbors[i].Distance < neighbors[j].Distance
+	})
+	if len(neighbors) > k {
+		neighbors = neighbors[:k]
+	}
+	return neighbors, nil
+}
@@ -0,0 +1,63 @@
+package vectorizer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFakeDeterministic(t *testing.T) {
+	a, b := NewFake(25, "king", "queen"), NewFake(25, "queen", "king")
+	for _, word := range []string{"king", "queen", "King"} {
+		va, err := a.VectorForWord(word)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vb, err := b.VectorForWord(word)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if equal, err := va.Equal(vb); err != nil || !equal {
+			t.Errorf("vectors of %q differ between fakes", word)
+		}
+	}
+	if _, err := a.VectorForWord("castle"); !errors.Is(err, ErrUnknownWord) {
+		t.Errorf("unknown word returned %v", err)
+	}
+}
+
+func TestFakeCorpi(t *testing.T) {
+	f := NewFake(2)
+	f.Set("a", []float32{1, 0})
+	f.Set("b", []float32{0, 1})
+	v, err := f.Corpi([]string{"a, B!", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.ToArray(); got[0] != 0.5 || got[1] != 0.5 {
+		t.Errorf("centroid is %v, want [0.5 0.5]", got)
+	}
+	if _, err := f.Corpi([]string{"unknown"}); !errors.Is(err, ErrNoVectors) {
+		t.Errorf("corpus without known words returned %v", err)
+	}
+}
+
+func TestFakeNeighbors(t *testing.T) {
+	f := NewFake(1)
+	for word, value := range map[string]float32{"zero": 0, "one": 1, "two": 2, "ten": 10} {
+		f.Set(word, []float32{value})
+	}
+	neighbors, err := f.Neighbors("One", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 2 || neighbors[0].Distance != 1 || neighbors[1].Distance != 1 {
+		t.Fatalf("neighbors of one are %v", neighbors)
+	}
+	neighbors, err = f.Neighbors("ten", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 3 || neighbors[0].Word != "two" || neighbors[2].Word != "zero" {
+		t.Errorf("neighbors of ten are %v", neighbors)
+	}
+}
@@ -0,0 +1,36 @@
+// Package vectorizer describes the vectorizer for Go programs building on
+// it. They depend on the Vectorizer interface and test against Fake, which
+// keeps deterministic vectors of a small vocabulary in memory, instead of a
+// server with the multi-GB database.
+package vectorizer
+
+import (
+	"errors"
+
+	"github.com/onepeerlabs/glove-840B-leveldb/pkg"
+)
+
+// ErrUnknownWord is returned for words that are not in the vocabulary
+var ErrUnknownWord = errors.New("word not in the vocabulary")
+
+// ErrNoVectors is returned by Corpi if none of the words has a vector
+var ErrNoVectors = errors.New("no word of the corpora is in the vocabulary")
+
+// Neighbor is a word near another one
+type Neighbor struct {
+	Word string `json:"word"`
+	// Distance is the Euclidean distance of the vectors
+	Distance float32 `json:"distance"`
+}
+
+// Vectorizer turns text into vectors
+type Vectorizer interface {
+	// Corpi returns the centroid of the words of corpi
+	Corpi(corpi []string) (*pkg.Vector, error)
+	// VectorForWord returns the vector of word, ErrUnknownWord if it has
+	// none. Words are looked up as they are, then lowercased
+	VectorForWord(word string) (*pkg.Vector, error)
+	// Neighbors returns up to k words closest to word, the closest first
+	// and without word itself
+	Neighbors(word string, k int) ([]Neighbor, error)
+}